@@ -52,9 +52,7 @@ type bindIQ struct {
 
 func (biq *bindIQ) TokenReader() xml.TokenReader {
 	if biq.Err != nil {
-		return biq.Wrap(xmlstream.Wrap(biq.Err.TokenReader(),
-			xml.StartElement{Name: xml.Name{Local: "bind", Space: ns.Bind}},
-		))
+		return biq.Wrap(biq.Err.TokenReader())
 	}
 
 	return biq.Wrap(xmlstream.Wrap(biq.Bind.TokenReader(),
@@ -72,12 +70,20 @@ type bindPayload struct {
 }
 
 func (bp bindPayload) TokenReader() xml.TokenReader {
-	return xmlstream.Wrap(
-		xmlstream.ReaderFunc(func() (xml.Token, error) {
-			return xml.CharData(bp.JID.String()), io.EOF
-		}),
-		xml.StartElement{Name: xml.Name{Local: "jid"}},
-	)
+	var inner []xml.TokenReader
+	if bp.Resource != "" {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(bp.Resource)),
+			xml.StartElement{Name: xml.Name{Local: "resource"}},
+		))
+	}
+	if !bp.JID.Equal(jid.JID{}) {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(bp.JID.String())),
+			xml.StartElement{Name: xml.Name{Local: "jid"}},
+		))
+	}
+	return xmlstream.MultiReader(inner...)
 }
 
 func bind(server func(jid.JID, string) (jid.JID, error)) StreamFeature {
@@ -151,10 +157,12 @@ func bind(server func(jid.JID, string) (jid.JID, error)) StreamFeature {
 
 				if ok {
 					// If a stanza error was returned:
+					resp.Type = stanza.ErrorIQ
 					resp.Err = &stanzaErr
 				} else {
-
 					resp.Bind = bindPayload{JID: j}
+					session.origin = j
+					mask = Ready
 				}
 
 				_, err = resp.WriteXML(w)
@@ -9,10 +9,13 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 
 	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
 )
 
 func TestBindList(t *testing.T) {
@@ -75,3 +78,57 @@ func TestBindParse(t *testing.T) {
 		})
 	}
 }
+
+func TestBindNegotiateServer(t *testing.T) {
+	for i, test := range []struct {
+		server func(jid.JID, string) (jid.JID, error)
+		resp   string
+		mask   SessionState
+	}{
+		0: {
+			server: func(j jid.JID, res string) (jid.JID, error) {
+				return j.WithResource(res)
+			},
+			resp: `<iq type="result" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>juliet@example.com/balcony</jid></bind></iq>`,
+			mask: Ready,
+		},
+		1: {
+			server: func(jid.JID, string) (jid.JID, error) {
+				return jid.JID{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.Conflict}
+			},
+			resp: `<iq type="error" id="bind_1"><error type="cancel"><conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></conflict></error></iq>`,
+		},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			var out bytes.Buffer
+			in := strings.NewReader(`<stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams"><iq xmlns="jabber:client" type="set" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>balcony</resource></bind></iq>`)
+			s, err := NegotiateSession(context.Background(), jid.MustParse("example.com"), jid.MustParse("juliet@example.com"), struct {
+				io.Reader
+				io.Writer
+			}{in, &out}, true, func(ctx context.Context, s *Session, data interface{}) (SessionState, io.ReadWriter, interface{}, error) {
+				r := s.TokenReader()
+				defer r.Close()
+				_, err := r.Token()
+				return Authn | Ready, nil, nil, err
+			})
+			if err != nil {
+				t.Fatalf("error creating session: %v", err)
+			}
+			mask, _, err := BindCustom(test.server).Negotiate(context.Background(), s, nil)
+			if err != nil {
+				t.Fatalf("unexpected error negotiating bind: %v", err)
+			}
+			if mask != test.mask {
+				t.Errorf("wrong mask: want=%v, got=%v", test.mask, mask)
+			}
+			if resp := out.String(); resp != test.resp {
+				t.Errorf("wrong response:\nwant=%s,\n got=%s", test.resp, resp)
+			}
+			if test.mask == Ready {
+				if addr := s.RemoteAddr().String(); addr != "juliet@example.com/balcony" {
+					t.Errorf("wrong remote address: want=%s, got=%s", "juliet@example.com/balcony", addr)
+				}
+			}
+		})
+	}
+}
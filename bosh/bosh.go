@@ -0,0 +1,158 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package bosh implements a BOSH client transport for XMPP.
+//
+// BOSH emulates a long lived, bidirectional connection using a series of
+// synchronous HTTP requests as described in XEP-0124: Bidirectional-streams
+// Over Synchronous HTTP (BOSH) and XEP-0206: XMPP Over BOSH.
+// Connections returned from this package translate the XML stream written by a
+// session into BOSH requests and the responses back into an XML stream, so any
+// session (and any stream features) can be negotiated on top of them.
+package bosh // import "mellium.im/xmpp/bosh"
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/discover"
+	"mellium.im/xmpp/jid"
+)
+
+// A list of namespaces used by this package, provided as a convenience.
+const (
+	NS      = "http://jabber.org/protocol/httpbind"
+	NSXBOSH = "urn:xmpp:xbosh"
+)
+
+const defaultWait = 60 * time.Second
+
+// Dial discovers and connects to a BOSH endpoint for the given address.
+//
+// For more information see the Dialer type.
+func Dial(ctx context.Context, addr jid.JID) (net.Conn, error) {
+	var d Dialer
+	return d.Dial(ctx, addr)
+}
+
+// DialDirect connects to the BOSH endpoint at the provided URL without
+// performing service discovery.
+//
+// For more information see the Dialer type.
+func DialDirect(ctx context.Context, uri string) (net.Conn, error) {
+	var d Dialer
+	return d.DialDirect(ctx, uri)
+}
+
+// DialSession discovers and connects to a BOSH endpoint for the given address
+// and attempts to negotiate a client-to-server session over it.
+//
+// If the provided context is canceled after stream negotiation is complete it
+// has no effect on the session.
+func DialSession(ctx context.Context, addr jid.JID, features ...xmpp.StreamFeature) (*xmpp.Session, error) {
+	conn, err := Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientSession(ctx, addr, conn, features...)
+}
+
+// A Dialer contains options for connecting to an XMPP address over BOSH.
+//
+// The zero value for each field is equivalent to dialing without that option.
+type Dialer struct {
+	// Client is used to make HTTP requests.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Resolver is used to look up the BOSH endpoints advertised in DNS TXT
+	// records as described in XEP-0156: Discovering Alternative XMPP Connection
+	// Methods.
+	// If nil, the default resolver is used.
+	Resolver *net.Resolver
+
+	// Wait is the longest time the connection manager is allowed to hold a
+	// request before responding.
+	// If zero, 60 seconds is used.
+	Wait time.Duration
+}
+
+// Dial discovers and connects to a BOSH endpoint for the given address.
+// The first discovered endpoint is used.
+//
+// No HTTP requests are made until the stream header is written to the
+// connection, so the context only applies to service discovery.
+func (d *Dialer) Dial(ctx context.Context, addr jid.JID) (net.Conn, error) {
+	urls, err := discover.LookupBOSH(ctx, d.Resolver, nil, &addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, discover.ErrNoServiceAtAddress
+	}
+	return d.DialDirect(ctx, urls[0])
+}
+
+// DialDirect returns a connection to the BOSH endpoint at the provided URL
+// without performing service discovery.
+// The URL must use the http or https scheme.
+//
+// No HTTP requests are made until the stream header is written to the
+// connection, at which point a new BOSH session is created.
+// Writing a stream end element or closing the connection terminates the BOSH
+// session.
+func (d *Dialer) DialDirect(ctx context.Context, uri string) (net.Conn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "http":
+	case "https":
+		secure = true
+	default:
+		return nil, errBadScheme
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	wait := d.Wait
+	if wait <= 0 {
+		wait = defaultWait
+	}
+	return newConn(u, client, wait, secure), nil
+}
+
+// NewClientSession attempts to use an existing BOSH connection to negotiate an
+// XMPP client-to-server session.
+// If the connection was returned by this package and is using HTTPS, the
+// session is marked as secure and StartTLS is not negotiated.
+// If the provided context is canceled before stream negotiation is complete an
+// error is returned.
+// After stream negotiation if the context is canceled it has no effect.
+func NewClientSession(ctx context.Context, origin jid.JID, rw io.ReadWriter, features ...xmpp.StreamFeature) (*xmpp.Session, error) {
+	c, ok := rw.(*conn)
+	secure := ok && c.secure
+	negotiate := xmpp.NewNegotiator(xmpp.StreamConfig{
+		Features: features,
+	})
+	return xmpp.NegotiateSession(ctx, origin.Domain(), origin, rw, false, func(ctx context.Context, s *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+		if secure {
+			secure = false
+			return xmpp.Secure, nil, nil, nil
+		}
+		return negotiate(ctx, s, data)
+	})
+}
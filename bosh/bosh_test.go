@@ -0,0 +1,365 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package bosh_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"mellium.im/sasl"
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/bosh"
+	"mellium.im/xmpp/internal/frame"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// connManager is a minimal BOSH connection manager that bridges requests to a
+// server side session over an in memory connection.
+type connManager struct {
+	t       *testing.T
+	session func(net.Conn)
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	nextRID uint64
+	conn    net.Conn
+	elems   chan []byte
+	reqs    []string
+}
+
+func newConnManager(t *testing.T, session func(net.Conn)) *connManager {
+	m := &connManager{t: t, session: session}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+func (m *connManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		m.t.Errorf("error reading request: %v", err)
+		return
+	}
+	attrs, payload, err := parseBody(body)
+	if err != nil {
+		m.t.Errorf("error parsing request %s: %v", body, err)
+		return
+	}
+	rid, err := strconv.ParseUint(attrs["rid"], 10, 64)
+	if err != nil {
+		m.t.Errorf("bad rid in request %s: %v", body, err)
+		return
+	}
+
+	// Handle requests in the order of their request IDs.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nextRID == 0 {
+		m.nextRID = rid
+	}
+	for m.nextRID != rid {
+		m.cond.Wait()
+	}
+	defer m.cond.Broadcast()
+	m.nextRID++
+	m.reqs = append(m.reqs, string(body))
+
+	const header = `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' to='example.net' version='1.0'>`
+	respAttrs := ""
+	switch {
+	case attrs["sid"] == "":
+		clientConn, serverConn := net.Pipe()
+		m.conn = clientConn
+		m.elems = make(chan []byte, 100)
+		go m.session(serverConn)
+		go func() {
+			/* #nosec */
+			io.Copy(frame.NewSplitter(func(p []byte) error {
+				m.elems <- append([]byte(nil), p...)
+				return nil
+			}), clientConn)
+			close(m.elems)
+		}()
+		if _, err = io.WriteString(m.conn, header); err != nil {
+			m.t.Errorf("error writing stream header: %v", err)
+			return
+		}
+		hdr := <-m.elems
+		tok, err := xml.NewDecoder(bytes.NewReader(hdr)).RawToken()
+		if err != nil {
+			m.t.Errorf("error decoding stream header %s: %v", hdr, err)
+			return
+		}
+		var id string
+		for _, a := range tok.(xml.StartElement).Attr {
+			if a.Name.Local == "id" {
+				id = a.Value
+			}
+		}
+		respAttrs = fmt.Sprintf(` sid='sid' authid='%s' from='example.net' requests='2' hold='1' wait='1' ver='1.6' xmpp:version='1.0' xmlns:stream='http://etherx.jabber.org/streams'`, id)
+	case attrs["xmpp:restart"] == "true":
+		if _, err = io.WriteString(m.conn, header); err != nil {
+			m.t.Errorf("error writing stream header: %v", err)
+			return
+		}
+	case attrs["type"] == "terminate":
+		for _, p := range payload {
+			/* #nosec */
+			m.conn.Write(p)
+		}
+		/* #nosec */
+		io.WriteString(m.conn, `</stream:stream>`)
+		fmt.Fprintf(w, `<body xmlns='%s' type='terminate'/>`, bosh.NS)
+		return
+	}
+	for _, p := range payload {
+		if _, err = m.conn.Write(p); err != nil {
+			m.t.Errorf("error writing payload: %v", err)
+			return
+		}
+	}
+
+	// Collect any output from the session.
+	var out bytes.Buffer
+	timeout := time.After(50 * time.Millisecond)
+collect:
+	for {
+		select {
+		case p, ok := <-m.elems:
+			if !ok {
+				break collect
+			}
+			if bytes.HasPrefix(p, []byte("<stream:stream")) {
+				continue
+			}
+			out.Write(p)
+		case <-timeout:
+			break collect
+		}
+	}
+	fmt.Fprintf(w, `<body xmlns='%s' xmlns:xmpp='%s'%s>%s</body>`, bosh.NS, bosh.NSXBOSH, respAttrs, out.Bytes())
+}
+
+func parseBody(b []byte) (map[string]string, [][]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	tok, err := d.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || start.Name != (xml.Name{Space: bosh.NS, Local: "body"}) {
+		return nil, nil, fmt.Errorf("expected body, got %v", tok)
+	}
+	attrs := make(map[string]string)
+	for _, a := range start.Attr {
+		switch a.Name.Space {
+		case "":
+			attrs[a.Name.Local] = a.Value
+		case bosh.NSXBOSH:
+			attrs["xmpp:"+a.Name.Local] = a.Value
+		case "http://www.w3.org/XML/1998/namespace":
+			attrs["xml:"+a.Name.Local] = a.Value
+		}
+	}
+	var payload [][]byte
+	for {
+		off := d.InputOffset()
+		tok, err = d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			if err = d.Skip(); err != nil {
+				return nil, nil, err
+			}
+			payload = append(payload, b[off:d.InputOffset()])
+		case xml.EndElement:
+			return attrs, payload, nil
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	permissions := func(n *sasl.Negotiator) bool {
+		user, pass, _ := n.Credentials()
+		return string(user) == "juliet" && string(pass) == "secret"
+	}
+
+	msgs := make(chan string, 1)
+	serveErr := make(chan error, 1)
+	servers := make(chan *xmpp.Session, 1)
+	m := newConnManager(t, func(conn net.Conn) {
+		negotiate := xmpp.NewNegotiator(xmpp.StreamConfig{Features: []xmpp.StreamFeature{
+			xmpp.SASLServer(permissions, nil, sasl.Plain),
+			xmpp.BindResource(),
+		}})
+		var secure bool
+		s, err := xmpp.NegotiateSession(ctx, location, jid.JID{}, conn, true, func(ctx context.Context, s *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+			if !secure {
+				secure = true
+				return xmpp.Secure, nil, nil, nil
+			}
+			return negotiate(ctx, s, data)
+		})
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		servers <- s
+		serveErr <- s.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			msgs <- "server:" + start.Name.Local
+			return nil
+		}))
+	})
+	srv := httptest.NewTLSServer(m)
+	defer srv.Close()
+
+	d := bosh.Dialer{Client: srv.Client()}
+	conn, err := d.DialDirect(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	client, err := bosh.NewClientSession(ctx, origin, conn,
+		xmpp.StartTLS(nil),
+		xmpp.SASL("", "secret", sasl.Plain),
+		xmpp.BindResource(),
+	)
+	if err != nil {
+		t.Fatalf("error negotiating session: %v", err)
+	}
+	if st := client.State(); st&xmpp.Secure == 0 || st&xmpp.Authn == 0 || st&xmpp.Ready == 0 {
+		t.Fatalf("wrong session state: %v", st)
+	}
+	if client.LocalAddr().Resourcepart() == "" {
+		t.Errorf("expected a resource to be bound, got %v", client.LocalAddr())
+	}
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			msgs <- "client:" + start.Name.Local
+			return nil
+		}))
+	}()
+
+	// Send a stanza in each direction.
+	msg := stanza.Message{To: jid.MustParse("romeo@example.net"), Type: stanza.ChatMessage}
+	if err = client.Send(ctx, msg.Wrap(nil)); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	expectMsg(ctx, t, msgs, "server:message")
+	server := <-servers
+	if err = server.Send(ctx, stanza.Presence{}.Wrap(nil)); err != nil {
+		t.Fatalf("error sending presence: %v", err)
+	}
+	expectMsg(ctx, t, msgs, "client:presence")
+
+	// Closing the session should terminate the BOSH session.
+	if err = client.Close(); err != nil {
+		t.Fatalf("error closing session: %v", err)
+	}
+	if err = <-clientErr; err != nil {
+		t.Errorf("unexpected error from client: %v", err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Errorf("error closing conn: %v", err)
+	}
+	if err = <-serveErr; err != nil {
+		t.Errorf("unexpected error from server: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.reqs); n < 4 {
+		t.Fatalf("expected at least 4 requests, got %d", n)
+	}
+	first, err := parseBodyAttrs(m.reqs[0])
+	if err != nil {
+		t.Fatalf("error parsing first request: %v", err)
+	}
+	if first["to"] != "example.net" || first["ver"] != "1.6" || first["xmpp:version"] != "1.0" {
+		t.Errorf("bad session creation request: %s", m.reqs[0])
+	}
+	var restarts int
+	for _, req := range m.reqs {
+		attrs, err := parseBodyAttrs(req)
+		if err != nil {
+			t.Fatalf("error parsing request: %v", err)
+		}
+		if attrs["xmpp:restart"] == "true" {
+			restarts++
+		}
+	}
+	if restarts != 1 {
+		t.Errorf("wrong number of stream restarts: want=1, got=%d", restarts)
+	}
+	last, err := parseBodyAttrs(m.reqs[len(m.reqs)-1])
+	if err != nil {
+		t.Fatalf("error parsing last request: %v", err)
+	}
+	if last["type"] != "terminate" {
+		t.Errorf("expected last request to terminate the session, got: %s", m.reqs[len(m.reqs)-1])
+	}
+}
+
+func parseBodyAttrs(s string) (map[string]string, error) {
+	attrs, _, err := parseBody([]byte(s))
+	return attrs, err
+}
+
+func expectMsg(ctx context.Context, t *testing.T, msgs <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-msgs:
+		if got != want {
+			t.Fatalf("wrong element handled: want=%s, got=%s", want, got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+func TestTerminateCondition(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<body xmlns='%s' type='terminate' condition='host-unknown'/>`, bosh.NS)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := bosh.DialDirect(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	_, err = xmpp.NewClientSession(ctx, jid.MustParse("juliet@example.net"), conn, false)
+	if _, ok := err.(bosh.TerminateError); !ok {
+		t.Errorf("wrong error: want=TerminateError, got=%T(%[1]v)", err)
+	}
+}
+
+func TestBadScheme(t *testing.T) {
+	_, err := bosh.DialDirect(context.Background(), "ws://example.net/")
+	if err == nil {
+		t.Errorf("expected error dialing a non-HTTP URL")
+	}
+}
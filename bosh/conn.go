@@ -0,0 +1,646 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package bosh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/internal/frame"
+	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/stream"
+)
+
+// Errors returned by connections in this package.
+var (
+	ErrClosed = errors.New("bosh: use of closed connection")
+
+	errBadScheme = errors.New("bosh: URL scheme must be http or https")
+	errNotBody   = errors.New("bosh: expected a body element in the response")
+	errNoSID     = errors.New("bosh: session creation response did not contain a session ID")
+)
+
+// TerminateError is returned when the connection manager terminates the
+// session with an error condition.
+type TerminateError struct {
+	Condition string
+}
+
+func (e TerminateError) Error() string {
+	return "bosh: session terminated: " + e.Condition
+}
+
+const (
+	boshVersion = "1.6"
+
+	// The amount of time to wait for a response in addition to the wait time
+	// negotiated with the connection manager.
+	requestSlack = 10 * time.Second
+
+	// The largest number of simultaneous requests that will be made, even if the
+	// connection manager allows more.
+	maxRequests = 4
+
+	streamStart = "<stream:stream"
+	streamEnd   = "</stream:stream"
+)
+
+type reqKind uint8
+
+const (
+	reqPayload reqKind = iota
+	reqCreate
+	reqRestart
+	reqTerminate
+)
+
+type response struct {
+	kind reqKind
+	body []byte
+	err  error
+}
+
+// conn translates between an XML stream and a BOSH session.
+type conn struct {
+	url    *url.URL
+	client *http.Client
+	wait   time.Duration
+	secure bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	split *frame.Splitter
+
+	// The session reads the XML stream from r, and responses are written to w.
+	r, w net.Conn
+
+	// Channels that will receive responses in the order the requests were made.
+	order chan chan response
+
+	mu          sync.Mutex
+	rid         uint64
+	sid         string
+	authid      string
+	from        string
+	requests    int
+	polling     time.Duration
+	lastPoll    time.Time
+	pollTimer   *time.Timer
+	outstanding int
+	pending     [][]byte
+	header      map[string]string
+	created     bool
+	restart     bool
+	terminate   bool
+	termDone    chan struct{}
+	done        bool
+	closed      bool
+	err         error
+}
+
+func newConn(u *url.URL, client *http.Client, wait time.Duration, secure bool) *conn {
+	c := &conn{
+		url:      u,
+		client:   client,
+		wait:     wait,
+		secure:   secure,
+		order:    make(chan chan response, maxRequests+1),
+		requests: 1,
+		rid:      initialRID(),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.r, c.w = net.Pipe()
+	c.split = frame.NewSplitter(c.element)
+	go c.process()
+	return c
+}
+
+// initialRID returns a random request ID that leaves plenty of room to be
+// incremented without exceeding 2^53 as recommended by XEP-0124.
+func initialRID() uint64 {
+	var b [8]byte
+	/* #nosec */
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:]) >> 21
+}
+
+// Read reads from the XML stream reconstructed from BOSH responses.
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		c.mu.Lock()
+		if c.err != nil {
+			err = c.err
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Write buffers the XML stream and sends complete elements to the connection
+// manager.
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.done {
+		if c.err != nil {
+			return 0, c.err
+		}
+		return 0, ErrClosed
+	}
+	n, err := c.split.Write(p)
+	if err != nil {
+		return n, err
+	}
+	c.pump()
+	return n, nil
+}
+
+// element is called by the splitter with each complete top level element.
+// It must be called with the lock held.
+func (c *conn) element(p []byte) error {
+	switch {
+	case bytes.HasPrefix(p, []byte(streamStart)):
+		if !c.created {
+			header, err := parseHeader(p)
+			if err != nil {
+				return err
+			}
+			c.header = header
+			return nil
+		}
+		c.restart = true
+	case bytes.HasPrefix(p, []byte(streamEnd)):
+		c.terminate = true
+	default:
+		c.pending = append(c.pending, append([]byte(nil), p...))
+	}
+	return nil
+}
+
+func parseHeader(p []byte) (map[string]string, error) {
+	tok, err := xml.NewDecoder(bytes.NewReader(p)).RawToken()
+	if err != nil {
+		return nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return nil, stream.BadFormat
+	}
+	header := make(map[string]string)
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "xml" && a.Name.Local == "lang":
+			header["xml:lang"] = a.Value
+		case a.Name.Space == "" && (a.Name.Local == "to" || a.Name.Local == "from"):
+			header[a.Name.Local] = a.Value
+		}
+	}
+	return header, nil
+}
+
+// pump sends any requests that can be sent.
+// It must be called with the lock held.
+func (c *conn) pump() {
+	if c.done {
+		return
+	}
+	if !c.created {
+		// Nothing can be sent until the stream header has been written.
+		if c.header == nil {
+			return
+		}
+		c.created = true
+		b := c.body(reqCreate, nil)
+		c.send(reqCreate, b)
+		return
+	}
+	if c.sid == "" {
+		// Wait for the session creation response.
+		return
+	}
+
+	for c.outstanding < c.requests && c.termDone == nil {
+		switch {
+		case c.restart:
+			c.restart = false
+			c.send(reqRestart, c.body(reqRestart, nil))
+		case c.terminate:
+			c.send(reqTerminate, c.body(reqTerminate, c.pending))
+			c.pending = nil
+		case len(c.pending) > 0:
+			c.send(reqPayload, c.body(reqPayload, c.pending))
+			c.pending = nil
+		case c.outstanding == 0:
+			// Always keep a request open so that the connection manager has
+			// something to respond with when it has data for us.
+			if next := c.lastPoll.Add(c.polling); c.polling > 0 && time.Now().Before(next) {
+				if c.pollTimer == nil {
+					c.pollTimer = time.AfterFunc(time.Until(next), func() {
+						c.mu.Lock()
+						defer c.mu.Unlock()
+						c.pollTimer = nil
+						c.pump()
+					})
+				}
+				return
+			}
+			c.lastPoll = time.Now()
+			c.send(reqPayload, c.body(reqPayload, nil))
+		default:
+			return
+		}
+	}
+}
+
+// body constructs the body of a new request.
+// It must be called with the lock held.
+func (c *conn) body(kind reqKind, payload [][]byte) []byte {
+	c.rid++
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<body xmlns='%s' xmlns:xmpp='%s' rid='%d'`, NS, NSXBOSH, c.rid)
+	switch kind {
+	case reqCreate:
+		fmt.Fprintf(&b, ` content='text/xml; charset=utf-8' hold='1' ver='%s' wait='%d' xmpp:version='1.0'`, boshVersion, c.wait/time.Second)
+		for _, name := range []string{"to", "from", "xml:lang"} {
+			if v, ok := c.header[name]; ok {
+				writeAttr(&b, name, v)
+			}
+		}
+	case reqRestart:
+		writeAttr(&b, "sid", c.sid)
+		b.WriteString(` xmpp:restart='true'`)
+		for _, name := range []string{"to", "xml:lang"} {
+			if v, ok := c.header[name]; ok {
+				writeAttr(&b, name, v)
+			}
+		}
+	case reqTerminate:
+		writeAttr(&b, "sid", c.sid)
+		b.WriteString(` type='terminate'`)
+	default:
+		writeAttr(&b, "sid", c.sid)
+	}
+	if len(payload) == 0 {
+		b.WriteString(`/>`)
+		return b.Bytes()
+	}
+	b.WriteString(`>`)
+	for _, p := range payload {
+		b.Write(p)
+	}
+	b.WriteString(`</body>`)
+	return b.Bytes()
+}
+
+func writeAttr(b *bytes.Buffer, name, value string) {
+	b.WriteString(` ` + name + `='`)
+	/* #nosec */
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`'`)
+}
+
+// send makes a request in the background and queues its response to be
+// processed in order.
+// It must be called with the lock held.
+func (c *conn) send(kind reqKind, body []byte) {
+	c.order <- c.request(kind, body)
+}
+
+// request makes a request in the background and returns the channel that its
+// response will be sent on.
+// The channel must be queued on c.order before any later request is made.
+// It must be called with the lock held.
+func (c *conn) request(kind reqKind, body []byte) chan response {
+	var termDone chan struct{}
+	if kind == reqTerminate {
+		termDone = make(chan struct{})
+		c.termDone = termDone
+	}
+	c.outstanding++
+	rc := make(chan response, 1)
+	go func() {
+		b, err := c.do(body)
+		if termDone != nil {
+			close(termDone)
+		}
+		rc <- response{kind: kind, body: b, err: err}
+	}()
+	return rc
+}
+
+// do performs a single HTTP request.
+func (c *conn) do(body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.wait+requestSlack)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, c.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	/* #nosec */
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bosh: unexpected HTTP status %q", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// process handles responses in the order that the requests were made and
+// writes their payloads to the XML stream.
+func (c *conn) process() {
+	for {
+		var rc chan response
+		select {
+		case rc = <-c.order:
+		case <-c.ctx.Done():
+			return
+		}
+		var resp response
+		select {
+		case resp = <-rc:
+		case <-c.ctx.Done():
+			return
+		}
+
+		end, err := c.handle(resp)
+		c.mu.Lock()
+		c.outstanding--
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		if end || err != nil {
+			c.done = true
+			if c.pollTimer != nil {
+				c.pollTimer.Stop()
+			}
+		}
+		c.pump()
+		c.mu.Unlock()
+
+		if end || err != nil {
+			/* #nosec */
+			c.w.Close()
+			return
+		}
+	}
+}
+
+// handle processes a single response and reports whether the BOSH session has
+// ended.
+func (c *conn) handle(resp response) (end bool, err error) {
+	if resp.err != nil {
+		return true, resp.err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(resp.body))
+	start, err := bodyStart(d)
+	if err != nil {
+		return true, err
+	}
+
+	var typ, condition string
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "type":
+			typ = a.Value
+		case "condition":
+			condition = a.Value
+		}
+	}
+
+	switch resp.kind {
+	case reqCreate:
+		if typ != "terminate" {
+			err = c.setSession(start)
+			if err != nil {
+				return true, err
+			}
+			if err = c.writeHeader(); err != nil {
+				return true, err
+			}
+		}
+	case reqRestart:
+		if err = c.writeHeader(); err != nil {
+			return true, err
+		}
+	}
+
+	// Copy the payloads into the XML stream.
+	for {
+		off := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return true, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			if err = d.Skip(); err != nil {
+				return true, err
+			}
+			if _, err = c.w.Write(resp.body[off:d.InputOffset()]); err != nil {
+				return true, err
+			}
+			continue
+		case xml.EndElement:
+		default:
+			continue
+		}
+		break
+	}
+
+	if typ == "terminate" || resp.kind == reqTerminate {
+		if condition != "" {
+			return true, TerminateError{Condition: condition}
+		}
+		/* #nosec */
+		io.WriteString(c.w, `</stream:stream>`)
+		return true, nil
+	}
+	return false, nil
+}
+
+// setSession stores the session attributes from the session creation
+// response.
+func (c *conn) setSession(start xml.StartElement) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range start.Attr {
+		if a.Name.Space != "" {
+			continue
+		}
+		switch a.Name.Local {
+		case "sid":
+			c.sid = a.Value
+		case "authid":
+			c.authid = a.Value
+		case "from":
+			c.from = a.Value
+		case "requests":
+			n, err := strconv.Atoi(a.Value)
+			if err == nil && n > 0 {
+				if n > maxRequests {
+					n = maxRequests
+				}
+				c.requests = n
+			}
+		case "polling":
+			n, err := strconv.Atoi(a.Value)
+			if err == nil && n > 0 {
+				c.polling = time.Duration(n) * time.Second
+			}
+		case "wait":
+			n, err := strconv.Atoi(a.Value)
+			if err == nil && n > 0 && time.Duration(n)*time.Second < c.wait {
+				c.wait = time.Duration(n) * time.Second
+			}
+		}
+	}
+	if c.sid == "" {
+		return errNoSID
+	}
+	if c.authid == "" {
+		c.authid = c.sid
+	}
+	return nil
+}
+
+// writeHeader writes a stream header to the XML stream using the attributes
+// returned by the connection manager.
+func (c *conn) writeHeader() error {
+	c.mu.Lock()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<stream:stream xmlns='%s' xmlns:stream='%s' version='1.0'`, ns.Client, stream.NS)
+	writeAttr(&b, "id", c.authid)
+	if c.from != "" {
+		writeAttr(&b, "from", c.from)
+	}
+	b.WriteString(`>`)
+	c.mu.Unlock()
+
+	_, err := c.w.Write(b.Bytes())
+	return err
+}
+
+func bodyStart(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space != NS || t.Name.Local != "body" {
+				return t, errNotBody
+			}
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, errNotBody
+		}
+	}
+}
+
+// Close terminates the BOSH session if it has not already been terminated and
+// closes the XML stream.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	var rc chan response
+	if c.termDone == nil && c.sid != "" && !c.done {
+		// The stream was never closed, so terminate the session ourselves.
+		rc = c.request(reqTerminate, c.body(reqTerminate, c.pending))
+		c.pending = nil
+	}
+	termDone := c.termDone
+	c.done = true
+	if c.pollTimer != nil {
+		c.pollTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	// The terminate request is not limited by the number of requests that the
+	// connection manager allows, so queuing its response may block until the
+	// process goroutine, which needs the lock, makes room for it.
+	// No more requests will be made once done is set, so it is queued after the
+	// lock is released without breaking the order of responses, and if the
+	// process goroutine has already stopped we give up once the request
+	// completes.
+	if rc != nil {
+		select {
+		case c.order <- rc:
+		case <-termDone:
+		}
+	}
+
+	// Give any terminate request a chance to complete.
+	if termDone != nil {
+		<-termDone
+	}
+	c.cancel()
+	/* #nosec */
+	c.w.Close()
+	return c.r.Close()
+}
+
+// LocalAddr returns the local network address.
+func (c *conn) LocalAddr() net.Addr {
+	return c.r.LocalAddr()
+}
+
+// RemoteAddr returns the URL of the connection manager.
+func (c *conn) RemoteAddr() net.Addr {
+	return addr{c.url}
+}
+
+// SetDeadline sets the read deadline.
+// Writes never block on the network so there is no write deadline.
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads from the XML stream.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is a no-op since writes never block on the network.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type addr struct {
+	u *url.URL
+}
+
+func (addr) Network() string {
+	return "bosh"
+}
+
+func (a addr) String() string {
+	return a.u.String()
+}
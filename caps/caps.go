@@ -0,0 +1,225 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package caps implements XEP-0115: Entity Capabilities and XEP-0390: Entity
+// Capabilities 2.0.
+//
+// Entity capabilities let entities advertise the identities and features that
+// they support in their presence as a short hash of their disco#info response.
+// Because many entities run the same software, the disco#info response only
+// has to be fetched the first time a hash is seen and can then be cached.
+package caps // import "mellium.im/xmpp/caps"
+
+import (
+	"crypto"
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS       = `http://jabber.org/protocol/caps`
+	NSHashes = `urn:xmpp:caps`
+	NSHash   = `urn:xmpp:hashes:2`
+)
+
+// Caps is an XEP-0115 entity capabilities element.
+type Caps struct {
+	// Hash is the hash function used to generate Ver.
+	Hash crypto.Hash
+	// Node is a URI that uniquely identifies the software that generated the
+	// capabilities.
+	Node string
+	// Ver is the verification string.
+	Ver string
+}
+
+// DiscoNode returns the node that should be queried to fetch the disco#info
+// response described by c.
+func (c Caps) DiscoNode() string {
+	return c.Node + "#" + c.Ver
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (c Caps) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "c"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "hash"}, Value: hashName(c.Hash)},
+			{Name: xml.Name{Local: "node"}, Value: c.Node},
+			{Name: xml.Name{Local: "ver"}, Value: c.Ver},
+		},
+	})
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (c Caps) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, c.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (c Caps) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := c.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML satisfies the xml.Unmarshaler interface.
+// If the hash function is not known, Hash is left unset.
+func (c *Caps) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	_, hash := attr.Get(start.Attr, "hash")
+	_, c.Node = attr.Get(start.Attr, "node")
+	_, c.Ver = attr.Get(start.Attr, "ver")
+	c.Hash = parseHash(hash)
+	return d.Skip()
+}
+
+// Hash is a single hash in an XEP-0390 entity capabilities element.
+type Hash struct {
+	// Algo is the hash function used to generate Value.
+	Algo crypto.Hash
+	// Value is the base64 encoded hash.
+	Value string
+}
+
+// DiscoNode returns the node that should be queried to fetch the disco#info
+// response described by h.
+func (h Hash) DiscoNode() string {
+	return NSHashes + "#" + hashName(h.Algo) + "." + h.Value
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (h Hash) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(h.Value)),
+		xml.StartElement{
+			Name: xml.Name{Space: NSHash, Local: "hash"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "algo"}, Value: hashName(h.Algo)}},
+		},
+	)
+}
+
+// Hashes is an XEP-0390 entity capabilities element.
+type Hashes []Hash
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (h Hashes) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, hash := range h {
+		inner = append(inner, hash.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NSHashes, Local: "c"}},
+	)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (h Hashes) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, h.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (h Hashes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := h.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML satisfies the xml.Unmarshaler interface.
+// Hashes using unknown hash functions are skipped.
+func (h *Hashes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	data := struct {
+		Hashes []struct {
+			Algo  string `xml:"algo,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"urn:xmpp:hashes:2 hash"`
+	}{}
+	if err := d.DecodeElement(&data, &start); err != nil {
+		return err
+	}
+	*h = (*h)[:0]
+	for _, hash := range data.Hashes {
+		algo := parseHash(hash.Algo)
+		if algo == 0 {
+			continue
+		}
+		*h = append(*h, Hash{Algo: algo, Value: hash.Value})
+	}
+	return nil
+}
+
+// Insert returns a transformer that adds the provided payloads (normally a Caps
+// and Hashes element) to the end of every available presence stanza read from
+// the stream.
+// Other elements are passed through unchanged.
+func Insert(payload ...xmlstream.Marshaler) xmlstream.Transformer {
+	return func(r xml.TokenReader) xml.TokenReader {
+		return &inserter{r: r, payload: payload}
+	}
+}
+
+type inserter struct {
+	r       xml.TokenReader
+	payload []xmlstream.Marshaler
+
+	depth      int
+	inPresence bool
+	queue      xml.TokenReader
+	end        xml.EndElement
+	err        error
+}
+
+func isAvailablePresence(start xml.StartElement) bool {
+	if start.Name.Local != "presence" {
+		return false
+	}
+	if start.Name.Space != "" && start.Name.Space != ns.Client && start.Name.Space != ns.Server {
+		return false
+	}
+	_, typ := attr.Get(start.Attr, "type")
+	return stanza.PresenceType(typ) == stanza.AvailablePresence
+}
+
+func (i *inserter) Token() (xml.Token, error) {
+	if i.queue != nil {
+		tok, err := i.queue.Token()
+		if tok != nil {
+			return tok, nil
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+		i.queue = nil
+		return i.end, i.err
+	}
+
+	tok, err := i.r.Token()
+	switch t := tok.(type) {
+	case xml.StartElement:
+		if i.depth == 0 && isAvailablePresence(t) {
+			i.inPresence = true
+		}
+		i.depth++
+	case xml.EndElement:
+		i.depth--
+		if i.depth == 0 && i.inPresence {
+			i.inPresence = false
+			var readers []xml.TokenReader
+			for _, p := range i.payload {
+				readers = append(readers, p.TokenReader())
+			}
+			i.queue = xmlstream.MultiReader(readers...)
+			i.end = t
+			i.err = err
+			return i.Token()
+		}
+	}
+	return tok, err
+}
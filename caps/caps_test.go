@@ -0,0 +1,343 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package caps_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/caps"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ info.FeatureIter    = &caps.Handler{}
+	_ info.IdentityIter   = &caps.Handler{}
+	_ mux.PresenceHandler = &caps.Handler{}
+	_ xmlstream.Marshaler = caps.Caps{}
+	_ xmlstream.Marshaler = caps.Hashes{}
+)
+
+func features(vars ...string) []info.Feature {
+	f := make([]info.Feature, 0, len(vars))
+	for _, v := range vars {
+		f = append(f, info.Feature{Var: v})
+	}
+	return f
+}
+
+// The examples from XEP-0115 §5.2 and §5.3.
+var (
+	simpleInfo = disco.Info{
+		Identities: []info.Identity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		Features: features(
+			"http://jabber.org/protocol/caps",
+			"http://jabber.org/protocol/disco#info",
+			"http://jabber.org/protocol/disco#items",
+			"http://jabber.org/protocol/muc",
+		),
+	}
+	complexInfo = disco.Info{
+		Identities: []info.Identity{
+			{Category: "client", Type: "pc", Name: "Psi 0.11", Lang: "en"},
+			{Category: "client", Type: "pc", Name: "Ψ 0.11", Lang: "el"},
+		},
+		Features: features(
+			"http://jabber.org/protocol/caps",
+			"http://jabber.org/protocol/disco#info",
+			"http://jabber.org/protocol/disco#items",
+			"http://jabber.org/protocol/muc",
+		),
+		Forms: []form.Data{*form.New(
+			form.Hidden("FORM_TYPE", form.Value("urn:xmpp:dataforms:softwareinfo")),
+			form.TextMulti("ip_version", form.Value("ipv6"), form.Value("ipv4")),
+			form.TextSingle("os", form.Value("Mac")),
+			form.TextSingle("os_version", form.Value("10.5.1")),
+			form.TextSingle("software", form.Value("Psi")),
+			form.TextSingle("software_version", form.Value("0.11")),
+		)},
+	}
+)
+
+var verTests = [...]struct {
+	info disco.Info
+	ver  string
+	err  error
+}{
+	0: {info: simpleInfo, ver: "QgayPKawpkPSDYmwT/WM94uAlu0="},
+	1: {info: complexInfo, ver: "q07IKJEyjvHSyhy//CH0CxmKi8w="},
+	2: {
+		info: disco.Info{Features: features("urn:example", "urn:example")},
+		err:  caps.ErrMalformed,
+	},
+	3: {
+		info: disco.Info{Forms: []form.Data{
+			*form.New(form.Hidden("FORM_TYPE", form.Value("urn:example"))),
+			*form.New(form.Hidden("FORM_TYPE", form.Value("urn:example"))),
+		}},
+		err: caps.ErrMalformed,
+	},
+	4: {
+		// Forms without a FORM_TYPE are ignored.
+		info: disco.Info{
+			Identities: simpleInfo.Identities,
+			Features:   simpleInfo.Features,
+			Forms:      []form.Data{*form.New(form.TextSingle("os", form.Value("Plan 9")))},
+		},
+		ver: "QgayPKawpkPSDYmwT/WM94uAlu0=",
+	},
+}
+
+func TestVer(t *testing.T) {
+	for i, tc := range verTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			ver, err := caps.Ver(crypto.SHA1, tc.info)
+			if err != tc.err {
+				t.Fatalf("wrong error: want=%v, got=%v", tc.err, err)
+			}
+			if ver != tc.ver {
+				t.Errorf("wrong verification string: want=%s, got=%s", tc.ver, ver)
+			}
+		})
+	}
+}
+
+func TestSum(t *testing.T) {
+	i := disco.Info{
+		Identities: []info.Identity{{Category: "client", Type: "bot", Name: "Feste"}},
+		Features:   features("urn:xmpp:ping", "http://jabber.org/protocol/disco#info"),
+		Forms: []form.Data{*form.New(
+			form.Hidden("FORM_TYPE", form.Value("urn:example")),
+			form.TextMulti("b", form.Value("2"), form.Value("1")),
+		)},
+	}
+	input := "http://jabber.org/protocol/disco#info\x1furn:xmpp:ping\x1f\x1c" +
+		"client\x1fbot\x1f\x1fFeste\x1f\x1e\x1c" +
+		"FORM_TYPE\x1furn:example\x1f\x1eb\x1f1\x1f2\x1f\x1e\x1d\x1c"
+	h := sha256.Sum256([]byte(input))
+	want := base64.StdEncoding.EncodeToString(h[:])
+
+	got, err := caps.Sum(crypto.SHA256, i)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("wrong hash: want=%s, got=%s", want, got)
+	}
+
+	if _, err = caps.Sum(crypto.MD4, i); err != caps.ErrUnknownHash {
+		t.Errorf("wrong error for unknown hash: want=%v, got=%v", caps.ErrUnknownHash, err)
+	}
+	if _, err = caps.Sum(crypto.SHA1, i); err != caps.ErrForbiddenHash {
+		t.Errorf("wrong error for SHA-1: want=%v, got=%v", caps.ErrForbiddenHash, err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	c := caps.Caps{Hash: crypto.SHA1, Node: "https://mellium.im/xmpp", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0="}
+	hashes := caps.Hashes{{Algo: crypto.SHA256, Value: "abc="}, {Algo: crypto.SHA512, Value: "def="}}
+
+	out, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"presence"`
+		Caps    caps.Caps
+		Hashes  caps.Hashes
+	}{Caps: c, Hashes: hashes})
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	const want = `<presence><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://mellium.im/xmpp" ver="QgayPKawpkPSDYmwT/WM94uAlu0="></c><c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">abc=</hash><hash xmlns="urn:xmpp:hashes:2" algo="sha-512">def=</hash></c></presence>`
+	if string(out) != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+
+	decoded := struct {
+		Caps   caps.Caps   `xml:"http://jabber.org/protocol/caps c"`
+		Hashes caps.Hashes `xml:"urn:xmpp:caps c"`
+	}{}
+	if err = xml.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	if decoded.Caps != c {
+		t.Errorf("wrong caps: want=%+v, got=%+v", c, decoded.Caps)
+	}
+	if fmt.Sprint(decoded.Hashes) != fmt.Sprint(hashes) {
+		t.Errorf("wrong hashes: want=%+v, got=%+v", hashes, decoded.Hashes)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	const in = `<presence><show>away</show></presence><presence type="unavailable"></presence><message><presence></presence></message>`
+	const want = `<presence><show>away</show><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="n" ver="v"></c></presence><presence type="unavailable"></presence><message><presence></presence></message>`
+
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	r := caps.Insert(caps.Caps{Hash: crypto.SHA1, Node: "n", Ver: "v"})(xml.NewDecoder(strings.NewReader(in)))
+	if _, err := xmlstream.Copy(e, r); err != nil {
+		t.Fatalf("error copying: %v", err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if out := b.String(); out != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+}
+
+type tokenReadEncoder struct {
+	xml.TokenReader
+	xmlstream.Encoder
+}
+
+// handle passes the element in req to m and returns anything written.
+func handle(t *testing.T, m *mux.ServeMux, req string) string {
+	t.Helper()
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	d := xml.NewDecoder(strings.NewReader(req))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err := m.HandleXMPP(tokenReadEncoder{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("unexpected error handling %s: %v", req, err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing encoder: %v", err)
+	}
+	return b.String()
+}
+
+func TestAdvertise(t *testing.T) {
+	bot := info.Identity{Category: "client", Type: "bot"}
+	h := &caps.Handler{Node: "https://mellium.im/xmpp"}
+	if _, _, err := h.Advertise(); err == nil {
+		t.Errorf("expected error advertising caps before registering the handler")
+	}
+	m := mux.New(disco.Handle(bot), caps.Handle(h), ping.Handle())
+
+	c, hashes, err := h.Advertise()
+	if err != nil {
+		t.Fatalf("error advertising caps: %v", err)
+	}
+	want := disco.Info{
+		Identities: []info.Identity{bot},
+		Features:   features(caps.NS, disco.NSInfo, caps.NSHashes, ping.NS),
+	}
+	ver, _ := caps.Ver(crypto.SHA1, want)
+	if c.Ver != ver || c.Node != h.Node || c.Hash != crypto.SHA1 {
+		t.Errorf("wrong caps: want ver=%s, got=%+v", ver, c)
+	}
+	hash, _ := caps.Sum(crypto.SHA256, want)
+	if len(hashes) != 1 || hashes[0].Value != hash || hashes[0].Algo != crypto.SHA256 {
+		t.Errorf("wrong hashes: want hash=%s, got=%+v", hash, hashes)
+	}
+
+	for _, node := range []string{c.DiscoNode(), hashes[0].DiscoNode()} {
+		out := handle(t, m, `<iq xmlns="jabber:client" type="get" id="123"><query xmlns="http://jabber.org/protocol/disco#info" node="`+node+`"/></iq>`)
+		resp := struct {
+			stanza.IQ
+			Info disco.Info
+		}{}
+		if err = xml.Unmarshal([]byte(out), &resp); err != nil {
+			t.Fatalf("error decoding response %s: %v", out, err)
+		}
+		if resp.Info.Node != node {
+			t.Errorf("wrong node in response: want=%s, got=%s", node, resp.Info.Node)
+		}
+		if got, _ := caps.Ver(crypto.SHA1, resp.Info); got != c.Ver {
+			t.Errorf("response for %s does not match advertised caps: %s", node, out)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	if _, err := xmlstream.Copy(e, complexInfo.TokenReader()); err != nil {
+		t.Fatalf("error encoding info: %v", err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("error flushing info: %v", err)
+	}
+	// The remote answers disco#info requests with the info and counts the
+	// number of requests.
+	var count int32
+	s, conn := xmpptest.NewServerSession(nil, func(xmpptest.Request) string {
+		atomic.AddInt32(&count, 1)
+		return b.String()
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	h := &caps.Handler{}
+	m := mux.New(caps.Handle(h))
+	sum, _ := caps.Sum(crypto.SHA256, complexInfo)
+	const node = "https://psi-im.org"
+	for _, p := range []string{
+		`<presence xmlns="jabber:client" from="juliet@example.net/balcony"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="` + node + `" ver="q07IKJEyjvHSyhy//CH0CxmKi8w="/></presence>`,
+		`<presence xmlns="jabber:client" from="romeo@example.net/orchard"><c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">` + sum + `</hash></c></presence>`,
+		`<presence xmlns="jabber:client" from="nurse@example.net/chamber"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="` + node + `" ver="QgayPKawpkPSDYmwT/WM94uAlu0="/></presence>`,
+		`<presence xmlns="jabber:client" from="tybalt@example.net/street"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="` + node + `" ver="QgayPKawpkPSDYmwT/WM94uAlu0="/></presence>`,
+		`<presence xmlns="jabber:client" from="tybalt@example.net/street" type="unavailable"/>`,
+	} {
+		handle(t, m, p)
+	}
+
+	juliet := jid.MustParse("juliet@example.net/balcony")
+	if c, ok := h.Caps(juliet); !ok || c.Node != node || c.Hash != crypto.SHA1 {
+		t.Errorf("wrong caps recorded for juliet: %+v", c)
+	}
+	if _, ok := h.Caps(jid.MustParse("tybalt@example.net/street")); ok {
+		t.Errorf("caps not removed after unavailable presence")
+	}
+
+	for _, tc := range []struct {
+		j     string
+		err   error
+		count int32
+	}{
+		{j: "juliet@example.net/balcony", count: 1},
+		// The first response is cached.
+		{j: "juliet@example.net/balcony", count: 1},
+		// XEP-0390 hashes are cached separately.
+		{j: "romeo@example.net/orchard", count: 2},
+		// The response does not match the hash and is not cached.
+		{j: "nurse@example.net/chamber", err: caps.ErrVerification, count: 3},
+		{j: "nurse@example.net/chamber", err: caps.ErrVerification, count: 4},
+	} {
+		i, err := h.Info(ctx, jid.MustParse(tc.j), s)
+		if err != tc.err {
+			t.Fatalf("wrong error for %s: want=%v, got=%v", tc.j, tc.err, err)
+		}
+		if ver, _ := caps.Ver(crypto.SHA1, i); ver != "q07IKJEyjvHSyhy//CH0CxmKi8w=" {
+			t.Errorf("wrong info returned for %s: %+v", tc.j, i)
+		}
+		if n := atomic.LoadInt32(&count); n != tc.count {
+			t.Errorf("wrong number of queries after %s: want=%d, got=%d", tc.j, tc.count, n)
+		}
+	}
+}
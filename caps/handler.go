@@ -0,0 +1,319 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package caps
+
+import (
+	"context"
+	"crypto"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// ErrVerification is returned by Info when the disco#info response does not
+// match the hash that the entity advertised.
+var ErrVerification = errors.New("caps: disco#info response does not match the advertised hash")
+
+// Cache stores disco#info responses that have been verified against their
+// hashes.
+// Keys are of the form "<hash function>.<hash>", for example
+// "sha-1.QgayPKawpkPSDYmwT/WM94uAlu0=".
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type Cache interface {
+	Get(key string) (disco.Info, bool)
+	Put(key string, info disco.Info)
+}
+
+type memCache struct {
+	m sync.Map
+}
+
+func (c *memCache) Get(key string) (disco.Info, bool) {
+	v, ok := c.m.Load(key)
+	if !ok {
+		return disco.Info{}, false
+	}
+	return v.(disco.Info), true
+}
+
+func (c *memCache) Put(key string, info disco.Info) {
+	c.m.Store(key, info)
+}
+
+func cacheKey(h crypto.Hash, value string) string {
+	return hashName(h) + "." + value
+}
+
+type entity struct {
+	caps   *Caps
+	hashes Hashes
+}
+
+// Handler keeps track of the capabilities advertised in presence received from
+// other entities and responds to disco#info requests for the capabilities that
+// we advertise.
+type Handler struct {
+	// Node is a URI that uniquely identifies the software, for example
+	// "https://mellium.im/xmpp".
+	// It is used when generating XEP-0115 capabilities.
+	Node string
+
+	// Cache stores verified disco#info responses.
+	// If nil, an in memory cache is used.
+	Cache Cache
+
+	mux       *mux.ServeMux
+	cacheOnce sync.Once
+	mu        sync.Mutex
+	entities  map[string]entity
+}
+
+// Handle returns an option that registers a Handler for incoming presence
+// containing capabilities and for unavailable presence.
+// The handler also reports the features for the disco#info nodes of our own
+// capabilities to any disco handler registered on the same mux.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		h.mux = m
+		mux.Presence(stanza.AvailablePresence, xml.Name{Space: NS, Local: "c"}, h)(m)
+		mux.Presence(stanza.AvailablePresence, xml.Name{Space: NSHashes, Local: "c"}, h)(m)
+		mux.Presence(stanza.UnavailablePresence, xml.Name{}, h)(m)
+	}
+}
+
+func (h *Handler) cache() Cache {
+	h.cacheOnce.Do(func() {
+		if h.Cache == nil {
+			h.Cache = &memCache{}
+		}
+	})
+	return h.Cache
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (h *Handler) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	from := p.From.String()
+	if p.Type == stanza.UnavailablePresence {
+		h.mu.Lock()
+		delete(h.entities, from)
+		h.mu.Unlock()
+		return nil
+	}
+
+	data := struct {
+		stanza.Presence
+		Caps   *Caps   `xml:"http://jabber.org/protocol/caps c"`
+		Hashes *Hashes `xml:"urn:xmpp:caps c"`
+	}{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	e := entity{caps: data.Caps}
+	if data.Hashes != nil {
+		e.hashes = *data.Hashes
+	}
+	if e.caps == nil && len(e.hashes) == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.entities == nil {
+		h.entities = make(map[string]entity)
+	}
+	h.entities[from] = e
+	return nil
+}
+
+// Caps returns the XEP-0115 capabilities most recently advertised by the
+// entity.
+func (h *Handler) Caps(j jid.JID) (Caps, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entities[j.String()]
+	if !ok || e.caps == nil {
+		return Caps{}, false
+	}
+	return *e.caps, true
+}
+
+// Hashes returns the XEP-0390 capabilities most recently advertised by the
+// entity.
+func (h *Handler) Hashes(j jid.JID) (Hashes, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entities[j.String()]
+	if !ok || len(e.hashes) == 0 {
+		return nil, false
+	}
+	return append(Hashes(nil), e.hashes...), true
+}
+
+// Info returns the disco#info response described by the capabilities most
+// recently advertised by the entity.
+// XEP-0390 hashes are preferred over XEP-0115 verification strings.
+//
+// If the response is not in the cache, it is queried from the entity and the
+// hash is verified before the response is added to the cache.
+// If verification fails, the response is returned along with ErrVerification
+// and is not cached.
+// If the entity has not advertised any capabilities that can be verified
+// (for example because it uses an unknown hash function), its disco#info is
+// queried directly and is not cached.
+//
+// Because Info may send an IQ and wait for the response, it must not be called
+// from within a handler unless the session is being served with
+// ServeConcurrent.
+func (h *Handler) Info(ctx context.Context, j jid.JID, s *xmpp.Session) (disco.Info, error) {
+	h.mu.Lock()
+	e := h.entities[j.String()]
+	h.mu.Unlock()
+
+	type candidate struct {
+		algo   crypto.Hash
+		value  string
+		node   string
+		verify func(crypto.Hash, disco.Info) (string, error)
+	}
+	var candidates []candidate
+	for _, hash := range e.hashes {
+		// SHA-1 is forbidden by XEP-0390 and cannot be verified with Sum.
+		if hash.Algo.Available() && hash.Algo != crypto.SHA1 {
+			candidates = append(candidates, candidate{
+				algo:   hash.Algo,
+				value:  hash.Value,
+				node:   hash.DiscoNode(),
+				verify: Sum,
+			})
+		}
+	}
+	if e.caps != nil && e.caps.Hash.Available() {
+		candidates = append(candidates, candidate{
+			algo:   e.caps.Hash,
+			value:  e.caps.Ver,
+			node:   e.caps.DiscoNode(),
+			verify: Ver,
+		})
+	}
+
+	cache := h.cache()
+	for _, c := range candidates {
+		if i, ok := cache.Get(cacheKey(c.algo, c.value)); ok {
+			return i, nil
+		}
+	}
+	if len(candidates) == 0 {
+		return disco.GetInfo(ctx, "", j, s)
+	}
+
+	c := candidates[0]
+	i, err := disco.GetInfo(ctx, c.node, j, s)
+	if err != nil {
+		return i, err
+	}
+	value, err := c.verify(c.algo, i)
+	if err != nil || value != c.value {
+		return i, ErrVerification
+	}
+	cache.Put(cacheKey(c.algo, c.value), i)
+	return i, nil
+}
+
+// Advertise returns the XEP-0115 capabilities (using SHA-1) and XEP-0390
+// hashes (using SHA-256) for the identities and features of the mux that the
+// handler is registered on.
+// They can be added to outgoing presence using Insert.
+func (h *Handler) Advertise() (Caps, Hashes, error) {
+	if h.mux == nil {
+		return Caps{}, nil, errors.New("caps: handler is not registered on a mux")
+	}
+	i, err := h.ownInfo()
+	if err != nil {
+		return Caps{}, nil, err
+	}
+	ver, err := Ver(crypto.SHA1, i)
+	if err != nil {
+		return Caps{}, nil, err
+	}
+	hash, err := Sum(crypto.SHA256, i)
+	if err != nil {
+		return Caps{}, nil, err
+	}
+	return Caps{Hash: crypto.SHA1, Node: h.Node, Ver: ver}, Hashes{{Algo: crypto.SHA256, Value: hash}}, nil
+}
+
+func (h *Handler) ownInfo() (disco.Info, error) {
+	var i disco.Info
+	err := h.mux.ForIdentities("", func(ident info.Identity) error {
+		i.Identities = append(i.Identities, ident)
+		return nil
+	})
+	if err != nil {
+		return i, err
+	}
+	err = h.mux.ForFeatures("", func(f info.Feature) error {
+		i.Features = append(i.Features, f)
+		return nil
+	})
+	return i, err
+}
+
+// isOwnNode reports whether node is the disco#info node for one of the
+// capabilities returned by Advertise.
+func (h *Handler) isOwnNode(node string) bool {
+	if h.mux == nil || (!strings.HasPrefix(node, NSHashes+"#") && !strings.HasPrefix(node, h.Node+"#")) {
+		return false
+	}
+	c, hashes, err := h.Advertise()
+	if err != nil {
+		return false
+	}
+	if node == c.DiscoNode() {
+		return true
+	}
+	for _, hash := range hashes {
+		if node == hash.DiscoNode() {
+			return true
+		}
+	}
+	return false
+}
+
+// ForFeatures implements info.FeatureIter.
+// For the root node it reports support for entity capabilities, and for the
+// nodes of our own capabilities it reports the same features as the root node
+// of the mux that the handler is registered on.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node == "" {
+		if err := f(info.Feature{Var: NS}); err != nil {
+			return err
+		}
+		return f(info.Feature{Var: NSHashes})
+	}
+	if !h.isOwnNode(node) {
+		return nil
+	}
+	return h.mux.ForFeatures("", f)
+}
+
+// ForIdentities implements info.IdentityIter.
+// For the nodes of our own capabilities it reports the same identities as the
+// root node of the mux that the handler is registered on.
+func (h *Handler) ForIdentities(node string, f func(info.Identity) error) error {
+	if node == "" || !h.isOwnNode(node) {
+		return nil
+	}
+	return h.mux.ForIdentities("", f)
+}
@@ -0,0 +1,267 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package caps
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+
+	// Register the hash functions that are used most often.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+)
+
+const formType = "FORM_TYPE"
+
+// Errors returned when computing or verifying capabilities.
+var (
+	ErrUnknownHash   = errors.New("caps: unknown or unavailable hash function")
+	ErrForbiddenHash = errors.New("caps: SHA-1 must not be used with entity capabilities 2.0")
+	ErrMalformed     = errors.New("caps: disco#info contains duplicate identities, features, or forms")
+)
+
+// Hash function names from the IANA Hash Function Textual Names registry and
+// XEP-0300: Use of Cryptographic Hash Functions in XMPP.
+var hashNames = map[crypto.Hash]string{
+	crypto.SHA1:        "sha-1",
+	crypto.SHA224:      "sha-224",
+	crypto.SHA256:      "sha-256",
+	crypto.SHA384:      "sha-384",
+	crypto.SHA512:      "sha-512",
+	crypto.SHA3_256:    "sha3-256",
+	crypto.SHA3_512:    "sha3-512",
+	crypto.BLAKE2b_256: "blake2b-256",
+	crypto.BLAKE2b_512: "blake2b-512",
+}
+
+func hashName(h crypto.Hash) string {
+	return hashNames[h]
+}
+
+func parseHash(name string) crypto.Hash {
+	for h, n := range hashNames {
+		if n == name {
+			return h
+		}
+	}
+	return 0
+}
+
+func encodeHash(h crypto.Hash, b []byte) (string, error) {
+	if hashName(h) == "" || !h.Available() {
+		return "", ErrUnknownHash
+	}
+	hash := h.New()
+	/* #nosec */
+	hash.Write(b)
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// formTypeOf returns the FORM_TYPE of a service discovery extension form.
+// If the form does not have a hidden FORM_TYPE field, ok is false.
+// If the FORM_TYPE is ambiguous, an error is returned.
+func formTypeOf(f *form.Data) (typ string, ok bool, err error) {
+	f.ForFields(func(field form.FieldData) {
+		if field.Var != formType || field.Type != "hidden" || len(field.Values) == 0 {
+			return
+		}
+		for _, v := range field.Values[1:] {
+			if v != field.Values[0] {
+				err = ErrMalformed
+			}
+		}
+		typ, ok = field.Values[0], true
+	})
+	return typ, ok, err
+}
+
+// validate checks that the disco#info response can be used to generate a
+// verification string.
+func validate(i disco.Info) error {
+	idents := make(map[info.Identity]struct{})
+	for _, ident := range i.Identities {
+		ident.XMLName.Space, ident.XMLName.Local = "", ""
+		if _, ok := idents[ident]; ok {
+			return ErrMalformed
+		}
+		idents[ident] = struct{}{}
+	}
+	features := make(map[string]struct{})
+	for _, f := range i.Features {
+		if _, ok := features[f.Var]; ok {
+			return ErrMalformed
+		}
+		features[f.Var] = struct{}{}
+	}
+	types := make(map[string]struct{})
+	for j := range i.Forms {
+		typ, ok, err := formTypeOf(&i.Forms[j])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, ok := types[typ]; ok {
+			return ErrMalformed
+		}
+		types[typ] = struct{}{}
+	}
+	return nil
+}
+
+// Ver returns the XEP-0115 verification string for the disco#info response
+// using the provided hash function.
+// The node is ignored.
+//
+// If the response contains duplicate identities or features, or multiple forms
+// with the same FORM_TYPE, ErrMalformed is returned.
+// Forms without a hidden FORM_TYPE field are ignored as required by XEP-0115.
+func Ver(h crypto.Hash, i disco.Info) (string, error) {
+	if err := validate(i); err != nil {
+		return "", err
+	}
+
+	var s strings.Builder
+	identities := make([]string, 0, len(i.Identities))
+	for _, ident := range i.Identities {
+		identities = append(identities, ident.Category+"/"+ident.Type+"/"+ident.Lang+"/"+ident.Name)
+	}
+	sort.Strings(identities)
+	for _, ident := range identities {
+		s.WriteString(ident)
+		s.WriteByte('<')
+	}
+
+	features := make([]string, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, f.Var)
+	}
+	sort.Strings(features)
+	for _, f := range features {
+		s.WriteString(f)
+		s.WriteByte('<')
+	}
+
+	type extension struct {
+		typ    string
+		fields []form.FieldData
+	}
+	var forms []extension
+	for j := range i.Forms {
+		f := &i.Forms[j]
+		typ, ok, _ := formTypeOf(f)
+		if !ok {
+			continue
+		}
+		ext := extension{typ: typ}
+		f.ForFields(func(field form.FieldData) {
+			if field.Var != formType {
+				ext.fields = append(ext.fields, field)
+			}
+		})
+		forms = append(forms, ext)
+	}
+	sort.Slice(forms, func(a, b int) bool {
+		return forms[a].typ < forms[b].typ
+	})
+	for _, ext := range forms {
+		s.WriteString(ext.typ)
+		s.WriteByte('<')
+		sort.Slice(ext.fields, func(a, b int) bool {
+			return ext.fields[a].Var < ext.fields[b].Var
+		})
+		for _, field := range ext.fields {
+			s.WriteString(field.Var)
+			s.WriteByte('<')
+			values := append([]string(nil), field.Values...)
+			sort.Strings(values)
+			for _, v := range values {
+				s.WriteString(v)
+				s.WriteByte('<')
+			}
+		}
+	}
+
+	return encodeHash(h, []byte(s.String()))
+}
+
+// Separators used by the XEP-0390 hash function input.
+const (
+	unitSep   = 0x1f
+	recordSep = 0x1e
+	groupSep  = 0x1d
+	fileSep   = 0x1c
+)
+
+// sortedJoin sorts the byte strings and concatenates them followed by sep.
+func sortedJoin(items [][]byte, sep byte) []byte {
+	sort.Slice(items, func(a, b int) bool {
+		return bytes.Compare(items[a], items[b]) < 0
+	})
+	return append(bytes.Join(items, nil), sep)
+}
+
+// Sum returns the XEP-0390 hash of the disco#info response using the provided
+// hash function.
+// The node is ignored.
+//
+// If the response contains duplicate identities or features, or multiple forms
+// with the same FORM_TYPE, ErrMalformed is returned.
+// XEP-0390 forbids the use of SHA-1, so if h is crypto.SHA1 ErrForbiddenHash is
+// returned.
+func Sum(h crypto.Hash, i disco.Info) (string, error) {
+	if h == crypto.SHA1 {
+		return "", ErrForbiddenHash
+	}
+	if err := validate(i); err != nil {
+		return "", err
+	}
+
+	features := make([][]byte, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, append([]byte(f.Var), unitSep))
+	}
+
+	identities := make([][]byte, 0, len(i.Identities))
+	for _, ident := range i.Identities {
+		var b []byte
+		for _, s := range []string{ident.Category, ident.Type, ident.Lang, ident.Name} {
+			b = append(b, s...)
+			b = append(b, unitSep)
+		}
+		identities = append(identities, append(b, recordSep))
+	}
+
+	forms := make([][]byte, 0, len(i.Forms))
+	for j := range i.Forms {
+		var fields [][]byte
+		i.Forms[j].ForFields(func(field form.FieldData) {
+			values := make([][]byte, 0, len(field.Values))
+			for _, v := range field.Values {
+				values = append(values, append([]byte(v), unitSep))
+			}
+			b := append([]byte(field.Var), unitSep)
+			b = append(b, sortedJoin(values, recordSep)...)
+			fields = append(fields, b)
+		})
+		forms = append(forms, sortedJoin(fields, groupSep))
+	}
+
+	var input []byte
+	input = append(input, sortedJoin(features, fileSep)...)
+	input = append(input, sortedJoin(identities, fileSep)...)
+	input = append(input, sortedJoin(forms, fileSep)...)
+	return encodeHash(h, input)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package carbons implements XEP-0280: Message Carbons.
+//
+// Message carbons let a user who is logged in with several clients at once see
+// the messages that were sent and received by all of them.
+// Once carbons are enabled, the server sends each client a copy of messages
+// sent or received by the users other clients, wrapped in a <sent/> or
+// <received/> element.
+package carbons // import "mellium.im/xmpp/carbons"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS        = "urn:xmpp:carbons:2"
+	NSForward = "urn:xmpp:forward:0"
+)
+
+// Enable requests that the server start sending carbons to the session.
+// If the server responds with an error it is returned as a stanza.Error.
+func Enable(ctx context.Context, s *xmpp.Session) error {
+	return toggle(ctx, s, "enable")
+}
+
+// Disable requests that the server stop sending carbons to the session.
+// If the server responds with an error it is returned as a stanza.Error.
+func Disable(ctx context.Context, s *xmpp.Session) error {
+	return toggle(ctx, s, "disable")
+}
+
+func toggle(ctx context.Context, s *xmpp.Session, local string) error {
+	return s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: local},
+	}), stanza.IQ{Type: stanza.SetIQ}, nil)
+}
+
+// MessageHandler responds to messages that were unwrapped from carbons.
+type MessageHandler interface {
+	HandleCarbon(msg stanza.Message, sent bool, t xmlstream.TokenReadEncoder) error
+}
+
+// The MessageHandlerFunc type is an adapter to allow the use of ordinary
+// functions as carbon handlers.
+// If f is a function with the appropriate signature, MessageHandlerFunc(f) is a
+// MessageHandler that calls f.
+type MessageHandlerFunc func(msg stanza.Message, sent bool, t xmlstream.TokenReadEncoder) error
+
+// HandleCarbon calls f(msg, sent, t).
+func (f MessageHandlerFunc) HandleCarbon(msg stanza.Message, sent bool, t xmlstream.TokenReadEncoder) error {
+	return f(msg, sent, t)
+}
+
+// Handle returns an option that registers a Handler for carbons.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		sent := xml.Name{Space: NS, Local: "sent"}
+		received := xml.Name{Space: NS, Local: "received"}
+		for _, typ := range []stanza.MessageType{
+			"",
+			stanza.NormalMessage,
+			stanza.ChatMessage,
+			stanza.HeadlineMessage,
+			stanza.GroupChatMessage,
+		} {
+			mux.Message(typ, sent, h)(m)
+			mux.Message(typ, received, h)(m)
+		}
+	}
+}
+
+// Handler unwraps carbons and passes the forwarded messages to another handler.
+//
+// To prevent other entities from injecting fake messages, carbons that were not
+// sent by the bare JID of Addr are ignored.
+type Handler struct {
+	// Addr is the address of the session, normally the value returned by its
+	// LocalAddr method.
+	Addr jid.JID
+
+	// Inner is called with each forwarded message.
+	// The message header and sent flag are taken from the forwarded message and
+	// the wrapper it was found in, and t reads the forwarded message.
+	// Anything written to t is sent over the session.
+	Inner MessageHandler
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	if h.Inner == nil || !msg.From.Equal(h.Addr.Bare()) {
+		return nil
+	}
+
+	// Pop the start message token.
+	_, err := t.Token()
+	if err != nil {
+		return err
+	}
+
+	iter := xmlstream.NewIter(t)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, r := iter.Current()
+		if start.Name.Space != NS || (start.Name.Local != "sent" && start.Name.Local != "received") {
+			continue
+		}
+		sent := start.Name.Local == "sent"
+
+		_, forwarded := child(r, func(name xml.Name) bool {
+			return name.Space == NSForward && name.Local == "forwarded"
+		})
+		if forwarded == nil {
+			return nil
+		}
+		msgStart, inner := child(forwarded, func(name xml.Name) bool {
+			return name.Local == "message" && (name.Space == ns.Client || name.Space == ns.Server)
+		})
+		if msgStart == nil {
+			return nil
+		}
+		fwd, err := stanza.NewMessage(*msgStart)
+		if err != nil {
+			return err
+		}
+		return h.Inner.HandleCarbon(fwd, sent, struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: xmlstream.MultiReader(xmlstream.Token(*msgStart), inner),
+			Encoder:     t,
+		})
+	}
+	return iter.Err()
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
+// child returns the first child element of r with a name that matches and a
+// reader over the rest of the element, or nil if no such child exists.
+func child(r xml.TokenReader, match func(xml.Name) bool) (*xml.StartElement, xml.TokenReader) {
+	iter := xmlstream.NewIter(r)
+	for iter.Next() {
+		start, inner := iter.Current()
+		if match(start.Name) {
+			return start, inner
+		}
+	}
+	return nil, nil
+}
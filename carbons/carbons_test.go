@@ -0,0 +1,170 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package carbons_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/carbons"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ mux.MessageHandler     = carbons.Handler{}
+	_ info.FeatureIter       = carbons.Handler{}
+	_ carbons.MessageHandler = carbons.MessageHandlerFunc(nil)
+)
+
+const (
+	sent     = `<message xmlns="jabber:client" from="%s" to="romeo@montague.example/home" type="chat"><sent xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><message xmlns="jabber:client" to="juliet@capulet.example/balcony" from="romeo@montague.example/garden" type="chat" id="%s"><body>Neither, fair saint, if either thee dislike.</body></message></forwarded></sent></message>`
+	received = `<message xmlns="jabber:client" from="%s" to="romeo@montague.example/home" type="chat"><received xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><message xmlns="jabber:client" from="juliet@capulet.example/balcony" to="romeo@montague.example/garden" type="chat" id="%s"><body>What man art thou that, thus bescreen'd in night, so stumblest on my counsel?</body></message></forwarded></received></message>`
+)
+
+type tokenReadEncoder struct {
+	xml.TokenReader
+	xmlstream.Encoder
+}
+
+type carbon struct {
+	id   string
+	from string
+	sent bool
+	body string
+}
+
+var handlerTests = [...]struct {
+	in  string
+	out []carbon
+}{
+	0: {
+		in:  fmt.Sprintf(sent, "romeo@montague.example", "1"),
+		out: []carbon{{id: "1", from: "romeo@montague.example/garden", sent: true, body: "Neither, fair saint, if either thee dislike."}},
+	},
+	1: {
+		in:  fmt.Sprintf(received, "romeo@montague.example", "2"),
+		out: []carbon{{id: "2", from: "juliet@capulet.example/balcony", body: "What man art thou that, thus bescreen'd in night, so stumblest on my counsel?"}},
+	},
+	2: {
+		// Carbons must come from our own bare JID.
+		in: fmt.Sprintf(received, "mallory@evil.example", "3"),
+	},
+	3: {
+		in: fmt.Sprintf(sent, "romeo@montague.example/garden", "4"),
+	},
+	4: {
+		// Messages without a forwarded payload are ignored.
+		in: `<message xmlns="jabber:client" from="romeo@montague.example" type="chat"><sent xmlns="urn:xmpp:carbons:2"/></message>`,
+	},
+}
+
+func TestHandler(t *testing.T) {
+	for i, tc := range handlerTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var got []carbon
+			m := mux.New(carbons.Handle(carbons.Handler{
+				Addr: jid.MustParse("romeo@montague.example/home"),
+				Inner: carbons.MessageHandlerFunc(func(msg stanza.Message, sent bool, t xmlstream.TokenReadEncoder) error {
+					body := struct {
+						Body string `xml:"body"`
+					}{}
+					err := xml.NewTokenDecoder(t).Decode(&body)
+					got = append(got, carbon{id: msg.ID, from: msg.From.String(), sent: sent, body: body.Body})
+					return err
+				}),
+			}))
+
+			d := xml.NewDecoder(strings.NewReader(tc.in))
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatalf("error popping start token: %v", err)
+			}
+			start := tok.(xml.StartElement)
+			err = m.HandleXMPP(tokenReadEncoder{
+				TokenReader: d,
+				Encoder:     xml.NewEncoder(ioutil.Discard),
+			}, &start)
+			if err != nil {
+				t.Fatalf("error handling message: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.out) {
+				t.Errorf("wrong carbons:\nwant=%+v,\n got=%+v", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestEnable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	/* #nosec */
+	defer clientConn.Close()
+	recv := make(chan string, 2)
+	go func() {
+		d := xml.NewDecoder(serverConn)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok || start.Name.Local != "iq" {
+				continue
+			}
+			var id string
+			for _, a := range start.Attr {
+				if a.Name.Local == "id" {
+					id = a.Value
+				}
+			}
+			tok, err = d.Token()
+			if err != nil {
+				return
+			}
+			payload := tok.(xml.StartElement)
+			if err = d.Skip(); err != nil {
+				return
+			}
+			recv <- payload.Name.Space + " " + payload.Name.Local
+			if payload.Name.Local == "enable" {
+				fmt.Fprintf(serverConn, `<iq xmlns="jabber:client" type="result" id="%s"/>`, id)
+				continue
+			}
+			fmt.Fprintf(serverConn, `<iq xmlns="jabber:client" type="error" id="%s"><error type="cancel"><not-allowed xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`, id)
+		}
+	}()
+	s := xmpptest.NewSession(0, clientConn)
+	go func() {
+		/* #nosec */
+		s.Serve(nil)
+	}()
+
+	if err := carbons.Enable(ctx, s); err != nil {
+		t.Errorf("error enabling carbons: %v", err)
+	}
+	if got := <-recv; got != carbons.NS+" enable" {
+		t.Errorf("wrong payload: want=%s enable, got=%s", carbons.NS, got)
+	}
+	if err, ok := carbons.Disable(ctx, s).(stanza.Error); !ok || err.Condition != stanza.NotAllowed {
+		t.Errorf("wrong error disabling carbons: %v", err)
+	}
+	if got := <-recv; got != carbons.NS+" disable" {
+		t.Errorf("wrong payload: want=%s disable, got=%s", carbons.NS, got)
+	}
+}
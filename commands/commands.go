@@ -0,0 +1,278 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package commands implements XEP-0050: Ad-Hoc Commands.
+//
+// Ad-hoc commands let an entity (the requester) run commands that are
+// advertised by another entity (the responder), such as a bot or a server.
+// Commands may complete in a single step or may be made up of several stages
+// in which the responder sends a data form and the requester submits it,
+// possibly moving back and forth between stages before completing the command.
+//
+// To run commands, list them with List and execute them, then use the methods
+// on each Response to continue executing the command until it is completed or
+// canceled.
+// To offer commands, register them on a Handler and register the Handler on
+// the mux used to serve the session.
+package commands // import "mellium.im/xmpp/commands"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the XML namespace used by ad-hoc commands.
+// It is provided as a convenience.
+const NS = "http://jabber.org/protocol/commands"
+
+// Action is an action that the requester can take when executing a command.
+type Action string
+
+// A list of possible actions.
+const (
+	Execute  Action = "execute"
+	Next     Action = "next"
+	Prev     Action = "prev"
+	Complete Action = "complete"
+	Cancel   Action = "cancel"
+)
+
+// Status is the status of a command execution.
+type Status string
+
+// A list of possible statuses.
+const (
+	Executing Status = "executing"
+	Completed Status = "completed"
+	Canceled  Status = "canceled"
+)
+
+// NoteType is the severity of a note.
+type NoteType string
+
+// A list of possible note types.
+const (
+	Info  NoteType = "info"
+	Warn  NoteType = "warn"
+	Error NoteType = "error"
+)
+
+// Note is a message from the responder about the execution of a command.
+type Note struct {
+	Type NoteType `xml:"type,attr,omitempty"`
+	Text string   `xml:",chardata"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (n Note) TokenReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Local: "note"}}
+	if n.Type != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: string(n.Type)})
+	}
+	return xmlstream.Wrap(xmlstream.Token(xml.CharData(n.Text)), start)
+}
+
+// Command is a command advertised by a responder.
+type Command struct {
+	JID  jid.JID
+	Node string
+	Name string
+}
+
+// Execute starts executing the command.
+func (c Command) Execute(ctx context.Context, s *xmpp.Session) (Response, error) {
+	return send(ctx, s, c.JID, c.Node, "", Execute, nil)
+}
+
+// List uses service discovery to request the commands advertised by the
+// entity at to.
+// If the remote entity responds with an error it is returned as a
+// stanza.Error.
+func List(ctx context.Context, s *xmpp.Session, to jid.JID) ([]Command, error) {
+	iter := disco.FetchItems(ctx, NS, to, s)
+	var cmds []Command
+	for iter.Next() {
+		item := iter.Item()
+		cmds = append(cmds, Command{JID: item.JID, Node: item.Node, Name: item.Name})
+	}
+	err := iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	return cmds, err
+}
+
+// Response is a stage in the execution of a command.
+//
+// Responders return a Response from each stage of a command.
+// If Status is empty, it is set to Executing if any actions are allowed and
+// to Completed otherwise.
+// When the requester asks for the default action and Default is empty, the
+// next stage is requested if it is allowed and otherwise the command is
+// completed.
+type Response struct {
+	Node      string
+	SessionID string
+	Status    Status
+
+	// Actions are the actions that the requester may take next, apart from
+	// canceling the command which is always allowed.
+	Actions []Action
+	// Default is the action to take if the requester does not pick one.
+	Default Action
+
+	Notes []Note
+	Form  *form.Data
+
+	from jid.JID
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (r Response) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	if len(r.Actions) > 0 {
+		actionsStart := xml.StartElement{Name: xml.Name{Local: "actions"}}
+		if r.Default != "" {
+			actionsStart.Attr = append(actionsStart.Attr, xml.Attr{Name: xml.Name{Local: "execute"}, Value: string(r.Default)})
+		}
+		var actions []xml.TokenReader
+		for _, action := range r.Actions {
+			actions = append(actions, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: string(action)}}))
+		}
+		inner = append(inner, xmlstream.Wrap(xmlstream.MultiReader(actions...), actionsStart))
+	}
+	for _, note := range r.Notes {
+		inner = append(inner, note.TokenReader())
+	}
+	if r.Form != nil {
+		inner = append(inner, r.Form.TokenReader())
+	}
+	start := commandStart(r.Node, r.SessionID, "")
+	if r.Status != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "status"}, Value: string(r.Status)})
+	}
+	return xmlstream.Wrap(xmlstream.MultiReader(inner...), start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (r Response) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (r Response) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// UnmarshalXML satisfies the xml.Unmarshaler interface.
+func (r *Response) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	data := struct {
+		Node      string `xml:"node,attr"`
+		SessionID string `xml:"sessionid,attr"`
+		Status    Status `xml:"status,attr"`
+		Actions   *struct {
+			Execute Action `xml:"execute,attr"`
+			Actions []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"actions"`
+		Notes []Note     `xml:"note"`
+		Form  *form.Data `xml:"jabber:x:data x"`
+	}{}
+	err := d.DecodeElement(&data, &start)
+	if err != nil {
+		return err
+	}
+	r.Node = data.Node
+	r.SessionID = data.SessionID
+	r.Status = data.Status
+	r.Actions = nil
+	r.Default = ""
+	if data.Actions != nil {
+		r.Default = data.Actions.Execute
+		for _, action := range data.Actions.Actions {
+			r.Actions = append(r.Actions, Action(action.XMLName.Local))
+		}
+	}
+	r.Notes = data.Notes
+	r.Form = data.Form
+	return nil
+}
+
+// Allowed reports whether the action may be taken next.
+func (r Response) Allowed(action Action) bool {
+	if action == Cancel || action == Execute {
+		return r.Status == Executing
+	}
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute continues executing the command with the default action, submitting
+// the form if it is not nil.
+func (r Response) Execute(ctx context.Context, s *xmpp.Session, f *form.Data) (Response, error) {
+	return send(ctx, s, r.from, r.Node, r.SessionID, Execute, f)
+}
+
+// Next moves to the next stage of the command, submitting the form if it is
+// not nil.
+func (r Response) Next(ctx context.Context, s *xmpp.Session, f *form.Data) (Response, error) {
+	return send(ctx, s, r.from, r.Node, r.SessionID, Next, f)
+}
+
+// Prev returns to the previous stage of the command.
+func (r Response) Prev(ctx context.Context, s *xmpp.Session) (Response, error) {
+	return send(ctx, s, r.from, r.Node, r.SessionID, Prev, nil)
+}
+
+// Complete completes the command, submitting the form if it is not nil.
+func (r Response) Complete(ctx context.Context, s *xmpp.Session, f *form.Data) (Response, error) {
+	return send(ctx, s, r.from, r.Node, r.SessionID, Complete, f)
+}
+
+// Cancel cancels execution of the command.
+func (r Response) Cancel(ctx context.Context, s *xmpp.Session) (Response, error) {
+	return send(ctx, s, r.from, r.Node, r.SessionID, Cancel, nil)
+}
+
+func send(ctx context.Context, s *xmpp.Session, to jid.JID, node, sessionID string, action Action, f *form.Data) (Response, error) {
+	var payload xml.TokenReader
+	if f != nil {
+		payload = f.TokenReader()
+	}
+	resp := Response{}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(payload, commandStart(node, sessionID, action)), stanza.IQ{Type: stanza.SetIQ, To: to}, &resp)
+	resp.from = to
+	return resp, err
+}
+
+func commandStart(node, sessionID string, action Action) xml.StartElement {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "command"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+	}
+	if sessionID != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "sessionid"}, Value: sessionID})
+	}
+	if action != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "action"}, Value: string(action)})
+	}
+	return start
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package commands_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/commands"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xmlstream.Marshaler = commands.Note{}
+	_ xmlstream.Marshaler = commands.Response{}
+	_ xml.Unmarshaler     = (*commands.Response)(nil)
+	_ mux.IQHandler       = (*commands.Handler)(nil)
+	_ info.FeatureIter    = (*commands.Handler)(nil)
+	_ info.IdentityIter   = (*commands.Handler)(nil)
+	_ commands.Responder  = commands.ResponderFunc(nil)
+)
+
+var responder = jid.MustParse("responder@example.net/bot")
+
+// newPeers returns a session that is connected to another session serving the
+// handler.
+// The peer answers requests sent to any address, so it is addressed as
+// responder.
+// The returned function closes the underlying connection.
+func newPeers(h *commands.Handler) (*xmpp.Session, func()) {
+	c1, c2 := net.Pipe()
+	s1 := xmpptest.NewSession(0, c1)
+	s2 := xmpptest.NewSession(0, c2)
+	// Serving stops with an error when the connection is closed at the end of
+	// the test, so there is nothing useful to report.
+	/* #nosec */
+	go s1.Serve(nil)
+	/* #nosec */
+	go s2.Serve(mux.New(commands.Handle(h)))
+	return s1, func() {
+		/* #nosec */
+		c1.Close()
+		/* #nosec */
+		c2.Close()
+	}
+}
+
+// wizard is a command with two pages that lets the requester move back and
+// forth between them before completing it.
+func wizard(req commands.Request) (commands.Response, error) {
+	switch {
+	case req.Action == commands.Complete:
+		var name string
+		req.Form.ForFields(func(f form.FieldData) {
+			if f.Var == "name" && len(f.Values) > 0 {
+				name = f.Values[0]
+			}
+		})
+		return commands.Response{
+			Notes: []commands.Note{{Type: commands.Info, Text: "Created " + name}},
+		}, nil
+	case req.Stage == 0:
+		return commands.Response{
+			Actions: []commands.Action{commands.Next},
+			Form:    form.New(form.Title("Pick a type"), form.ListSingle("type")),
+		}, nil
+	}
+	return commands.Response{
+		Actions: []commands.Action{commands.Prev, commands.Complete},
+		Default: commands.Complete,
+		Form:    form.New(form.Title("Pick a name"), form.TextSingle("name")),
+	}, nil
+}
+
+func TestList(t *testing.T) {
+	h := &commands.Handler{}
+	h.HandleFunc("wizard", "Run the wizard", wizard)
+	h.HandleFunc("config", "Configure the service", wizard)
+	s, closer := newPeers(h)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmds, err := commands.List(ctx, s, responder)
+	if err != nil {
+		t.Fatalf("error listing commands: %v", err)
+	}
+	want := []commands.Command{
+		{JID: responder, Node: "wizard", Name: "Run the wizard"},
+		{JID: responder, Node: "config", Name: "Configure the service"},
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("wrong commands: want=%+v, got=%+v", want, cmds)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	h := &commands.Handler{}
+	h.HandleFunc("wizard", "Run the wizard", wizard)
+	s, closer := newPeers(h)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := commands.Command{JID: responder, Node: "wizard"}.Execute(ctx, s)
+	if err != nil {
+		t.Fatalf("error executing command: %v", err)
+	}
+	if resp.Status != commands.Executing || resp.SessionID == "" || resp.Form == nil {
+		t.Fatalf("wrong first stage: %+v", resp)
+	}
+	if !resp.Allowed(commands.Next) || resp.Allowed(commands.Prev) {
+		t.Errorf("wrong actions on first stage: %v", resp.Actions)
+	}
+	sessionID := resp.SessionID
+
+	resp, err = resp.Next(ctx, s, form.New(form.ListSingle("type", form.Value("user"))))
+	if err != nil {
+		t.Fatalf("error moving to the next stage: %v", err)
+	}
+	if resp.SessionID != sessionID || resp.Default != commands.Complete || !resp.Allowed(commands.Prev) {
+		t.Fatalf("wrong second stage: %+v", resp)
+	}
+
+	resp, err = resp.Prev(ctx, s)
+	if err != nil {
+		t.Fatalf("error moving to the previous stage: %v", err)
+	}
+	if resp.Allowed(commands.Prev) {
+		t.Fatalf("expected to be back on the first stage, got: %+v", resp)
+	}
+
+	// The default action of the first stage is next.
+	resp, err = resp.Execute(ctx, s, form.New(form.ListSingle("type", form.Value("user"))))
+	if err != nil {
+		t.Fatalf("error executing default action: %v", err)
+	}
+	if !resp.Allowed(commands.Complete) {
+		t.Fatalf("expected to be on the second stage, got: %+v", resp)
+	}
+
+	resp, err = resp.Complete(ctx, s, form.New(form.TextSingle("name", form.Value("romeo"))))
+	if err != nil {
+		t.Fatalf("error completing command: %v", err)
+	}
+	if resp.Status != commands.Completed || resp.Form != nil {
+		t.Errorf("wrong final stage: %+v", resp)
+	}
+	wantNotes := []commands.Note{{Type: commands.Info, Text: "Created romeo"}}
+	if !reflect.DeepEqual(resp.Notes, wantNotes) {
+		t.Errorf("wrong notes: want=%+v, got=%+v", wantNotes, resp.Notes)
+	}
+
+	// The session is gone once the command has completed.
+	_, err = resp.Cancel(ctx, s)
+	var stanzaErr stanza.Error
+	if !errors.As(err, &stanzaErr) || stanzaErr.Condition != stanza.BadRequest {
+		t.Errorf("wrong error for completed session: want=%v, got=%v", stanza.BadRequest, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	var canceled bool
+	h := &commands.Handler{}
+	h.HandleFunc("wizard", "Run the wizard", func(req commands.Request) (commands.Response, error) {
+		if req.Action == commands.Cancel {
+			canceled = true
+		}
+		return wizard(req)
+	})
+	s, closer := newPeers(h)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := commands.Command{JID: responder, Node: "wizard"}.Execute(ctx, s)
+	if err != nil {
+		t.Fatalf("error executing command: %v", err)
+	}
+	_, err = resp.Prev(ctx, s)
+	var stanzaErr stanza.Error
+	if !errors.As(err, &stanzaErr) || stanzaErr.Condition != stanza.BadRequest {
+		t.Errorf("wrong error for disallowed action: want=%v, got=%v", stanza.BadRequest, err)
+	}
+	resp, err = resp.Cancel(ctx, s)
+	if err != nil {
+		t.Fatalf("error canceling command: %v", err)
+	}
+	if resp.Status != commands.Canceled {
+		t.Errorf("wrong status: want=%s, got=%s", commands.Canceled, resp.Status)
+	}
+	if !canceled {
+		t.Errorf("responder was not told that the command was canceled")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	h := &commands.Handler{}
+	h.HandleFunc("forbidden", "Forbidden", func(commands.Request) (commands.Response, error) {
+		return commands.Response{}, stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	})
+	h.HandleFunc("broken", "Broken", func(commands.Request) (commands.Response, error) {
+		return commands.Response{}, errors.New("broken")
+	})
+	s, closer := newPeers(h)
+	defer closer()
+
+	for node, cond := range map[string]stanza.Condition{
+		"forbidden": stanza.Forbidden,
+		"broken":    stanza.InternalServerError,
+		"missing":   stanza.ItemNotFound,
+	} {
+		t.Run(node, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := commands.Command{JID: responder, Node: node}.Execute(ctx, s)
+			var stanzaErr stanza.Error
+			if !errors.As(err, &stanzaErr) || stanzaErr.Condition != cond {
+				t.Errorf("wrong error: want=%v, got=%v", cond, err)
+			}
+		})
+	}
+}
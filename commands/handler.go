@@ -0,0 +1,369 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// sessionTimeout is how long a session may go without activity before it is
+// expired.
+const sessionTimeout = 10 * time.Minute
+
+// Application specific error conditions.
+const (
+	condMalformedAction = "malformed-action"
+	condBadAction       = "bad-action"
+	condBadSessionID    = "bad-sessionid"
+	condSessionExpired  = "session-expired"
+)
+
+// Request is a request to execute a stage of a command.
+type Request struct {
+	// From is the address of the requester.
+	From jid.JID
+
+	// Node is the node of the command being executed.
+	Node string
+
+	// SessionID identifies this execution of the command.
+	SessionID string
+
+	// Action is the action requested.
+	// If the requester asked for the default action it is replaced by the
+	// default action of the previous stage, so Action is only Execute when
+	// execution of the command starts.
+	Action Action
+
+	// Stage is the index of the stage being requested, starting at zero.
+	// It is incremented by Next and Complete and decremented by Prev.
+	Stage int
+
+	// Form is the form submitted by the requester, if any.
+	Form *form.Data
+}
+
+// Responder responds to requests to execute a stage of a command.
+//
+// If RespondCommand returns a stanza.Error it is sent to the requester,
+// any other error results in an internal-server-error.
+// When the requester cancels the command, the Response is ignored.
+type Responder interface {
+	RespondCommand(Request) (Response, error)
+}
+
+// ResponderFunc is an adapter that lets a function be used as a Responder.
+type ResponderFunc func(Request) (Response, error)
+
+// RespondCommand satisfies the Responder interface by calling f.
+func (f ResponderFunc) RespondCommand(r Request) (Response, error) {
+	return f(r)
+}
+
+type command struct {
+	name string
+	r    Responder
+}
+
+type session struct {
+	from    jid.JID
+	node    string
+	stage   int
+	resp    Response
+	expires time.Time
+}
+
+// Handle returns an option that registers a Handler for ad-hoc commands.
+// It also registers a handler for disco#items requests so that the commands
+// can be listed.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "command"}, h)(m)
+		mux.IQ(stanza.GetIQ, xml.Name{Space: disco.NSItems, Local: "query"}, h)(m)
+	}
+}
+
+// Handler responds to requests to list and execute commands.
+// The zero value is ready to use.
+type Handler struct {
+	mu       sync.Mutex
+	cmds     map[string]command
+	order    []string
+	sessions map[string]*session
+}
+
+// Handle registers a command that is advertised with the given node and name.
+// If a command is already registered for node, Handle panics.
+func (h *Handler) Handle(node, name string, r Responder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r == nil {
+		panic("commands: nil responder")
+	}
+	if _, ok := h.cmds[node]; ok {
+		panic("commands: multiple registrations for " + node)
+	}
+	if h.cmds == nil {
+		h.cmds = make(map[string]command)
+	}
+	h.cmds[node] = command{name: name, r: r}
+	h.order = append(h.order, node)
+}
+
+// HandleFunc registers a function as a command.
+// It is like Handle except that it takes a function.
+func (h *Handler) HandleFunc(node, name string, f func(Request) (Response, error)) {
+	h.Handle(node, name, ResponderFunc(f))
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node == "" {
+		return f(info.Feature{Var: NS})
+	}
+	if _, ok := h.command(node); !ok {
+		return nil
+	}
+	err := f(info.Feature{Var: NS})
+	if err != nil {
+		return err
+	}
+	return f(info.Feature{Var: form.NS})
+}
+
+// ForIdentities implements info.IdentityIter.
+func (h *Handler) ForIdentities(node string, f func(info.Identity) error) error {
+	if node == NS {
+		return f(info.Identity{Category: "automation", Type: "command-list"})
+	}
+	cmd, ok := h.command(node)
+	if !ok {
+		return nil
+	}
+	return f(info.Identity{Category: "automation", Type: "command-node", Name: cmd.name})
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h *Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	switch {
+	case iq.Type == stanza.GetIQ && start.Name == xml.Name{Space: disco.NSItems, Local: "query"}:
+		return h.handleItems(iq, t, start)
+	case iq.Type == stanza.SetIQ && start.Name == xml.Name{Space: NS, Local: "command"}:
+		return h.handleCommand(iq, t, start)
+	}
+	return nil
+}
+
+func (h *Handler) handleItems(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	_, node := attr.Get(start.Attr, "node")
+	var items []xml.TokenReader
+	switch node {
+	case NS:
+		h.mu.Lock()
+		for _, node := range h.order {
+			items = append(items, disco.Item{JID: iq.To, Node: node, Name: h.cmds[node].name}.TokenReader())
+		}
+		h.mu.Unlock()
+	case "":
+	default:
+		return sendError(iq, t, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}, "")
+	}
+	_, err := xmlstream.Copy(t, iq.Result(xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{
+			Name: xml.Name{Space: disco.NSItems, Local: "query"},
+			Attr: start.Attr,
+		},
+	)))
+	return err
+}
+
+func (h *Handler) handleCommand(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	data := struct {
+		Node      string     `xml:"node,attr"`
+		SessionID string     `xml:"sessionid,attr"`
+		Action    Action     `xml:"action,attr"`
+		Form      *form.Data `xml:"jabber:x:data x"`
+	}{}
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(
+		xmlstream.Token(*start),
+		xmlstream.Inner(t),
+		xmlstream.Token(start.End()),
+	)).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	cmd, ok := h.command(data.Node)
+	if !ok {
+		return sendError(iq, t, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}, "")
+	}
+	switch data.Action {
+	case "", Execute, Next, Prev, Complete, Cancel:
+	default:
+		return sendError(iq, t, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}, condMalformedAction)
+	}
+
+	req := Request{
+		From:      iq.From,
+		Node:      data.Node,
+		SessionID: data.SessionID,
+		Action:    data.Action,
+		Form:      data.Form,
+	}
+	if req.SessionID == "" {
+		if req.Action != "" && req.Action != Execute {
+			return sendError(iq, t, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}, condBadSessionID)
+		}
+		req.Action = Execute
+		req.SessionID = attr.RandomID()
+	} else {
+		sess, stanzaErr, app := h.session(req.SessionID, req.From, req.Node)
+		if app != "" {
+			return sendError(iq, t, stanzaErr, app)
+		}
+		if req.Action == "" || req.Action == Execute {
+			req.Action = defaultAction(sess.resp)
+		}
+		if !sess.resp.Allowed(req.Action) {
+			return sendError(iq, t, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}, condBadAction)
+		}
+		req.Stage = sess.stage
+		switch req.Action {
+		case Next, Complete:
+			req.Stage++
+		case Prev:
+			req.Stage--
+		}
+	}
+
+	resp, err := cmd.r.RespondCommand(req)
+	if err != nil {
+		if req.Action == Cancel {
+			h.forget(req.SessionID)
+		}
+		stanzaErr, ok := err.(stanza.Error)
+		if !ok {
+			stanzaErr = stanza.Error{Type: stanza.Cancel, Condition: stanza.InternalServerError}
+		}
+		return sendError(iq, t, stanzaErr, "")
+	}
+	resp.Node = req.Node
+	resp.SessionID = req.SessionID
+	if req.Action == Cancel {
+		resp = Response{Node: req.Node, SessionID: req.SessionID, Status: Canceled}
+	}
+	if resp.Status == "" {
+		resp.Status = Completed
+		if len(resp.Actions) > 0 {
+			resp.Status = Executing
+		}
+	}
+	if resp.Status == Executing {
+		h.store(req, resp)
+	} else {
+		h.forget(req.SessionID)
+	}
+
+	_, err = xmlstream.Copy(t, iq.Result(resp.TokenReader()))
+	return err
+}
+
+// defaultAction returns the action to take when the requester does not pick
+// one.
+func defaultAction(resp Response) Action {
+	switch {
+	case resp.Default != "":
+		return resp.Default
+	case resp.Allowed(Next):
+		return Next
+	}
+	return Complete
+}
+
+func (h *Handler) command(node string) (command, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cmd, ok := h.cmds[node]
+	return cmd, ok
+}
+
+// session returns the session with the given ID if it was started by from for
+// the given node and has not expired.
+// Otherwise it returns the error to send and the application specific
+// condition.
+func (h *Handler) session(id string, from jid.JID, node string) (session, stanza.Error, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sess, ok := h.sessions[id]
+	switch {
+	case !ok || !sess.from.Equal(from) || sess.node != node:
+		return session{}, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}, condBadSessionID
+	case time.Now().After(sess.expires):
+		delete(h.sessions, id)
+		return session{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAllowed}, condSessionExpired
+	}
+	return *sess, stanza.Error{}, ""
+}
+
+func (h *Handler) store(req Request, resp Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*session)
+	}
+	now := time.Now()
+	for id, sess := range h.sessions {
+		if now.After(sess.expires) {
+			delete(h.sessions, id)
+		}
+	}
+	h.sessions[req.SessionID] = &session{
+		from:    req.From,
+		node:    req.Node,
+		stage:   req.Stage,
+		resp:    resp,
+		expires: now.Add(sessionTimeout),
+	}
+}
+
+func (h *Handler) forget(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, id)
+}
+
+// sendError responds to the IQ with the stanza error.
+// If app is not empty, an element with that name in the commands namespace is
+// added to the error as an application specific condition.
+func sendError(iq stanza.IQ, t xmlstream.TokenReadEncoder, stanzaErr stanza.Error, app string) error {
+	r := stanzaErr.TokenReader()
+	if app != "" {
+		tok, err := r.Token()
+		if err != nil {
+			return err
+		}
+		start := tok.(xml.StartElement)
+		r = xmlstream.Wrap(xmlstream.MultiReader(
+			xmlstream.Inner(r),
+			xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: NS, Local: app}}),
+		), start)
+	}
+	iq.To, iq.From = iq.From, iq.To
+	iq.Type = stanza.ErrorIQ
+	_, err := xmlstream.Copy(t, iq.Wrap(r))
+	return err
+}
@@ -10,12 +10,19 @@ import (
 	"context"
 	/* #nosec */
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/decl"
+	"mellium.im/xmpp/internal/ns"
+	intstream "mellium.im/xmpp/internal/stream"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/stream"
 )
@@ -34,90 +41,57 @@ func NewClientSession(ctx context.Context, addr jid.JID, secret []byte, rw io.Re
 
 // AcceptSession accepts an XMPP session on the given io.ReadWriter using the
 // component protocol.
-//func AcceptSession(ctx context.Context, addr jid.JID, secret []byte, rw io.ReadWriter) (*xmpp.Session, error) {
-//	return xmpp.NegotiateSession(ctx, nil, rw, Negotiator(addr, secret, true))
-//}
+// The component must request the domainpart of addr in its stream header, and
+// secret is called with that address to look up the shared secret that the
+// components handshake is checked against.
+// If the handshake does not match, a not-authorized stream error is sent to the
+// component and returned.
+func AcceptSession(ctx context.Context, addr jid.JID, rw io.ReadWriter, secret func(jid.JID) ([]byte, error)) (*xmpp.Session, error) {
+	addr = addr.Domain()
+	return xmpp.NegotiateSession(ctx, addr, addr, rw, true, acceptNegotiator(addr, secret))
+}
 
 // Negotiator returns a new function that can be used to negotiate a component
 // protocol connection when passed to xmpp.NegotiateSession.
 //
-// It currently only supports the client side of the component protocol.
 // If recv is true (indicating that we are receiving a connection on the server
-// side) the returned xmpp.Negotiator will panic.
+// side) the handshake sent by the component is checked against secret.
+// To look up the secret only once the component has connected use
+// AcceptSession.
 func Negotiator(addr jid.JID, secret []byte, recv bool) xmpp.Negotiator {
+	addr = addr.Domain()
+	if recv {
+		return acceptNegotiator(addr, func(jid.JID) ([]byte, error) {
+			return secret, nil
+		})
+	}
 	return func(ctx context.Context, s *xmpp.Session, _ interface{}) (mask xmpp.SessionState, _ io.ReadWriter, _ interface{}, err error) {
-		d := xml.NewDecoder(s.Conn())
-
-		if recv {
-			// If we're the receiving entity wait for a new stream, then send one in
-			// response.
-			panic("component: receiving connections not yet implemented")
-		} else {
-			// If we're the initiating entity, send a new stream and then wait for one
-			// in response.
-			_, err = fmt.Fprintf(s.Conn(), `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='%s'>`, addr)
-			if err != nil {
-				return mask, nil, nil, err
-			}
-		}
-
-		foundProc := false
-		var start xml.StartElement
-		// TODO: This loop is stupid and probably broken. Find a way to reuse existing
-		// logic from the xmpp package?
-	procloop:
-		for {
-			tok, err := d.Token()
-			if err != nil {
-				return mask, nil, nil, err
-			}
-			switch t := tok.(type) {
-			case xml.ProcInst:
-				if !foundProc {
-					foundProc = true
-					continue
-				}
-				return mask, nil, nil, errors.New("Received unexpected proc inst from server")
-			case xml.StartElement:
-				start = t
-				break procloop
-			default:
-				return mask, nil, nil, errors.New("Received unexpected token from server")
-			}
-		}
+		r := s.TokenReader()
+		defer r.Close()
 
-		if start.Name.Local != "stream" || start.Name.Space != stream.NS {
-			return mask, nil, nil, errors.New("Expected stream:stream from server")
+		// If we're the initiating entity, send a new stream and then wait for one
+		// in response.
+		_, err = fmt.Fprintf(s.Conn(), `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='%s'>`, addr)
+		if err != nil {
+			return mask, nil, nil, err
 		}
 
-		var id string
-		for _, attr := range start.Attr {
-			if attr.Name.Local == "id" {
-				id = attr.Value
-				break
-			}
+		info, err := intstream.Expect(ctx, r, false, false)
+		if err != nil {
+			return mask, nil, nil, err
 		}
-
-		if id == "" {
-			return mask, nil, nil, errors.New("Expected server stream to contain stream ID")
+		if info.XMLNS() != ns.Component {
+			return mask, nil, nil, stream.InvalidNamespace
 		}
 
-		/* #nosec */
-		h := sha1.New()
-
-		// hash.Write never returns an error per the documentation.
-		/* #nosec */
-		_, _ = h.Write([]byte(id))
-
-		// hash.Write never returns an error per the documentation.
-		/* #nosec */
-		_, _ = h.Write(secret)
-
-		_, err = fmt.Fprintf(s.Conn(), `<handshake>%x</handshake>`, h.Sum(nil))
+		_, err = fmt.Fprintf(s.Conn(), `<handshake>%x</handshake>`, handshake(info.ID(), secret))
 		if err != nil {
 			return mask, nil, nil, err
 		}
 
+		// Any stream errors sent by the server (eg. not-authorized if the handshake
+		// is wrong) are unmarshaled and returned by the stream reader.
+		d := xml.NewTokenDecoder(intstream.Reader(r))
 		tok, err := d.Token()
 		if err != nil {
 			return mask, nil, nil, err
@@ -127,11 +101,7 @@ func Negotiator(addr jid.JID, secret []byte, recv bool) xmpp.Negotiator {
 			return mask, nil, nil, errors.New("Expected acknowledgement or error start token from server")
 		}
 
-		// TODO: Actually unmarshal the stream error.
-		switch start.Name.Local {
-		case "error":
-			return mask, nil, nil, stream.NotAuthorized
-		case "handshake":
+		if start.Name.Local == "handshake" {
 			err = d.Skip()
 			return xmpp.Ready | xmpp.Authn, nil, nil, err
 		}
@@ -139,3 +109,99 @@ func Negotiator(addr jid.JID, secret []byte, recv bool) xmpp.Negotiator {
 		return mask, nil, nil, fmt.Errorf("Unknown start element: %v", start)
 	}
 }
+
+func acceptNegotiator(addr jid.JID, secret func(jid.JID) ([]byte, error)) xmpp.Negotiator {
+	return func(ctx context.Context, s *xmpp.Session, _ interface{}) (mask xmpp.SessionState, _ io.ReadWriter, _ interface{}, err error) {
+		r := s.TokenReader()
+		defer r.Close()
+		w := s.TokenWriter()
+		defer w.Close()
+
+		// If we're the receiving entity wait for a new stream, then send one in
+		// response.
+		info, err := intstream.Expect(ctx, r, true, false)
+		if err != nil {
+			return mask, nil, nil, err
+		}
+		id := attr.RandomID()
+		_, err = fmt.Fprintf(s.Conn(), decl.XMLHeader+`<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='%s' id='%s'>`, addr, id)
+		if err != nil {
+			return mask, nil, nil, err
+		}
+
+		// Stream errors can only be sent after we've sent our own stream header.
+		fail := func(e stream.Error) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+			if _, err := e.WriteXML(w); err != nil {
+				return mask, nil, nil, err
+			}
+			if err := w.Flush(); err != nil {
+				return mask, nil, nil, err
+			}
+			if _, err := fmt.Fprint(s.Conn(), `</stream:stream>`); err != nil {
+				return mask, nil, nil, err
+			}
+			return mask, nil, nil, e
+		}
+
+		if info.XMLNS() != ns.Component {
+			return fail(stream.InvalidNamespace)
+		}
+
+		// Read the handshake before validating the address so that we don't block
+		// writing an error while the component is still trying to send it on
+		// unbuffered connections.
+		d := xml.NewTokenDecoder(r)
+		tok, err := d.Token()
+		if err != nil {
+			return mask, nil, nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name != (xml.Name{Space: ns.Component, Local: "handshake"}) {
+			return fail(stream.NotAuthorized)
+		}
+		hs := struct {
+			Data string `xml:",chardata"`
+		}{}
+		err = d.DecodeElement(&hs, &start)
+		if err != nil {
+			return mask, nil, nil, err
+		}
+
+		to, ok := info.To()
+		if !ok || !to.Equal(addr) {
+			return fail(stream.HostUnknown)
+		}
+		key, err := secret(to)
+		if err != nil {
+			return fail(stream.InternalServerError)
+		}
+
+		expected := hex.EncodeToString(handshake(id, key))
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(strings.TrimSpace(hs.Data))), []byte(expected)) != 1 {
+			return fail(stream.NotAuthorized)
+		}
+
+		_, err = fmt.Fprint(s.Conn(), `<handshake/>`)
+		if err != nil {
+			return mask, nil, nil, err
+		}
+		return xmpp.Ready | xmpp.Authn, nil, nil, nil
+	}
+}
+
+// handshake computes the SHA-1 hash of the concatenation of the stream ID and
+// shared secret as described in XEP-0114 §3.
+func handshake(id string, secret []byte) []byte {
+	/* #nosec */
+	h := sha1.New()
+
+	// hash.Write never returns an error per the documentation.
+	/* #nosec */
+	_, _ = h.Write([]byte(id))
+
+	// hash.Write never returns an error per the documentation.
+	/* #nosec */
+	_, _ = h.Write(secret)
+
+	return h.Sum(nil)
+}
@@ -8,12 +8,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"mellium.im/xmpp/component"
 	"mellium.im/xmpp/jid"
@@ -63,9 +67,9 @@ var componentClientTests = [...]componentClientTest{
 		err:    some{}, // expect ack or error
 	},
 	6: {
-		server: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234'><error></error>`,
+		server: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234'><stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`,
 		client: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='example.net'><handshake>32532c0f7dbf1253c095b18b18e36d38d94c1256</handshake>`,
-		err:    stream.NotAuthorized, // expect not authorized if error reported
+		err:    stream.NotAuthorized, // expect stream errors to be unmarshaled
 	},
 	7: {
 		server: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234'><wrong/>`,
@@ -82,6 +86,20 @@ var componentClientTests = [...]componentClientTest{
 		client: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='example.net'><handshake>32532c0f7dbf1253c095b18b18e36d38d94c1256</handshake>`,
 		err:    nil,
 	},
+	10: {
+		server: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234'><stream:error><host-unknown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`,
+		client: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='example.net'><handshake>32532c0f7dbf1253c095b18b18e36d38d94c1256</handshake>`,
+		err:    stream.HostUnknown,
+	},
+	11: {
+		server: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234'><error></error>`,
+		client: `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='example.net'><handshake>32532c0f7dbf1253c095b18b18e36d38d94c1256</handshake>`,
+		err:    some{}, // errors that aren't stream errors are not handled
+	},
+	12: {
+		server: `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.net' id='1234' version='1.0'><handshake></handshake>`,
+		err:    stream.InvalidNamespace,
+	},
 }
 
 func TestComponent(t *testing.T) {
@@ -132,3 +150,61 @@ func TestComponent(t *testing.T) {
 		})
 	}
 }
+
+func TestAccept(t *testing.T) {
+	addr := jid.MustParse("component.example.net")
+	secret := []byte("secret")
+	lookup := func(j jid.JID) ([]byte, error) {
+		if !j.Equal(addr) {
+			return nil, errors.New("unknown component")
+		}
+		return secret, nil
+	}
+
+	for i, tc := range [...]struct {
+		addr      jid.JID
+		secret    []byte
+		lookup    func(jid.JID) ([]byte, error)
+		clientErr error
+		serverErr error
+	}{
+		0: {addr: addr, secret: secret, lookup: lookup},
+		1: {addr: addr, secret: []byte("wrong"), lookup: lookup, clientErr: stream.NotAuthorized, serverErr: stream.NotAuthorized},
+		2: {addr: jid.MustParse("other.example.net"), secret: secret, lookup: lookup, clientErr: stream.HostUnknown, serverErr: stream.HostUnknown},
+		3: {
+			addr:   addr,
+			secret: secret,
+			lookup: func(jid.JID) ([]byte, error) {
+				return nil, errors.New("database unavailable")
+			},
+			clientErr: stream.InternalServerError,
+			serverErr: stream.InternalServerError,
+		},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			serverErr := make(chan error, 1)
+			go func() {
+				_, err := component.AcceptSession(ctx, addr, serverConn, tc.lookup)
+				serverErr <- err
+			}()
+
+			_, err := component.NewClientSession(ctx, tc.addr, tc.secret, clientConn, false)
+			if !reflect.DeepEqual(err, tc.clientErr) {
+				t.Errorf("Unexpected client error, got='%v' want='%v'", err, tc.clientErr)
+			}
+			// Drain anything the server sends after the client has finished reading so
+			// that it doesn't block.
+			go func() {
+				/* #nosec */
+				io.Copy(ioutil.Discard, clientConn)
+			}()
+			if err = <-serverErr; !reflect.DeepEqual(err, tc.serverErr) {
+				t.Errorf("Unexpected server error, got='%v' want='%v'", err, tc.serverErr)
+			}
+		})
+	}
+}
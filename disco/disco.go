@@ -0,0 +1,184 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package disco implements XEP-0030: Service Discovery.
+//
+// Service discovery lets an entity query another entity on the network for its
+// identities and the features that it supports (disco#info), and for a list of
+// other entities associated with it (disco#items).
+//
+// To advertise features, register Handle on a mux.ServeMux alongside the other
+// handlers.
+// The identities and features of any handler registered on the same mux that
+// implements info.IdentityIter or info.FeatureIter are reported automatically.
+package disco // import "mellium.im/xmpp/disco"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NSInfo  = info.NS
+	NSItems = `http://jabber.org/protocol/disco#items`
+)
+
+// Info is the response to a disco#info query.
+type Info struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string          `xml:"node,attr,omitempty"`
+	Identities []info.Identity `xml:"http://jabber.org/protocol/disco#info identity"`
+	Features   []info.Feature  `xml:"http://jabber.org/protocol/disco#info feature"`
+
+	// Forms contains any service discovery extensions (XEP-0128).
+	Forms []form.Data `xml:"jabber:x:data x"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (i Info) TokenReader() xml.TokenReader {
+	var payloads []xml.TokenReader
+	for _, ident := range i.Identities {
+		payloads = append(payloads, ident.TokenReader())
+	}
+	for _, feature := range i.Features {
+		payloads = append(payloads, feature.TokenReader())
+	}
+	for j := range i.Forms {
+		payloads = append(payloads, i.Forms[j].TokenReader())
+	}
+
+	start := xml.StartElement{Name: xml.Name{Space: NSInfo, Local: "query"}}
+	if i.Node != "" {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "node"},
+			Value: i.Node,
+		})
+	}
+	return xmlstream.Wrap(xmlstream.MultiReader(payloads...), start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (i Info) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, i.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (i Info) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := i.WriteXML(e)
+	return err
+}
+
+// GetInfo requests the identities and features of the provided node on the
+// entity at to and blocks until a response is received.
+// To query the entity itself, node should be empty.
+// If the remote entity responds with an error it is returned as a
+// stanza.Error.
+func GetInfo(ctx context.Context, node string, to jid.JID, s *xmpp.Session) (Info, error) {
+	return GetInfoIQ(ctx, node, stanza.IQ{To: to}, s)
+}
+
+// GetInfoIQ is like GetInfo but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func GetInfoIQ(ctx context.Context, node string, iq stanza.IQ, s *xmpp.Session) (Info, error) {
+	iq.Type = stanza.GetIQ
+	var resp Info
+	err := s.UnmarshalIQElement(ctx, Info{Node: node}.TokenReader(), iq, &resp)
+	return resp, err
+}
+
+// Handle returns an option that registers a handler for disco#info requests.
+//
+// The handler responds with the identities and features reported by the
+// ServeMux that it is registered on, which in turn reports the identities and
+// features of all of its handlers that implement info.IdentityIter or
+// info.FeatureIter.
+// Any identities passed to Handle are also advertised for the root node.
+// XEP-0030 requires that entities have at least one identity, so clients
+// normally provide an identity with the "client" category and a type such as
+// "pc", "phone", or "bot".
+//
+// Requests for nodes that have no identities or features result in an
+// item-not-found error.
+func Handle(identities ...info.Identity) mux.Option {
+	return func(m *mux.ServeMux) {
+		h := infoHandler{
+			mux:        m,
+			identities: identities,
+		}
+		mux.IQ(stanza.GetIQ, xml.Name{Space: NSInfo, Local: "query"}, h)(m)
+	}
+}
+
+type infoHandler struct {
+	mux        *mux.ServeMux
+	identities []info.Identity
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h infoHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NSInfo})
+}
+
+// ForIdentities implements info.IdentityIter.
+func (h infoHandler) ForIdentities(node string, f func(info.Identity) error) error {
+	if node != "" {
+		return nil
+	}
+	for _, ident := range h.identities {
+		if err := f(ident); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h infoHandler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	if iq.Type != stanza.GetIQ || start.Name.Local != "query" || start.Name.Space != NSInfo {
+		return nil
+	}
+
+	resp := Info{}
+	_, resp.Node = attr.Get(start.Attr, "node")
+	err := h.mux.ForIdentities(resp.Node, func(ident info.Identity) error {
+		resp.Identities = append(resp.Identities, ident)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = h.mux.ForFeatures(resp.Node, func(feature info.Feature) error {
+		resp.Features = append(resp.Features, feature)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.Node != "" && len(resp.Identities) == 0 && len(resp.Features) == 0 {
+		iq.To, iq.From = iq.From, iq.To
+		iq.Type = stanza.ErrorIQ
+		_, err = xmlstream.Copy(t, iq.Wrap(stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.ItemNotFound,
+		}.TokenReader()))
+		return err
+	}
+	_, err = xmlstream.Copy(t, iq.Result(resp.TokenReader()))
+	return err
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/receipts"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+var (
+	_ info.FeatureIter  = ping.Handler{}
+	_ info.FeatureIter  = xtime.Handler{}
+	_ info.FeatureIter  = &receipts.Handler{}
+	_ info.FeatureIter  = mux.New()
+	_ info.IdentityIter = mux.New()
+)
+
+var bot = info.Identity{Category: "client", Type: "bot", Name: "Feste"}
+
+type tokenReadEncoder struct {
+	xml.TokenReader
+	xmlstream.Encoder
+}
+
+// handle passes the IQ in req to m and returns the response.
+func handle(t *testing.T, m *mux.ServeMux, req string) string {
+	t.Helper()
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	d := xml.NewDecoder(strings.NewReader(req))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err := m.HandleXMPP(tokenReadEncoder{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("unexpected error handling disco#info: %v", err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing encoder: %v", err)
+	}
+	return b.String()
+}
+
+func TestHandle(t *testing.T) {
+	m := mux.New(
+		disco.Handle(bot),
+		ping.Handle(),
+		xtime.Handle(xtime.Handler{}),
+		receipts.Handle(&receipts.Handler{}),
+	)
+
+	out := handle(t, m, `<iq xmlns="jabber:client" type="get" id="123" from="juliet@example.net/balcony"><query xmlns="http://jabber.org/protocol/disco#info"/></iq>`)
+	resp := struct {
+		stanza.IQ
+		Info disco.Info
+	}{}
+	if err := xml.Unmarshal([]byte(out), &resp); err != nil {
+		t.Fatalf("error decoding response %s: %v", out, err)
+	}
+	if resp.Type != stanza.ResultIQ || resp.ID != "123" || resp.To.String() != "juliet@example.net/balcony" {
+		t.Errorf("wrong IQ in response: %s", out)
+	}
+	if len(resp.Info.Identities) != 1 {
+		t.Fatalf("wrong number of identities: want=1, got=%d", len(resp.Info.Identities))
+	}
+	ident := resp.Info.Identities[0]
+	ident.XMLName = xml.Name{}
+	if ident != bot {
+		t.Errorf("wrong identity: want=%+v, got=%+v", bot, ident)
+	}
+	var features []string
+	for _, f := range resp.Info.Features {
+		features = append(features, f.Var)
+	}
+	want := []string{disco.NSInfo, ping.NS, receipts.NS, xtime.NS}
+	if !reflect.DeepEqual(features, want) {
+		t.Errorf("wrong features: want=%v, got=%v", want, features)
+	}
+}
+
+func TestHandleUnknownNode(t *testing.T) {
+	m := mux.New(disco.Handle(bot), ping.Handle())
+
+	out := handle(t, m, `<iq xmlns="jabber:client" type="get" id="123"><query xmlns="http://jabber.org/protocol/disco#info" node="urn:example"/></iq>`)
+	resp := struct {
+		stanza.IQ
+		Err stanza.Error `xml:"error"`
+	}{}
+	if err := xml.Unmarshal([]byte(out), &resp); err != nil {
+		t.Fatalf("error decoding response %s: %v", out, err)
+	}
+	if resp.Type != stanza.ErrorIQ || resp.Err.Condition != stanza.ItemNotFound {
+		t.Errorf("expected item-not-found error, got: %s", out)
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, conn := xmpptest.NewServerSession(nil, func(req xmpptest.Request) string {
+		var node string
+		for _, a := range req.Payload().Attr {
+			if a.Name.Local == "node" {
+				node = a.Value
+			}
+		}
+		if node != "" {
+			return `<error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		}
+		return `<query xmlns="http://jabber.org/protocol/disco#info"><identity category="server" type="im"/><feature var="urn:xmpp:ping"/></query>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	to := jid.MustParse("example.net")
+	i, err := disco.GetInfo(ctx, "", to, s)
+	if err != nil {
+		t.Fatalf("error getting info: %v", err)
+	}
+	if len(i.Identities) != 1 || i.Identities[0].Category != "server" || i.Identities[0].Type != "im" {
+		t.Errorf("wrong identities: %+v", i.Identities)
+	}
+	if len(i.Features) != 1 || i.Features[0].Var != ping.NS {
+		t.Errorf("wrong features: %+v", i.Features)
+	}
+
+	_, err = disco.GetInfo(ctx, "urn:example", to, s)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.ItemNotFound {
+		t.Errorf("expected item-not-found error, got: %v", err)
+	}
+}
+
+func TestFetchItems(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, conn := xmpptest.NewServerSession(nil, func(req xmpptest.Request) string {
+		if req.To != "example.net" {
+			return `<error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		}
+		return `<query xmlns="http://jabber.org/protocol/disco#items"><item jid="conference.example.net" name="Chatrooms"/><item jid="example.net" node="announce"/></query>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	iter := disco.FetchItems(ctx, "", jid.MustParse("example.net"), s)
+	var items []disco.Item
+	for iter.Next() {
+		item := iter.Item()
+		item.XMLName = xml.Name{}
+		items = append(items, item)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error iterating over items: %v", err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("error closing iter: %v", err)
+	}
+	want := []disco.Item{
+		{JID: jid.MustParse("conference.example.net"), Name: "Chatrooms"},
+		{JID: jid.MustParse("example.net"), Node: "announce"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items: want=%+v, got=%+v", want, items)
+	}
+
+	iter = disco.FetchItems(ctx, "", jid.MustParse("romeo@example.net"), s)
+	if iter.Next() {
+		t.Errorf("expected no items from error response")
+	}
+	if stanzaErr, ok := iter.Err().(stanza.Error); !ok || stanzaErr.Condition != stanza.ServiceUnavailable {
+		t.Errorf("expected service-unavailable error, got: %v", iter.Err())
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("error closing iter: %v", err)
+	}
+}
+
+func TestFetchItemsPage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var req xmpptest.Request
+	s, conn := xmpptest.NewServerSession(nil, func(r xmpptest.Request) string {
+		req = r
+		return `<query xmlns="http://jabber.org/protocol/disco#items"><item jid="a.example.net"/><set xmlns="http://jabber.org/protocol/rsm"><first index="0">a.example.net</first><last>a.example.net</last><count>2</count></set></query>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	iter := disco.FetchItemsPage(ctx, "", paging.Request{Max: 1}, stanza.IQ{To: jid.MustParse("example.net")}, s)
+	var n int
+	for iter.Next() {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error iterating over items: %v", err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("error closing iter: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("wrong number of items: want=1, got=%d", n)
+	}
+	const wantReq = `<query xmlns="http://jabber.org/protocol/disco#items"><set xmlns="http://jabber.org/protocol/rsm"><max>1</max></set></query>`
+	if req.Inner != wantReq {
+		t.Errorf("wrong request:\nwant=%s,\n got=%s", wantReq, req.Inner)
+	}
+	want := paging.Set{
+		XMLName: xml.Name{Space: paging.NS, Local: "set"},
+		First:   "a.example.net",
+		Last:    "a.example.net",
+		Count:   2,
+	}
+	if set := iter.Set(); set != want {
+		t.Errorf("wrong result set: want=%+v, got=%+v", want, set)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package info contains the types used to describe entities in service
+// discovery responses.
+//
+// It is separate from the disco package so that packages which the disco
+// package depends on (such as mux) can describe the features they implement.
+package info // import "mellium.im/xmpp/disco/info"
+
+import (
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/ns"
+)
+
+// NS is the namespace used by disco#info queries.
+// It is provided as a convenience.
+const NS = "http://jabber.org/protocol/disco#info"
+
+// FeatureIter is the interface implemented by types that implement features
+// that should be advertised in service discovery responses.
+//
+// ForFeatures calls f once for each feature supported by the type for the
+// given node (the empty string is the root node).
+// If f returns an error iteration stops and the error is returned.
+type FeatureIter interface {
+	ForFeatures(node string, f func(Feature) error) error
+}
+
+// IdentityIter is the interface implemented by types that provide identities
+// that should be advertised in service discovery responses.
+//
+// ForIdentities calls f once for each identity of the type for the given node
+// (the empty string is the root node).
+// If f returns an error iteration stops and the error is returned.
+type IdentityIter interface {
+	ForIdentities(node string, f func(Identity) error) error
+}
+
+// Feature represents a feature supported by an entity on the network.
+type Feature struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/disco#info feature"`
+	Var     string   `xml:"var,attr"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (f Feature) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "feature"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "var"}, Value: f.Var}},
+	})
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (f Feature) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, f.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (f Feature) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := f.WriteXML(e)
+	return err
+}
+
+// Identity is the type and category of a node on the network.
+// The registered categories and types are listed in the XMPP Registrar's
+// service discovery identities registry.
+type Identity struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/disco#info identity"`
+	Category string   `xml:"category,attr"`
+	Type     string   `xml:"type,attr"`
+	Name     string   `xml:"name,attr,omitempty"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (i Identity) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "identity"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "category"}, Value: i.Category},
+			{Name: xml.Name{Local: "type"}, Value: i.Type},
+		},
+	}
+	if i.Name != "" {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "name"},
+			Value: i.Name,
+		})
+	}
+	if i.Lang != "" {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Space: ns.XML, Local: "lang"},
+			Value: i.Lang,
+		})
+	}
+	return xmlstream.Wrap(nil, start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (i Identity) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, i.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (i Identity) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := i.WriteXML(e)
+	return err
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/stanzaerr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+)
+
+// Item represents an entity or node associated with another entity, as
+// returned by a disco#items query.
+type Item struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/disco#items item"`
+	JID     jid.JID  `xml:"jid,attr"`
+	Node    string   `xml:"node,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (i Item) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NSItems, Local: "item"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "jid"}, Value: i.JID.String()}},
+	}
+	if i.Node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: i.Node})
+	}
+	if i.Name != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "name"}, Value: i.Name})
+	}
+	return xmlstream.Wrap(nil, start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (i Item) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, i.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (i Item) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := i.WriteXML(e)
+	return err
+}
+
+// ItemIter is an iterator over the items in a disco#items response.
+type ItemIter struct {
+	iter    *xmlstream.Iter
+	current Item
+	set     paging.Set
+	err     error
+}
+
+// Next returns true if there are more items to decode.
+func (i *ItemIter) Next() bool {
+	if i.err != nil || !i.iter.Next() {
+		return false
+	}
+	start, r := i.iter.Current()
+	if start.Name.Local == "set" && start.Name.Space == paging.NS {
+		i.err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&i.set)
+		if i.err != nil {
+			return false
+		}
+		return i.Next()
+	}
+	// Skip anything else that isn't an item.
+	if start.Name.Local != "item" || start.Name.Space != NSItems {
+		return i.Next()
+	}
+	item := Item{}
+	// Decode the start token along with the rest of the element, token decoders
+	// do not know about start tokens passed to DecodeElement and report an error
+	// when they reach the end element.
+	i.err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&item)
+	if i.err != nil {
+		return false
+	}
+	i.current = item
+	return true
+}
+
+// Err returns the last error encountered by the iterator (if any).
+func (i *ItemIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.iter == nil {
+		return nil
+	}
+	return i.iter.Err()
+}
+
+// Item returns the last item parsed by the iterator.
+func (i *ItemIter) Item() Item {
+	return i.current
+}
+
+// Set returns the result set management data for the page of items, which can
+// be used to request the next or previous page.
+// It is only valid after Next has returned false and is the zero value if the
+// response was not paged.
+func (i *ItemIter) Set() paging.Set {
+	return i.set
+}
+
+// Close indicates that we are finished with the given iterator and processing
+// the stream may continue.
+// Calling it multiple times has no effect.
+func (i *ItemIter) Close() error {
+	if i.iter == nil {
+		return nil
+	}
+	return i.iter.Close()
+}
+
+// FetchItems requests the items associated with the provided node on the entity
+// at to and returns an iterator over the items (blocking until a response is
+// received).
+// To query the entity itself, node should be empty.
+//
+// The iterator must be closed before anything else is done on the session or it
+// will become invalid.
+// Any errors encountered while creating the iter are deferred until the iter is
+// used.
+// If the remote entity responds with an error it is returned from the
+// iterators Err method as a stanza.Error.
+func FetchItems(ctx context.Context, node string, to jid.JID, s *xmpp.Session) *ItemIter {
+	return FetchItemsIQ(ctx, node, stanza.IQ{To: to}, s)
+}
+
+// FetchItemsIQ is like FetchItems but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func FetchItemsIQ(ctx context.Context, node string, iq stanza.IQ, s *xmpp.Session) *ItemIter {
+	return fetchItems(ctx, node, nil, iq, s)
+}
+
+// FetchItemsPage is like FetchItemsIQ but it requests a single page of the
+// items using result set management.
+// The result set data returned by the iterators Set method can be used to
+// request the following or preceding page.
+func FetchItemsPage(ctx context.Context, node string, page paging.Request, iq stanza.IQ, s *xmpp.Session) *ItemIter {
+	return fetchItems(ctx, node, page.TokenReader(), iq, s)
+}
+
+func fetchItems(ctx context.Context, node string, payload xml.TokenReader, iq stanza.IQ, s *xmpp.Session) *ItemIter {
+	iq.Type = stanza.GetIQ
+	start := xml.StartElement{Name: xml.Name{Space: NSItems, Local: "query"}}
+	if node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: node})
+	}
+	r, err := s.SendIQElement(ctx, xmlstream.Wrap(payload, start), iq)
+	if err != nil {
+		return &ItemIter{err: err}
+	}
+
+	// Pop the start IQ token.
+	tok, err := r.Token()
+	if err != nil {
+		/* #nosec */
+		r.Close()
+		return &ItemIter{err: err}
+	}
+	if iqStart, ok := tok.(xml.StartElement); ok {
+		resp, err := stanza.NewIQ(iqStart)
+		if err == nil && resp.Type == stanza.ErrorIQ {
+			err = stanzaerr.Decode(r)
+		}
+		if err != nil {
+			/* #nosec */
+			r.Close()
+			return &ItemIter{err: err}
+		}
+	}
+
+	// Pop the query wrapper token.
+	_, err = r.Token()
+	if err != nil {
+		/* #nosec */
+		r.Close()
+		return &ItemIter{err: err}
+	}
+
+	// Return the iterator which will parse the rest of the payload incrementally.
+	return &ItemIter{
+		iter: xmlstream.NewIter(r),
+	}
+}
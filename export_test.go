@@ -9,3 +9,7 @@ package xmpp
 var (
 	ErrNotStart = errNotStart
 )
+
+// WorkerQueueSize has been exported only for tests in the xmpp_test package
+// that fill the queue of a worker.
+const WorkerQueueSize = workerQueueSize
@@ -5,6 +5,7 @@
 package xmpp
 
 import (
+	"bytes"
 	"context"
 	"encoding/xml"
 	"errors"
@@ -84,7 +85,7 @@ func containsStartTLS(features []StreamFeature) (startTLS StreamFeature, ok bool
 }
 
 func negotiateFeatures(ctx context.Context, s *Session, first bool, features []StreamFeature) (mask SessionState, rw io.ReadWriter, err error) {
-	server := (s.state & Received) == Received
+	server := (s.State() & Received) == Received
 
 	// If we're the server, write the initial stream features.
 	var list *streamFeaturesList
@@ -144,6 +145,7 @@ func negotiateFeatures(ctx context.Context, s *Session, first bool, features []S
 	}
 
 	var sent bool
+	var reqDone bool
 
 	// If the list has any optional items that we support, negotiate them first
 	// before moving on to the required items.
@@ -152,20 +154,22 @@ func negotiateFeatures(ctx context.Context, s *Session, first bool, features []S
 
 		if server {
 			// Read a new feature to negotiate.
-			t, err = s.in.d.Token()
+			var name xml.Name
+			name, err = nextFeature(s)
 			if err != nil {
 				return mask, nil, err
 			}
-			start, ok = t.(xml.StartElement)
-			if !ok {
-				return mask, nil, stream.BadFormat
-			}
 
 			// If the feature was not sent or was already negotiated, error.
-
-			_, negotiated := s.negotiated[start.Name.Space]
-			data, sent = list.cache[start.Name.Space]
+			// However, if the list has no required features the initiating entity
+			// may have moved on to sending stanzas, so leave the element on the
+			// stream and finish negotiation.
+			_, negotiated := s.negotiated[name.Space]
+			data, sent = list.cache[name.Space]
 			if !sent || negotiated {
+				if !list.req {
+					return Ready, nil, nil
+				}
 				// TODO: What should we return here?
 				return mask, rw, stream.PolicyViolation
 			}
@@ -207,18 +211,48 @@ func negotiateFeatures(ctx context.Context, s *Session, first bool, features []S
 		}
 
 		mask, rw, err = data.feature.Negotiate(ctx, s, s.features[data.feature.Name.Space])
-		if err == nil {
-			s.state |= mask
+		if err != nil {
+			return mask, nil, err
 		}
+		s.setState(mask)
 		s.negotiated[data.feature.Name.Space] = struct{}{}
 
-		// If we negotiated a required feature or a stream restart is required
-		// we're done with this feature set.
-		if rw != nil || data.req {
+		// If a stream restart is required we're done with this feature set.
+		if rw != nil {
+			break
+		}
+
+		// If an optional feature completed the session (eg. resuming a previous
+		// stream using stream management) there is nothing left to negotiate.
+		if !data.req && mask&Ready == Ready {
+			break
+		}
+
+		// If we negotiated a required feature we're also done.
+		// The initiating entity may wait for the session to be ready before it
+		// sends anything else, so the receiving entity must not wait to find out
+		// if it will negotiate any remaining optional features.
+		if data.req {
+			reqDone = true
 			break
 		}
 	}
 
+	// Stream management can only be enabled after resource binding, so if it
+	// is still outstanding the receiving entity lets Serve handle the request to
+	// enable it instead.
+	if server && reqDone && rw == nil {
+		if _, negotiated := s.negotiated[ns.SM]; !negotiated {
+			if data, ok := list.cache[ns.SM]; ok {
+				_, _, err = data.feature.Negotiate(ctx, s, negotiateLater{})
+				if err != nil {
+					return mask, nil, err
+				}
+				s.negotiated[ns.SM] = struct{}{}
+			}
+		}
+	}
+
 	// If the list contains no required features and a stream restart is not
 	// required,  negotiation is complete.
 	if !list.req {
@@ -228,6 +262,52 @@ func negotiateFeatures(ctx context.Context, s *Session, first bool, features []S
 	return mask, rw, err
 }
 
+// negotiateLater is passed to the Negotiate function of an optional feature on
+// a received session when the required features have been negotiated but the
+// optional feature has not.
+// Instead of reading a request from the stream, the feature should prepare the
+// session to handle a request that arrives once the session is ready.
+type negotiateLater struct{}
+
+// nextFeature peeks at the next element on the input stream and returns the
+// name of the feature that should be used to negotiate it.
+// The element is left on the stream so that the feature's Negotiate function
+// can read it in its entirety.
+// Because resource binding is performed with an IQ, IQs are looked up by the
+// name of their payload.
+func nextFeature(s *Session) (xml.Name, error) {
+	var peeked []xml.Token
+	defer func() {
+		readers := make([]xml.TokenReader, 0, len(peeked)+1)
+		for _, tok := range peeked {
+			readers = append(readers, xmlstream.Token(tok))
+		}
+		s.in.d = xmlstream.MultiReader(append(readers, s.in.d)...)
+	}()
+
+	for {
+		tok, err := s.in.d.Token()
+		if err != nil {
+			return xml.Name{}, err
+		}
+		tok = xml.CopyToken(tok)
+		peeked = append(peeked, tok)
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(peeked) == 1 && isIQ(t.Name) {
+				continue
+			}
+			return t.Name, nil
+		case xml.CharData:
+			if len(peeked) > 1 && len(bytes.TrimLeft(t, " \t\r\n")) == 0 {
+				continue
+			}
+		}
+		return xml.Name{}, stream.BadFormat
+	}
+}
+
 type sfData struct {
 	req     bool
 	feature StreamFeature
@@ -252,6 +332,14 @@ func getFeature(name xml.Name, features []StreamFeature) (feature StreamFeature,
 
 func writeStreamFeatures(ctx context.Context, s *Session, features []StreamFeature) (list *streamFeaturesList, err error) {
 	start := xml.StartElement{Name: xml.Name{Space: "", Local: "stream:features"}}
+	if s.out.Info.WebSocket() {
+		// Framed streams do not have a stream start element that declares the
+		// stream prefix, so each element must declare it.
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "xmlns:stream"},
+			Value: stream.NS,
+		})
+	}
 	w := s.TokenWriter()
 	defer w.Close()
 	if err = w.EncodeToken(start); err != nil {
@@ -266,8 +354,8 @@ func writeStreamFeatures(ctx context.Context, s *Session, features []StreamFeatu
 	for _, feature := range features {
 		// Check if all the necessary bits are set and none of the prohibited bits
 		// are set.
-		if (s.state&feature.Necessary) == feature.Necessary &&
-			(s.state&feature.Prohibited) == 0 {
+		if (s.State()&feature.Necessary) == feature.Necessary &&
+			(s.State()&feature.Prohibited) == 0 {
 			var r bool
 			r, err = feature.List(ctx, s.out.e, xml.StartElement{
 				Name: feature.Name,
@@ -330,8 +418,8 @@ parsefeatures:
 				}
 				sf.req = sf.req || req
 
-				if s.state&feature.Necessary == feature.Necessary &&
-					s.state&feature.Prohibited == 0 {
+				if s.State()&feature.Necessary == feature.Necessary &&
+					s.State()&feature.Prohibited == 0 {
 
 					// TODO: Since we're storing the features data on s.features we can
 					// probably remove it from this temporary cache.
@@ -4,5 +4,16 @@
 
 // Package form is an implementation of XEP-0004: Data Forms.
 //
+// Forms are built from fields using New and the other constructors, or decoded
+// from forms received from other entities.
+// After a received form has been filled out using Set, the Submit method
+// returns a form that can be sent back as a reply.
+// Fields may also include XEP-0122: Data Forms Validation rules which are
+// checked by the Validate method.
+//
+// Forms can also be mapped to and from Go structs using Marshal and Unmarshal,
+// which makes it easy to work with forms that have a well known FORM_TYPE such
+// as room or node configuration forms.
+//
 // BE ADVISED: This API is unstable and subject to change.
 package form // import "mellium.im/xmpp/form"
@@ -6,25 +6,129 @@ package form
 
 import (
 	"encoding/xml"
+
+	"mellium.im/xmlstream"
 )
 
 // A field represents a data field that may be added to a form.
 type field struct {
 	XMLName  xml.Name   `xml:"field"`
-	Typ      string     `xml:"type,attr"`
+	Typ      string     `xml:"type,attr,omitempty"`
 	Var      string     `xml:"var,attr,omitempty"`
 	Label    string     `xml:"label,attr,omitempty"`
 	Desc     string     `xml:"desc,omitempty"`
 	Value    []string   `xml:"value,omitempty"`
 	Required *struct{}  `xml:"required,omitempty"`
 	Field    []fieldopt `xml:"option,omitempty"`
+	Validate *validate  `xml:"http://jabber.org/protocol/xdata-validate validate"`
+}
+
+// TokenReader returns a stream of XML tokens representing the field.
+func (f field) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "field"},
+	}
+	if f.Typ != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: f.Typ})
+	}
+	if f.Var != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "var"}, Value: f.Var})
+	}
+	if f.Label != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "label"}, Value: f.Label})
+	}
+
+	var inner []xml.TokenReader
+	if f.Desc != "" {
+		inner = append(inner, textElement("desc", f.Desc))
+	}
+	for _, v := range f.Value {
+		inner = append(inner, textElement("value", v))
+	}
+	if f.Required != nil {
+		inner = append(inner, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "required"}}))
+	}
+	for _, opt := range f.Field {
+		var value xml.TokenReader
+		if opt.Value != "" {
+			value = textElement("value", opt.Value)
+		}
+		optStart := xml.StartElement{Name: xml.Name{Space: NS, Local: "option"}}
+		if opt.Label != "" {
+			optStart.Attr = append(optStart.Attr, xml.Attr{Name: xml.Name{Local: "label"}, Value: opt.Label})
+		}
+		inner = append(inner, xmlstream.Wrap(value, optStart))
+	}
+	if f.Validate != nil {
+		inner = append(inner, f.Validate.TokenReader())
+	}
+	return xmlstream.Wrap(xmlstream.MultiReader(inner...), start)
 }
 
 type fieldopt struct {
 	XMLName xml.Name `xml:"jabber:x:data option"`
+	Label   string   `xml:"label,attr,omitempty"`
 	Value   string   `xml:"value,omitempty"`
 }
 
+// validate contains the XEP-0122: Data Forms Validation rules for a field.
+type validate struct {
+	Datatype string    `xml:"datatype,attr,omitempty"`
+	Basic    *struct{} `xml:"basic"`
+	Open     *struct{} `xml:"open"`
+	Range    *struct {
+		Min string `xml:"min,attr,omitempty"`
+		Max string `xml:"max,attr,omitempty"`
+	} `xml:"range"`
+	Regex     *string `xml:"regex"`
+	ListRange *struct {
+		Min string `xml:"min,attr,omitempty"`
+		Max string `xml:"max,attr,omitempty"`
+	} `xml:"list-range"`
+}
+
+// TokenReader returns a stream of XML tokens representing the validation
+// rules.
+func (v validate) TokenReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Space: NSValidate, Local: "validate"}}
+	if v.Datatype != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "datatype"}, Value: v.Datatype})
+	}
+	var inner []xml.TokenReader
+	switch {
+	case v.Open != nil:
+		inner = append(inner, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "open"}}))
+	case v.Range != nil:
+		inner = append(inner, xmlstream.Wrap(nil, rangeStart("range", v.Range.Min, v.Range.Max)))
+	case v.Regex != nil:
+		inner = append(inner, textElement("regex", *v.Regex))
+	case v.Basic != nil:
+		inner = append(inner, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "basic"}}))
+	}
+	if v.ListRange != nil {
+		inner = append(inner, xmlstream.Wrap(nil, rangeStart("list-range", v.ListRange.Min, v.ListRange.Max)))
+	}
+	return xmlstream.Wrap(xmlstream.MultiReader(inner...), start)
+}
+
+func rangeStart(name, min, max string) xml.StartElement {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if min != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "min"}, Value: min})
+	}
+	if max != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "max"}, Value: max})
+	}
+	return start
+}
+
+func textElement(name, text string) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(text)),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
+
 func newField(typ, id string, o ...Option) func(data *Data) {
 	return func(data *Data) {
 		f := field{
@@ -39,7 +143,7 @@ func newField(typ, id string, o ...Option) func(data *Data) {
 // Boolean fields enable an entity to gather or provide an either-or choice
 // between two options.
 func Boolean(id string, o ...Option) Field {
-	return newField("boolean", "", o...)
+	return newField("boolean", id, o...)
 }
 
 // Fixed is intended for data description (e.g., human-readable text such as
@@ -91,3 +195,33 @@ func TextPrivate(id string, o ...Option) Field {
 func TextSingle(id string, o ...Option) Field {
 	return newField("text-single", id, o...)
 }
+
+// Reported adds the header of a result table to the form.
+// The fields describe the columns of the table, and should not have values.
+func Reported(o ...Field) Field {
+	return func(data *Data) {
+		data.reported = collectFields(o...)
+	}
+}
+
+// Item adds a row to a result table.
+// There should be one field for each of the fields in the header of the table.
+func Item(o ...Field) Field {
+	return func(data *Data) {
+		data.items = append(data.items, collectFields(o...))
+	}
+}
+
+// collectFields returns the fields added by the options, ignoring anything
+// else.
+func collectFields(o ...Field) []field {
+	tmp := &Data{}
+	getOpts(tmp, o...)
+	var fields []field
+	for _, c := range tmp.children {
+		if f, ok := c.(field); ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
@@ -6,6 +6,9 @@ package form
 
 import (
 	"encoding/xml"
+	"strings"
+
+	"mellium.im/xmlstream"
 )
 
 // NS is the data forms namespace.
@@ -15,6 +18,28 @@ var (
 	formName = xml.Name{Space: "jabber:x:data", Local: "x"}
 )
 
+// Type is the type of a form.
+type Type string
+
+// A list of form types.
+const (
+	// TypeForm is a form that the form-processing entity asks the
+	// form-submitting entity to fill out.
+	TypeForm Type = "form"
+
+	// TypeSubmit is a form containing the data submitted by the
+	// form-submitting entity.
+	TypeSubmit Type = "submit"
+
+	// TypeCancel tells the form-processing entity that the form-submitting
+	// entity has canceled submission of the data.
+	TypeCancel Type = "cancel"
+
+	// TypeResult is a form containing data returned by the form-processing
+	// entity.
+	TypeResult Type = "result"
+)
+
 // Data represents a data form.
 type Data struct {
 	title struct {
@@ -23,47 +48,289 @@ type Data struct {
 	}
 	typ      string
 	children []interface{}
+	reported []field
+	items    [][]field
 }
 
-// MarshalXML satisfies the xml.Marshaler interface for *Data.
-func (d *Data) MarshalXML(e *xml.Encoder, start xml.StartElement) (err error) {
-	start = xml.StartElement{Name: formName}
-	start.Attr = append(start.Attr, xml.Attr{
-		Name:  xml.Name{Local: "type"},
-		Value: d.typ,
-	})
-	if err = e.EncodeToken(start); err != nil {
-		return
+// FieldData is the data contained in a single field of a form.
+type FieldData struct {
+	Type     string
+	Var      string
+	Label    string
+	Desc     string
+	Required bool
+	Values   []string
+
+	// Options are the options that may be picked from in list fields.
+	Options []FieldOption
+
+	// Datatype is the XEP-0122: Data Forms Validation datatype of the field
+	// values, if any.
+	Datatype string
+}
+
+// FieldOption is one of the options that may be picked from in a list field.
+type FieldOption struct {
+	Label string
+	Value string
+}
+
+func (f field) data() FieldData {
+	data := FieldData{
+		Type:     f.Typ,
+		Var:      f.Var,
+		Label:    f.Label,
+		Desc:     f.Desc,
+		Required: f.Required != nil,
+		Values:   f.Value,
 	}
+	for _, opt := range f.Field {
+		data.Options = append(data.Options, FieldOption{Label: opt.Label, Value: opt.Value})
+	}
+	if f.Validate != nil {
+		data.Datatype = f.Validate.Datatype
+	}
+	return data
+}
 
-	// Encode the title.
-	if d.title.Text != "" {
-		if err = e.Encode(d.title); err != nil {
-			return
+// ForFields calls f for each field in the form in the order in which they
+// appear.
+func (d *Data) ForFields(f func(FieldData)) {
+	for _, c := range d.children {
+		field, ok := c.(field)
+		if !ok {
+			continue
+		}
+		f(field.data())
+	}
+}
+
+// ForReported calls f for each field in the header of a result table.
+// The header describes the fields that are present in each item of the table.
+func (d *Data) ForReported(f func(FieldData)) {
+	for _, field := range d.reported {
+		f(field.data())
+	}
+}
+
+// ForItems calls f for each item in a result table.
+// Each item is a form of type "result" containing the fields of a single row of
+// the table.
+// Fields that do not specify a type are given the type from the header of the
+// table.
+func (d *Data) ForItems(f func(*Data)) {
+	for _, item := range d.items {
+		row := &Data{typ: string(TypeResult)}
+		for _, field := range item {
+			if field.Typ == "" {
+				for _, reported := range d.reported {
+					if reported.Var == field.Var {
+						field.Typ = reported.Typ
+						break
+					}
+				}
+			}
+			row.children = append(row.children, field)
+		}
+		f(row)
+	}
+}
+
+// Type returns the type of the form.
+func (d *Data) Type() Type {
+	return Type(d.typ)
+}
+
+// Title returns the title of the form.
+func (d *Data) Title() string {
+	return d.title.Text
+}
+
+// Instructions returns the instructions for filling out the form.
+// If the form has multiple sets of instructions they are separated by
+// newlines.
+func (d *Data) Instructions() string {
+	var inst []string
+	for _, c := range d.children {
+		if i, ok := c.(instructions); ok {
+			inst = append(inst, i.Text)
+		}
+	}
+	return strings.Join(inst, "\n")
+}
+
+// Submit returns a form of type "submit" containing the current values of the
+// fields in d.
+// It can be used to reply to a form after filling it out with Set.
+// Fixed fields and fields without a var are left out, as are the labels,
+// descriptions, options, and validation rules of each field.
+func (d *Data) Submit() *Data {
+	submit := &Data{typ: string(TypeSubmit)}
+	for _, c := range d.children {
+		f, ok := c.(field)
+		if !ok || f.Var == "" || f.Typ == "fixed" {
+			continue
 		}
+		submit.children = append(submit.children, field{
+			Typ:   f.Typ,
+			Var:   f.Var,
+			Value: f.Value,
+		})
 	}
+	return submit
+}
 
+// TokenReader satisfies the xmlstream.Marshaler interface for *Data.
+func (d *Data) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	if d.title.Text != "" {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(d.title.Text)),
+			xml.StartElement{Name: xml.Name{Local: "title"}},
+		))
+	}
 	for _, c := range d.children {
-		if err = e.Encode(c); err != nil {
-			return
+		switch child := c.(type) {
+		case instructions:
+			inner = append(inner, xmlstream.Wrap(
+				xmlstream.Token(xml.CharData(child.Text)),
+				xml.StartElement{Name: xml.Name{Local: "instructions"}},
+			))
+		case field:
+			inner = append(inner, child.TokenReader())
 		}
 	}
+	if len(d.reported) > 0 {
+		inner = append(inner, fieldsElement("reported", d.reported))
+	}
+	for _, item := range d.items {
+		inner = append(inner, fieldsElement("item", item))
+	}
 
-	// Encode the end element of the form.
-	if err = e.EncodeToken(start.End()); err != nil {
-		return
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{
+			Name: formName,
+			Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: d.typ}},
+		},
+	)
+}
+
+func fieldsElement(name string, fields []field) xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, f := range fields {
+		inner = append(inner, f.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface for *Data.
+// It is like MarshalXML except it writes tokens to w.
+func (d *Data) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, d.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface for *Data.
+func (d *Data) MarshalXML(e *xml.Encoder, start xml.StartElement) (err error) {
+	_, err = d.WriteXML(e)
+	if err != nil {
+		return err
 	}
 	return e.Flush()
 }
 
+// UnmarshalXML satisfies the xml.Unmarshaler interface for *Data.
+func (d *Data) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+	d.typ = ""
+	for _, a := range start.Attr {
+		if a.Name.Local == "type" {
+			d.typ = a.Value
+			break
+		}
+	}
+	d.title.Text = ""
+	d.children = d.children[:0]
+	d.reported = nil
+	d.items = nil
+
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var child xml.StartElement
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child = t
+		case xml.EndElement:
+			return nil
+		default:
+			continue
+		}
+
+		switch child.Name.Local {
+		case "title":
+			err = decoder.DecodeElement(&d.title, &child)
+		case "instructions":
+			inst := instructions{}
+			err = decoder.DecodeElement(&inst, &child)
+			d.children = append(d.children, inst)
+		case "field":
+			f := field{}
+			err = decoder.DecodeElement(&f, &child)
+			d.children = append(d.children, f)
+		case "reported", "item":
+			fields := struct {
+				Fields []field `xml:"field"`
+			}{}
+			err = decoder.DecodeElement(&fields, &child)
+			if child.Name.Local == "reported" {
+				d.reported = fields.Fields
+			} else {
+				d.items = append(d.items, fields.Fields)
+			}
+		default:
+			err = decoder.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 type instructions struct {
 	XMLName xml.Name `xml:"instructions"`
 	Text    string   `xml:",chardata"`
 }
 
-// New builds a new data form from the provided options.
+// New builds a new data form of type "form" from the provided options.
 func New(o ...Field) *Data {
-	form := &Data{typ: "form"}
+	return newData(TypeForm, o...)
+}
+
+// NewSubmit builds a new data form of type "submit" from the provided options.
+// To reply to a form that was received from another entity, use the Submit
+// method instead.
+func NewSubmit(o ...Field) *Data {
+	return newData(TypeSubmit, o...)
+}
+
+// NewResult builds a new data form of type "result" from the provided options.
+func NewResult(o ...Field) *Data {
+	return newData(TypeResult, o...)
+}
+
+// NewCancel returns a data form of type "cancel" which may be sent in place of
+// a submission to cancel it.
+func NewCancel() *Data {
+	return newData(TypeCancel)
+}
+
+func newData(typ Type, o ...Field) *Data {
+	form := &Data{typ: string(typ)}
 	getOpts(form, o...)
 	return form
 }
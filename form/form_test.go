@@ -0,0 +1,371 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package form_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+)
+
+var (
+	_ xmlstream.Marshaler = (*form.Data)(nil)
+	_ xml.Unmarshaler     = (*form.Data)(nil)
+	_ error               = form.FieldError{}
+	_ error               = form.ValidationError{}
+)
+
+const configForm = `<x xmlns="jabber:x:data" type="form">
+  <title>Bot Configuration</title>
+  <instructions>Fill out this form to configure your new bot!</instructions>
+  <field type="hidden" var="FORM_TYPE"><value>jabber:bot</value></field>
+  <field type="fixed"><value>Section 1: Bot Info</value></field>
+  <field type="text-single" var="botname" label="The name of your bot"/>
+  <field type="text-multi" var="description" label="Helpful description of your bot"/>
+  <field type="boolean" var="public" label="Public bot?"><required/></field>
+  <field type="text-private" var="password" label="Password for special access"/>
+  <field type="list-multi" var="features" label="What features will the bot support?">
+    <option label="Contests"><value>contests</value></option>
+    <option label="News"><value>news</value></option>
+    <option label="Polls"><value>polls</value></option>
+    <value>news</value>
+  </field>
+  <field type="list-single" var="maxsubs" label="Maximum number of subscribers">
+    <value>20</value>
+    <option label="10"><value>10</value></option>
+    <option label="20"><value>20</value></option>
+    <validate xmlns="http://jabber.org/protocol/xdata-validate" datatype="xs:integer"><open/></validate>
+  </field>
+  <field type="jid-multi" var="invitelist" label="People to invite"><desc>Tell all your friends about your new bot!</desc></field>
+  <field type="jid-single" var="owner"/>
+  <field var="untyped"/>
+</x>`
+
+func decode(t *testing.T, s string) *form.Data {
+	t.Helper()
+	data := &form.Data{}
+	err := xml.NewDecoder(strings.NewReader(s)).Decode(data)
+	if err != nil {
+		t.Fatalf("error decoding form: %v", err)
+	}
+	return data
+}
+
+func TestDecode(t *testing.T) {
+	data := decode(t, configForm)
+	if data.Type() != form.TypeForm {
+		t.Errorf("wrong type: want=%s, got=%s", form.TypeForm, data.Type())
+	}
+	if title := data.Title(); title != "Bot Configuration" {
+		t.Errorf("wrong title: %q", title)
+	}
+	if inst := data.Instructions(); inst != "Fill out this form to configure your new bot!" {
+		t.Errorf("wrong instructions: %q", inst)
+	}
+
+	var fields []form.FieldData
+	data.ForFields(func(f form.FieldData) {
+		fields = append(fields, f)
+	})
+	if len(fields) != 11 {
+		t.Fatalf("wrong number of fields: want=11, got=%d", len(fields))
+	}
+	features := form.FieldData{
+		Type:  "list-multi",
+		Var:   "features",
+		Label: "What features will the bot support?",
+		Options: []form.FieldOption{
+			{Label: "Contests", Value: "contests"},
+			{Label: "News", Value: "news"},
+			{Label: "Polls", Value: "polls"},
+		},
+		Values: []string{"news"},
+	}
+	if !reflect.DeepEqual(fields[6], features) {
+		t.Errorf("wrong list field:\nwant=%+v,\n got=%+v", features, fields[6])
+	}
+	if !fields[4].Required {
+		t.Errorf("expected boolean field to be required")
+	}
+	if fields[7].Datatype != "xs:integer" {
+		t.Errorf("wrong datatype: want=xs:integer, got=%q", fields[7].Datatype)
+	}
+	if fields[8].Desc != "Tell all your friends about your new bot!" {
+		t.Errorf("wrong description: %q", fields[8].Desc)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := decode(t, configForm)
+	var b strings.Builder
+	err := xml.NewEncoder(&b).Encode(data)
+	if err != nil {
+		t.Fatalf("error encoding form: %v", err)
+	}
+	again := decode(t, b.String())
+	if !reflect.DeepEqual(data, again) {
+		t.Errorf("form changed after round trip:\nwant=%+v,\n got=%+v", data, again)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	data := decode(t, configForm)
+
+	if v, ok := data.Get("FORM_TYPE"); !ok || v != "jabber:bot" {
+		t.Errorf("wrong FORM_TYPE: want=jabber:bot, got=%q (%t)", v, ok)
+	}
+	if _, ok := data.Get("botname"); ok {
+		t.Errorf("expected field without a value to not be ok")
+	}
+	if _, ok := data.Get("missing"); ok {
+		t.Errorf("expected missing field to not be ok")
+	}
+	if v, ok := data.GetBool("public"); !ok || v {
+		t.Errorf("wrong default boolean: want=false, got=%t (%t)", v, ok)
+	}
+
+	for _, tc := range []struct {
+		id  string
+		v   interface{}
+		err bool
+	}{
+		{id: "botname", v: "The Bot"},
+		{id: "public", v: true},
+		{id: "botname", v: true, err: true},
+		{id: "botname", v: []string{"a", "b"}, err: true},
+		{id: "botname", v: 1, err: true},
+		{id: "features", v: []string{"contests", "polls"}},
+		{id: "owner", v: jid.MustParse("romeo@example.net")},
+		{id: "invitelist", v: []jid.JID{jid.MustParse("juliet@example.net"), jid.MustParse("benvolio@example.net")}},
+	} {
+		ok, err := data.Set(tc.id, tc.v)
+		if !ok {
+			t.Errorf("field %q not found", tc.id)
+		}
+		if (err != nil) != tc.err {
+			t.Errorf("unexpected error setting %q to %v: %v", tc.id, tc.v, err)
+		}
+	}
+	if ok, _ := data.Set("missing", "value"); ok {
+		t.Errorf("expected setting a missing field to not be ok")
+	}
+
+	if v, _ := data.Get("botname"); v != "The Bot" {
+		t.Errorf("wrong botname: %q", v)
+	}
+	if v, ok := data.GetBool("public"); !ok || !v {
+		t.Errorf("wrong boolean: want=true, got=%t (%t)", v, ok)
+	}
+	if v, _ := data.GetStrings("features"); !reflect.DeepEqual(v, []string{"contests", "polls"}) {
+		t.Errorf("wrong features: %v", v)
+	}
+	if j, ok := data.GetJID("owner"); !ok || !j.Equal(jid.MustParse("romeo@example.net")) {
+		t.Errorf("wrong owner: %v (%t)", j, ok)
+	}
+	if j, ok := data.GetJIDs("invitelist"); !ok || len(j) != 2 || !j[1].Equal(jid.MustParse("benvolio@example.net")) {
+		t.Errorf("wrong invite list: %v (%t)", j, ok)
+	}
+
+	var b strings.Builder
+	err := xml.NewEncoder(&b).Encode(data.Submit())
+	if err != nil {
+		t.Fatalf("error encoding submission: %v", err)
+	}
+	const want = `<x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>jabber:bot</value></field><field type="text-single" var="botname"><value>The Bot</value></field><field type="text-multi" var="description"></field><field type="boolean" var="public"><value>true</value></field><field type="text-private" var="password"></field><field type="list-multi" var="features"><value>contests</value><value>polls</value></field><field type="list-single" var="maxsubs"><value>20</value></field><field type="jid-multi" var="invitelist"><value>juliet@example.net</value><value>benvolio@example.net</value></field><field type="jid-single" var="owner"><value>romeo@example.net</value></field><field var="untyped"></field></x>`
+	if s := b.String(); s != want {
+		t.Errorf("wrong submission:\nwant=%s,\n got=%s", want, s)
+	}
+}
+
+func TestTable(t *testing.T) {
+	data := decode(t, `<x xmlns="jabber:x:data" type="result">
+  <title>Search Results</title>
+  <reported>
+    <field var="name" label="Name"/>
+    <field var="admin" type="boolean" label="Admin?"/>
+  </reported>
+  <item><field var="name"><value>Romeo</value></field><field var="admin"><value>1</value></field></item>
+  <item><field var="name"><value>Juliet</value></field><field var="admin"><value>0</value></field></item>
+</x>`)
+
+	var reported []string
+	data.ForReported(func(f form.FieldData) {
+		reported = append(reported, f.Label)
+	})
+	if !reflect.DeepEqual(reported, []string{"Name", "Admin?"}) {
+		t.Errorf("wrong reported fields: %v", reported)
+	}
+
+	var rows []string
+	data.ForItems(func(item *form.Data) {
+		name, _ := item.Get("name")
+		admin, _ := item.GetBool("admin")
+		var typ string
+		item.ForFields(func(f form.FieldData) {
+			if f.Var == "admin" {
+				typ = f.Type
+			}
+		})
+		rows = append(rows, fmt.Sprintf("%s %t %s", name, admin, typ))
+	})
+	if want := []string{"Romeo true boolean", "Juliet false boolean"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("wrong items: want=%v, got=%v", want, rows)
+	}
+
+	built := form.NewResult(
+		form.Title("Search Results"),
+		form.Reported(form.TextSingle("name"), form.Boolean("admin")),
+		form.Item(form.TextSingle("name", form.Value("Romeo"))),
+	)
+	var b strings.Builder
+	err := xml.NewEncoder(&b).Encode(built)
+	if err != nil {
+		t.Fatalf("error encoding table: %v", err)
+	}
+	const want = `<x xmlns="jabber:x:data" type="result"><title>Search Results</title><reported><field type="text-single" var="name"></field><field type="boolean" var="admin"></field></reported><item><field type="text-single" var="name"><value>Romeo</value></field></item></x>`
+	if s := b.String(); s != want {
+		t.Errorf("wrong table:\nwant=%s,\n got=%s", want, s)
+	}
+}
+
+var validateTestCases = [...]struct {
+	field form.Field
+	err   bool
+}{
+	0:  {field: form.TextSingle("f", form.Required), err: true},
+	1:  {field: form.TextSingle("f", form.Required, form.Value("a"))},
+	2:  {field: form.TextSingle("f", form.Value("a"), form.Value("b")), err: true},
+	3:  {field: form.TextMulti("f", form.Value("a"), form.Value("b"))},
+	4:  {field: form.Boolean("f", form.Value("yes")), err: true},
+	5:  {field: form.Boolean("f", form.Value("1"))},
+	6:  {field: form.JID("f", form.Value("@example.net")), err: true},
+	7:  {field: form.ListSingle("f", form.ListField("a"), form.Value("b")), err: true},
+	8:  {field: form.ListSingle("f", form.ListField("a"), form.Value("b"), form.Open)},
+	9:  {field: form.TextSingle("f", form.Datatype("xs:integer"), form.Value("1.5")), err: true},
+	10: {field: form.TextSingle("f", form.Datatype("xs:integer"), form.Range("1", "10"), form.Value("10"))},
+	11: {field: form.TextSingle("f", form.Datatype("xs:integer"), form.Range("1", "10"), form.Value("11")), err: true},
+	12: {field: form.TextSingle("f", form.Datatype("xs:byte"), form.Value("300")), err: true},
+	13: {field: form.TextSingle("f", form.Datatype("xs:decimal"), form.Range("0.5", ""), form.Value("0.25")), err: true},
+	14: {field: form.TextSingle("f", form.Datatype("xs:dateTime"), form.Value("2020-03-08T13:41:00Z"))},
+	15: {field: form.TextSingle("f", form.Datatype("xs:dateTime"), form.Value("yesterday")), err: true},
+	16: {field: form.TextSingle("f", form.Datatype("xs:date"), form.Range("2020-01-01", "2020-12-31"), form.Value("2021-01-01")), err: true},
+	17: {field: form.TextSingle("f", form.Regex("([0-9]{3})-([0-9]{2})-([0-9]{4})"), form.Value("123-45-6789"))},
+	18: {field: form.TextSingle("f", form.Regex("[0-9]+"), form.Value("12a")), err: true},
+	19: {field: form.ListMulti("f", form.ListField("a"), form.ListField("b"), form.ListRange(2, 0), form.Value("a")), err: true},
+	20: {field: form.ListMulti("f", form.ListField("a"), form.ListField("b"), form.ListRange(2, 0), form.Value("a"), form.Value("b"))},
+	21: {field: form.TextSingle("f", form.Datatype("x:custom"), form.Value("anything"))},
+}
+
+func TestValidate(t *testing.T) {
+	for i, tc := range validateTestCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			err := form.New(form.Fixed(form.Value("Header")), tc.field).Validate()
+			if !tc.err {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var validationErr form.ValidationError
+			if !errors.As(err, &validationErr) || len(validationErr) != 1 || validationErr[0].Var != "f" {
+				t.Errorf("wrong error: want=ValidationError for field f, got=%v", err)
+			}
+		})
+	}
+}
+
+type roomConfig struct {
+	FormType    string    `form:"FORM_TYPE"`
+	Name        string    `form:"muc#roomconfig_roomname" label:"Room name"`
+	Description string    `form:"muc#roomconfig_roomdesc,multi"`
+	Public      bool      `form:"muc#roomconfig_publicroom"`
+	MaxUsers    int32     `form:"muc#roomconfig_maxusers,list,open" options:"10,20,30"`
+	Whois       string    `form:"muc#roomconfig_whois,list,required" options:"moderators,anyone"`
+	Password    *string   `form:"muc#roomconfig_roomsecret,private"`
+	Admins      []jid.JID `form:"muc#roomconfig_roomadmins,omitempty"`
+	Owner       jid.JID   `form:"muc#roomconfig_roomowner"`
+	Created     time.Time `form:"created,omitempty"`
+	Ignored     string    `form:"-"`
+	unexported  string
+}
+
+func TestMarshal(t *testing.T) {
+	password := "secret"
+	config := roomConfig{
+		FormType:    "http://jabber.org/protocol/muc#roomconfig",
+		Name:        "Balcony",
+		Description: "A balcony\nin Verona",
+		Public:      true,
+		MaxUsers:    20,
+		Whois:       "anyone",
+		Password:    &password,
+		Owner:       jid.MustParse("juliet@example.net"),
+		Ignored:     "ignored",
+		unexported:  "unexported",
+	}
+	data, err := form.Marshal(form.TypeSubmit, &config)
+	if err != nil {
+		t.Fatalf("error marshaling struct: %v", err)
+	}
+	if err = data.Validate(); err != nil {
+		t.Errorf("marshaled form is invalid: %v", err)
+	}
+
+	var b strings.Builder
+	err = xml.NewEncoder(&b).Encode(data)
+	if err != nil {
+		t.Fatalf("error encoding form: %v", err)
+	}
+	const want = `<x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>http://jabber.org/protocol/muc#roomconfig</value></field><field type="text-single" var="muc#roomconfig_roomname" label="Room name"><value>Balcony</value></field><field type="text-multi" var="muc#roomconfig_roomdesc"><value>A balcony</value><value>in Verona</value></field><field type="boolean" var="muc#roomconfig_publicroom"><value>true</value></field><field type="list-single" var="muc#roomconfig_maxusers"><value>20</value><option xmlns="jabber:x:data"><value>10</value></option><option xmlns="jabber:x:data"><value>20</value></option><option xmlns="jabber:x:data"><value>30</value></option><validate xmlns="http://jabber.org/protocol/xdata-validate" datatype="xs:int"><open></open></validate></field><field type="list-single" var="muc#roomconfig_whois"><value>anyone</value><required></required><option xmlns="jabber:x:data"><value>moderators</value></option><option xmlns="jabber:x:data"><value>anyone</value></option></field><field type="text-private" var="muc#roomconfig_roomsecret"><value>secret</value></field><field type="jid-single" var="muc#roomconfig_roomowner"><value>juliet@example.net</value></field></x>`
+	if s := b.String(); s != want {
+		t.Errorf("wrong form:\nwant=%s,\n got=%s", want, s)
+	}
+
+	got := roomConfig{}
+	err = form.Unmarshal(decode(t, b.String()), &got)
+	if err != nil {
+		t.Fatalf("error unmarshaling form: %v", err)
+	}
+	config.Ignored = ""
+	config.unexported = ""
+	if !reflect.DeepEqual(got, config) {
+		t.Errorf("wrong struct after round trip:\nwant=%+v,\n got=%+v", config, got)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	data := form.New(
+		form.Hidden("FORM_TYPE", form.Value("urn:example:other")),
+		form.TextSingle("muc#roomconfig_maxusers", form.Value("many")),
+	)
+
+	config := roomConfig{FormType: "http://jabber.org/protocol/muc#roomconfig"}
+	err := form.Unmarshal(data, &config)
+	var fieldErr form.FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Var != "FORM_TYPE" {
+		t.Errorf("wrong error for mismatched FORM_TYPE: %v", err)
+	}
+
+	config = roomConfig{}
+	err = form.Unmarshal(data, &config)
+	if !errors.As(err, &fieldErr) || fieldErr.Var != "muc#roomconfig_maxusers" {
+		t.Errorf("wrong error for invalid integer: %v", err)
+	}
+
+	if err = form.Unmarshal(data, config); err == nil {
+		t.Errorf("expected error when unmarshaling into a non-pointer")
+	}
+	if _, err = form.Marshal(form.TypeForm, struct{ C chan int }{}); err == nil {
+		t.Errorf("expected error when marshaling an unsupported type")
+	}
+}
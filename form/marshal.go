@@ -0,0 +1,481 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// formType is the var of the hidden field that contains the namespace of a
+// form as defined by XEP-0068: Field Standardization for Data Forms.
+const formType = "FORM_TYPE"
+
+var (
+	errNotStruct = errors.New("form: value must be a struct or a non-nil pointer to a struct")
+	errFormType  = errors.New("form: wrong FORM_TYPE")
+)
+
+var (
+	jidType     = reflect.TypeOf(jid.JID{})
+	jidsType    = reflect.TypeOf([]jid.JID(nil))
+	timeType    = reflect.TypeOf(time.Time{})
+	stringsType = reflect.TypeOf([]string(nil))
+)
+
+// structField contains the options set on a struct field by its tags.
+type structField struct {
+	index    int
+	name     string
+	label    string
+	desc     string
+	options  []string
+	omit     bool
+	required bool
+	hidden   bool
+	private  bool
+	multi    bool
+	list     bool
+	open     bool
+}
+
+// structFields returns the options of each exported field of the struct type
+// that is not ignored.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get("form")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := structField{
+			index: i,
+			name:  opts[0],
+			label: sf.Tag.Get("label"),
+			desc:  sf.Tag.Get("desc"),
+		}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		if options := sf.Tag.Get("options"); options != "" {
+			f.options = strings.Split(options, ",")
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				f.omit = true
+			case "required":
+				f.required = true
+			case "hidden":
+				f.hidden = true
+			case "private":
+				f.private = true
+			case "multi":
+				f.multi = true
+			case "list":
+				f.list = true
+			case "open":
+				f.open = true
+			}
+		}
+		if f.name == formType {
+			f.hidden = true
+			f.omit = true
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// Marshal returns a form of the given type containing a field for each
+// exported field of the struct v, which may also be a pointer to a struct.
+//
+// Each field is named after the struct field unless a name is set with the
+// "form" struct tag, and a field tagged with "-" is skipped.
+// The type of the field depends on the type of the struct field:
+//
+//	string              text-single
+//	[]string            text-multi
+//	bool                boolean
+//	jid.JID             jid-single
+//	[]jid.JID           jid-multi
+//	integers            text-single with the xs:integer datatype (or a
+//	                    more specific datatype for sized integers)
+//	floats              text-single with the xs:double datatype
+//	time.Time           text-single with the xs:dateTime datatype
+//
+// Pointers to any of these types are also supported, and a nil pointer results
+// in a field with no value.
+// Options may be added to the form struct tag after the name, separated by
+// commas:
+//
+//	omitempty  leave out the field if its value is the zero value
+//	required   mark the field as required
+//	hidden     use a hidden field for strings and string slices
+//	private    use a text-private field for strings
+//	multi      use a text-multi field for strings, one value per line
+//	list       use a list-single field for strings and numbers, or a
+//	           list-multi field for string slices
+//	open       allow values that are not one of the list options
+//
+// The "label" and "desc" struct tags set the label and description of the
+// field, and the "options" struct tag sets a comma separated list of options
+// for list fields.
+//
+// A string field named "FORM_TYPE" is always hidden as defined by XEP-0068:
+// Field Standardization for Data Forms, and is left out if it is empty.
+//
+// For example, the following struct:
+//
+//	type config struct {
+//	    FormType string    `form:"FORM_TYPE"`
+//	    Name     string    `form:"muc#roomconfig_roomname" label:"Room name"`
+//	    Public   bool      `form:"muc#roomconfig_publicroom"`
+//	    Admins   []jid.JID `form:"muc#roomconfig_roomadmins,omitempty"`
+//	}
+//
+// is marshaled as a form containing a hidden field, a text-single field, a
+// boolean field, and if there are any admins, a jid-multi field.
+func Marshal(typ Type, v interface{}) (*Data, error) {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return nil, errNotStruct
+	}
+
+	var fields []Field
+	for _, sf := range structFields(val.Type()) {
+		f, err := sf.marshal(val.Field(sf.index))
+		if err != nil {
+			return nil, FieldError{Var: sf.name, Err: err}
+		}
+		if f != nil {
+			fields = append(fields, f)
+		}
+	}
+	return newData(typ, fields...), nil
+}
+
+func (sf structField) marshal(v reflect.Value) (Field, error) {
+	if sf.omit && isZero(v) {
+		return nil, nil
+	}
+	var opts []Option
+	if sf.label != "" {
+		opts = append(opts, Label(sf.label))
+	}
+	if sf.desc != "" {
+		opts = append(opts, Desc(sf.desc))
+	}
+	if sf.required {
+		opts = append(opts, Required)
+	}
+	for _, opt := range sf.options {
+		opts = append(opts, ListField(opt))
+	}
+	if sf.open {
+		opts = append(opts, Open)
+	}
+
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		if v.IsNil() {
+			v = reflect.Value{}
+		} else {
+			v = v.Elem()
+		}
+	}
+	// values returns the options with the values added, or with no values if v
+	// is the zero Value because it came from a nil pointer.
+	values := func(f func() []string) []Option {
+		if !v.IsValid() {
+			return opts
+		}
+		for _, s := range f() {
+			opts = append(opts, Value(s))
+		}
+		return opts
+	}
+
+	switch t {
+	case jidType:
+		return JID(sf.name, values(func() []string {
+			j := v.Interface().(jid.JID)
+			if j.Equal(jid.JID{}) {
+				return nil
+			}
+			return []string{j.String()}
+		})...), nil
+	case jidsType:
+		return JIDMulti(sf.name, values(func() []string {
+			var s []string
+			for _, j := range v.Interface().([]jid.JID) {
+				s = append(s, j.String())
+			}
+			return s
+		})...), nil
+	case timeType:
+		opts = append(opts, Datatype("xs:dateTime"))
+		return TextSingle(sf.name, values(func() []string {
+			tm := v.Interface().(time.Time)
+			if tm.IsZero() {
+				return nil
+			}
+			return []string{tm.Format(time.RFC3339Nano)}
+		})...), nil
+	case stringsType:
+		opts = values(func() []string {
+			return append([]string(nil), v.Interface().([]string)...)
+		})
+		switch {
+		case sf.hidden:
+			return Hidden(sf.name, opts...), nil
+		case sf.list:
+			return ListMulti(sf.name, opts...), nil
+		}
+		return TextMulti(sf.name, opts...), nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if sf.multi {
+			opts = values(func() []string {
+				return strings.Split(v.String(), "\n")
+			})
+			return TextMulti(sf.name, opts...), nil
+		}
+		opts = values(func() []string {
+			return []string{v.String()}
+		})
+		switch {
+		case sf.hidden:
+			return Hidden(sf.name, opts...), nil
+		case sf.private:
+			return TextPrivate(sf.name, opts...), nil
+		case sf.list:
+			return ListSingle(sf.name, opts...), nil
+		}
+		return TextSingle(sf.name, opts...), nil
+	case reflect.Bool:
+		return Boolean(sf.name, values(func() []string {
+			return []string{strconv.FormatBool(v.Bool())}
+		})...), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		opts = append(opts, Datatype(intDatatype(t.Kind())))
+		return sf.single(values(func() []string {
+			return []string{strconv.FormatInt(v.Int(), 10)}
+		})...), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		opts = append(opts, Datatype("xs:integer"))
+		return sf.single(values(func() []string {
+			return []string{strconv.FormatUint(v.Uint(), 10)}
+		})...), nil
+	case reflect.Float32, reflect.Float64:
+		opts = append(opts, Datatype("xs:double"))
+		return sf.single(values(func() []string {
+			return []string{strconv.FormatFloat(v.Float(), 'g', -1, t.Bits())}
+		})...), nil
+	}
+	return nil, fmt.Errorf("form: unsupported type %s", t)
+}
+
+// single returns a list-single field if the list option was set and a
+// text-single field otherwise.
+func (sf structField) single(opts ...Option) Field {
+	if sf.list {
+		return ListSingle(sf.name, opts...)
+	}
+	return TextSingle(sf.name, opts...)
+}
+
+// intDatatype returns the XEP-0122 datatype for signed integers of the given
+// kind.
+func intDatatype(k reflect.Kind) string {
+	switch k {
+	case reflect.Int64:
+		return "xs:long"
+	case reflect.Int32:
+		return "xs:int"
+	case reflect.Int16:
+		return "xs:short"
+	case reflect.Int8:
+		return "xs:byte"
+	}
+	return "xs:integer"
+}
+
+func isZero(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// Unmarshal sets the fields of the struct pointed to by v to the values of the
+// fields in the form.
+// Struct fields are matched to form fields using the same rules as Marshal.
+// Struct fields that do not have a matching field in the form are left
+// unchanged, and form fields that do not have a matching struct field are
+// ignored.
+//
+// If the struct has a "FORM_TYPE" field that is already set, the form must
+// have the same FORM_TYPE.
+// If a value cannot be stored in its struct field, an error of type FieldError
+// is returned.
+func Unmarshal(d *Data, v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return errNotStruct
+	}
+	val = val.Elem()
+
+	fields := structFields(val.Type())
+	for _, sf := range fields {
+		if sf.name != formType {
+			continue
+		}
+		field := val.Field(sf.index)
+		got, _ := d.Get(formType)
+		if field.Kind() == reflect.String && field.String() != "" && field.String() != got {
+			return FieldError{Var: formType, Err: errFormType}
+		}
+	}
+	for _, sf := range fields {
+		values, ok := d.GetStrings(sf.name)
+		if !ok {
+			continue
+		}
+		err := sf.unmarshal(val.Field(sf.index), values)
+		if err != nil {
+			return FieldError{Var: sf.name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (sf structField) unmarshal(v reflect.Value, values []string) error {
+	if v.Kind() == reflect.Ptr {
+		if len(values) == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		ptr := reflect.New(v.Type().Elem())
+		err := sf.unmarshal(ptr.Elem(), values)
+		if err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	var first string
+	if len(values) > 0 {
+		first = values[0]
+	}
+	switch v.Type() {
+	case jidType:
+		j := jid.JID{}
+		if first != "" {
+			var err error
+			j, err = jid.Parse(first)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(reflect.ValueOf(j))
+		return nil
+	case jidsType:
+		var jids []jid.JID
+		for _, s := range values {
+			j, err := jid.Parse(s)
+			if err != nil {
+				return err
+			}
+			jids = append(jids, j)
+		}
+		v.Set(reflect.ValueOf(jids))
+		return nil
+	case timeType:
+		tm := time.Time{}
+		if first != "" {
+			var err error
+			tm, err = parseTime("xs:dateTime", first)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	case stringsType:
+		v.Set(reflect.ValueOf(append([]string(nil), values...)))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if sf.multi {
+			v.SetString(strings.Join(values, "\n"))
+			return nil
+		}
+		v.SetString(first)
+	case reflect.Bool:
+		b := false
+		if first != "" {
+			var err error
+			b, err = parseBool(first)
+			if err != nil {
+				return err
+			}
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if first != "" {
+			var err error
+			n, err = strconv.ParseInt(first, 10, v.Type().Bits())
+			if err != nil {
+				return err
+			}
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if first != "" {
+			var err error
+			n, err = strconv.ParseUint(first, 10, v.Type().Bits())
+			if err != nil {
+				return err
+			}
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var n float64
+		if first != "" {
+			var err error
+			n, err = strconv.ParseFloat(first, v.Type().Bits())
+			if err != nil {
+				return err
+			}
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("form: unsupported type %s", v.Type())
+	}
+	return nil
+}
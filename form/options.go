@@ -78,6 +78,24 @@ func ListField(s string) Option {
 	}
 }
 
+// LabeledListField is one of the values in a list with a human readable label.
+// It has no effect on any non-list field type.
+func LabeledListField(label, s string) Option {
+	return func(f *field) {
+		f.Field = append(f.Field, fieldopt{
+			Label: label,
+			Value: s,
+		})
+	}
+}
+
+// Label sets a human readable name for the field.
+func Label(s string) Option {
+	return func(f *field) {
+		f.Label = s
+	}
+}
+
 func getFieldOpts(f *field, o ...Option) {
 	for _, opt := range o {
 		opt(f)
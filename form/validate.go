@@ -0,0 +1,357 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// NSValidate is the namespace used by XEP-0122: Data Forms Validation.
+const NSValidate = "http://jabber.org/protocol/xdata-validate"
+
+var (
+	errRequired      = errors.New("form: a value is required")
+	errNotAnOption   = errors.New("form: value is not one of the options")
+	errOutOfRange    = errors.New("form: value is out of range")
+	errNoMatch       = errors.New("form: value does not match the regular expression")
+	errListRange     = errors.New("form: wrong number of values selected")
+	errInvalidNumber = errors.New("form: invalid number")
+)
+
+// FieldError is an error with the value of a single field.
+type FieldError struct {
+	Var string
+	Err error
+}
+
+// Error satisfies the error interface.
+func (e FieldError) Error() string {
+	return fmt.Sprintf("field %q: %v", e.Var, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is returned by Validate if any fields are invalid.
+// It contains an error for each invalid field.
+type ValidationError []FieldError
+
+// Error satisfies the error interface.
+func (e ValidationError) Error() string {
+	errs := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		errs = append(errs, fieldErr.Error())
+	}
+	return "form: invalid fields: " + strings.Join(errs, "; ")
+}
+
+// Datatype sets the XEP-0122: Data Forms Validation datatype of the field
+// values, for example "xs:integer" or "xs:dateTime".
+// Fields without a datatype are treated as having the datatype "xs:string".
+func Datatype(dt string) Option {
+	return func(f *field) {
+		getValidate(f).Datatype = dt
+	}
+}
+
+// Range restricts the values of the field to an inclusive range.
+// If min or max is empty, the range is open on that end.
+// Ranges only apply to the numeric, date, and time datatypes.
+func Range(min, max string) Option {
+	return func(f *field) {
+		v := getValidate(f)
+		v.Range = &struct {
+			Min string `xml:"min,attr,omitempty"`
+			Max string `xml:"max,attr,omitempty"`
+		}{Min: min, Max: max}
+	}
+}
+
+// Regex restricts the values of the field to those that match the regular
+// expression.
+// The whole value must match, as if the expression was wrapped in ^ and $.
+func Regex(expr string) Option {
+	return func(f *field) {
+		getValidate(f).Regex = &expr
+	}
+}
+
+// ListRange restricts the number of values that can be selected in a list-multi
+// field.
+// If min or max is zero, there is no limit on that end.
+func ListRange(min, max uint) Option {
+	return func(f *field) {
+		v := getValidate(f)
+		v.ListRange = &struct {
+			Min string `xml:"min,attr,omitempty"`
+			Max string `xml:"max,attr,omitempty"`
+		}{Min: uintAttr(min), Max: uintAttr(max)}
+	}
+}
+
+var (
+	// Open lets the values of a list field be something other than one of its
+	// options.
+	Open Option = open
+)
+
+var (
+	open Option = func(f *field) {
+		getValidate(f).Open = &struct{}{}
+	}
+)
+
+func getValidate(f *field) *validate {
+	if f.Validate == nil {
+		f.Validate = &validate{}
+	}
+	return f.Validate
+}
+
+func uintAttr(v uint) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// Validate checks the values of every field against its type and any
+// XEP-0122: Data Forms Validation rules.
+// If any fields are invalid, an error of type ValidationError is returned.
+//
+// Because submitted forms do not normally contain the validation rules, a
+// form-processing entity can validate a submission by setting its values on
+// the form that it sent and then validating that.
+func (d *Data) Validate() error {
+	var errs ValidationError
+	for _, c := range d.children {
+		f, ok := c.(field)
+		if !ok || f.Var == "" || f.Typ == "fixed" {
+			continue
+		}
+		if err := f.validate(); err != nil {
+			errs = append(errs, FieldError{Var: f.Var, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (f field) validate() error {
+	values := f.Value
+	if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+		if f.Required != nil {
+			return errRequired
+		}
+		return nil
+	}
+	if len(values) > 1 && !multi(f.Typ) {
+		return errTooManyValues
+	}
+
+	rules := validate{}
+	if f.Validate != nil {
+		rules = *f.Validate
+	}
+	if rules.ListRange != nil {
+		if min, err := strconv.Atoi(rules.ListRange.Min); err == nil && len(values) < min {
+			return errListRange
+		}
+		if max, err := strconv.Atoi(rules.ListRange.Max); err == nil && len(values) > max {
+			return errListRange
+		}
+	}
+	var re *regexp.Regexp
+	if rules.Regex != nil {
+		var err error
+		re, err = regexp.Compile("^(?:" + *rules.Regex + ")$")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range values {
+		switch f.Typ {
+		case "boolean":
+			if _, err := parseBool(v); err != nil {
+				return err
+			}
+		case "jid-single", "jid-multi":
+			if _, err := jid.Parse(v); err != nil {
+				return err
+			}
+		case "list-single", "list-multi":
+			if rules.Open == nil && len(f.Field) > 0 && !f.hasOption(v) {
+				return errNotAnOption
+			}
+		}
+		if re != nil && !re.MatchString(v) {
+			return errNoMatch
+		}
+		cmp, err := order(rules.Datatype, v)
+		if err != nil {
+			return err
+		}
+		if cmp == nil || rules.Range == nil {
+			continue
+		}
+		if rules.Range.Min != "" {
+			n, err := cmp(rules.Range.Min)
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return errOutOfRange
+			}
+		}
+		if rules.Range.Max != "" {
+			n, err := cmp(rules.Range.Max)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return errOutOfRange
+			}
+		}
+	}
+	return nil
+}
+
+func (f field) hasOption(v string) bool {
+	for _, opt := range f.Field {
+		if opt.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Layouts used by the XML Schema date and time datatypes.
+const (
+	layoutDate = "2006-01-02"
+	layoutTime = "15:04:05.999999999"
+)
+
+// order checks that v is a valid value of the datatype.
+// If values of the datatype are ordered it returns a function that parses
+// another value of the same type and compares v to it, returning -1, 0, or +1
+// if v is less than, equal to, or greater than the other value.
+// Unknown datatypes are not checked.
+func order(datatype, v string) (func(string) (int, error), error) {
+	switch datatype {
+	case "xs:integer", "xs:long", "xs:int", "xs:short", "xs:byte":
+		n, err := parseInt(datatype, v)
+		if err != nil {
+			return nil, err
+		}
+		return func(other string) (int, error) {
+			m, err := parseInt(datatype, other)
+			if err != nil {
+				return 0, err
+			}
+			return n.Cmp(m), nil
+		}, nil
+	case "xs:decimal", "xs:double":
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, errInvalidNumber
+		}
+		return func(other string) (int, error) {
+			m, err := strconv.ParseFloat(other, 64)
+			if err != nil {
+				return 0, errInvalidNumber
+			}
+			switch {
+			case n < m:
+				return -1, nil
+			case n > m:
+				return 1, nil
+			}
+			return 0, nil
+		}, nil
+	case "xs:date", "xs:time", "xs:dateTime":
+		t, err := parseTime(datatype, v)
+		if err != nil {
+			return nil, err
+		}
+		return func(other string) (int, error) {
+			u, err := parseTime(datatype, other)
+			switch {
+			case err != nil:
+				return 0, err
+			case t.Before(u):
+				return -1, nil
+			case t.After(u):
+				return 1, nil
+			}
+			return 0, nil
+		}, nil
+	case "xs:boolean":
+		_, err := parseBool(v)
+		return nil, err
+	case "xs:anyURI":
+		_, err := url.Parse(v)
+		return nil, err
+	}
+	return nil, nil
+}
+
+func parseInt(datatype, v string) (*big.Int, error) {
+	var bits int
+	switch datatype {
+	case "xs:long":
+		bits = 64
+	case "xs:int":
+		bits = 32
+	case "xs:short":
+		bits = 16
+	case "xs:byte":
+		bits = 8
+	}
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(v, "+"), 10)
+	if !ok {
+		return nil, errInvalidNumber
+	}
+	if bits != 0 {
+		if _, err := strconv.ParseInt(n.String(), 10, bits); err != nil {
+			return nil, errOutOfRange
+		}
+	}
+	return n, nil
+}
+
+func parseTime(datatype, v string) (time.Time, error) {
+	var layouts []string
+	switch datatype {
+	case "xs:date":
+		layouts = []string{layoutDate + "Z07:00", layoutDate}
+	case "xs:time":
+		layouts = []string{layoutTime + "Z07:00", layoutTime}
+	default:
+		layouts = []string{time.RFC3339Nano, layoutDate + "T" + layoutTime}
+	}
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		t, err = time.Parse(layout, v)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
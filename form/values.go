@@ -0,0 +1,159 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"errors"
+
+	"mellium.im/xmpp/jid"
+)
+
+var (
+	errWrongType      = errors.New("form: value has the wrong type for the field")
+	errTooManyValues  = errors.New("form: field only accepts a single value")
+	errInvalidBoolean = errors.New("form: invalid boolean")
+)
+
+// field returns the index of the first field with the given var.
+func (d *Data) field(id string) (int, bool) {
+	for i, c := range d.children {
+		if f, ok := c.(field); ok && f.Var == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Get returns the first value of the field with the given var.
+// If the field does not exist or has no value, ok is false.
+func (d *Data) Get(id string) (v string, ok bool) {
+	values, ok := d.GetStrings(id)
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// GetStrings returns all values of the field with the given var.
+// If the field does not exist, ok is false.
+func (d *Data) GetStrings(id string) (v []string, ok bool) {
+	i, ok := d.field(id)
+	if !ok {
+		return nil, false
+	}
+	return d.children[i].(field).Value, true
+}
+
+// GetBool returns the value of the boolean field with the given var.
+// A field without a value is false.
+// If the field does not exist or its value is not a valid boolean, ok is false.
+func (d *Data) GetBool(id string) (v, ok bool) {
+	values, ok := d.GetStrings(id)
+	if !ok {
+		return false, false
+	}
+	if len(values) == 0 {
+		return false, true
+	}
+	v, err := parseBool(values[0])
+	return v, err == nil
+}
+
+// GetJID returns the value of the field with the given var parsed as a JID.
+// If the field does not exist, has no value, or its value is not a valid JID,
+// ok is false.
+func (d *Data) GetJID(id string) (j jid.JID, ok bool) {
+	v, ok := d.Get(id)
+	if !ok {
+		return jid.JID{}, false
+	}
+	j, err := jid.Parse(v)
+	return j, err == nil
+}
+
+// GetJIDs returns all values of the field with the given var parsed as JIDs.
+// If the field does not exist or any of its values are not valid JIDs, ok is
+// false.
+func (d *Data) GetJIDs(id string) (j []jid.JID, ok bool) {
+	values, ok := d.GetStrings(id)
+	if !ok {
+		return nil, false
+	}
+	for _, v := range values {
+		parsed, err := jid.Parse(v)
+		if err != nil {
+			return nil, false
+		}
+		j = append(j, parsed)
+	}
+	return j, true
+}
+
+// Set replaces the values of the field with the given var.
+// The value may be a string, []string, bool, jid.JID, or []jid.JID.
+// Booleans may only be used with boolean fields and slices may only be used
+// with fields that accept multiple values.
+//
+// If there is no field with the given var, ok is false.
+// If the value has the wrong type for the field, an error is returned and the
+// field is not changed.
+func (d *Data) Set(id string, v interface{}) (ok bool, err error) {
+	i, ok := d.field(id)
+	if !ok {
+		return false, nil
+	}
+	f := d.children[i].(field)
+
+	var values []string
+	switch val := v.(type) {
+	case string:
+		values = []string{val}
+	case []string:
+		values = append(values, val...)
+	case bool:
+		if f.Typ != "boolean" {
+			return true, errWrongType
+		}
+		values = []string{"false"}
+		if val {
+			values[0] = "true"
+		}
+	case jid.JID:
+		values = []string{val.String()}
+	case []jid.JID:
+		for _, j := range val {
+			values = append(values, j.String())
+		}
+	default:
+		return true, errWrongType
+	}
+	if len(values) > 1 && !multi(f.Typ) {
+		return true, errTooManyValues
+	}
+
+	f.Value = values
+	d.children[i] = f
+	return true, nil
+}
+
+// multi reports whether fields of type typ may have multiple values.
+func multi(typ string) bool {
+	switch typ {
+	case "hidden", "jid-multi", "list-multi", "text-multi":
+		return true
+	}
+	return false
+}
+
+// parseBool parses an xs:boolean.
+func parseBool(v string) (bool, error) {
+	switch v {
+	case "1", "true":
+		return true, nil
+	case "0", "false":
+		return false, nil
+	}
+	return false, errInvalidBoolean
+}
@@ -0,0 +1,362 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package ibb
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// retryDelay is how long to wait before resending data that the remote entity
+// was not ready to receive.
+const retryDelay = 50 * time.Millisecond
+
+var _ net.Conn = (*Conn)(nil)
+
+// timeoutError is returned when a deadline is exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "ibb: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Conn is an IBB stream.
+// Writes to the stream are buffered up to blocksize and calling Close forces
+// any remaining data to be flushed.
+type Conn struct {
+	h       *Handler
+	s       *xmpp.Session
+	sid     string
+	carrier string
+	size    uint16
+	local   jid.JID
+	remote  jid.JID
+
+	wmu     sync.Mutex
+	wbuf    []byte
+	wseq    uint16
+	wclosed bool
+
+	rmu          sync.Mutex
+	rbuf         []byte
+	rseq         uint16
+	rerr         error
+	remoteClosed bool
+	notify       chan struct{}
+
+	dmu       sync.Mutex
+	rdeadline time.Time
+	wdeadline time.Time
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newConn(h *Handler, s *xmpp.Session, sid, carrier string, size uint16, local, remote jid.JID) *Conn {
+	return &Conn{
+		h:       h,
+		s:       s,
+		sid:     sid,
+		carrier: carrier,
+		size:    size,
+		local:   local,
+		remote:  remote,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (c *Conn) key() connKey {
+	return connKey{sid: c.sid, peer: c.remote.String()}
+}
+
+// SID returns a unique session ID for the connection.
+func (c *Conn) SID() string {
+	return c.sid
+}
+
+// Size returns the blocksize for the underlying buffer when writing to the IBB
+// stream.
+func (c *Conn) Size() int {
+	return int(c.size)
+}
+
+// Stanza returns the carrier stanza type ("message" or "iq") for payloads
+// received by the IBB session.
+func (c *Conn) Stanza() string {
+	return c.carrier
+}
+
+// LocalAddr returns the address of the session that the stream was opened on.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end of the stream.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// connection.
+// It is equivalent to calling both SetReadDeadline and SetWriteDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.rdeadline = t
+	c.wdeadline = t
+	c.dmu.Unlock()
+	c.signal()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any
+// currently-blocked Read call.
+// A zero value for t means Read will not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.rdeadline = t
+	c.dmu.Unlock()
+	c.signal()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+// Because data is only sent once a full block has been buffered, a Write may
+// return successfully even after the deadline has passed.
+// A zero value for t means Write will not time out.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.dmu.Lock()
+	c.wdeadline = t
+	c.dmu.Unlock()
+	return nil
+}
+
+// Read reads data from the stream.
+// After the remote entity closes the stream and all data has been read, Read
+// returns io.EOF.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.rmu.Lock()
+		if len(c.rbuf) > 0 {
+			n := copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			c.rmu.Unlock()
+			return n, nil
+		}
+		err := c.rerr
+		c.rmu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		c.dmu.Lock()
+		deadline := c.rdeadline
+		c.dmu.Unlock()
+		if deadline.IsZero() {
+			<-c.notify
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, timeoutError{}
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-c.notify:
+			t.Stop()
+		case <-t.C:
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Write writes data to the stream.
+// Data is sent every time a full block has been buffered.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(b) > 0 {
+		if c.wclosed || c.isRemoteClosed() {
+			return n, errClosed
+		}
+		m := int(c.size) - len(c.wbuf)
+		if m > len(b) {
+			m = len(b)
+		}
+		c.wbuf = append(c.wbuf, b[:m]...)
+		b = b[m:]
+		n += m
+		if len(c.wbuf) == int(c.size) {
+			if err = c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close flushes any buffered data and closes the stream.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		c.closeErr = c.flush()
+		c.wclosed = true
+
+		c.rmu.Lock()
+		remoteClosed := c.remoteClosed
+		// Keep the reason that the stream was aborted so that it can still be
+		// reported by Read.
+		if _, aborted := c.rerr.(stanza.Error); !aborted {
+			c.rerr = errClosed
+		}
+		c.rmu.Unlock()
+		c.signal()
+		c.h.remove(c)
+		if remoteClosed {
+			return
+		}
+
+		ctx, cancel := c.writeContext()
+		defer cancel()
+		err := c.s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "close"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "sid"}, Value: c.sid}},
+		}), stanza.IQ{Type: stanza.SetIQ, To: c.remote}, nil)
+		if c.closeErr == nil {
+			c.closeErr = c.translate(err)
+		}
+	})
+	return c.closeErr
+}
+
+// flush sends any buffered data.
+// It must be called while holding the write lock.
+func (c *Conn) flush() error {
+	if len(c.wbuf) == 0 || c.isRemoteClosed() {
+		return nil
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+
+	var err error
+	if c.carrier == stanzaMessage {
+		err = c.s.Send(ctx, stanza.Message{To: c.remote}.Wrap(dataElement(c.sid, c.wseq, c.wbuf)))
+	} else {
+		for {
+			err = c.s.UnmarshalIQElement(ctx, dataElement(c.sid, c.wseq, c.wbuf), stanza.IQ{Type: stanza.SetIQ, To: c.remote}, nil)
+			stanzaErr, ok := err.(stanza.Error)
+			if !ok || stanzaErr.Type != stanza.Wait {
+				break
+			}
+			// The remote entity is not ready for more data, so back off and try again
+			// to avoid filling its buffers.
+			t := time.NewTimer(retryDelay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return c.translate(ctx.Err())
+			case <-t.C:
+			}
+		}
+	}
+	if err != nil {
+		return c.translate(err)
+	}
+	c.wseq++
+	c.wbuf = c.wbuf[:0]
+	return nil
+}
+
+func (c *Conn) writeContext() (context.Context, context.CancelFunc) {
+	c.dmu.Lock()
+	deadline := c.wdeadline
+	c.dmu.Unlock()
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+func (c *Conn) translate(err error) error {
+	if err == context.DeadlineExceeded {
+		return timeoutError{}
+	}
+	return err
+}
+
+// receive buffers data received from the remote entity.
+// Any error returned is a stanza.Error that should be reported to the remote
+// entity.
+func (c *Conn) receive(seq uint16, data []byte) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	switch {
+	case c.rerr != nil:
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	case len(data) > int(c.size):
+		return stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	case seq != c.rseq:
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.UnexpectedRequest}
+	case len(c.rbuf)+len(data) > window*int(c.size):
+		return stanza.Error{Type: stanza.Wait, Condition: stanza.ResourceConstraint}
+	}
+	c.rseq++
+	c.rbuf = append(c.rbuf, data...)
+	c.signalLocked()
+	return nil
+}
+
+// abort closes the stream after the remote entity sent invalid data.
+func (c *Conn) abort(err error) {
+	c.rmu.Lock()
+	if c.rerr == nil {
+		c.rerr = err
+	}
+	c.rmu.Unlock()
+	c.signal()
+	// Closing the stream requires waiting for a response, which cannot happen
+	// while a handler is running.
+	/* #nosec */
+	go c.Close()
+}
+
+// remoteClose marks the stream as closed by the remote entity.
+func (c *Conn) remoteClose() {
+	c.rmu.Lock()
+	c.remoteClosed = true
+	if c.rerr == nil {
+		c.rerr = io.EOF
+	}
+	c.rmu.Unlock()
+	c.signal()
+}
+
+func (c *Conn) isRemoteClosed() bool {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return c.remoteClosed
+}
+
+func (c *Conn) signal() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.signalLocked()
+}
+
+func (c *Conn) signalLocked() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
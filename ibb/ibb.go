@@ -0,0 +1,379 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package ibb implements data transfer with XEP-0047: In-Band Bytestreams.
+//
+// In-band bytestreams (IBB) are the lowest common denominator for transferring
+// binary data such as files over XMPP.
+// They are slow because all data is base64 encoded and sent over the XMPP
+// session, but they work between any two entities that can exchange stanzas.
+//
+// Each stream is exposed as a Conn with the semantics of a net.Conn.
+// Streams are opened with a Handler, which must also be registered on the mux
+// used to serve the session to receive data and incoming streams.
+//
+// Data may be carried in IQs or in messages.
+// IQs are acknowledged by the recipient so writes to a stream using IQs block
+// until the remote entity has received the data, and a recipient that is not
+// reading fast enough can ask the sender to wait.
+// This keeps large transfers from filling up the session and delaying other
+// stanzas, so most users should prefer IQs.
+// Messages are not acknowledged and there is no way to ask the sender to slow
+// down, so if a stream carried in messages receives more than 16 blocks that
+// have not been read the recipient closes it and Read returns an error.
+package ibb // import "mellium.im/xmpp/ibb"
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the XML namespace used by in-band bytestreams.
+// It is provided as a convenience.
+const NS = "http://jabber.org/protocol/ibb"
+
+const (
+	// DefaultBlockSize is the block size used if a block size of zero is passed
+	// to Open or OpenMessage.
+	DefaultBlockSize = 4096
+
+	// window is the number of blocks that may be received and buffered before
+	// the sender is asked to wait.
+	window = 16
+)
+
+// Carrier stanza types.
+const (
+	stanzaIQ      = "iq"
+	stanzaMessage = "message"
+)
+
+var (
+	errListening = errors.New("ibb: handler is already listening")
+	errClosed    = errors.New("ibb: use of closed connection")
+)
+
+// Handle returns an option that registers a Handler for in-band bytestreams.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		for _, local := range []string{"open", "data", "close"} {
+			mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: local}, h)(m)
+		}
+		data := xml.Name{Space: NS, Local: "data"}
+		// Data is normally sent without a type attribute, which the mux does not
+		// treat as equivalent to "normal".
+		mux.Message("", data, h)(m)
+		mux.Message(stanza.NormalMessage, data, h)(m)
+	}
+}
+
+// Handler is an xmpp.Handler that handles multiplexing of bidirectional IBB
+// streams.
+// The zero value is ready to use.
+type Handler struct {
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+	l     *Listener
+
+	muxOnce sync.Once
+	mux     *mux.ServeMux
+}
+
+type connKey struct {
+	sid  string
+	peer string
+}
+
+// HandleXMPP implements xmpp.Handler.
+func (h *Handler) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	h.muxOnce.Do(func() {
+		h.mux = mux.New(Handle(h))
+	})
+	return h.mux.HandleXMPP(t, start)
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
+// Open attempts to create a new IBB stream on the provided session using IQs
+// as the carrier stanza.
+// If blockSize is zero, DefaultBlockSize is used.
+// If the remote entity asks for a smaller block size, the size is halved until
+// it is accepted.
+func (h *Handler) Open(ctx context.Context, s *xmpp.Session, to jid.JID, blockSize uint16) (*Conn, error) {
+	return h.open(ctx, s, to, blockSize, stanzaIQ)
+}
+
+// OpenMessage attempts to create a new IBB stream on the provided session
+// using messages as the carrier stanza.
+// Writes to the stream do not wait for the remote entity to read the data, and
+// a remote entity that falls too far behind closes the stream.
+// Most users should call Open instead.
+func (h *Handler) OpenMessage(ctx context.Context, s *xmpp.Session, to jid.JID, blockSize uint16) (*Conn, error) {
+	return h.open(ctx, s, to, blockSize, stanzaMessage)
+}
+
+func (h *Handler) open(ctx context.Context, s *xmpp.Session, to jid.JID, blockSize uint16, carrier string) (*Conn, error) {
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	c := newConn(h, s, attr.RandomID(), carrier, blockSize, s.LocalAddr(), to)
+	// Register the stream before opening it so that we don't miss any data that
+	// the remote entity sends as soon as it accepts.
+	h.add(c)
+	for {
+		err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "open"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "block-size"}, Value: strconv.FormatUint(uint64(c.size), 10)},
+				{Name: xml.Name{Local: "sid"}, Value: c.sid},
+				{Name: xml.Name{Local: "stanza"}, Value: carrier},
+			},
+		}), stanza.IQ{Type: stanza.SetIQ, To: to}, nil)
+		if stanzaErr, ok := err.(stanza.Error); ok && stanzaErr.Condition == stanza.ResourceConstraint && c.size > 1 {
+			c.size /= 2
+			continue
+		}
+		if err != nil {
+			h.remove(c)
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// Listen returns a listener that accepts streams opened by other entities on
+// the session.
+// Streams that ask for a block size larger than maxBlockSize are rejected so
+// that the remote entity can retry with a smaller block size.
+// If maxBlockSize is zero, any block size is accepted.
+// Only one listener may be active at a time, until it is closed all other calls
+// to Listen return an error.
+// If there is no active listener, all incoming streams are rejected.
+func (h *Handler) Listen(s *xmpp.Session, maxBlockSize uint16) (*Listener, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.l != nil {
+		return nil, errListening
+	}
+	h.l = &Listener{
+		h:     h,
+		s:     s,
+		max:   maxBlockSize,
+		conns: make(chan *Conn, window),
+		done:  make(chan struct{}),
+	}
+	return h.l, nil
+}
+
+func (h *Handler) add(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns == nil {
+		h.conns = make(map[connKey]*Conn)
+	}
+	h.conns[c.key()] = c
+}
+
+func (h *Handler) remove(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[c.key()] == c {
+		delete(h.conns, c.key())
+	}
+}
+
+func (h *Handler) conn(sid string, peer jid.JID) *Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conns[connKey{sid: sid, peer: peer.String()}]
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h *Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	if iq.Type != stanza.SetIQ || start.Name.Space != NS {
+		return nil
+	}
+	var err error
+	switch start.Name.Local {
+	case "open":
+		err = h.handleOpen(iq, start)
+	case "data":
+		var data []byte
+		data, err = readData(t)
+		if err == nil {
+			err = h.handleData(iq.From, start, data)
+		}
+	case "close":
+		_, sid := attr.Get(start.Attr, "sid")
+		c := h.conn(sid, iq.From)
+		if c == nil {
+			err = stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+			break
+		}
+		h.remove(c)
+		c.remoteClose()
+	default:
+		return nil
+	}
+	if stanzaErr, ok := err.(stanza.Error); ok {
+		iq.To, iq.From = iq.From, iq.To
+		iq.Type = stanza.ErrorIQ
+		_, err = xmlstream.Copy(t, iq.Wrap(stanzaErr.TokenReader()))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
+
+// HandleMessage implements mux.MessageHandler.
+func (h *Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	// Pop the start message token.
+	_, err := t.Token()
+	if err != nil {
+		return err
+	}
+	iter := xmlstream.NewIter(t)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, r := iter.Current()
+		if start.Name.Space != NS || start.Name.Local != "data" {
+			continue
+		}
+		data, err := readData(r)
+		if err == nil {
+			err = h.handleData(msg.From, start, data)
+		}
+		if _, ok := err.(stanza.Error); ok {
+			// There is no way to report errors for data carried in messages, so
+			// close the stream instead.
+			_, sid := attr.Get(start.Attr, "sid")
+			if c := h.conn(sid, msg.From); c != nil {
+				c.abort(err)
+			}
+			return nil
+		}
+		return err
+	}
+	return iter.Err()
+}
+
+func (h *Handler) handleOpen(iq stanza.IQ, start *xml.StartElement) error {
+	badRequest := stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	_, sid := attr.Get(start.Attr, "sid")
+	_, sizeStr := attr.Get(start.Attr, "block-size")
+	_, carrier := attr.Get(start.Attr, "stanza")
+	if carrier == "" {
+		carrier = stanzaIQ
+	}
+	size, err := strconv.ParseUint(sizeStr, 10, 16)
+	if sid == "" || err != nil || size == 0 || (carrier != stanzaIQ && carrier != stanzaMessage) {
+		return badRequest
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := h.l
+	if l == nil {
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAcceptable}
+	}
+	if l.max != 0 && uint16(size) > l.max {
+		return stanza.Error{Type: stanza.Modify, Condition: stanza.ResourceConstraint}
+	}
+	key := connKey{sid: sid, peer: iq.From.String()}
+	if _, ok := h.conns[key]; ok {
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAcceptable}
+	}
+	c := newConn(h, l.s, sid, carrier, uint16(size), l.s.LocalAddr(), iq.From)
+	select {
+	case l.conns <- c:
+	default:
+		return stanza.Error{Type: stanza.Wait, Condition: stanza.ResourceConstraint}
+	}
+	if h.conns == nil {
+		h.conns = make(map[connKey]*Conn)
+	}
+	h.conns[key] = c
+	return nil
+}
+
+func (h *Handler) handleData(from jid.JID, start *xml.StartElement, data []byte) error {
+	_, sid := attr.Get(start.Attr, "sid")
+	c := h.conn(sid, from)
+	if c == nil {
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	}
+	_, seqStr := attr.Get(start.Attr, "seq")
+	seq, err := strconv.ParseUint(seqStr, 10, 16)
+	if err != nil {
+		return stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	}
+	err = c.receive(uint16(seq), data)
+	if stanzaErr, ok := err.(stanza.Error); ok && stanzaErr.Condition == stanza.UnexpectedRequest {
+		// Data was lost, so the stream cannot continue.
+		c.abort(err)
+	}
+	return err
+}
+
+// readData decodes the base64 encoded character data from the remainder of a
+// data element.
+func readData(r xml.TokenReader) ([]byte, error) {
+	var b strings.Builder
+	inner := xmlstream.Inner(r)
+	for {
+		tok, err := inner.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data, ok := tok.(xml.CharData); ok {
+			b.Write(data)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b.String()), ""))
+	if err != nil {
+		return nil, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	}
+	return data, nil
+}
+
+// dataElement returns a data element containing the base64 encoded data.
+func dataElement(sid string, seq uint16, data []byte) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(base64.StdEncoding.EncodeToString(data))),
+		xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "data"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "seq"}, Value: strconv.FormatUint(uint64(seq), 10)},
+				{Name: xml.Name{Local: "sid"}, Value: sid},
+			},
+		},
+	)
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package ibb_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/ibb"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xmpp.Handler       = (*ibb.Handler)(nil)
+	_ mux.IQHandler      = (*ibb.Handler)(nil)
+	_ mux.MessageHandler = (*ibb.Handler)(nil)
+	_ info.FeatureIter   = (*ibb.Handler)(nil)
+	_ net.Conn           = (*ibb.Conn)(nil)
+	_ net.Listener       = (*ibb.Listener)(nil)
+)
+
+// newPeers returns two sessions that are connected to one another and serve
+// the provided handlers.
+// Because neither session stamps a from address on the stanzas that it sends,
+// the peers address each other using the zero JID.
+// The returned function closes the underlying connection.
+func newPeers(h1, h2 *ibb.Handler) (s1, s2 *xmpp.Session, closer func()) {
+	c1, c2 := net.Pipe()
+	s1 = xmpptest.NewSession(0, c1)
+	s2 = xmpptest.NewSession(0, c2)
+	for _, p := range []struct {
+		s *xmpp.Session
+		h *ibb.Handler
+	}{{s1, h1}, {s2, h2}} {
+		// Serving stops with an error when the connection is closed at the end of
+		// the test, so there is nothing useful to report.
+		/* #nosec */
+		go p.s.Serve(mux.New(ibb.Handle(p.h)))
+	}
+	return s1, s2, func() {
+		/* #nosec */
+		c1.Close()
+		/* #nosec */
+		c2.Close()
+	}
+}
+
+func TestStream(t *testing.T) {
+	for _, open := range []string{"iq", "message"} {
+		t.Run(open, func(t *testing.T) {
+			h1, h2 := &ibb.Handler{}, &ibb.Handler{}
+			s1, s2, closer := newPeers(h1, h2)
+			defer closer()
+
+			l, err := h2.Listen(s2, 0)
+			if err != nil {
+				t.Fatalf("error listening: %v", err)
+			}
+			defer l.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var conn *ibb.Conn
+			if open == "message" {
+				conn, err = h1.OpenMessage(ctx, s1, jid.JID{}, 16)
+			} else {
+				conn, err = h1.Open(ctx, s1, jid.JID{}, 16)
+			}
+			if err != nil {
+				t.Fatalf("error opening stream: %v", err)
+			}
+			if s := conn.Stanza(); s != open {
+				t.Errorf("wrong carrier stanza: want=%q, got=%q", open, s)
+			}
+
+			accepted, err := l.AcceptIBB()
+			if err != nil {
+				t.Fatalf("error accepting stream: %v", err)
+			}
+			if accepted.SID() != conn.SID() {
+				t.Errorf("wrong SID: want=%q, got=%q", conn.SID(), accepted.SID())
+			}
+			if accepted.Size() != 16 || accepted.Stanza() != open {
+				t.Errorf("wrong stream parameters: want=16/%s, got=%d/%s", open, accepted.Size(), accepted.Stanza())
+			}
+
+			want := bytes.Repeat([]byte("To be, or not to be. "), 10)
+			errs := make(chan error, 1)
+			go func() {
+				_, err := conn.Write(want)
+				if err == nil {
+					err = conn.Close()
+				}
+				errs <- err
+			}()
+			got, err := ioutil.ReadAll(accepted)
+			if err != nil {
+				t.Fatalf("error reading stream: %v", err)
+			}
+			if err = <-errs; err != nil {
+				t.Fatalf("error writing stream: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("wrong data: want=%q, got=%q", want, got)
+			}
+
+			_, err = conn.Write([]byte("Ay, there's the rub"))
+			if err == nil {
+				t.Errorf("expected error writing to closed stream")
+			}
+			err = accepted.Close()
+			if err != nil {
+				t.Errorf("error closing remotely closed stream: %v", err)
+			}
+		})
+	}
+}
+
+func TestRejected(t *testing.T) {
+	h1, h2 := &ibb.Handler{}, &ibb.Handler{}
+	s1, _, closer := newPeers(h1, h2)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := h1.Open(ctx, s1, jid.JID{}, 0)
+	stanzaErr, ok := err.(stanza.Error)
+	if !ok || stanzaErr.Condition != stanza.NotAcceptable {
+		t.Fatalf("wrong error: want=%v, got=%v", stanza.NotAcceptable, err)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	h1, h2 := &ibb.Handler{}, &ibb.Handler{}
+	s1, s2, closer := newPeers(h1, h2)
+	defer closer()
+
+	l, err := h2.Listen(s2, 1000)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+	_, err = h2.Listen(s2, 0)
+	if err == nil {
+		t.Errorf("expected error listening twice")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h1.Open(ctx, s1, jid.JID{}, 0)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	if size := conn.Size(); size != ibb.DefaultBlockSize/8 {
+		t.Errorf("wrong negotiated block size: want=%d, got=%d", ibb.DefaultBlockSize/8, size)
+	}
+	accepted, err := l.AcceptIBB()
+	if err != nil {
+		t.Fatalf("error accepting stream: %v", err)
+	}
+	if accepted.Size() != conn.Size() {
+		t.Errorf("block sizes do not match: want=%d, got=%d", conn.Size(), accepted.Size())
+	}
+
+	err = accepted.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("error setting deadline: %v", err)
+	}
+	_, err = accepted.Read(make([]byte, 10))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected timeout, got: %v", err)
+	}
+}
+
+func TestMessageOverflow(t *testing.T) {
+	h1, h2 := &ibb.Handler{}, &ibb.Handler{}
+	s1, s2, closer := newPeers(h1, h2)
+	defer closer()
+
+	l, err := h2.Listen(s2, 0)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h1.OpenMessage(ctx, s1, jid.JID{}, 16)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	accepted, err := l.AcceptIBB()
+	if err != nil {
+		t.Fatalf("error accepting stream: %v", err)
+	}
+
+	// Messages are not flow controlled, so writing more blocks than the
+	// recipient buffers before it reads any of them closes the stream.
+	// The write may fail once the close is received.
+	/* #nosec */
+	conn.Write(bytes.Repeat([]byte("0123456789abcdef"), 20))
+	got, err := ioutil.ReadAll(accepted)
+	stanzaErr, ok := err.(stanza.Error)
+	if !ok || stanzaErr.Condition != stanza.ResourceConstraint {
+		t.Errorf("wrong error: want=%v, got=%v", stanza.ResourceConstraint, err)
+	}
+	if len(got) != 16*16 {
+		t.Errorf("wrong amount of data buffered: want=%d, got=%d", 16*16, len(got))
+	}
+}
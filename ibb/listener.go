@@ -0,0 +1,83 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package ibb
+
+import (
+	"net"
+	"sync"
+
+	"mellium.im/xmpp"
+)
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listener is an IBB listener.
+// It implements the net.Listener interface.
+type Listener struct {
+	h     *Handler
+	s     *xmpp.Session
+	max   uint16
+	conns chan *Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Accept waits for the next incoming IBB stream and returns the connection.
+// If the listener is closed while Accept is blocked, Accept unblocks and
+// returns an error.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptIBB()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptIBB is like Accept except that it returns an IBB stream.
+func (l *Listener) AcceptIBB() (*Conn, error) {
+	select {
+	case <-l.done:
+		return nil, errClosed
+	default:
+	}
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+// Close stops listening and causes any blocked Accept operations to return an
+// error.
+// Any streams that were opened but not yet accepted are closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.h.mu.Lock()
+		if l.h.l == l {
+			l.h.l = nil
+		}
+		l.h.mu.Unlock()
+		close(l.done)
+		for {
+			select {
+			case c := <-l.conns:
+				// Closing the stream waits for a response, so don't block the caller.
+				/* #nosec */
+				go c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Addr returns the address of the session that the listener is accepting
+// streams on.
+func (l *Listener) Addr() net.Addr {
+	return l.s.LocalAddr()
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package frame splits the XML written to a session into top level elements
+// for transports that send each element separately.
+package frame // import "mellium.im/xmpp/internal/frame"
+
+import (
+	"bytes"
+)
+
+type scanState uint8
+
+const (
+	scanText scanState = iota
+	scanOpen
+	scanStartTag
+	scanQuote
+	scanEndTag
+	scanBang
+	scanComment
+	scanCDATA
+	scanProcInst
+)
+
+var streamStart = []byte("<stream:stream")
+
+// Splitter is an io.Writer that buffers XML until one or more complete top
+// level elements have been written and then calls a function with each of them.
+//
+// Whitespace, comments, and processing instructions outside of any element are
+// discarded.
+// Because the stream start element is never closed, the start tag of the stream
+// element and the stream end tag are each treated as a complete element.
+type Splitter struct {
+	f func([]byte) error
+
+	buf   []byte
+	depth int
+	state scanState
+	quote byte
+	slash bool
+}
+
+// NewSplitter returns a Splitter that calls f with each top level element.
+// The slice passed to f is only valid until f returns.
+// If f returns an error it is returned from Write.
+func NewSplitter(f func([]byte) error) *Splitter {
+	return &Splitter{f: f}
+}
+
+// Write scans p and calls the Splitters function for each element that is
+// completed.
+// It always consumes all of p unless an error is returned, in which case the
+// byte that completed the element passed to the function is the last byte
+// consumed.
+func (s *Splitter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		s.buf = append(s.buf, b)
+		var err error
+		switch s.state {
+		case scanText:
+			switch {
+			case b == '<':
+				s.state = scanOpen
+			case s.depth == 0:
+				// Drop anything that is not part of an element.
+				s.buf = s.buf[:len(s.buf)-1]
+			}
+		case scanOpen:
+			switch b {
+			case '/':
+				s.state = scanEndTag
+			case '!':
+				s.state = scanBang
+			case '?':
+				s.state = scanProcInst
+			default:
+				s.state = scanStartTag
+				s.slash = false
+			}
+		case scanStartTag:
+			switch b {
+			case '"', '\'':
+				s.state = scanQuote
+				s.quote = b
+			case '/':
+				s.slash = true
+			case '>':
+				s.state = scanText
+				switch {
+				case s.slash:
+				case s.depth == 0 && bytes.HasPrefix(s.buf, streamStart):
+				default:
+					s.depth++
+				}
+				err = s.flush()
+			default:
+				s.slash = false
+			}
+		case scanQuote:
+			if b == s.quote {
+				s.state = scanStartTag
+			}
+		case scanEndTag:
+			if b == '>' {
+				s.state = scanText
+				// An end tag at the top level can only be the end of the stream.
+				if s.depth > 0 {
+					s.depth--
+				}
+				err = s.flush()
+			}
+		case scanBang:
+			switch b {
+			case '-':
+				s.state = scanComment
+			case '[':
+				s.state = scanCDATA
+			default:
+				// Treat anything else (such as a DTD) the same as a processing
+				// instruction and skip to the end of the tag.
+				s.state = scanProcInst
+			}
+		case scanComment:
+			if b == '>' && bytes.HasSuffix(s.buf, []byte("-->")) {
+				s.endMarkup()
+			}
+		case scanCDATA:
+			if b == '>' && bytes.HasSuffix(s.buf, []byte("]]>")) {
+				s.endMarkup()
+			}
+		case scanProcInst:
+			if b == '>' {
+				s.endMarkup()
+			}
+		}
+		if err != nil {
+			return i + 1, err
+		}
+	}
+	return len(p), nil
+}
+
+// endMarkup is called at the end of a comment, CDATA section, or processing
+// instruction.
+func (s *Splitter) endMarkup() {
+	s.state = scanText
+	if s.depth == 0 {
+		s.buf = s.buf[:0]
+	}
+}
+
+// flush calls the splitters function with the buffered element if it is
+// complete.
+func (s *Splitter) flush() error {
+	if s.depth > 0 {
+		return nil
+	}
+	err := s.f(s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package frame_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"mellium.im/xmpp/internal/frame"
+)
+
+var splitTestCases = [...]struct {
+	in  []string
+	out []string
+}{
+	0: {},
+	1: {
+		in:  []string{`<a/>`, ` <b></b>`, "\n"},
+		out: []string{`<a/>`, `<b></b>`},
+	},
+	2: {
+		in:  []string{`<?xml version="1.0"?><stream:stream xmlns:stream='http://etherx.jabber.org/streams'>`, `<a>`, `</a></stream:stream>`},
+		out: []string{`<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>`, `<a></a>`, `</stream:stream>`},
+	},
+	3: {
+		in:  []string{"\n<a b='/>'><b/>", `<!-- </a> --><![CDATA[</a>]]></a><c`, `></c>`},
+		out: []string{`<a b='/>'><b/><!-- </a> --><![CDATA[</a>]]></a>`, `<c></c>`},
+	},
+	4: {
+		in:  []string{`<!-- <a> -->`, `<a b="'"`, `/>`},
+		out: []string{`<a b="'"/>`},
+	},
+}
+
+func TestSplitter(t *testing.T) {
+	for i, tc := range splitTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var out []string
+			s := frame.NewSplitter(func(p []byte) error {
+				out = append(out, string(p))
+				return nil
+			})
+			for _, in := range tc.in {
+				n, err := s.Write([]byte(in))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if n != len(in) {
+					t.Fatalf("short write: want=%d, got=%d", len(in), n)
+				}
+			}
+			if len(out) != len(tc.out) {
+				t.Fatalf("wrong output: want=%q, got=%q", tc.out, out)
+			}
+			for i := range tc.out {
+				if out[i] != tc.out[i] {
+					t.Errorf("wrong element %d: want=%q, got=%q", i, tc.out[i], out[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitterError(t *testing.T) {
+	errTest := errors.New("test")
+	s := frame.NewSplitter(func(p []byte) error {
+		return errTest
+	})
+	n, err := s.Write([]byte(`<a/><b/>`))
+	if err != errTest {
+		t.Errorf("wrong error: want=%v, got=%v", errTest, err)
+	}
+	if n != 4 {
+		t.Errorf("wrong number of bytes written: want=4, got=%d", n)
+	}
+}
@@ -16,13 +16,35 @@ import (
 // BUG(ssw): This package is very inefficient, see https://mellium.im/issue/38.
 
 // TokenReader returns a reader for the XML encoding of v.
+//
+// The default namespace is carried by the name of each start element, so
+// xmlns attributes are removed to prevent them from being duplicated when the
+// tokens are re-encoded.
 func TokenReader(v interface{}) (xml.TokenReader, error) {
 	var b bytes.Buffer
 	err := xml.NewEncoder(&b).Encode(v)
 	if err != nil {
 		return nil, err
 	}
-	return xml.NewDecoder(&b), nil
+	return removeXMLNS(xml.NewDecoder(&b)), nil
+}
+
+func removeXMLNS(r xml.TokenReader) xml.TokenReader {
+	return xmlstream.Map(func(t xml.Token) xml.Token {
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			return t
+		}
+		attrs := start.Attr[:0]
+		for _, a := range start.Attr {
+			if a.Name.Space == "" && a.Name.Local == "xmlns" {
+				continue
+			}
+			attrs = append(attrs, a)
+		}
+		start.Attr = attrs
+		return start
+	})(r)
 }
 
 // EncodeXML writes the XML encoding of v to the stream.
@@ -6,6 +6,7 @@ package marshal_test
 
 import (
 	"encoding/xml"
+	"strings"
 	"testing"
 
 	"mellium.im/xmpp/internal/marshal"
@@ -47,3 +48,19 @@ func TestFlushes(t *testing.T) {
 		}
 	})
 }
+
+func TestNoDuplicateXMLNS(t *testing.T) {
+	v := struct {
+		XMLName xml.Name `xml:"urn:example foo"`
+		Bar     string   `xml:"urn:example:bar bar"`
+	}{Bar: "baz"}
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	if err := marshal.EncodeXML(e, v); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `<foo xmlns="urn:example"><bar xmlns="urn:example:bar">baz</bar></foo>`
+	if out := b.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
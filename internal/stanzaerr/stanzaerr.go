@@ -0,0 +1,49 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package stanzaerr extracts stanza errors from responses of type "error".
+package stanzaerr // import "mellium.im/xmpp/internal/stanzaerr"
+
+import (
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmpp/stanza"
+)
+
+// Decode finds the stanza error in a stanza of type "error" that has already
+// had its start token consumed and returns it as a stanza.Error.
+// Error responses may include the original payload, so any other child
+// elements are skipped.
+// If the stanza does not contain an error, an undefined-condition error is
+// returned.
+func Decode(r xml.TokenReader) error {
+	d := xml.NewTokenDecoder(r)
+	for {
+		tok, err := d.Token()
+		switch {
+		case err == io.EOF:
+			return stanza.Error{Condition: stanza.UndefinedCondition}
+		case err != nil:
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "error" {
+				if err = d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			stanzaErr := stanza.Error{}
+			if err = d.DecodeElement(&stanzaErr, &t); err != nil {
+				return err
+			}
+			return stanzaErr
+		case xml.EndElement:
+			// The end of the stanza was reached without finding an error.
+			return stanza.Error{Condition: stanza.UndefinedCondition}
+		}
+	}
+}
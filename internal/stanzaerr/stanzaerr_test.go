@@ -0,0 +1,57 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package stanzaerr_test
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/internal/stanzaerr"
+	"mellium.im/xmpp/stanza"
+)
+
+var decodeTestCases = [...]struct {
+	in        string
+	condition stanza.Condition
+}{
+	0: {
+		in:        `<iq type="error"><error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`,
+		condition: stanza.ItemNotFound,
+	},
+	1: {
+		in:        `<iq type="error"><query xmlns="jabber:iq:roster"><error/></query><error type="auth"><forbidden xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`,
+		condition: stanza.Forbidden,
+	},
+	2: {
+		in:        `<iq type="error"><query xmlns="jabber:iq:roster"/></iq><error type="auth"><forbidden xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`,
+		condition: stanza.UndefinedCondition,
+	},
+	3: {
+		in:        `<iq type="error"></iq>`,
+		condition: stanza.UndefinedCondition,
+	},
+}
+
+func TestDecode(t *testing.T) {
+	for i, tc := range decodeTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d := xml.NewDecoder(strings.NewReader(tc.in))
+			// Pop the stanza start token.
+			if _, err := d.Token(); err != nil {
+				t.Fatalf("error popping start token: %v", err)
+			}
+			err := stanzaerr.Decode(d)
+			stanzaErr, ok := err.(stanza.Error)
+			if !ok {
+				t.Fatalf("expected a stanza error, got %T: %v", err, err)
+			}
+			if stanzaErr.Condition != tc.condition {
+				t.Errorf("wrong condition: want=%v, got=%v", tc.condition, stanzaErr.Condition)
+			}
+		})
+	}
+}
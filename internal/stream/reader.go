@@ -9,6 +9,8 @@ import (
 	"errors"
 	"io"
 
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/stream"
 )
 
@@ -30,6 +32,18 @@ func (r reader) Token() (xml.Token, error) {
 
 	switch t := tok.(type) {
 	case xml.StartElement:
+		if t.Name.Space == ns.WS {
+			// RFC 7395 framed streams are closed (or restarted) with elements in the
+			// framing namespace instead of the stream end element.
+			switch t.Name.Local {
+			case "close":
+				return nil, io.EOF
+			case "open":
+				return nil, ErrUnexpectedRestart
+			default:
+				return nil, ErrUnknownStreamElement
+			}
+		}
 		if t.Name.Space != stream.NS {
 			return tok, err
 		}
@@ -38,8 +52,7 @@ func (r reader) Token() (xml.Token, error) {
 		// delegating to the normal handler.
 		switch t.Name.Local {
 		case "error":
-			// TODO: Unmarshal the error and return it.
-			return nil, stream.InternalServerError
+			return nil, decodeError(r.r, t)
 		case "stream":
 			// Special case returning a nice error here.
 			return nil, ErrUnexpectedRestart
@@ -68,3 +81,18 @@ func (r reader) Token() (xml.Token, error) {
 func Reader(r xml.TokenReader) xml.TokenReader {
 	return reader{r: r}
 }
+
+// decodeError decodes the stream error that starts with start from r.
+// If decoding fails, the decoding error is returned instead.
+func decodeError(r xml.TokenReader, start xml.StartElement) error {
+	se := stream.Error{}
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(
+		xmlstream.Token(start),
+		xmlstream.Inner(r),
+		xmlstream.Token(start.End()),
+	))
+	if err := d.Decode(&se); err != nil {
+		return err
+	}
+	return se
+}
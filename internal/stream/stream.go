@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 
+	"mellium.im/xmlstream"
 	"mellium.im/xmpp/internal/decl"
 	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/jid"
@@ -26,6 +27,31 @@ type Info struct {
 	version Version
 	xmlns   string
 	lang    string
+	ws      bool
+}
+
+// To returns the address from the "to" attribute of the stream header, if any.
+func (i Info) To() (jid.JID, bool) {
+	if i.to == nil {
+		return jid.JID{}, false
+	}
+	return *i.to, true
+}
+
+// ID returns the stream ID.
+func (i Info) ID() string {
+	return i.id
+}
+
+// XMLNS returns the default namespace of the stream.
+func (i Info) XMLNS() string {
+	return i.xmlns
+}
+
+// WebSocket reports whether the stream is framed using the WebSocket
+// subprotocol defined in RFC 7395.
+func (i Info) WebSocket() bool {
+	return i.ws
 }
 
 // This MUST only return stream errors.
@@ -52,7 +78,10 @@ func streamFromStartElement(s xml.StartElement) (Info, error) {
 				return streamData, stream.BadFormat
 			}
 		case xml.Name{Space: "", Local: "xmlns"}:
-			if attr.Value != "jabber:client" && attr.Value != "jabber:server" {
+			switch {
+			case attr.Value == ns.WS && s.Name.Space == ns.WS:
+				streamData.ws = true
+			case attr.Value != ns.Client && attr.Value != ns.Server && attr.Value != ns.Component:
 				return streamData, stream.InvalidNamespace
 			}
 			streamData.xmlns = attr.Value
@@ -75,8 +104,11 @@ func streamFromStartElement(s xml.StartElement) (Info, error) {
 // is much faster than encoding.
 // Afterwards, clear the StreamRestartRequired bit and set the output stream
 // information.
-func Send(rw io.ReadWriter, s2s bool, version Version, lang string, location, origin, id string) (Info, error) {
-	streamData := Info{}
+//
+// If ws is true, an RFC 7395 <open/> element is sent instead of the XML header
+// and stream start element.
+func Send(rw io.ReadWriter, s2s, ws bool, version Version, lang string, location, origin, id string) (Info, error) {
+	streamData := Info{ws: ws}
 	switch s2s {
 	case true:
 		streamData.xmlns = ns.Server
@@ -92,13 +124,24 @@ func Send(rw io.ReadWriter, s2s bool, version Version, lang string, location, or
 	}
 
 	b := bufio.NewWriter(rw)
-	_, err := fmt.Fprintf(b,
-		decl.XMLHeader+`<stream:stream%sto='%s' from='%s' version='%s' `,
-		id,
-		location,
-		origin,
-		version,
-	)
+	var err error
+	if ws {
+		_, err = fmt.Fprintf(b,
+			`<open%sto='%s' from='%s' version='%s' `,
+			id,
+			location,
+			origin,
+			version,
+		)
+	} else {
+		_, err = fmt.Fprintf(b,
+			decl.XMLHeader+`<stream:stream%sto='%s' from='%s' version='%s' `,
+			id,
+			location,
+			origin,
+			version,
+		)
+	}
 	if err != nil {
 		return streamData, err
 	}
@@ -118,9 +161,13 @@ func Send(rw io.ReadWriter, s2s bool, version Version, lang string, location, or
 		}
 	}
 
-	_, err = fmt.Fprintf(b, `xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams'>`,
-		streamData.xmlns,
-	)
+	if ws {
+		_, err = fmt.Fprintf(b, `xmlns='%s'/>`, ns.WS)
+	} else {
+		_, err = fmt.Fprintf(b, `xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams'>`,
+			streamData.xmlns,
+		)
+	}
 	if err != nil {
 		return streamData, err
 	}
@@ -133,7 +180,10 @@ func Send(rw io.ReadWriter, s2s bool, version Version, lang string, location, or
 // If not, an error is returned. It then handles feature negotiation for the new
 // stream.
 // If an XML header is discovered instead, it is skipped.
-func Expect(ctx context.Context, d xml.TokenReader, recv bool) (streamData Info, err error) {
+//
+// If ws is true, an RFC 7395 <open/> element is expected instead of a stream
+// start element.
+func Expect(ctx context.Context, d xml.TokenReader, recv, ws bool) (streamData Info, err error) {
 	// Skip the XML declaration (if any).
 	d = decl.Skip(d)
 
@@ -151,11 +201,16 @@ func Expect(ctx context.Context, d xml.TokenReader, recv bool) (streamData Info,
 		case xml.StartElement:
 			switch {
 			case tok.Name.Local == "error" && tok.Name.Space == stream.NS:
-				se := stream.Error{}
-				if err := xml.NewTokenDecoder(d).DecodeElement(&se, &tok); err != nil {
+				return streamData, decodeError(d, tok)
+			case ws && tok.Name.Local != "open":
+				return streamData, stream.BadFormat
+			case ws && tok.Name.Space != ns.WS:
+				return streamData, stream.InvalidNamespace
+			case ws:
+				// The open element is always empty, so pop its end token.
+				if err = xmlstream.Skip(d); err != nil {
 					return streamData, err
 				}
-				return streamData, se
 			case tok.Name.Local != "stream":
 				return streamData, stream.BadFormat
 			case tok.Name.Space != stream.NS:
@@ -166,7 +221,9 @@ func Expect(ctx context.Context, d xml.TokenReader, recv bool) (streamData Info,
 			switch {
 			case err != nil:
 				return streamData, err
-			case streamData.version != DefaultVersion:
+			case streamData.version != DefaultVersion && streamData.xmlns != ns.Component:
+				// XEP-0114 predates stream versions, so component streams do not have
+				// one.
 				return streamData, stream.UnsupportedVersion
 			}
 
@@ -6,6 +6,8 @@ package stream_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"strings"
@@ -13,6 +15,7 @@ import (
 
 	"mellium.im/xmpp/internal/decl"
 	"mellium.im/xmpp/internal/stream"
+	xmppstream "mellium.im/xmpp/stream"
 )
 
 func TestSendNewS2S(t *testing.T) {
@@ -34,7 +37,7 @@ func TestSendNewS2S(t *testing.T) {
 			if tc.id {
 				ids = "abc"
 			}
-			_, err := stream.Send(&b, tc.s2s, stream.Version{Major: 1, Minor: 0}, "und", "example.net", "test@example.net", ids)
+			_, err := stream.Send(&b, tc.s2s, false, stream.Version{Major: 1, Minor: 0}, "und", "example.net", "test@example.net", ids)
 
 			str := b.String()
 			if !strings.HasPrefix(str, decl.XMLHeader) {
@@ -83,8 +86,71 @@ func TestSendNewS2SReturnsWriteErr(t *testing.T) {
 	}{
 		nopReader{},
 		errWriter{},
-	}, true, stream.Version{Major: 1, Minor: 0}, "und", "example.net", "test@example.net", "abc")
+	}, true, false, stream.Version{Major: 1, Minor: 0}, "und", "example.net", "test@example.net", "abc")
 	if err != io.ErrUnexpectedEOF {
 		t.Errorf("Expected errWriterErr (%s) but got `%s`", io.ErrUnexpectedEOF, err)
 	}
 }
+
+func TestSendWebSocket(t *testing.T) {
+	var b bytes.Buffer
+	info, err := stream.Send(&b, false, true, stream.Version{Major: 1, Minor: 0}, "und", "example.net", "test@example.net", "abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !info.WebSocket() {
+		t.Errorf("expected stream info to be marked as a WebSocket stream")
+	}
+	const expected = `<open id='abc' to='example.net' from='test@example.net' version='1.0' xml:lang='und' xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>`
+	if out := b.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestExpectWebSocket(t *testing.T) {
+	for i, tc := range []struct {
+		in  string
+		ws  bool
+		err error
+	}{
+		0: {in: `<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' id='abc' version='1.0'/><a/>`, ws: true},
+		1: {in: `<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' id='abc' version='1.0'/>`, err: xmppstream.BadFormat},
+		2: {in: `<stream:stream xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:client' id='abc' version='1.0'>`, ws: true, err: xmppstream.BadFormat},
+		3: {in: `<open xmlns='jabber:client' id='abc' version='1.0'/>`, ws: true, err: xmppstream.InvalidNamespace},
+		4: {in: `<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' id='abc' version='2.0'/>`, ws: true, err: xmppstream.UnsupportedVersion},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			d := xml.NewDecoder(strings.NewReader(tc.in))
+			info, err := stream.Expect(context.Background(), d, false, tc.ws)
+			if err != tc.err {
+				t.Fatalf("unexpected error: want=%v, got=%v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if !info.WebSocket() || info.ID() != "abc" {
+				t.Errorf("wrong stream info: %+v", info)
+			}
+			// The end of the open element should have been consumed.
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatalf("error reading next token: %v", err)
+			}
+			if start, ok := tok.(xml.StartElement); !ok || start.Name.Local != "a" {
+				t.Errorf("wrong next token: %v", tok)
+			}
+		})
+	}
+}
+
+func TestReaderWebSocketClose(t *testing.T) {
+	r := stream.Reader(xml.NewDecoder(strings.NewReader(`<a/><close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>`)))
+	for i := 0; i < 2; i++ {
+		if _, err := r.Token(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := r.Token(); err != io.EOF {
+		t.Errorf("wrong error reading close: want=%v, got=%v", io.EOF, err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpptest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"mellium.im/xmpp"
+)
+
+// Request is an IQ sent to a fake server by the session under test.
+type Request struct {
+	XMLName xml.Name
+	Type    string `xml:"type,attr"`
+	To      string `xml:"to,attr"`
+	ID      string `xml:"id,attr"`
+	Inner   string `xml:",innerxml"`
+
+	w io.Writer
+}
+
+// Payload returns the start element of the first child of the IQ.
+// If the IQ is empty, Payload returns the zero value.
+func (r Request) Payload() xml.StartElement {
+	d := xml.NewDecoder(strings.NewReader(r.Inner))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start
+		}
+	}
+}
+
+// Send writes raw XML to the session before the response to the request.
+// It can only be used on requests passed to the respond function of Answer or
+// NewServerSession.
+func (r Request) Send(raw string) error {
+	_, err := io.WriteString(r.w, raw)
+	return err
+}
+
+// Respond writes a response to req to w with the provided payload.
+// The response is sent from the address that the request was sent to.
+// If payload starts with "<error" an error IQ is sent, otherwise the response
+// is a result.
+func Respond(w io.Writer, req Request, payload string) error {
+	typ := "result"
+	if strings.HasPrefix(payload, "<error") {
+		typ = "error"
+	}
+	var from string
+	if req.To != "" {
+		from = fmt.Sprintf(` from="%s"`, req.To)
+	}
+	_, err := fmt.Fprintf(w, `<iq xmlns="jabber:client" type="%s" id="%s"%s>%s</iq>`, typ, req.ID, from, payload)
+	return err
+}
+
+// Answer acts as a fake server on the other end of a session.
+// It reads stanzas from rw and answers each IQ with the payload returned by
+// respond as described by Respond, ignoring any other stanzas, until reading
+// from rw fails.
+func Answer(rw io.ReadWriter, respond func(Request) string) {
+	d := xml.NewDecoder(rw)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		req := Request{w: rw}
+		if err = d.DecodeElement(&req, &start); err != nil {
+			return
+		}
+		if req.XMLName.Local != "iq" || (req.Type != "get" && req.Type != "set") {
+			continue
+		}
+		if err = Respond(rw, req, respond(req)); err != nil {
+			return
+		}
+	}
+}
+
+// NewServerSession returns a session that is served with h and that is
+// connected to a fake server that answers IQs using Answer.
+// The session is created with NewSession and closing the returned connection
+// stops both the server and the session.
+func NewServerSession(h xmpp.Handler, respond func(Request) string) (*xmpp.Session, net.Conn) {
+	clientConn, serverConn := net.Pipe()
+	go Answer(serverConn, respond)
+	s := NewSession(0, clientConn)
+	go func() {
+		/* #nosec */
+		s.Serve(h)
+	}()
+	return s, clientConn
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpptest_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/internal/xmpptest"
+)
+
+var respondTestCases = [...]struct {
+	req     xmpptest.Request
+	payload string
+	out     string
+}{
+	0: {
+		req: xmpptest.Request{ID: "123"},
+		out: `<iq xmlns="jabber:client" type="result" id="123"></iq>`,
+	},
+	1: {
+		req:     xmpptest.Request{ID: "123", To: "example.net"},
+		payload: `<query xmlns="urn:example"/>`,
+		out:     `<iq xmlns="jabber:client" type="result" id="123" from="example.net"><query xmlns="urn:example"/></iq>`,
+	},
+	2: {
+		req:     xmpptest.Request{ID: "123"},
+		payload: `<error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`,
+		out:     `<iq xmlns="jabber:client" type="error" id="123"><error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`,
+	},
+}
+
+func TestRespond(t *testing.T) {
+	for i, tc := range respondTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var b strings.Builder
+			err := xmpptest.Respond(&b, tc.req, tc.payload)
+			if err != nil {
+				t.Fatalf("error responding: %v", err)
+			}
+			if out := b.String(); out != tc.out {
+				t.Errorf("wrong response:\nwant=%s,\n got=%s", tc.out, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package keepalive keeps idle sessions alive and detects dead connections.
+//
+// Sessions that do not send or receive anything for a while are often silently
+// dropped by NATs and firewalls, and without traffic neither side notices until
+// it tries to send something.
+// The keepalive scheduler in this package sends either whitespace keepalives
+// (RFC 6120 §4.6.1) or XEP-0199: XMPP Ping requests whenever nothing has been
+// received for a configurable interval.
+package keepalive // import "mellium.im/xmpp/keepalive"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+)
+
+const defaultInterval = time.Minute
+
+// ErrTimeout is returned when a ping is not answered in time and the session is
+// closed because the connection is assumed to be dead.
+var ErrTimeout = errors.New("keepalive: timed out waiting for a ping response")
+
+// Config contains options for the keepalive scheduler.
+//
+// The zero value for each field is equivalent to running without that option.
+type Config struct {
+	// Interval is how long the session may go without receiving anything before
+	// a keepalive is sent.
+	// If zero, one minute is used.
+	Interval time.Duration
+
+	// Ping causes XEP-0199 pings to be sent to the remote entity instead of
+	// whitespace.
+	// Because whitespace does not elicit a response, only pings are able to
+	// detect a dead connection before the operating system notices that writes
+	// are failing.
+	Ping bool
+
+	// Timeout is how long to wait for a response to a ping before the connection
+	// is considered dead.
+	// If zero, the interval is used.
+	Timeout time.Duration
+
+	// OnTimeout is called after the session has been closed because a ping
+	// timed out.
+	// It can be used to trigger reconnection.
+	OnTimeout func(*xmpp.Session)
+}
+
+// Run sends keepalives on the session whenever nothing has been received for
+// the configured interval.
+// It blocks until the context is canceled, sending a keepalive fails, or a ping
+// times out.
+//
+// If a ping times out the session and its underlying connection are closed and
+// ErrTimeout is returned.
+// Closing the connection causes any call to Serve to return, so clients
+// managed by the reconnect package will automatically reconnect.
+//
+// The session must be served concurrently for the last input time to be
+// updated and ping responses to be received.
+func Run(ctx context.Context, s *xmpp.Session, cfg Config) error {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		// If something was received since the timer was set, wait until the
+		// session has been idle for the full interval.
+		if idle := time.Since(s.LastInput()); idle < interval {
+			t.Reset(interval - idle)
+			continue
+		}
+
+		var err error
+		if cfg.Ping {
+			err = sendPing(ctx, s, timeout)
+		} else {
+			err = sendWhitespace(s)
+		}
+		if err == ErrTimeout {
+			/* #nosec */
+			s.Close()
+			/* #nosec */
+			s.Conn().Close()
+			if cfg.OnTimeout != nil {
+				cfg.OnTimeout(s)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		t.Reset(interval)
+	}
+}
+
+func sendPing(ctx context.Context, s *xmpp.Session, timeout time.Duration) error {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := ping.Send(pingCtx, s, s.RemoteAddr())
+	switch err.(type) {
+	case nil:
+		return nil
+	case stanza.Error:
+		// Any response, even an error, means the connection is alive.
+		return nil
+	}
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return ErrTimeout
+	}
+	return err
+}
+
+func sendWhitespace(s *xmpp.Session) error {
+	w := s.TokenWriter()
+	defer w.Close()
+	if err := w.EncodeToken(xml.CharData(" ")); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package keepalive_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/keepalive"
+)
+
+// remote reads from conn and reports the name of every top level element that
+// it receives.
+// If respond is true, IQs are answered with an empty result.
+func remote(conn net.Conn, respond bool, recv chan<- string) {
+	d := xml.NewDecoder(conn)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		if t, ok := tok.(xml.StartElement); ok {
+			var id string
+			for _, a := range t.Attr {
+				if a.Name.Local == "id" {
+					id = a.Value
+				}
+			}
+			if err = d.Skip(); err != nil {
+				return
+			}
+			recv <- t.Name.Local
+			if respond && t.Name.Local == "iq" {
+				/* #nosec */
+				fmt.Fprintf(conn, `<iq type="result" id="%s"/>`, id)
+			}
+		}
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	// Whitespace is not reported by an XML decoder until the next element starts,
+	// so read the raw bytes.
+	recv := make(chan string, 10)
+	go func() {
+		b := make([]byte, 10)
+		for {
+			n, err := serverConn.Read(b)
+			if err != nil {
+				return
+			}
+			recv <- string(b[:n])
+		}
+	}()
+	s := xmpptest.NewSession(0, clientConn)
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- keepalive.Run(runCtx, s, keepalive.Config{Interval: 10 * time.Millisecond})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-recv:
+			if got != " " {
+				t.Fatalf("wrong keepalive sent: want=%q, got=%q", " ", got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for keepalive %d", i)
+		}
+	}
+	runCancel()
+	if err := <-runErr; err != context.Canceled {
+		t.Errorf("wrong error: want=%v, got=%v", context.Canceled, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	recv := make(chan string, 10)
+	go remote(serverConn, true, recv)
+	s := xmpptest.NewSession(0, clientConn)
+	go func() {
+		/* #nosec */
+		s.Serve(nil)
+	}()
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- keepalive.Run(runCtx, s, keepalive.Config{
+			Interval: 10 * time.Millisecond,
+			Ping:     true,
+		})
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-recv:
+			if got != "iq" {
+				t.Fatalf("wrong keepalive sent: want=iq, got=%s", got)
+			}
+		case err := <-runErr:
+			t.Fatalf("keepalive stopped early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for ping %d", i)
+		}
+	}
+	runCancel()
+	if err := <-runErr; err != context.Canceled {
+		t.Errorf("wrong error: want=%v, got=%v", context.Canceled, err)
+	}
+	/* #nosec */
+	clientConn.Close()
+}
+
+func TestPingTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	recv := make(chan string, 10)
+	go remote(serverConn, false, recv)
+	s := xmpptest.NewSession(0, struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: clientConn,
+		Writer: clientConn,
+	})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(nil)
+	}()
+
+	timedOut := make(chan *xmpp.Session, 1)
+	err := keepalive.Run(ctx, s, keepalive.Config{
+		Interval: 10 * time.Millisecond,
+		Ping:     true,
+		OnTimeout: func(s *xmpp.Session) {
+			timedOut <- s
+		},
+	})
+	if err != keepalive.ErrTimeout {
+		t.Errorf("wrong error: want=%v, got=%v", keepalive.ErrTimeout, err)
+	}
+	select {
+	case got := <-timedOut:
+		if got != s {
+			t.Errorf("wrong session passed to OnTimeout")
+		}
+	default:
+		t.Errorf("OnTimeout was not called")
+	}
+	if s.State()&xmpp.OutputStreamClosed == 0 {
+		t.Errorf("expected the output stream to be closed")
+	}
+
+	/* #nosec */
+	clientConn.Close()
+	<-serveErr
+}
@@ -0,0 +1,436 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package mam implements querying message archives.
+//
+// Message Archive Management (XEP-0313) lets clients fetch messages that were
+// stored by their server or by a multi-user chat service, for example to
+// backfill conversation history after reconnecting.
+// Archived messages are not returned in the response to the query, instead
+// they are sent as separate messages while the query is pending.
+// To receive them, a Handler must be registered on the mux used to serve the
+// session.
+//
+// Large archives are paged using result set management as implemented by the
+// paging package.
+package mam // import "mellium.im/xmpp/mam"
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS        = "urn:xmpp:mam:2"
+	NSForward = "urn:xmpp:forward:0"
+	NSDelay   = "urn:xmpp:delay"
+)
+
+// Query is a request for the messages in an archive that match all of the
+// provided filters.
+// The zero value matches every message in the archive.
+type Query struct {
+	// ID is used to match the results to the query.
+	// If empty, a random ID is generated when the query is sent.
+	ID string
+
+	// Node is the pubsub node to query for archives stored on a node.
+	Node string
+
+	// With limits the results to messages sent to or received from the provided
+	// JID.
+	With jid.JID
+
+	// Start and End limit the results to messages that were stored at or after
+	// Start and at or before End.
+	// Zero times are ignored.
+	Start xtime.Time
+	End   xtime.Time
+
+	// BeforeID and AfterID limit the results to messages that were stored before
+	// or after the messages with the given archive IDs.
+	BeforeID string
+	AfterID  string
+
+	// Page selects a single page of the results.
+	Page paging.Request
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (q Query) TokenReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}}
+	if q.ID != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "queryid"}, Value: q.ID})
+	}
+	if q.Node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: q.Node})
+	}
+
+	var fields []xml.TokenReader
+	if !q.With.Equal(jid.JID{}) {
+		fields = append(fields, field("with", q.With.String()))
+	}
+	if t := time.Time(q.Start); !t.IsZero() {
+		fields = append(fields, field("start", t.UTC().Format(time.RFC3339)))
+	}
+	if t := time.Time(q.End); !t.IsZero() {
+		fields = append(fields, field("end", t.UTC().Format(time.RFC3339)))
+	}
+	if q.BeforeID != "" {
+		fields = append(fields, field("before-id", q.BeforeID))
+	}
+	if q.AfterID != "" {
+		fields = append(fields, field("after-id", q.AfterID))
+	}
+
+	var inner []xml.TokenReader
+	if len(fields) > 0 {
+		formType := xmlstream.Wrap(
+			textElement("value", NS),
+			xml.StartElement{
+				Name: xml.Name{Local: "field"},
+				Attr: []xml.Attr{
+					{Name: xml.Name{Local: "var"}, Value: "FORM_TYPE"},
+					{Name: xml.Name{Local: "type"}, Value: "hidden"},
+				},
+			},
+		)
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.MultiReader(append([]xml.TokenReader{formType}, fields...)...),
+			xml.StartElement{
+				Name: xml.Name{Space: form.NS, Local: "x"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "submit"}},
+			},
+		))
+	}
+	if q.Page != (paging.Request{}) {
+		inner = append(inner, q.Page.TokenReader())
+	}
+	return xmlstream.Wrap(xmlstream.MultiReader(inner...), start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (q Query) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, q.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (q Query) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := q.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Result is a message that was returned from an archive.
+type Result struct {
+	// ID is the archive ID of the message.
+	ID string
+
+	// QueryID is the ID of the query that returned the message.
+	QueryID string
+
+	// Time is when the message was stored in the archive.
+	Time time.Time
+
+	// Message is the header of the archived message.
+	Message stanza.Message
+
+	toks []xml.Token
+}
+
+// TokenReader returns a stream of XML tokens representing the archived message
+// including its payload.
+func (r Result) TokenReader() xml.TokenReader {
+	return &tokenReader{toks: r.toks}
+}
+
+// Handle returns an option that registers a Handler for archived messages.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		result := xml.Name{Space: NS, Local: "result"}
+		// Archived messages are normally sent without a type attribute, which the
+		// mux does not treat as equivalent to "normal".
+		mux.Message("", result, h)(m)
+		mux.Message(stanza.NormalMessage, result, h)(m)
+	}
+}
+
+// Handler collects the results of archive queries.
+// The zero value is ready to use.
+type Handler struct {
+	mu      sync.Mutex
+	pending map[string]*pending
+}
+
+type pending struct {
+	from    []jid.JID
+	results []Result
+
+	// last is the ID of the last result in the page and done is closed when it
+	// is handled, see FetchIQ.
+	last string
+	done chan struct{}
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+// It records archived messages sent in response to a pending query, any other
+// messages are ignored.
+func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	data := struct {
+		Result struct {
+			QueryID   string `xml:"queryid,attr"`
+			ID        string `xml:"id,attr"`
+			Forwarded struct {
+				Delay struct {
+					Stamp string `xml:"stamp,attr"`
+				} `xml:"urn:xmpp:delay delay"`
+				Message rawElement `xml:"message"`
+			} `xml:"urn:xmpp:forward:0 forwarded"`
+		} `xml:"urn:xmpp:mam:2 result"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.pending[data.Result.QueryID]
+	if !ok || !p.matches(msg.From) {
+		return nil
+	}
+	forwarded := data.Result.Forwarded
+	if len(forwarded.Message.toks) == 0 {
+		return nil
+	}
+	header, err := stanza.NewMessage(forwarded.Message.toks[0].(xml.StartElement))
+	if err != nil {
+		return nil
+	}
+	result := Result{
+		ID:      data.Result.ID,
+		QueryID: data.Result.QueryID,
+		Message: header,
+		toks:    forwarded.Message.toks,
+	}
+	if forwarded.Delay.Stamp != "" {
+		result.Time, _ = time.Parse(time.RFC3339, forwarded.Delay.Stamp)
+	}
+	p.results = append(p.results, result)
+	if p.done != nil && result.ID == p.last {
+		close(p.done)
+		p.done = nil
+	}
+	return nil
+}
+
+func (p *pending) has(id string) bool {
+	for _, r := range p.results {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pending) matches(from jid.JID) bool {
+	for _, j := range p.from {
+		if from.Equal(j) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch queries the users own archive and returns an iterator over the
+// results (blocking until the query is complete).
+//
+// The handler must be registered on the mux that is serving the session.
+// Fetch does not return until the last result reported by the archive has been
+// handled, so ctx should have a deadline in case the archive never sends it.
+// Any errors encountered while querying the archive are deferred until the iter
+// is used.
+// If the archive responds with an error it is returned from the iterators Err
+// method as a stanza.Error.
+func (h *Handler) Fetch(ctx context.Context, q Query, s *xmpp.Session) *Iter {
+	return h.FetchIQ(ctx, q, stanza.IQ{}, s)
+}
+
+// FetchIQ is like Fetch but it allows you to customize the IQ, for example to
+// query the archive of a multi-user chat by setting the IQs "to" attribute.
+// Changing the type of the provided IQ has no effect.
+func (h *Handler) FetchIQ(ctx context.Context, q Query, iq stanza.IQ, s *xmpp.Session) *Iter {
+	iq.Type = stanza.SetIQ
+	if q.ID == "" {
+		q.ID = attr.RandomID()
+	}
+
+	p := &pending{}
+	if iq.To.Equal(jid.JID{}) {
+		p.from = []jid.JID{{}, s.LocalAddr().Bare()}
+	} else {
+		p.from = []jid.JID{iq.To}
+	}
+	h.mu.Lock()
+	if h.pending == nil {
+		h.pending = make(map[string]*pending)
+	}
+	h.pending[q.ID] = p
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, q.ID)
+		h.mu.Unlock()
+	}()
+
+	fin := struct {
+		XMLName  xml.Name   `xml:"urn:xmpp:mam:2 fin"`
+		Complete bool       `xml:"complete,attr"`
+		Set      paging.Set `xml:"http://jabber.org/protocol/rsm set"`
+	}{}
+	err := s.UnmarshalIQElement(ctx, q.TokenReader(), iq, &fin)
+	if err != nil {
+		return &Iter{err: err}
+	}
+
+	// If the session is served with ServeConcurrent the archived messages may
+	// still be waiting for a worker when the response to the query arrives, so
+	// wait until the last result in the page has been handled.
+	h.mu.Lock()
+	if fin.Set.Last != "" && !p.has(fin.Set.Last) {
+		done := make(chan struct{})
+		p.last, p.done = fin.Set.Last, done
+		h.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return &Iter{err: ctx.Err()}
+		}
+		h.mu.Lock()
+	}
+	defer h.mu.Unlock()
+	return &Iter{
+		results:  p.results,
+		complete: fin.Complete,
+		set:      fin.Set,
+	}
+}
+
+// Iter is an iterator over the results of an archive query.
+type Iter struct {
+	results  []Result
+	current  Result
+	complete bool
+	set      paging.Set
+	err      error
+}
+
+// Next returns true if there are more results.
+func (i *Iter) Next() bool {
+	if i.err != nil || len(i.results) == 0 {
+		return false
+	}
+	i.current, i.results = i.results[0], i.results[1:]
+	return true
+}
+
+// Err returns the last error encountered by the iterator (if any).
+func (i *Iter) Err() error {
+	return i.err
+}
+
+// Result returns the last result returned by the iterator.
+func (i *Iter) Result() Result {
+	return i.current
+}
+
+// Complete returns true if the last page of results in the direction of the
+// query was returned.
+func (i *Iter) Complete() bool {
+	return i.complete
+}
+
+// Set returns the result set management data for the page of results, which
+// can be used to request the next or previous page.
+func (i *Iter) Set() paging.Set {
+	return i.set
+}
+
+// Close indicates that we are finished with the given iterator.
+// Calling it multiple times has no effect.
+func (i *Iter) Close() error {
+	i.results = nil
+	return nil
+}
+
+// rawElement records the tokens that make up an element.
+type rawElement struct {
+	toks []xml.Token
+}
+
+func (e *rawElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	e.toks = append(e.toks[:0], start.Copy())
+	depth := 1
+	for depth > 0 {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+		e.toks = append(e.toks, xml.CopyToken(tok))
+	}
+	return nil
+}
+
+type tokenReader struct {
+	toks []xml.Token
+}
+
+func (r *tokenReader) Token() (xml.Token, error) {
+	if len(r.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := r.toks[0]
+	r.toks = r.toks[1:]
+	return tok, nil
+}
+
+func field(name, value string) xml.TokenReader {
+	return xmlstream.Wrap(
+		textElement("value", value),
+		xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "var"}, Value: name}},
+		},
+	)
+}
+
+func textElement(name, text string) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(text)),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
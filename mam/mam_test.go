@@ -0,0 +1,192 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package mam_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mam"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+var (
+	_ mux.MessageHandler  = (*mam.Handler)(nil)
+	_ xml.Marshaler       = mam.Query{}
+	_ xmlstream.Marshaler = mam.Query{}
+	_ xmlstream.WriterTo  = mam.Query{}
+)
+
+func TestMarshalQuery(t *testing.T) {
+	q := mam.Query{
+		ID:      "f27",
+		With:    jid.MustParse("juliet@capulet.lit"),
+		Start:   xtime.Time(time.Date(2010, time.June, 7, 0, 0, 0, 0, time.UTC)),
+		AfterID: "28482-98726-73623",
+		Page:    paging.Request{Max: 10},
+	}
+	out, err := xml.Marshal(q)
+	if err != nil {
+		t.Fatalf("error marshaling query: %v", err)
+	}
+	const want = `<query xmlns="urn:xmpp:mam:2" queryid="f27"><x xmlns="jabber:x:data" type="submit"><field var="FORM_TYPE" type="hidden"><value>urn:xmpp:mam:2</value></field><field var="with"><value>juliet@capulet.lit</value></field><field var="start"><value>2010-06-07T00:00:00Z</value></field><field var="after-id"><value>28482-98726-73623</value></field></x><set xmlns="http://jabber.org/protocol/rsm"><max>10</max></set></query>`
+	if s := string(out); s != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, s)
+	}
+
+	out, err = xml.Marshal(mam.Query{})
+	if err != nil {
+		t.Fatalf("error marshaling empty query: %v", err)
+	}
+	const wantEmpty = `<query xmlns="urn:xmpp:mam:2"></query>`
+	if s := string(out); s != wantEmpty {
+		t.Errorf("wrong output for empty query:\nwant=%s,\n got=%s", wantEmpty, s)
+	}
+}
+
+func getAttr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// queryID returns the ID of the archive query in req.
+func queryID(req xmpptest.Request) string {
+	return getAttr(req.Payload(), "queryid")
+}
+
+const result = `<message xmlns="jabber:client" %s><result xmlns="urn:xmpp:mam:2" queryid="%s" id="%s"><forwarded xmlns="urn:xmpp:forward:0"><delay xmlns="urn:xmpp:delay" stamp="2010-07-10T23:08:25Z"/><message xmlns="jabber:client" from="witch@shakespeare.lit" to="macbeth@shakespeare.lit" type="chat"><body>%s</body></message></forwarded></result></message>`
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h := &mam.Handler{}
+	s, conn := xmpptest.NewServerSession(mux.New(mam.Handle(h)), func(req xmpptest.Request) string {
+		id := queryID(req)
+		/* #nosec */
+		req.Send(fmt.Sprintf(result, "", id, "28482-98726-73623", "Hail to thee") +
+			fmt.Sprintf(result, `from="mallory@example.net"`, id, "spoofed", "All hail Macbeth") +
+			fmt.Sprintf(result, "", "other", "09af3-cc343-b409f", "Thou shalt get kings") +
+			fmt.Sprintf(result, "", id, "09af3-cc343-b409f", "All hail, Macbeth!"))
+		return `<fin xmlns="urn:xmpp:mam:2" complete="true"><set xmlns="http://jabber.org/protocol/rsm"><first index="0">28482-98726-73623</first><last>09af3-cc343-b409f</last></set></fin>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	iter := h.Fetch(ctx, mam.Query{}, s)
+	var ids, bodies []string
+	for iter.Next() {
+		r := iter.Result()
+		if r.Time.Year() != 2010 {
+			t.Errorf("wrong time for %s: %v", r.ID, r.Time)
+		}
+		if r.Message.Type != stanza.ChatMessage || r.Message.From.String() != "witch@shakespeare.lit" {
+			t.Errorf("wrong message header for %s: %+v", r.ID, r.Message)
+		}
+		body := struct {
+			Body string `xml:"body"`
+		}{}
+		if err := xml.NewTokenDecoder(r.TokenReader()).Decode(&body); err != nil {
+			t.Errorf("error decoding archived message: %v", err)
+		}
+		ids = append(ids, r.ID)
+		bodies = append(bodies, body.Body)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error fetching archive: %v", err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("error closing iter: %v", err)
+	}
+	if s := strings.Join(ids, ","); s != "28482-98726-73623,09af3-cc343-b409f" {
+		t.Errorf("wrong results: %s", s)
+	}
+	if s := strings.Join(bodies, ","); s != "Hail to thee,All hail, Macbeth!" {
+		t.Errorf("wrong bodies: %s", s)
+	}
+	if !iter.Complete() {
+		t.Errorf("expected the query to be complete")
+	}
+	set := iter.Set()
+	if set.First != "28482-98726-73623" || set.Last != "09af3-cc343-b409f" {
+		t.Errorf("wrong result set: %+v", set)
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h := &mam.Handler{}
+	s, conn := xmpptest.NewServerSession(mux.New(mam.Handle(h)), func(xmpptest.Request) string {
+		return `<error type="modify"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	iter := h.Fetch(ctx, mam.Query{Page: paging.Request{After: "unknown"}}, s)
+	if iter.Next() {
+		t.Errorf("expected no results")
+	}
+	if err, ok := iter.Err().(stanza.Error); !ok || err.Condition != stanza.ItemNotFound {
+		t.Errorf("wrong error: %v", iter.Err())
+	}
+}
+
+func TestFetchConcurrent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h := &mam.Handler{}
+	clientConn, serverConn := net.Pipe()
+	/* #nosec */
+	defer clientConn.Close()
+	go xmpptest.Answer(serverConn, func(req xmpptest.Request) string {
+		id := queryID(req)
+		/* #nosec */
+		req.Send(fmt.Sprintf(result, "", id, "28482-98726-73623", "Hail to thee") +
+			fmt.Sprintf(result, "", id, "09af3-cc343-b409f", "All hail, Macbeth!"))
+		return `<fin xmlns="urn:xmpp:mam:2"><set xmlns="http://jabber.org/protocol/rsm"><first index="0">28482-98726-73623</first><last>09af3-cc343-b409f</last></set></fin>`
+	})
+	s := xmpptest.NewSession(0, clientConn)
+	m := mux.New(mam.Handle(h))
+	go func() {
+		// Slow down the workers so that the response to the query is received
+		// before the archived messages are handled.
+		/* #nosec */
+		s.ServeConcurrent(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			time.Sleep(50 * time.Millisecond)
+			return m.HandleXMPP(r, start)
+		}), 2)
+	}()
+
+	iter := h.Fetch(ctx, mam.Query{}, s)
+	var ids []string
+	for iter.Next() {
+		ids = append(ids, iter.Result().ID)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error fetching archive: %v", err)
+	}
+	if s := strings.Join(ids, ","); s != "28482-98726-73623,09af3-cc343-b409f" {
+		t.Errorf("wrong results: %s", s)
+	}
+}
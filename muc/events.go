@@ -0,0 +1,78 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package muc
+
+import (
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// Event is a change in the state of a room that is sent on the rooms event
+// channel.
+// It is one of OccupantJoined, OccupantChanged, OccupantLeft, NickChanged,
+// Message, or SubjectChanged.
+type Event interface {
+	event()
+}
+
+// OccupantJoined is sent when an occupant (including ourselves) joins the room.
+type OccupantJoined struct {
+	Occupant Occupant
+}
+
+// OccupantChanged is sent when an occupant that is already in the room changes
+// their presence, affiliation, or role.
+type OccupantChanged struct {
+	Occupant Occupant
+}
+
+// OccupantLeft is sent when an occupant leaves the room or is removed from it.
+// If the occupant was removed, Status contains the reason such as
+// StatusKicked or StatusBanned.
+type OccupantLeft struct {
+	Occupant Occupant
+	Reason   string
+	Status   []Status
+}
+
+// NickChanged is sent when an occupant changes their nickname.
+type NickChanged struct {
+	Occupant Occupant
+	OldNick  string
+}
+
+// Message is a message sent to the room or a private message from one of its
+// occupants.
+type Message struct {
+	From jid.JID
+	Body string
+
+	// Private is true if the message was sent only to us.
+	Private bool
+
+	// Delay is the time at which the message was originally sent if it was
+	// delivered from the rooms history, otherwise it is the zero time.
+	Delay time.Time
+}
+
+// Nick returns the nickname of the occupant that sent the message.
+func (m Message) Nick() string {
+	return m.From.Resourcepart()
+}
+
+// SubjectChanged is sent when the subject of the room changes and when the
+// current subject is sent after joining.
+type SubjectChanged struct {
+	From    jid.JID
+	Subject string
+}
+
+func (OccupantJoined) event()  {}
+func (OccupantChanged) event() {}
+func (OccupantLeft) event()    {}
+func (NickChanged) event()     {}
+func (Message) event()         {}
+func (SubjectChanged) event()  {}
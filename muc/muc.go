@@ -0,0 +1,454 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package muc implements the client side of XEP-0045: Multi-User Chat.
+//
+// To use multi-user chat, register a Client on the mux that is used to serve
+// the session and then join rooms with the client.
+// Each joined room is represented by a Room that keeps track of the rooms
+// occupants and reports changes to the room on its event channel.
+//
+//	client := &muc.Client{}
+//	m := mux.New(muc.Handle(client))
+//	go session.Serve(m)
+//	room, err := client.Join(ctx, jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), session)
+package muc // import "mellium.im/xmpp/muc"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS           = "http://jabber.org/protocol/muc"
+	NSUser       = "http://jabber.org/protocol/muc#user"
+	NSAdmin      = "http://jabber.org/protocol/muc#admin"
+	NSOwner      = "http://jabber.org/protocol/muc#owner"
+	NSConference = "jabber:x:conference"
+)
+
+// Errors returned by this package.
+var (
+	ErrNoNick = errors.New("muc: room address must contain a nickname")
+	ErrJoined = errors.New("muc: already joined to room")
+)
+
+// Status is a status code that conveys information about a room or occupant.
+type Status int
+
+// A list of commonly used status codes.
+const (
+	StatusSelf               Status = 110
+	StatusCreated            Status = 201
+	StatusNickModified       Status = 210
+	StatusBanned             Status = 301
+	StatusNickChanged        Status = 303
+	StatusKicked             Status = 307
+	StatusAffiliationRemoved Status = 321
+	StatusMembersOnly        Status = 322
+	StatusShutdown           Status = 332
+)
+
+// Affiliation is a long lived association between a user and a room.
+type Affiliation string
+
+// A list of possible affiliations.
+const (
+	AffiliationOwner   Affiliation = "owner"
+	AffiliationAdmin   Affiliation = "admin"
+	AffiliationMember  Affiliation = "member"
+	AffiliationOutcast Affiliation = "outcast"
+	AffiliationNone    Affiliation = "none"
+)
+
+// Role is a temporary position of an occupant that lasts until they leave the
+// room.
+type Role string
+
+// A list of possible roles.
+const (
+	RoleModerator   Role = "moderator"
+	RoleParticipant Role = "participant"
+	RoleVisitor     Role = "visitor"
+	RoleNone        Role = "none"
+)
+
+// Occupant is a user that is present in a room.
+type Occupant struct {
+	Nick string
+
+	// JID is the real address of the occupant.
+	// It is only known in non-anonymous rooms or if we are a moderator.
+	JID jid.JID
+
+	Affiliation Affiliation
+	Role        Role
+
+	// Show and Status are the availability and status message from the
+	// occupants presence.
+	Show   string
+	Status string
+}
+
+// Option configures how a room is joined.
+type Option func(*joinConfig)
+
+type joinConfig struct {
+	password string
+	history  []xml.Attr
+}
+
+// Password sets the password used to join a password protected room.
+func Password(password string) Option {
+	return func(c *joinConfig) {
+		c.password = password
+	}
+}
+
+func historyAttr(name, value string) Option {
+	return func(c *joinConfig) {
+		c.history = append(c.history, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+}
+
+// MaxStanzas limits the number of messages from the rooms history that are
+// sent after joining.
+// MaxStanzas(0) requests that no history be sent.
+func MaxStanzas(n int) Option {
+	return historyAttr("maxstanzas", strconv.Itoa(n))
+}
+
+// MaxChars limits the total number of characters of history that are sent
+// after joining.
+func MaxChars(n int) Option {
+	return historyAttr("maxchars", strconv.Itoa(n))
+}
+
+// HistorySince requests only messages from the rooms history that were sent
+// after t.
+func HistorySince(t time.Time) Option {
+	return historyAttr("since", t.UTC().Format(time.RFC3339))
+}
+
+// HistoryDuration requests only messages from the rooms history that were sent
+// within the provided duration.
+func HistoryDuration(d time.Duration) Option {
+	return historyAttr("seconds", strconv.Itoa(int(d/time.Second)))
+}
+
+// Invitation is an invitation to join a room.
+type Invitation struct {
+	Room     jid.JID
+	From     jid.JID
+	Reason   string
+	Password string
+
+	// Direct is true if the invitation was sent directly by the inviter (as
+	// described in XEP-0249: Direct MUC Invitations) instead of through the
+	// room.
+	Direct bool
+}
+
+// Client keeps track of joined rooms and dispatches incoming stanzas to them.
+type Client struct {
+	// HandleInvite is called when an invitation to a room is received.
+	// If nil, invitations are ignored.
+	HandleInvite func(Invitation)
+
+	mu    sync.Mutex
+	rooms map[string]*Room
+}
+
+// Handle returns an option that registers the handlers that a Client needs to
+// receive presence and messages from rooms, as well as invitations.
+func Handle(c *Client) mux.Option {
+	return func(m *mux.ServeMux) {
+		user := xml.Name{Space: NSUser, Local: "x"}
+		mux.Presence(stanza.AvailablePresence, user, c)(m)
+		mux.Presence(stanza.UnavailablePresence, user, c)(m)
+		mux.Presence(stanza.ErrorPresence, xml.Name{Local: "error"}, c)(m)
+		mux.MessageFunc(stanza.GroupChatMessage, xml.Name{Local: "body"}, c.handleBody)(m)
+		mux.MessageFunc(stanza.GroupChatMessage, xml.Name{Local: "subject"}, c.handleSubject)(m)
+		mux.MessageFunc(stanza.ChatMessage, user, c.handlePrivate)(m)
+		// Invitations are normally sent without a type attribute, which the mux
+		// does not treat as equivalent to "normal".
+		for _, typ := range []stanza.MessageType{"", stanza.NormalMessage} {
+			mux.MessageFunc(typ, user, c.handleMediatedInvite)(m)
+			mux.MessageFunc(typ, xml.Name{Space: NSConference, Local: "x"}, c.handleDirectInvite)(m)
+		}
+	}
+}
+
+// Join joins the room at the bare part of room using the resourcepart as our
+// nickname and blocks until the room confirms that we have joined or returns
+// an error.
+// If the room responds with an error it is returned as a stanza.Error.
+//
+// Because Join waits for presence from the room, it must not be called from
+// within a handler unless the session is being served with ServeConcurrent.
+func (c *Client) Join(ctx context.Context, room jid.JID, s *xmpp.Session, opt ...Option) (*Room, error) {
+	if room.Resourcepart() == "" {
+		return nil, ErrNoNick
+	}
+	cfg := joinConfig{}
+	for _, o := range opt {
+		o(&cfg)
+	}
+
+	r := newRoom(c, room, s)
+	key := room.Bare().String()
+	c.mu.Lock()
+	if _, ok := c.rooms[key]; ok {
+		c.mu.Unlock()
+		return nil, ErrJoined
+	}
+	if c.rooms == nil {
+		c.rooms = make(map[string]*Room)
+	}
+	c.rooms[key] = r
+	c.mu.Unlock()
+
+	var inner []xml.TokenReader
+	if cfg.password != "" {
+		inner = append(inner, textElement("password", cfg.password))
+	}
+	if cfg.history != nil {
+		inner = append(inner, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "history"},
+			Attr: cfg.history,
+		}))
+	}
+	err := s.Send(ctx, stanza.Presence{To: room}.Wrap(xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "x"}},
+	)))
+	if err != nil {
+		c.remove(r)
+		return nil, err
+	}
+
+	select {
+	case <-r.joined:
+	case <-ctx.Done():
+		c.remove(r)
+		return nil, ctx.Err()
+	}
+	if r.joinErr != nil {
+		return nil, r.joinErr
+	}
+	return r, nil
+}
+
+// Room returns the joined room with the provided address (the resourcepart is
+// ignored).
+func (c *Client) Room(room jid.JID) (*Room, bool) {
+	r := c.room(room)
+	return r, r != nil
+}
+
+func (c *Client) room(j jid.JID) *Room {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[j.Bare().String()]
+}
+
+func (c *Client) remove(r *Room) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := r.Addr().Bare().String()
+	if c.rooms[key] == r {
+		delete(c.rooms, key)
+	}
+}
+
+type mucItem struct {
+	Affiliation Affiliation `xml:"affiliation,attr"`
+	Role        Role        `xml:"role,attr"`
+	Nick        string      `xml:"nick,attr"`
+	JID         jid.JID     `xml:"jid,attr"`
+	Reason      string      `xml:"reason"`
+}
+
+type presenceData struct {
+	stanza.Presence
+
+	Show   string       `xml:"show"`
+	Status string       `xml:"status"`
+	Error  stanza.Error `xml:"error"`
+	User   struct {
+		Item   mucItem `xml:"item"`
+		Status []struct {
+			Code Status `xml:"code,attr"`
+		} `xml:"status"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+func (p presenceData) hasStatus(s Status) bool {
+	for _, status := range p.User.Status {
+		if status.Code == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (c *Client) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	room := c.room(p.From)
+	if room == nil {
+		return nil
+	}
+	data := presenceData{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	room.handlePresence(data)
+	return nil
+}
+
+type messageData struct {
+	stanza.Message
+
+	Body    string `xml:"body"`
+	Subject *struct {
+		Text string `xml:",chardata"`
+	} `xml:"subject"`
+	Delay struct {
+		Stamp string `xml:"stamp,attr"`
+	} `xml:"urn:xmpp:delay delay"`
+}
+
+func decodeMessage(r xml.TokenReader) (messageData, error) {
+	data := messageData{}
+	err := xml.NewTokenDecoder(r).Decode(&data)
+	return data, err
+}
+
+func (c *Client) handleBody(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	room := c.room(msg.From)
+	if room == nil {
+		return nil
+	}
+	data, err := decodeMessage(r)
+	if err != nil {
+		return err
+	}
+	m := Message{From: msg.From, Body: data.Body}
+	if data.Delay.Stamp != "" {
+		m.Delay, _ = time.Parse(time.RFC3339, data.Delay.Stamp)
+	}
+	room.emit(m)
+	return nil
+}
+
+func (c *Client) handleSubject(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	room := c.room(msg.From)
+	if room == nil {
+		return nil
+	}
+	data, err := decodeMessage(r)
+	if err != nil {
+		return err
+	}
+	// Messages with a body are not subject changes, even if they contain a
+	// subject.
+	if data.Body != "" || data.Subject == nil {
+		return nil
+	}
+	room.setSubject(msg.From, data.Subject.Text)
+	return nil
+}
+
+func (c *Client) handlePrivate(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	room := c.room(msg.From)
+	if room == nil || msg.From.Resourcepart() == "" {
+		return nil
+	}
+	data, err := decodeMessage(r)
+	if err != nil {
+		return err
+	}
+	if data.Body == "" {
+		return nil
+	}
+	room.emit(Message{From: msg.From, Body: data.Body, Private: true})
+	return nil
+}
+
+type inviteData struct {
+	stanza.Message
+
+	User *struct {
+		Invite *struct {
+			From   jid.JID `xml:"from,attr"`
+			Reason string  `xml:"reason"`
+		} `xml:"invite"`
+		Password string `xml:"password"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+	Conference *struct {
+		JID      jid.JID `xml:"jid,attr"`
+		Password string  `xml:"password,attr"`
+		Reason   string  `xml:"reason,attr"`
+	} `xml:"jabber:x:conference x"`
+}
+
+func (c *Client) handleMediatedInvite(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	if c.HandleInvite == nil {
+		return nil
+	}
+	data := inviteData{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	// If the invitation was also sent directly, handleDirectInvite reports it.
+	if data.Conference != nil || data.User == nil || data.User.Invite == nil {
+		return nil
+	}
+	c.HandleInvite(Invitation{
+		Room:     msg.From.Bare(),
+		From:     data.User.Invite.From,
+		Reason:   data.User.Invite.Reason,
+		Password: data.User.Password,
+	})
+	return nil
+}
+
+func (c *Client) handleDirectInvite(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	if c.HandleInvite == nil {
+		return nil
+	}
+	data := inviteData{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	if data.Conference == nil {
+		return nil
+	}
+	c.HandleInvite(Invitation{
+		Room:     data.Conference.JID,
+		From:     msg.From,
+		Reason:   data.Conference.Reason,
+		Password: data.Conference.Password,
+		Direct:   true,
+	})
+	return nil
+}
+
+func textElement(name, text string) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(text)),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
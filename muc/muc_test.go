@@ -0,0 +1,439 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package muc_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ mux.PresenceHandler = &muc.Client{}
+
+var roomJID = jid.MustParse("coven@chat.shakespeare.lit/thirdwitch")
+
+// element is a top level element sent by the client.
+type element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (e element) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// room acts as the multi-user chat service on the other end of a session.
+type room struct {
+	t    *testing.T
+	ctx  context.Context
+	conn net.Conn
+	recv chan element
+}
+
+func (r room) read() element {
+	r.t.Helper()
+	select {
+	case el := <-r.recv:
+		return el
+	case <-r.ctx.Done():
+		r.t.Fatalf("timed out waiting for element from client")
+	}
+	return element{}
+}
+
+func (r room) write(s string) {
+	r.t.Helper()
+	if _, err := io.WriteString(r.conn, s); err != nil {
+		r.t.Fatalf("error writing %s: %v", s, err)
+	}
+}
+
+func newRoom(ctx context.Context, t *testing.T, client *muc.Client) (room, *xmpp.Session) {
+	clientConn, serverConn := net.Pipe()
+	recv := make(chan element, 10)
+	go func() {
+		d := xml.NewDecoder(serverConn)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			el := element{}
+			if err = d.DecodeElement(&el, &start); err != nil {
+				return
+			}
+			recv <- el
+		}
+	}()
+	s := xmpptest.NewSession(0, clientConn)
+	go func() {
+		/* #nosec */
+		s.Serve(mux.New(muc.Handle(client)))
+	}()
+	return room{t: t, ctx: ctx, conn: serverConn, recv: recv}, s
+}
+
+func nextEvent(ctx context.Context, t *testing.T, r *muc.Room) muc.Event {
+	t.Helper()
+	select {
+	case e := <-r.Events():
+		return e
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for event")
+	}
+	return nil
+}
+
+func TestRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &muc.Client{}
+	remote, s := newRoom(ctx, t, client)
+	/* #nosec */
+	defer remote.conn.Close()
+
+	type joinResult struct {
+		room *muc.Room
+		err  error
+	}
+	joined := make(chan joinResult, 1)
+	go func() {
+		r, err := client.Join(ctx, roomJID, s, muc.Password("cauldronburn"), muc.MaxStanzas(2))
+		joined <- joinResult{room: r, err: err}
+	}()
+
+	el := remote.read()
+	if el.XMLName.Local != "presence" || el.attr("to") != roomJID.String() {
+		t.Fatalf("wrong join presence: %+v", el)
+	}
+	for _, want := range []string{`<password>cauldronburn</password>`, `maxstanzas="2"`, `xmlns="http://jabber.org/protocol/muc"`} {
+		if !strings.Contains(el.Inner, want) {
+			t.Errorf("join presence does not contain %s: %s", want, el.Inner)
+		}
+	}
+	remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/firstwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="owner" role="moderator"/></x></presence>`)
+	remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="owner" role="moderator" jid="hag66@shakespeare.lit/pda"/><status code="110"/><status code="201"/></x></presence>`)
+	remote.write(`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/firstwitch"><subject>Fire Burn and Cauldron Bubble!</subject></message>`)
+
+	res := <-joined
+	if res.err != nil {
+		t.Fatalf("error joining room: %v", res.err)
+	}
+	r := res.room
+	if r.Nick() != "thirdwitch" || !r.Created() {
+		t.Errorf("wrong room state: nick=%s, created=%t", r.Nick(), r.Created())
+	}
+	if got, ok := client.Room(roomJID.Bare()); !ok || got != r {
+		t.Errorf("joined room not returned by client")
+	}
+	occupants := r.Occupants()
+	if len(occupants) != 2 || occupants[0].Nick != "firstwitch" || occupants[1].JID.String() != "hag66@shakespeare.lit/pda" {
+		t.Errorf("wrong occupants: %+v", occupants)
+	}
+	if e, ok := nextEvent(ctx, t, r).(muc.OccupantJoined); !ok || e.Occupant.Nick != "firstwitch" || e.Occupant.Role != muc.RoleModerator {
+		t.Errorf("wrong first event: %+v", e)
+	}
+	if e, ok := nextEvent(ctx, t, r).(muc.OccupantJoined); !ok || e.Occupant.Nick != "thirdwitch" {
+		t.Errorf("wrong second event: %+v", e)
+	}
+	if e, ok := nextEvent(ctx, t, r).(muc.SubjectChanged); !ok || e.Subject != "Fire Burn and Cauldron Bubble!" {
+		t.Errorf("wrong subject event: %+v", e)
+	}
+	if subject := r.Subject(); subject != "Fire Burn and Cauldron Bubble!" {
+		t.Errorf("wrong subject: %s", subject)
+	}
+
+	// Messages
+	if err := r.Send(ctx, "Thrice the brinded cat hath mew'd."); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	el = remote.read()
+	if el.attr("type") != "groupchat" || el.attr("to") != "coven@chat.shakespeare.lit" || !strings.Contains(el.Inner, "Thrice the brinded cat") {
+		t.Errorf("wrong message sent: %+v", el)
+	}
+	remote.write(`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/firstwitch"><body>Thrice and once the hedge-pig whined.</body><delay xmlns="urn:xmpp:delay" stamp="2002-10-13T23:58:37Z"/></message>`)
+	if e, ok := nextEvent(ctx, t, r).(muc.Message); !ok || e.Nick() != "firstwitch" || e.Private || e.Delay.Year() != 2002 {
+		t.Errorf("wrong message event: %+v", e)
+	}
+	remote.write(`<message xmlns="jabber:client" type="chat" from="coven@chat.shakespeare.lit/firstwitch"><body>I'll give thee a wind.</body><x xmlns="http://jabber.org/protocol/muc#user"/></message>`)
+	if e, ok := nextEvent(ctx, t, r).(muc.Message); !ok || !e.Private || e.Body != "I'll give thee a wind." {
+		t.Errorf("wrong private message event: %+v", e)
+	}
+
+	// Nickname changes
+	remote.write(`<presence xmlns="jabber:client" type="unavailable" from="coven@chat.shakespeare.lit/firstwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="owner" role="moderator" nick="oldhag"/><status code="303"/></x></presence>`)
+	remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/oldhag"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="owner" role="moderator"/></x></presence>`)
+	if e, ok := nextEvent(ctx, t, r).(muc.NickChanged); !ok || e.OldNick != "firstwitch" || e.Occupant.Nick != "oldhag" {
+		t.Errorf("wrong nick change event: %+v", e)
+	}
+	if e, ok := nextEvent(ctx, t, r).(muc.OccupantChanged); !ok || e.Occupant.Nick != "oldhag" {
+		t.Errorf("wrong occupant change event: %+v", e)
+	}
+	if _, ok := r.Occupant("firstwitch"); ok {
+		t.Errorf("occupant with old nickname still in room")
+	}
+
+	// Moderation
+	kicked := make(chan error, 1)
+	go func() {
+		kicked <- r.Kick(ctx, "oldhag", "Avaunt, you cullion!")
+	}()
+	el = remote.read()
+	if el.XMLName.Local != "iq" || el.attr("type") != "set" || !strings.Contains(el.Inner, `role="none"`) || !strings.Contains(el.Inner, "<reason>Avaunt, you cullion!</reason>") {
+		t.Errorf("wrong kick request: %+v", el)
+	}
+	remote.write(`<iq xmlns="jabber:client" type="error" from="coven@chat.shakespeare.lit" id="` + el.attr("id") + `"><error type="cancel"><not-allowed xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`)
+	if err, ok := (<-kicked).(stanza.Error); !ok || err.Condition != stanza.NotAllowed {
+		t.Errorf("wrong error kicking occupant: %v", err)
+	}
+
+	// Configuration
+	configured := make(chan error, 1)
+	go func() {
+		configured <- r.CreateInstant(ctx)
+	}()
+	el = remote.read()
+	if el.attr("type") != "set" || !strings.Contains(el.Inner, `type="submit"`) {
+		t.Errorf("wrong configuration request: %+v", el)
+	}
+	remote.write(`<iq xmlns="jabber:client" type="result" from="coven@chat.shakespeare.lit" id="` + el.attr("id") + `"/>`)
+	if err := <-configured; err != nil {
+		t.Errorf("error configuring room: %v", err)
+	}
+
+	// Leaving
+	left := make(chan error, 1)
+	go func() {
+		left <- r.Leave(ctx, "gone where the goblins go")
+	}()
+	el = remote.read()
+	if el.attr("type") != "unavailable" || el.attr("to") != roomJID.String() {
+		t.Errorf("wrong leave presence: %+v", el)
+	}
+	remote.write(`<presence xmlns="jabber:client" type="unavailable" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="owner" role="none"/><status code="110"/></x></presence>`)
+	if err := <-left; err != nil {
+		t.Errorf("error leaving room: %v", err)
+	}
+	if e, ok := nextEvent(ctx, t, r).(muc.OccupantLeft); !ok || e.Occupant.Nick != "thirdwitch" {
+		t.Errorf("wrong leave event: %+v", e)
+	}
+	if _, ok := <-r.Events(); ok {
+		t.Errorf("expected events to be closed after leaving")
+	}
+	if _, ok := client.Room(roomJID); ok {
+		t.Errorf("room still returned by client after leaving")
+	}
+}
+
+func TestJoinError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &muc.Client{}
+	remote, s := newRoom(ctx, t, client)
+	/* #nosec */
+	defer remote.conn.Close()
+
+	joined := make(chan error, 1)
+	go func() {
+		_, err := client.Join(ctx, roomJID, s)
+		joined <- err
+	}()
+	remote.read()
+	remote.write(`<presence xmlns="jabber:client" type="error" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc"/><error type="cancel"><conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></presence>`)
+	if err, ok := (<-joined).(stanza.Error); !ok || err.Condition != stanza.Conflict {
+		t.Errorf("wrong error joining room: %v", err)
+	}
+	if _, ok := client.Room(roomJID); ok {
+		t.Errorf("room returned by client after failing to join")
+	}
+
+	if _, err := client.Join(ctx, roomJID.Bare(), s); err != muc.ErrNoNick {
+		t.Errorf("wrong error joining without a nickname: want=%v, got=%v", muc.ErrNoNick, err)
+	}
+}
+
+func TestJoinLargeRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &muc.Client{}
+	remote, s := newRoom(ctx, t, client)
+	/* #nosec */
+	defer remote.conn.Close()
+
+	joined := make(chan *muc.Room, 1)
+	go func() {
+		r, err := client.Join(ctx, roomJID, s)
+		if err != nil {
+			t.Errorf("error joining room: %v", err)
+		}
+		joined <- r
+	}()
+	remote.read()
+
+	// Nothing reads the events until Join returns, so more occupants than can be
+	// buffered must not block the session.
+	const occupants = 70
+	for i := 0; i < occupants; i++ {
+		remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/witch` + strconv.Itoa(i) + `"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="member" role="participant"/></x></presence>`)
+	}
+	remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="member" role="participant"/><status code="110"/></x></presence>`)
+
+	var r *muc.Room
+	select {
+	case r = <-joined:
+	case <-ctx.Done():
+		t.Fatalf("timed out joining a room with %d occupants", occupants)
+	}
+	if r == nil {
+		t.FailNow()
+	}
+	if n := len(r.Occupants()); n != occupants+1 {
+		t.Errorf("wrong number of occupants: want=%d, got=%d", occupants+1, n)
+	}
+	for i := 0; i <= occupants; i++ {
+		want := "thirdwitch"
+		if i < occupants {
+			want = "witch" + strconv.Itoa(i)
+		}
+		if e, ok := nextEvent(ctx, t, r).(muc.OccupantJoined); !ok || e.Occupant.Nick != want {
+			t.Fatalf("wrong event %d: want join of %s, got %+v", i, want, e)
+		}
+	}
+}
+
+type tokenReadEncoder struct {
+	xml.TokenReader
+	xmlstream.Encoder
+}
+
+func TestInvite(t *testing.T) {
+	var invites []muc.Invitation
+	m := mux.New(muc.Handle(&muc.Client{
+		HandleInvite: func(i muc.Invitation) {
+			invites = append(invites, i)
+		},
+	}))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" from="darkcave@chat.shakespeare.lit"><x xmlns="http://jabber.org/protocol/muc#user"><invite from="crone1@shakespeare.lit/desktop"><reason>Hey Hecate, this is the place for all good witches!</reason></invite><password>cauldronburn</password></x></message>`,
+		`<message xmlns="jabber:client" from="crone1@shakespeare.lit/desktop"><x xmlns="jabber:x:conference" jid="darkcave@chat.shakespeare.lit" password="cauldronburn"/><x xmlns="http://jabber.org/protocol/muc#user"><invite/></x></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(tokenReadEncoder{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(ioutil.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling invite: %v", err)
+		}
+	}
+
+	if len(invites) != 2 {
+		t.Fatalf("wrong number of invites: want=2, got=%d", len(invites))
+	}
+	mediated, direct := invites[0], invites[1]
+	if mediated.Direct || mediated.Room.String() != "darkcave@chat.shakespeare.lit" || mediated.From.String() != "crone1@shakespeare.lit/desktop" || mediated.Password != "cauldronburn" || mediated.Reason == "" {
+		t.Errorf("wrong mediated invitation: %+v", mediated)
+	}
+	if !direct.Direct || direct.Room.String() != "darkcave@chat.shakespeare.lit" || direct.From.String() != "crone1@shakespeare.lit/desktop" || direct.Password != "cauldronburn" {
+		t.Errorf("wrong direct invitation: %+v", direct)
+	}
+}
+
+func TestUnreadEventsDroppedAfterLeave(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &muc.Client{}
+	remote, s := newRoom(ctx, t, client)
+	/* #nosec */
+	defer remote.conn.Close()
+
+	joined := make(chan *muc.Room, 1)
+	go func() {
+		r, err := client.Join(ctx, roomJID, s)
+		if err != nil {
+			t.Errorf("error joining room: %v", err)
+		}
+		joined <- r
+	}()
+	remote.read()
+	const occupants = 70
+	for i := 0; i < occupants; i++ {
+		remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/witch` + strconv.Itoa(i) + `"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="member" role="participant"/></x></presence>`)
+	}
+	remote.write(`<presence xmlns="jabber:client" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="member" role="participant"/><status code="110"/></x></presence>`)
+	var r *muc.Room
+	select {
+	case r = <-joined:
+	case <-ctx.Done():
+		t.Fatalf("timed out joining room")
+	}
+	if r == nil {
+		t.FailNow()
+	}
+
+	// Leave without reading any events.
+	left := make(chan error, 1)
+	go func() {
+		left <- r.Leave(ctx, "")
+	}()
+	remote.read()
+	remote.write(`<presence xmlns="jabber:client" type="unavailable" from="coven@chat.shakespeare.lit/thirdwitch"><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="member" role="none"/><status code="110"/></x></presence>`)
+	if err := <-left; err != nil {
+		t.Fatalf("error leaving room: %v", err)
+	}
+
+	// The first events are still delivered in order, but the channel is closed
+	// instead of waiting forever for the rest to be read.
+	var n int
+	for {
+		var e muc.Event
+		var ok bool
+		select {
+		case e, ok = <-r.Events():
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for events to be closed after %d events", n)
+		}
+		if !ok {
+			break
+		}
+		if j, isJoin := e.(muc.OccupantJoined); !isJoin || j.Occupant.Nick != "witch"+strconv.Itoa(n) {
+			t.Errorf("wrong event %d: %+v", n, e)
+		}
+		n++
+	}
+	if n == 0 || n > occupants {
+		t.Errorf("wrong number of events after leaving: %d", n)
+	}
+}
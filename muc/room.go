@@ -0,0 +1,469 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package muc
+
+import (
+	"context"
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Room is a multi-user chat room that we have joined.
+type Room struct {
+	client *Client
+	s      *xmpp.Session
+
+	joined   chan struct{}
+	joinErr  error
+	joinOnce sync.Once
+	left     chan struct{}
+
+	mu        sync.Mutex
+	addr      jid.JID
+	created   bool
+	subject   string
+	occupants map[string]Occupant
+
+	// evMu protects the queue of events that have not yet been delivered on the
+	// events channel.
+	// Events are queued so that handling incoming stanzas never waits for the
+	// events to be read, otherwise joining a room with many occupants would
+	// block before Join could return the room.
+	evMu    sync.Mutex
+	events  chan Event
+	queue   []Event
+	sending bool
+	closed  bool
+}
+
+func newRoom(c *Client, addr jid.JID, s *xmpp.Session) *Room {
+	return &Room{
+		client:    c,
+		s:         s,
+		addr:      addr,
+		joined:    make(chan struct{}),
+		left:      make(chan struct{}),
+		occupants: make(map[string]Occupant),
+		events:    make(chan Event, eventBuffer),
+	}
+}
+
+// Addr returns the address of our occupant in the room (the rooms address with
+// our nickname as the resourcepart).
+func (r *Room) Addr() jid.JID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addr
+}
+
+// Nick returns our current nickname in the room.
+func (r *Room) Nick() string {
+	return r.Addr().Resourcepart()
+}
+
+// Created reports whether the room was created when we joined it.
+// New rooms are locked until they are configured with SetConfig or
+// CreateInstant.
+func (r *Room) Created() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.created
+}
+
+// Subject returns the current subject of the room.
+func (r *Room) Subject() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subject
+}
+
+// Occupant returns the occupant using the provided nickname.
+func (r *Room) Occupant(nick string) (Occupant, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.occupants[nick]
+	return o, ok
+}
+
+// Occupants returns all occupants of the room (including ourselves) sorted by
+// nickname.
+func (r *Room) Occupants() []Occupant {
+	r.mu.Lock()
+	occupants := make([]Occupant, 0, len(r.occupants))
+	for _, o := range r.occupants {
+		occupants = append(occupants, o)
+	}
+	r.mu.Unlock()
+	sort.Slice(occupants, func(i, j int) bool {
+		return occupants[i].Nick < occupants[j].Nick
+	})
+	return occupants
+}
+
+// eventBuffer is the number of events that can still be read from the events
+// channel after we leave the room.
+const eventBuffer = 16
+
+// Events returns a channel on which changes to the room are reported.
+// The channel is closed after we leave the room (or are removed from it).
+//
+// Events that have not been read yet are queued in memory until we leave the
+// room.
+// Once we have left, the channel is closed after at most 16 of the remaining
+// events have been read and any events after those are dropped, so a room
+// whose events are never read does not hold on to them forever.
+func (r *Room) Events() <-chan Event {
+	return r.events
+}
+
+func (r *Room) emit(e Event) {
+	r.evMu.Lock()
+	defer r.evMu.Unlock()
+	if r.closed {
+		return
+	}
+	r.queue = append(r.queue, e)
+	if !r.sending {
+		r.sending = true
+		go r.deliver()
+	}
+}
+
+// deliver sends queued events on the events channel until the queue is empty
+// or we leave the room.
+// Only one deliver goroutine runs at a time so that events are delivered in
+// order.
+func (r *Room) deliver() {
+	for {
+		r.evMu.Lock()
+		if r.closed {
+			// Keep the events that fit in the channels buffer and drop the rest.
+		flush:
+			for _, e := range r.queue {
+				select {
+				case r.events <- e:
+				default:
+					break flush
+				}
+			}
+			r.queue = nil
+			r.sending = false
+			close(r.events)
+			r.evMu.Unlock()
+			return
+		}
+		if len(r.queue) == 0 {
+			r.sending = false
+			r.evMu.Unlock()
+			return
+		}
+		e := r.queue[0]
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.evMu.Unlock()
+
+		select {
+		case r.events <- e:
+		case <-r.left:
+			r.evMu.Lock()
+			r.queue = append([]Event{e}, r.queue...)
+			r.evMu.Unlock()
+		}
+	}
+}
+
+func (r *Room) close() {
+	r.evMu.Lock()
+	defer r.evMu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.left)
+	// If events are still being delivered the channel is closed by the deliver
+	// goroutine once it stops.
+	if !r.sending {
+		close(r.events)
+	}
+}
+
+func (r *Room) finishJoin(err error) {
+	r.joinOnce.Do(func() {
+		r.joinErr = err
+		close(r.joined)
+	})
+}
+
+func (r *Room) isJoined() bool {
+	select {
+	case <-r.joined:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Room) setSubject(from jid.JID, subject string) {
+	r.mu.Lock()
+	r.subject = subject
+	r.mu.Unlock()
+	r.emit(SubjectChanged{From: from, Subject: subject})
+}
+
+func (r *Room) handlePresence(p presenceData) {
+	nick := p.From.Resourcepart()
+
+	r.mu.Lock()
+	self := p.hasStatus(StatusSelf) || nick == r.addr.Resourcepart()
+
+	if p.Type == stanza.ErrorPresence {
+		r.mu.Unlock()
+		// Errors after we have joined (for example, when changing our nickname)
+		// do not affect the rest of the room.
+		if self && !r.isJoined() {
+			r.client.remove(r)
+			r.finishJoin(p.Error)
+		}
+		return
+	}
+
+	o := Occupant{
+		Nick:        nick,
+		JID:         p.User.Item.JID,
+		Affiliation: p.User.Item.Affiliation,
+		Role:        p.User.Item.Role,
+		Show:        p.Show,
+		Status:      p.Status,
+	}
+
+	if p.Type == stanza.UnavailablePresence {
+		delete(r.occupants, nick)
+		if newNick := p.User.Item.Nick; p.hasStatus(StatusNickChanged) && newNick != "" {
+			o.Nick = newNick
+			r.occupants[newNick] = o
+			if self {
+				r.addr, _ = r.addr.WithResource(newNick)
+			}
+			r.mu.Unlock()
+			r.emit(NickChanged{Occupant: o, OldNick: nick})
+			return
+		}
+		r.mu.Unlock()
+
+		var status []Status
+		for _, s := range p.User.Status {
+			status = append(status, s.Code)
+		}
+		r.emit(OccupantLeft{Occupant: o, Reason: p.User.Item.Reason, Status: status})
+		if self {
+			r.client.remove(r)
+			r.finishJoin(stanza.Error{Condition: stanza.UndefinedCondition})
+			r.close()
+		}
+		return
+	}
+
+	_, existed := r.occupants[nick]
+	r.occupants[nick] = o
+	if self {
+		// The service may have modified our nickname.
+		r.addr, _ = r.addr.WithResource(nick)
+		if p.hasStatus(StatusCreated) {
+			r.created = true
+		}
+	}
+	r.mu.Unlock()
+
+	if existed {
+		r.emit(OccupantChanged{Occupant: o})
+	} else {
+		r.emit(OccupantJoined{Occupant: o})
+	}
+	if self {
+		r.finishJoin(nil)
+	}
+}
+
+func (r *Room) send(ctx context.Context, to jid.JID, typ stanza.MessageType, payload ...xml.TokenReader) error {
+	return r.s.Send(ctx, stanza.Message{
+		To:   to,
+		Type: typ,
+	}.Wrap(xmlstream.MultiReader(payload...)))
+}
+
+// Send sends a message to all occupants of the room.
+func (r *Room) Send(ctx context.Context, body string) error {
+	return r.send(ctx, r.Addr().Bare(), stanza.GroupChatMessage, textElement("body", body))
+}
+
+// SendPrivate sends a private message to the occupant using the provided
+// nickname.
+func (r *Room) SendPrivate(ctx context.Context, nick, body string) error {
+	to, err := r.Addr().WithResource(nick)
+	if err != nil {
+		return err
+	}
+	return r.send(ctx, to, stanza.ChatMessage,
+		textElement("body", body),
+		xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: NSUser, Local: "x"}}),
+	)
+}
+
+// SetSubject changes the subject of the room.
+func (r *Room) SetSubject(ctx context.Context, subject string) error {
+	return r.send(ctx, r.Addr().Bare(), stanza.GroupChatMessage, textElement("subject", subject))
+}
+
+// Invite asks the room to send an invitation to the provided JID.
+func (r *Room) Invite(ctx context.Context, to jid.JID, reason string) error {
+	var inner xml.TokenReader
+	if reason != "" {
+		inner = textElement("reason", reason)
+	}
+	return r.send(ctx, r.Addr().Bare(), stanza.NormalMessage, xmlstream.Wrap(
+		xmlstream.Wrap(inner, xml.StartElement{
+			Name: xml.Name{Local: "invite"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "to"}, Value: to.String()}},
+		}),
+		xml.StartElement{Name: xml.Name{Space: NSUser, Local: "x"}},
+	))
+}
+
+// SetNick requests that our nickname in the room be changed.
+// When the room confirms the change a NickChanged event is sent.
+func (r *Room) SetNick(ctx context.Context, nick string) error {
+	to, err := r.Addr().WithResource(nick)
+	if err != nil {
+		return err
+	}
+	return r.s.Send(ctx, stanza.Presence{To: to}.Wrap(nil))
+}
+
+// Leave exits the room with an optional status message and blocks until the
+// room confirms that we have left or the context is canceled.
+//
+// Because Leave waits for presence from the room, it must not be called from
+// within a handler unless the session is being served with ServeConcurrent.
+func (r *Room) Leave(ctx context.Context, status string) error {
+	var inner xml.TokenReader
+	if status != "" {
+		inner = textElement("status", status)
+	}
+	err := r.s.Send(ctx, stanza.Presence{
+		To:   r.Addr(),
+		Type: stanza.UnavailablePresence,
+	}.Wrap(inner))
+	if err != nil {
+		return err
+	}
+	select {
+	case <-r.left:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setItem sends an item to the room in a query with the provided namespace.
+func (r *Room) setItem(ctx context.Context, ns string, attrs []xml.Attr, reason string) error {
+	var inner xml.TokenReader
+	if reason != "" {
+		inner = textElement("reason", reason)
+	}
+	return r.s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(inner, xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs}),
+		xml.StartElement{Name: xml.Name{Space: ns, Local: "query"}},
+	), stanza.IQ{
+		Type: stanza.SetIQ,
+		To:   r.Addr().Bare(),
+	}, nil)
+}
+
+// SetRole changes the role of the occupant using the provided nickname.
+// Granting the participant role gives a visitor voice in a moderated room and
+// granting the visitor role revokes it.
+// If the room responds with an error it is returned as a stanza.Error.
+func (r *Room) SetRole(ctx context.Context, nick string, role Role, reason string) error {
+	return r.setItem(ctx, NSAdmin, []xml.Attr{
+		{Name: xml.Name{Local: "nick"}, Value: nick},
+		{Name: xml.Name{Local: "role"}, Value: string(role)},
+	}, reason)
+}
+
+// Kick removes the occupant using the provided nickname from the room.
+// It is the same as setting their role to RoleNone.
+func (r *Room) Kick(ctx context.Context, nick, reason string) error {
+	return r.SetRole(ctx, nick, RoleNone, reason)
+}
+
+// SetAffiliation changes the affiliation of the user with the provided bare
+// JID.
+// If the room responds with an error it is returned as a stanza.Error.
+func (r *Room) SetAffiliation(ctx context.Context, j jid.JID, affiliation Affiliation, reason string) error {
+	return r.setItem(ctx, NSAdmin, []xml.Attr{
+		{Name: xml.Name{Local: "jid"}, Value: j.Bare().String()},
+		{Name: xml.Name{Local: "affiliation"}, Value: string(affiliation)},
+	}, reason)
+}
+
+// Ban bans the user with the provided bare JID from the room.
+// It is the same as setting their affiliation to AffiliationOutcast.
+func (r *Room) Ban(ctx context.Context, j jid.JID, reason string) error {
+	return r.SetAffiliation(ctx, j, AffiliationOutcast, reason)
+}
+
+// Config requests the configuration form for the room.
+// Only owners of the room may request its configuration.
+// If the room responds with an error it is returned as a stanza.Error.
+func (r *Room) Config(ctx context.Context) (*form.Data, error) {
+	resp := struct {
+		XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#owner query"`
+		Form    form.Data `xml:"jabber:x:data x"`
+	}{}
+	err := r.s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NSOwner, Local: "query"},
+	}), stanza.IQ{
+		Type: stanza.GetIQ,
+		To:   r.Addr().Bare(),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Form, nil
+}
+
+func (r *Room) setConfig(ctx context.Context, config xml.TokenReader) error {
+	return r.s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		config,
+		xml.StartElement{Name: xml.Name{Space: NSOwner, Local: "query"}},
+	), stanza.IQ{
+		Type: stanza.SetIQ,
+		To:   r.Addr().Bare(),
+	}, nil)
+}
+
+// SetConfig submits a completed configuration form for the room.
+// If the room was just created this also unlocks it.
+// If the room responds with an error it is returned as a stanza.Error.
+func (r *Room) SetConfig(ctx context.Context, config *form.Data) error {
+	return r.setConfig(ctx, config.TokenReader())
+}
+
+// CreateInstant accepts the default configuration for a room that we just
+// created, unlocking it so that others may join.
+// If the room responds with an error it is returned as a stanza.Error.
+func (r *Room) CreateInstant(ctx context.Context) error {
+	return r.setConfig(ctx, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: form.NS, Local: "x"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "submit"}},
+	}))
+}
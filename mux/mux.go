@@ -13,10 +13,13 @@ package mux // import "mellium.im/xmpp/mux"
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/stanza"
 )
@@ -52,6 +55,7 @@ type ServeMux struct {
 	iqPatterns       map[pattern]IQHandler
 	msgPatterns      map[pattern]MessageHandler
 	presencePatterns map[pattern]PresenceHandler
+	presenceAll      map[string][]PresenceHandler
 }
 
 // New allocates and returns a new ServeMux.
@@ -209,6 +213,106 @@ func (m *ServeMux) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.StartElem
 	return h.HandleXMPP(t, start)
 }
 
+// handlers calls f for every handler registered on the mux.
+// Handlers registered for multiple patterns are visited once per pattern.
+func (m *ServeMux) handlers(f func(h interface{})) {
+	for _, h := range m.patterns {
+		f(h)
+	}
+	for _, h := range m.iqPatterns {
+		f(h)
+	}
+	for _, h := range m.msgPatterns {
+		f(h)
+	}
+	for _, h := range m.presencePatterns {
+		f(h)
+	}
+	for _, all := range m.presenceAll {
+		for _, h := range all {
+			f(h)
+		}
+	}
+}
+
+// ForFeatures implements info.FeatureIter.
+// It reports the features of every registered handler that implements
+// info.FeatureIter, sorted by name and with duplicates removed.
+func (m *ServeMux) ForFeatures(node string, f func(info.Feature) error) error {
+	seen := make(map[string]struct{})
+	var features []info.Feature
+	var err error
+	m.handlers(func(h interface{}) {
+		iter, ok := h.(info.FeatureIter)
+		if !ok || err != nil {
+			return
+		}
+		err = iter.ForFeatures(node, func(feature info.Feature) error {
+			if _, ok := seen[feature.Var]; !ok {
+				seen[feature.Var] = struct{}{}
+				features = append(features, feature)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Var < features[j].Var
+	})
+	for _, feature := range features {
+		if err = f(feature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForIdentities implements info.IdentityIter.
+// It reports the identities of every registered handler that implements
+// info.IdentityIter, sorted and with duplicates removed.
+func (m *ServeMux) ForIdentities(node string, f func(info.Identity) error) error {
+	seen := make(map[info.Identity]struct{})
+	var identities []info.Identity
+	var err error
+	m.handlers(func(h interface{}) {
+		iter, ok := h.(info.IdentityIter)
+		if !ok || err != nil {
+			return
+		}
+		err = iter.ForIdentities(node, func(ident info.Identity) error {
+			ident.XMLName = xml.Name{}
+			if _, ok := seen[ident]; !ok {
+				seen[ident] = struct{}{}
+				identities = append(identities, ident)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		a, b := identities[i], identities[j]
+		switch {
+		case a.Category != b.Category:
+			return a.Category < b.Category
+		case a.Type != b.Type:
+			return a.Type < b.Type
+		case a.Lang != b.Lang:
+			return a.Lang < b.Lang
+		}
+		return a.Name < b.Name
+	})
+	for _, ident := range identities {
+		if err = f(ident); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Option configures a ServeMux.
 type Option func(m *ServeMux)
 
@@ -276,6 +380,27 @@ func Presence(typ stanza.PresenceType, payload xml.Name, h PresenceHandler) Opti
 	}
 }
 
+// PresenceAll returns an option that passes every presence stanza of the given
+// type to h once, regardless of its payload.
+// Handlers registered with Presence are called once for each payload, and only
+// one of them may be registered for any payload, so PresenceAll is meant for
+// handlers that track all presence, such as a roster of available contacts.
+// Any number of handlers may be registered for the same type and they do not
+// stop the stanza from being passed to the handlers for its payload.
+// They are called in the order in which they were registered before the
+// handlers for the payload.
+func PresenceAll(typ stanza.PresenceType, h PresenceHandler) Option {
+	return func(m *ServeMux) {
+		if h == nil {
+			panic("mux: nil presence handler")
+		}
+		if m.presenceAll == nil {
+			m.presenceAll = make(map[string][]PresenceHandler)
+		}
+		m.presenceAll[string(typ)] = append(m.presenceAll[string(typ)], h)
+	}
+}
+
 // PresenceFunc returns an option that matches on presence stanzas.
 // For more information see Presence.
 func PresenceFunc(typ stanza.PresenceType, payload xml.Name, h PresenceHandlerFunc) Option {
@@ -366,6 +491,12 @@ func (r *bufReader) Token() (xml.Token, error) {
 	return tok, err
 }
 
+type eofReader struct{}
+
+func (eofReader) Token() (xml.Token, error) {
+	return nil, io.EOF
+}
+
 // TODO: this is terrible error handling, figure out a better way to handle
 // multiple errors that should be turned into a single stanza error.
 type multiErr []error
@@ -397,6 +528,33 @@ func (m *ServeMux) presenceRouter(t xmlstream.TokenReadEncoder, start *xml.Start
 		return err
 	}
 
+	if all := m.presenceAll[string(presence.Type)]; len(all) > 0 {
+		// Buffer the stanza so that it can be read by every handler.
+		inner, err := xmlstream.ReadAll(xmlstream.Inner(t))
+		if err != nil {
+			return err
+		}
+		toks := append(append([]xml.Token{*start}, inner...), start.End())
+		for _, h := range all {
+			err = h.HandlePresence(presence, struct {
+				xml.TokenReader
+				xmlstream.Encoder
+			}{
+				TokenReader: &bufReader{r: eofReader{}, buf: toks},
+				Encoder:     t,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		t = struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: &bufReader{r: eofReader{}, buf: toks, offset: 1},
+			Encoder:     t,
+		}
+	}
 	return forChildren(m, presence, t, start)
 }
 
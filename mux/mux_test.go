@@ -562,6 +562,113 @@ func TestFallback(t *testing.T) {
 	}
 }
 
+func TestPresenceAll(t *testing.T) {
+	var calls []string
+	record := func(name string) mux.PresenceHandlerFunc {
+		return func(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+			data := struct {
+				stanza.Presence
+				Status string `xml:"status"`
+				Nick   string `xml:"http://jabber.org/protocol/nick nick"`
+			}{}
+			if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+				return err
+			}
+			calls = append(calls, name+":"+data.Status+":"+data.Nick)
+			return nil
+		}
+	}
+	nick := xml.Name{Space: "http://jabber.org/protocol/nick", Local: "nick"}
+	const both = `<presence xmlns="jabber:client" type="subscribe"><status>Hi</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`
+
+	for i, tc := range [...]struct {
+		m    []mux.Option
+		x    string
+		want string
+		err  error
+	}{
+		0: {
+			// Handlers for every presence are called once, in order, before the
+			// handlers for each payload.
+			m: []mux.Option{
+				mux.PresenceAll(stanza.SubscribePresence, record("a")),
+				mux.Presence(stanza.SubscribePresence, nick, record("nick")),
+				mux.PresenceAll(stanza.SubscribePresence, record("b")),
+				// Registering for every presence does not collide with wildcard
+				// handlers.
+				mux.Presence(stanza.SubscribePresence, xml.Name{}, record("wildcard")),
+			},
+			x:    both,
+			want: "a:Hi:Romeo,b:Hi:Romeo,wildcard:Hi:Romeo,nick:Hi:Romeo",
+		},
+		1: {
+			// Presence without a payload is still passed to every handler.
+			m: []mux.Option{
+				mux.PresenceAll(stanza.SubscribePresence, record("a")),
+				mux.Presence(stanza.SubscribePresence, xml.Name{}, record("wildcard")),
+			},
+			x:    `<presence xmlns="jabber:client" type="subscribe"/>`,
+			want: "a::,wildcard::",
+		},
+		2: {
+			// Presence whose only payload has its own handler is still passed to the
+			// handlers for every presence.
+			m: []mux.Option{
+				mux.Presence(stanza.SubscribePresence, nick, record("nick")),
+				mux.PresenceAll(stanza.SubscribePresence, record("a")),
+			},
+			x:    `<presence xmlns="jabber:client" type="subscribe"><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`,
+			want: "a::Romeo,nick::Romeo",
+		},
+		3: {
+			// Handlers only receive presence of the type they were registered for.
+			// Unlike them, wildcard handlers are called once for each payload.
+			m: []mux.Option{
+				mux.PresenceAll(stanza.UnsubscribePresence, record("a")),
+				mux.Presence(stanza.SubscribePresence, xml.Name{}, record("wildcard")),
+			},
+			x:    both,
+			want: "wildcard:Hi:Romeo,wildcard:Hi:Romeo",
+		},
+		4: {
+			// An error stops the presence from being passed to later handlers.
+			m: []mux.Option{
+				mux.PresenceAll(stanza.SubscribePresence, record("a")),
+				mux.PresenceAll(stanza.SubscribePresence, failHandler{}),
+				mux.PresenceAll(stanza.SubscribePresence, record("b")),
+				mux.Presence(stanza.SubscribePresence, xml.Name{}, record("wildcard")),
+			},
+			x:    both,
+			want: "a:Hi:Romeo",
+			err:  failTest,
+		},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			calls = calls[:0]
+			m := mux.New(tc.m...)
+			d := xml.NewDecoder(strings.NewReader(tc.x))
+			tok, _ := d.Token()
+			start := tok.(xml.StartElement)
+			err := m.HandleXMPP(nopEncoder{TokenReader: d}, &start)
+			if err != tc.err {
+				t.Fatalf("unexpected error: want=%v, got=%v", tc.err, err)
+			}
+			if got := strings.Join(calls, ","); got != tc.want {
+				t.Errorf("wrong handler calls:\nwant=%s,\n got=%s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPresenceAllNilPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected registering a nil handler to panic")
+		}
+	}()
+	mux.New(mux.PresenceAll(stanza.SubscribePresence, nil))
+}
+
 func TestLazyServeMuxMapInitialization(t *testing.T) {
 	m := &mux.ServeMux{}
 
@@ -570,4 +677,5 @@ func TestLazyServeMuxMapInitialization(t *testing.T) {
 	mux.IQ(stanza.GetIQ, xml.Name{}, failHandler{})(m)
 	mux.Message(stanza.NormalMessage, xml.Name{}, failHandler{})(m)
 	mux.Presence(stanza.SubscribePresence, xml.Name{}, failHandler{})(m)
+	mux.PresenceAll(stanza.SubscribePresence, failHandler{})(m)
 }
@@ -11,6 +11,7 @@ import (
 	"net"
 
 	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/internal/stream"
 )
 
@@ -104,6 +105,14 @@ type StreamConfig struct {
 	// A list of stream features to attempt to negotiate.
 	Features []StreamFeature
 
+	// WebSocket causes the negotiator to frame the stream using the WebSocket
+	// subprotocol defined in RFC 7395.
+	// Instead of a stream start element an <open/> element is sent, and the
+	// stream is closed with a <close/> element.
+	// Because TLS is handled by the WebSocket connection, StartTLS is never
+	// negotiated even if it is in the features list.
+	WebSocket bool
+
 	// If set a copy of any reads from the session will be written to TeeIn and
 	// any writes to the session will be written to TeeOut (similar to the tee(1)
 	// command).
@@ -127,6 +136,15 @@ type negotiatorState struct {
 }
 
 func negotiator(cfg StreamConfig) Negotiator {
+	if cfg.WebSocket {
+		features := make([]StreamFeature, 0, len(cfg.Features))
+		for _, feature := range cfg.Features {
+			if feature.Name.Space != ns.StartTLS {
+				features = append(features, feature)
+			}
+		}
+		cfg.Features = features
+	}
 	return func(ctx context.Context, s *Session, data interface{}) (mask SessionState, rw io.ReadWriter, restartNext interface{}, err error) {
 		nState, ok := data.(negotiatorState)
 		// If no state was passed in, this is the first negotiate call so make up a
@@ -159,16 +177,16 @@ func negotiator(cfg StreamConfig) Negotiator {
 		// Loop for as long as we're not done negotiating features or a stream
 		// restart is still required.
 		if nState.doRestart {
-			if (s.state & Received) == Received {
+			if (s.State() & Received) == Received {
 				// If we're the receiving entity wait for a new stream, then send one in
 				// response.
 
-				s.in.Info, err = stream.Expect(ctx, s.in.d, s.State()&Received == Received)
+				s.in.Info, err = stream.Expect(ctx, s.in.d, s.State()&Received == Received, cfg.WebSocket)
 				if err != nil {
 					nState.doRestart = false
 					return mask, nil, nState, err
 				}
-				s.out.Info, err = stream.Send(s.Conn(), cfg.S2S, stream.DefaultVersion, cfg.Lang, s.location.String(), s.origin.String(), attr.RandomID())
+				s.out.Info, err = stream.Send(s.Conn(), cfg.S2S, cfg.WebSocket, stream.DefaultVersion, cfg.Lang, s.location.String(), s.origin.String(), attr.RandomID())
 				if err != nil {
 					nState.doRestart = false
 					return mask, nil, nState, err
@@ -176,23 +194,31 @@ func negotiator(cfg StreamConfig) Negotiator {
 			} else {
 				// If we're the initiating entity, send a new stream and then wait for
 				// one in response.
-				s.out.Info, err = stream.Send(s.Conn(), cfg.S2S, stream.DefaultVersion, cfg.Lang, s.location.String(), s.origin.String(), "")
+				s.out.Info, err = stream.Send(s.Conn(), cfg.S2S, cfg.WebSocket, stream.DefaultVersion, cfg.Lang, s.location.String(), s.origin.String(), "")
 				if err != nil {
 					nState.doRestart = false
 					return mask, nil, nState, err
 				}
-				s.in.Info, err = stream.Expect(ctx, s.in.d, s.State()&Received == Received)
+				s.in.Info, err = stream.Expect(ctx, s.in.d, s.State()&Received == Received, cfg.WebSocket)
 				if err != nil {
 					nState.doRestart = false
 					return mask, nil, nState, err
 				}
 			}
+			if cfg.WebSocket {
+				s.out.e = addXMLNS(s.out.e, s.out.Info.XMLNS())
+			}
 		}
 
 		// TODO: Check if the first token is a stream error (if so, unmarshal and
 		// return, otherwise pass the token into negotiateFeatures).
 		mask, rw, err = negotiateFeatures(ctx, s, data == nil, cfg.Features)
 		nState.doRestart = rw != nil
+		// Stream management can only be enabled once a resource has been bound, so
+		// if it was selected earlier during negotiation enable it now.
+		if err == nil && rw == nil && (s.State()|mask)&Ready == Ready && s.State()&Received == 0 {
+			err = enableSM(s)
+		}
 		return mask, rw, nState, err
 	}
 }
@@ -0,0 +1,176 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package paging implements result set management.
+//
+// Result set management (XEP-0059) lets an entity request large result sets,
+// such as the items in a disco#items response or the messages in an archive,
+// one page at a time.
+// The requesting entity includes a Request in its query and the responding
+// entity includes a Set describing the page that was returned, which can then
+// be used to request the next or previous page.
+package paging // import "mellium.im/xmpp/paging"
+
+import (
+	"encoding/xml"
+	"strconv"
+
+	"mellium.im/xmlstream"
+)
+
+// NS is the XML namespace used by result set management.
+// It is provided as a convenience.
+const NS = "http://jabber.org/protocol/rsm"
+
+// Request is a request for a single page of a result set.
+// The zero value lets the responding entity pick the page size and requests the
+// first page.
+type Request struct {
+	// Max is the maximum number of items to return.
+	// If zero, the responding entity picks a page size.
+	Max uint64
+
+	// After requests the page that follows the item with the given ID.
+	After string
+
+	// Before requests the page that precedes the item with the given ID.
+	Before string
+
+	// Last requests the last page in the result set.
+	// It has no effect if Before is set.
+	Last bool
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (r Request) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	if r.Max > 0 {
+		inner = append(inner, textElement("max", strconv.FormatUint(r.Max, 10)))
+	}
+	if r.After != "" {
+		inner = append(inner, textElement("after", r.After))
+	}
+	switch {
+	case r.Before != "":
+		inner = append(inner, textElement("before", r.Before))
+	case r.Last:
+		inner = append(inner, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "before"}}))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "set"}},
+	)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (r Request) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (r Request) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Set describes the page of a result set that was returned by the responding
+// entity.
+type Set struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+
+	// First and Last are the IDs of the first and last items in the page.
+	// They are empty if the page did not contain any items.
+	First string
+	Last  string
+
+	// FirstIndex is the position of the first item in the page within the full
+	// result set, if the responding entity reported it.
+	FirstIndex uint64
+
+	// Count is the total number of items in the result set, if the responding
+	// entity reported it.
+	Count uint64
+}
+
+// Next returns a request for the page following s with at most max items.
+func (s Set) Next(max uint64) Request {
+	return Request{Max: max, After: s.Last}
+}
+
+// Prev returns a request for the page preceding s with at most max items.
+func (s Set) Prev(max uint64) Request {
+	return Request{Max: max, Before: s.First}
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (s Set) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	if s.First != "" {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(s.First)),
+			xml.StartElement{
+				Name: xml.Name{Local: "first"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "index"}, Value: strconv.FormatUint(s.FirstIndex, 10)}},
+			},
+		))
+	}
+	if s.Last != "" {
+		inner = append(inner, textElement("last", s.Last))
+	}
+	if s.Count > 0 {
+		inner = append(inner, textElement("count", strconv.FormatUint(s.Count, 10)))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "set"}},
+	)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (s Set) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (s Set) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// UnmarshalXML satisfies the xml.Unmarshaler interface.
+func (s *Set) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	data := struct {
+		First struct {
+			Index uint64 `xml:"index,attr"`
+			ID    string `xml:",chardata"`
+		} `xml:"first"`
+		Last  string `xml:"last"`
+		Count uint64 `xml:"count"`
+	}{}
+	err := d.DecodeElement(&data, &start)
+	if err != nil {
+		return err
+	}
+	s.XMLName = start.Name
+	s.First = data.First.ID
+	s.FirstIndex = data.First.Index
+	s.Last = data.Last
+	s.Count = data.Count
+	return nil
+}
+
+func textElement(name, text string) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(text)),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
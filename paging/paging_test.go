@@ -0,0 +1,94 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package paging_test
+
+import (
+	"encoding/xml"
+	"strconv"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/paging"
+)
+
+var (
+	_ xml.Marshaler       = paging.Request{}
+	_ xmlstream.Marshaler = paging.Request{}
+	_ xmlstream.WriterTo  = paging.Request{}
+	_ xml.Marshaler       = paging.Set{}
+	_ xml.Unmarshaler     = (*paging.Set)(nil)
+	_ xmlstream.Marshaler = paging.Set{}
+	_ xmlstream.WriterTo  = paging.Set{}
+)
+
+var requestTests = [...]struct {
+	req paging.Request
+	out string
+}{
+	0: {out: `<set xmlns="http://jabber.org/protocol/rsm"></set>`},
+	1: {
+		req: paging.Request{Max: 10},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><max>10</max></set>`,
+	},
+	2: {
+		req: paging.Request{Max: 10, After: "09af3-cc343-b409f"},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><max>10</max><after>09af3-cc343-b409f</after></set>`,
+	},
+	3: {
+		req: paging.Request{Before: "peterpan@neverland.lit", Last: true},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><before>peterpan@neverland.lit</before></set>`,
+	},
+	4: {
+		req: paging.Request{Max: 10, Last: true},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><max>10</max><before></before></set>`,
+	},
+}
+
+func TestMarshalRequest(t *testing.T) {
+	for i, tc := range requestTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out, err := xml.Marshal(tc.req)
+			if err != nil {
+				t.Fatalf("error marshaling request: %v", err)
+			}
+			if s := string(out); s != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, s)
+			}
+		})
+	}
+}
+
+func TestRoundTripSet(t *testing.T) {
+	set := paging.Set{
+		First:      "stpeter@jabber.org",
+		FirstIndex: 20,
+		Last:       "peterpan@neverland.lit",
+		Count:      800,
+	}
+	out, err := xml.Marshal(set)
+	if err != nil {
+		t.Fatalf("error marshaling set: %v", err)
+	}
+	const want = `<set xmlns="http://jabber.org/protocol/rsm"><first index="20">stpeter@jabber.org</first><last>peterpan@neverland.lit</last><count>800</count></set>`
+	if s := string(out); s != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, s)
+	}
+
+	var got paging.Set
+	if err = xml.Unmarshal(out, &got); err != nil {
+		t.Fatalf("error unmarshaling set: %v", err)
+	}
+	got.XMLName = xml.Name{}
+	if got != set {
+		t.Errorf("wrong set after round trip: want=%+v, got=%+v", set, got)
+	}
+
+	if next := got.Next(10); next != (paging.Request{Max: 10, After: set.Last}) {
+		t.Errorf("wrong next page request: %+v", next)
+	}
+	if prev := got.Prev(10); prev != (paging.Request{Max: 10, Before: set.First}) {
+		t.Errorf("wrong previous page request: %+v", prev)
+	}
+}
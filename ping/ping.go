@@ -11,6 +11,7 @@ import (
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
@@ -37,6 +38,14 @@ func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml
 	return err
 }
 
+// ForFeatures implements info.FeatureIter.
+func (h Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
 // Send sends a ping to the provided JID and blocks until a response is
 // received.
 // Pings sent to other clients should use the full JID, otherwise they will be
@@ -51,11 +60,7 @@ func Send(ctx context.Context, s *xmpp.Session, to jid.JID) error {
 		Type: stanza.GetIQ,
 		To:   to,
 	}}
-	resp, err := s.SendIQ(ctx, iq.TokenReader())
-	if resp != nil {
-		defer resp.Close()
-	}
-
+	err := s.UnmarshalIQ(ctx, iq.TokenReader(), nil)
 	if stanzaErr, ok := err.(stanza.Error); ok {
 		// If the ping namespace isn't supported and we get back
 		// service-unavailable, treat this as if the ping succeeded (because the
@@ -0,0 +1,290 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package presence tracks the availability of contacts and handles presence
+// subscriptions.
+//
+// A Tracker keeps track of the available resources of each contact along with
+// their show, status, and priority and reports changes as events.
+// The resource that messages sent to the contact's bare JID would most likely
+// be delivered to is reported as the best resource.
+//
+//	tracker := &presence.Tracker{
+//		Changed: func(e presence.Event) {
+//			log.Printf("%v is now %q", e.Best.JID, e.Best.Show)
+//		},
+//	}
+//	subs := &presence.Subscriptions{Policy: presence.AutoApprove}
+//	m := mux.New(presence.Handle(tracker), presence.HandleSubscriptions(subs))
+//	go session.Serve(m)
+//
+// Subscriptions answers requests from other entities to subscribe to our
+// presence according to a policy and lets subscriptions be approved before
+// they are requested.
+package presence // import "mellium.im/xmpp/presence"
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Show is the availability of an available resource.
+type Show string
+
+// A list of possible show values.
+// Resources that do not set a more specific value are Online.
+const (
+	Online Show = ""
+	Chat   Show = "chat"
+	Away   Show = "away"
+	XA     Show = "xa"
+	DND    Show = "dnd"
+)
+
+// rank orders show values from most to least available.
+func (s Show) rank() int {
+	switch s {
+	case Chat:
+		return 0
+	case Away:
+		return 2
+	case XA:
+		return 3
+	case DND:
+		return 4
+	}
+	return 1
+}
+
+// Resource is the presence of one available resource of a contact.
+type Resource struct {
+	JID      jid.JID
+	Show     Show
+	Status   string
+	Priority int8
+}
+
+func (r Resource) equal(other Resource) bool {
+	return r.JID.Equal(other.JID) &&
+		r.Show == other.Show &&
+		r.Status == other.Status &&
+		r.Priority == other.Priority
+}
+
+// Event is a change in the presence of one of a contact's resources.
+type Event struct {
+	// Resource is the resource whose presence changed.
+	// If it became unavailable only the JID is set.
+	Resource    Resource
+	Unavailable bool
+
+	// Best is the best available resource of the contact after the change (see
+	// Tracker.Best).
+	// If the contact has no available resources with a non-negative priority it
+	// is the zero value.
+	Best Resource
+}
+
+type resource struct {
+	Resource
+	seq uint64
+}
+
+// less reports whether a is more likely to receive messages sent to the bare
+// JID than b.
+// Resources with a higher priority come first, followed by those that are more
+// available and then by those that changed their presence most recently.
+func less(a, b resource) bool {
+	switch {
+	case a.Priority != b.Priority:
+		return a.Priority > b.Priority
+	case a.Show.rank() != b.Show.rank():
+		return a.Show.rank() < b.Show.rank()
+	}
+	return a.seq > b.seq
+}
+
+// Handle returns an option that registers a Tracker for available and
+// unavailable presence.
+// The tracker receives every such presence once, so it can be registered on
+// the same mux as other presence handlers such as the one in the caps package.
+func Handle(t *Tracker) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.PresenceAll(stanza.AvailablePresence, t)(m)
+		mux.PresenceAll(stanza.UnavailablePresence, t)(m)
+	}
+}
+
+// Tracker keeps track of the available resources of contacts.
+// Presence from the occupants of multi-user chat rooms is ignored.
+// The zero value is ready to use.
+type Tracker struct {
+	// Changed is called for each change to the presence of a resource.
+	Changed func(Event)
+
+	mu       sync.Mutex
+	seq      uint64
+	contacts map[string]map[string]resource
+}
+
+// Resources returns the available resources of the contact with the bare JID
+// of j, with the best resource first.
+func (t *Tracker) Resources(j jid.JID) []Resource {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resources(j.Bare().String())
+}
+
+func (t *Tracker) resources(bare string) []Resource {
+	sorted := make([]resource, 0, len(t.contacts[bare]))
+	for _, res := range t.contacts[bare] {
+		sorted = append(sorted, res)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	resources := make([]Resource, 0, len(sorted))
+	for _, res := range sorted {
+		resources = append(resources, res.Resource)
+	}
+	return resources
+}
+
+// Best returns the best available resource of the contact with the bare JID of
+// j.
+// Resources with a negative priority never receive messages sent to the bare
+// JID (RFC 6121 §4.7.2.3) so they are never the best resource.
+// If the contact has no available resources with a non-negative priority, ok
+// is false.
+func (t *Tracker) Best(j jid.JID) (res Resource, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.best(j.Bare().String())
+}
+
+func (t *Tracker) best(bare string) (Resource, bool) {
+	var best resource
+	var ok bool
+	for _, res := range t.contacts[bare] {
+		if res.Priority < 0 {
+			continue
+		}
+		if !ok || less(res, best) {
+			best, ok = res, true
+		}
+	}
+	return best.Resource, ok
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (t *Tracker) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	if p.From.Equal(jid.JID{}) {
+		return nil
+	}
+	data := struct {
+		stanza.Presence
+		Show     Show      `xml:"show"`
+		Status   string    `xml:"status"`
+		Priority string    `xml:"priority"`
+		MUC      *struct{} `xml:"http://jabber.org/protocol/muc#user x"`
+	}{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	if data.MUC != nil {
+		return nil
+	}
+
+	var events []Event
+	if p.Type == stanza.UnavailablePresence {
+		events = t.remove(p.From)
+	} else {
+		show := data.Show
+		switch show {
+		case Chat, Away, XA, DND:
+		default:
+			show = Online
+		}
+		// Invalid priorities are treated as the default priority of zero.
+		priority, _ := strconv.ParseInt(data.Priority, 10, 8)
+		events = t.update(Resource{
+			JID:      p.From,
+			Show:     show,
+			Status:   data.Status,
+			Priority: int8(priority),
+		})
+	}
+	if t.Changed != nil {
+		for _, e := range events {
+			t.Changed(e)
+		}
+	}
+	return nil
+}
+
+// update records the presence of an available resource.
+// An update that does not change anything is ignored.
+func (t *Tracker) update(res Resource) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bare := res.JID.Bare().String()
+	resources := t.contacts[bare]
+	if old, ok := resources[res.JID.Resourcepart()]; ok && old.equal(res) {
+		return nil
+	}
+
+	if t.contacts == nil {
+		t.contacts = make(map[string]map[string]resource)
+	}
+	if resources == nil {
+		resources = make(map[string]resource)
+		t.contacts[bare] = resources
+	}
+	t.seq++
+	resources[res.JID.Resourcepart()] = resource{Resource: res, seq: t.seq}
+	best, _ := t.best(bare)
+	return []Event{{Resource: res, Best: best}}
+}
+
+// remove forgets an unavailable resource.
+// If the presence came from the bare JID, all of the contact's resources are
+// unavailable.
+func (t *Tracker) remove(j jid.JID) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bare := j.Bare().String()
+	resources := t.contacts[bare]
+
+	var removed []jid.JID
+	if j.Resourcepart() == "" {
+		for _, res := range t.resources(bare) {
+			removed = append(removed, res.JID)
+		}
+		delete(t.contacts, bare)
+	} else if res, ok := resources[j.Resourcepart()]; ok {
+		removed = append(removed, res.JID)
+		delete(resources, j.Resourcepart())
+		if len(resources) == 0 {
+			delete(t.contacts, bare)
+		}
+	}
+
+	best, _ := t.best(bare)
+	events := make([]Event, 0, len(removed))
+	for _, j := range removed {
+		events = append(events, Event{
+			Resource:    Resource{JID: j},
+			Unavailable: true,
+			Best:        best,
+		})
+	}
+	return events
+}
@@ -0,0 +1,375 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/caps"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ mux.PresenceHandler = &presence.Tracker{}
+	_ mux.PresenceHandler = &presence.Subscriptions{}
+)
+
+// handle passes a stanza to the mux and returns anything that is written in
+// response.
+func handle(t *testing.T, m *mux.ServeMux, in string) string {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(in))
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("unexpected error popping start token: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("unexpected error in handler: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error flushing encoder: %v", err)
+	}
+	return b.String()
+}
+
+var (
+	romeo   = jid.MustParse("romeo@example.net")
+	orchard = jid.MustParse("romeo@example.net/orchard")
+	balcony = jid.MustParse("romeo@example.net/balcony")
+	phone   = jid.MustParse("romeo@example.net/phone")
+)
+
+var trackerTestCases = [...]struct {
+	in     string
+	events []presence.Event
+	best   presence.Resource
+}{
+	0: {
+		in: `<presence xmlns="jabber:client" from="romeo@example.net/orchard"><show>away</show><priority>1</priority></presence>`,
+		events: []presence.Event{{
+			Resource: presence.Resource{JID: orchard, Show: presence.Away, Priority: 1},
+			Best:     presence.Resource{JID: orchard, Show: presence.Away, Priority: 1},
+		}},
+		best: presence.Resource{JID: orchard, Show: presence.Away, Priority: 1},
+	},
+	1: {
+		in: `<presence xmlns="jabber:client" from="romeo@example.net/balcony"><show>chat</show><status>Wherefore art thou?</status><priority>1</priority></presence>`,
+		events: []presence.Event{{
+			Resource: presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+			Best:     presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+		}},
+		best: presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+	},
+	2: {
+		// Presence that does not change anything does not result in an event.
+		in:   `<presence xmlns="jabber:client" from="romeo@example.net/balcony"><show>chat</show><status>Wherefore art thou?</status><priority>1</priority></presence>`,
+		best: presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+	},
+	3: {
+		in: `<presence xmlns="jabber:client" from="romeo@example.net/phone"><show>bogus</show><priority>5</priority></presence>`,
+		events: []presence.Event{{
+			Resource: presence.Resource{JID: phone, Priority: 5},
+			Best:     presence.Resource{JID: phone, Priority: 5},
+		}},
+		best: presence.Resource{JID: phone, Priority: 5},
+	},
+	4: {
+		// Presence from multi-user chat occupants is ignored.
+		in:   `<presence xmlns="jabber:client" from="romeo@example.net/room"><priority>10</priority><x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="none" role="participant"/></x></presence>`,
+		best: presence.Resource{JID: phone, Priority: 5},
+	},
+	5: {
+		in: `<presence xmlns="jabber:client" type="unavailable" from="romeo@example.net/phone"/>`,
+		events: []presence.Event{{
+			Resource:    presence.Resource{JID: phone},
+			Unavailable: true,
+			Best:        presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+		}},
+		best: presence.Resource{JID: balcony, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+	},
+	6: {
+		// The most recent resource wins if the priority and show are the same.
+		in: `<presence xmlns="jabber:client" from="romeo@example.net/orchard"><show>chat</show><status>Wherefore art thou?</status><priority>1</priority></presence>`,
+		events: []presence.Event{{
+			Resource: presence.Resource{JID: orchard, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+			Best:     presence.Resource{JID: orchard, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+		}},
+		best: presence.Resource{JID: orchard, Show: presence.Chat, Status: "Wherefore art thou?", Priority: 1},
+	},
+	7: {
+		// Unavailable presence from the bare JID means all resources are offline.
+		in: `<presence xmlns="jabber:client" type="unavailable" from="romeo@example.net"/>`,
+		events: []presence.Event{{
+			Resource:    presence.Resource{JID: orchard},
+			Unavailable: true,
+		}, {
+			Resource:    presence.Resource{JID: balcony},
+			Unavailable: true,
+		}},
+	},
+}
+
+func TestTracker(t *testing.T) {
+	var events []presence.Event
+	tracker := &presence.Tracker{
+		Changed: func(e presence.Event) {
+			events = append(events, e)
+		},
+	}
+	m := mux.New(presence.Handle(tracker))
+	// The test cases share a tracker and build on one another.
+	for i, tc := range trackerTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			events = nil
+			out := handle(t, m, tc.in)
+			if out != "" {
+				t.Errorf("unexpected output: %s", out)
+			}
+			if !reflect.DeepEqual(events, tc.events) {
+				t.Errorf("wrong events:\nwant=%+v,\n got=%+v", tc.events, events)
+			}
+			best, _ := tracker.Best(romeo)
+			if !reflect.DeepEqual(best, tc.best) {
+				t.Errorf("wrong best resource: want=%+v, got=%+v", tc.best, best)
+			}
+		})
+	}
+	if res, ok := tracker.Best(romeo); ok {
+		t.Errorf("expected no available resources, got %+v", res)
+	}
+}
+
+func TestResources(t *testing.T) {
+	tracker := &presence.Tracker{}
+	m := mux.New(presence.Handle(tracker))
+	for _, in := range []string{
+		`<presence xmlns="jabber:client" from="romeo@example.net/orchard"><show>dnd</show></presence>`,
+		`<presence xmlns="jabber:client" from="romeo@example.net/balcony"><priority>-1</priority></presence>`,
+		`<presence xmlns="jabber:client" from="romeo@example.net/phone"><show>xa</show></presence>`,
+	} {
+		handle(t, m, in)
+	}
+	want := []presence.Resource{
+		{JID: phone, Show: presence.XA},
+		{JID: orchard, Show: presence.DND},
+		{JID: balcony, Priority: -1},
+	}
+	if resources := tracker.Resources(balcony); !reflect.DeepEqual(resources, want) {
+		t.Errorf("wrong resources:\nwant=%+v,\n got=%+v", want, resources)
+	}
+}
+
+func TestBestNegativePriority(t *testing.T) {
+	tracker := &presence.Tracker{}
+	m := mux.New(presence.Handle(tracker))
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/balcony"><show>chat</show><priority>-1</priority></presence>`)
+	if res, ok := tracker.Best(romeo); ok || !reflect.DeepEqual(res, presence.Resource{}) {
+		t.Errorf("resource with a negative priority returned as best: %+v", res)
+	}
+
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/phone"><show>xa</show></presence>`)
+	want := presence.Resource{JID: phone, Show: presence.XA}
+	if res, ok := tracker.Best(romeo); !ok || !reflect.DeepEqual(res, want) {
+		t.Errorf("wrong best resource: want=%+v, got=%+v", want, res)
+	}
+}
+
+func TestHandleWithCaps(t *testing.T) {
+	var events []presence.Event
+	tracker := &presence.Tracker{
+		Changed: func(e presence.Event) {
+			events = append(events, e)
+		},
+	}
+	// Both handlers are registered for unavailable presence with any payload.
+	m := mux.New(caps.Handle(&caps.Handler{}), presence.Handle(tracker))
+
+	// Presence that is handled by another handler is still tracked.
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/orchard"><show>away</show><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://example.net" ver="QgayPKawpkPSDYmwT/WM94uAlu0="/></presence>`)
+	handle(t, m, `<presence xmlns="jabber:client" type="unavailable" from="romeo@example.net/orchard"><status>Adieu</status></presence>`)
+	want := []presence.Event{{
+		Resource: presence.Resource{JID: orchard, Show: presence.Away},
+		Best:     presence.Resource{JID: orchard, Show: presence.Away},
+	}, {
+		Resource:    presence.Resource{JID: orchard},
+		Unavailable: true,
+	}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("wrong events:\nwant=%+v,\n got=%+v", want, events)
+	}
+}
+
+var subscribeTestCases = [...]struct {
+	policy  presence.Policy
+	in      string
+	out     string
+	pending []presence.Request
+}{
+	0: {
+		in: `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"/>`,
+		pending: []presence.Request{{
+			From: romeo,
+		}},
+	},
+	1: {
+		policy: presence.AutoApprove,
+		in:     `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"/>`,
+		out:    `<presence to="romeo@example.net" type="subscribed"></presence>`,
+	},
+	2: {
+		policy: presence.AutoDeny,
+		in:     `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"><status>It is my lady!</status></presence>`,
+		out:    `<presence to="romeo@example.net" type="unsubscribed"></presence>`,
+	},
+	3: {
+		policy: func(req presence.Request) presence.Decision {
+			if req.Status == "It is my lady!" {
+				return presence.Approved
+			}
+			return presence.Pending
+		},
+		in: `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"><status>O, it is my love!</status></presence>`,
+		pending: []presence.Request{{
+			From:   romeo,
+			Status: "O, it is my love!",
+		}},
+	},
+	4: {
+		policy: presence.AutoApprove,
+		in:     `<presence xmlns="jabber:client" type="subscribed" from="romeo@example.net"/>`,
+	},
+	5: {
+		// Requests with several payloads are only answered once.
+		policy: presence.AutoApprove,
+		in:     `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"><status>Wherefore art thou?</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`,
+		out:    `<presence to="romeo@example.net" type="subscribed"></presence>`,
+	},
+}
+
+func TestSubscribe(t *testing.T) {
+	for i, tc := range subscribeTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			h := &presence.Subscriptions{Policy: tc.policy}
+			out := handle(t, mux.New(presence.HandleSubscriptions(h)), tc.in)
+			if out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+			if pending := h.Pending(); !reflect.DeepEqual(pending, tc.pending) && (len(pending) > 0 || len(tc.pending) > 0) {
+				t.Errorf("wrong pending requests:\nwant=%+v,\n got=%+v", tc.pending, pending)
+			}
+		})
+	}
+}
+
+func TestAsk(t *testing.T) {
+	var asked []presence.Request
+	h := &presence.Subscriptions{
+		Policy: presence.Ask(func(req presence.Request) {
+			asked = append(asked, req)
+		}),
+	}
+	var changed []stanza.PresenceType
+	h.Changed = func(from jid.JID, typ stanza.PresenceType) {
+		if !from.Equal(romeo) {
+			t.Errorf("wrong JID: want=%v, got=%v", romeo, from)
+		}
+		changed = append(changed, typ)
+	}
+	m := mux.New(presence.HandleSubscriptions(h))
+
+	// The user is asked once for a request with several payloads.
+	out := handle(t, m, `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"><status>Wherefore art thou?</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`)
+	if out != "" {
+		t.Errorf("unexpected output: %s", out)
+	}
+	want := []presence.Request{{From: romeo, Status: "Wherefore art thou?"}}
+	if !reflect.DeepEqual(asked, want) {
+		t.Errorf("wrong requests asked:\nwant=%+v,\n got=%+v", want, asked)
+	}
+	if pending := h.Pending(); !reflect.DeepEqual(pending, want) {
+		t.Errorf("wrong pending requests:\nwant=%+v,\n got=%+v", want, pending)
+	}
+
+	// Answering the request removes it and sends the answer.
+	var buf bytes.Buffer
+	s := xmpptest.NewSession(0, &buf)
+	err := h.Approve(context.Background(), s, orchard)
+	if err != nil {
+		t.Fatalf("error approving request: %v", err)
+	}
+	const approval = `<presence to="romeo@example.net" type="subscribed"></presence>`
+	if out := buf.String(); out != approval {
+		t.Errorf("wrong approval: want=%s, got=%s", approval, out)
+	}
+	if pending := h.Pending(); len(pending) != 0 {
+		t.Errorf("expected no pending requests after approval, got %+v", pending)
+	}
+
+	// Requests that are canceled are no longer pending.
+	handle(t, m, `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"/>`)
+	handle(t, m, `<presence xmlns="jabber:client" type="unsubscribe" from="romeo@example.net/orchard"><status>Farewell</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`)
+	if pending := h.Pending(); len(pending) != 0 {
+		t.Errorf("expected no pending requests after cancellation, got %+v", pending)
+	}
+	if len(asked) != 2 {
+		t.Errorf("expected to be asked about the second request")
+	}
+	if want := []stanza.PresenceType{stanza.UnsubscribePresence}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("wrong changes: want=%v, got=%v", want, changed)
+	}
+}
+
+func TestPreApprove(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewSession(0, &buf)
+	h := &presence.Subscriptions{Policy: presence.AutoDeny}
+
+	// The server does not support pre-approval so nothing is sent until the
+	// request is received.
+	err := h.PreApprove(context.Background(), s, orchard)
+	if err != nil {
+		t.Fatalf("error pre-approving subscription: %v", err)
+	}
+	if out := buf.String(); out != "" {
+		t.Errorf("unexpected output: %s", out)
+	}
+	m := mux.New(presence.HandleSubscriptions(h))
+	// The request is only answered once even though it has several payloads.
+	const approval = `<presence to="romeo@example.net" type="subscribed"></presence>`
+	out := handle(t, m, `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/balcony"><status>Wherefore art thou?</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`)
+	if out != approval {
+		t.Errorf("wrong output: want=%s, got=%s", approval, out)
+	}
+
+	// Pre-approvals are only used once.
+	const denial = `<presence to="romeo@example.net" type="unsubscribed"></presence>`
+	out = handle(t, m, `<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/balcony"/>`)
+	if out != denial {
+		t.Errorf("wrong output: want=%s, got=%s", denial, out)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence
+
+import (
+	"context"
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSPreApproval is the namespace of the stream feature advertised by servers
+// that support subscription pre-approval.
+const NSPreApproval = "urn:xmpp:features:pre-approval"
+
+// Request is a request from another entity to subscribe to our presence.
+type Request struct {
+	// From is the bare JID of the entity that sent the request.
+	From jid.JID
+
+	// Status is an optional message sent with the request.
+	Status string
+}
+
+// Decision is the answer to a subscription request.
+type Decision uint8
+
+// A list of possible decisions.
+const (
+	// Pending leaves the request unanswered so that it can be answered later
+	// with Approve or Deny.
+	Pending Decision = iota
+
+	// Approved lets the entity receive our presence.
+	Approved
+
+	// Denied refuses the request.
+	Denied
+)
+
+// Policy decides how to answer a subscription request.
+// Policies are called from the handler and should not block.
+type Policy func(Request) Decision
+
+var (
+	// AutoApprove approves every subscription request.
+	AutoApprove Policy = func(Request) Decision {
+		return Approved
+	}
+
+	// AutoDeny denies every subscription request.
+	AutoDeny Policy = func(Request) Decision {
+		return Denied
+	}
+)
+
+// Ask returns a policy that leaves requests pending and calls f with each new
+// request, for example to ask the user whether to approve it.
+// The request can then be answered with the Subscriptions Approve or Deny
+// methods.
+func Ask(f func(Request)) Policy {
+	return func(req Request) Decision {
+		f(req)
+		return Pending
+	}
+}
+
+// HandleSubscriptions returns an option that registers a Subscriptions handler
+// for presence subscription stanzas.
+// The handler receives each subscription stanza once, regardless of its
+// payload.
+func HandleSubscriptions(h *Subscriptions) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.PresenceAll(stanza.SubscribePresence, h)(m)
+		mux.PresenceAll(stanza.SubscribedPresence, h)(m)
+		mux.PresenceAll(stanza.UnsubscribePresence, h)(m)
+		mux.PresenceAll(stanza.UnsubscribedPresence, h)(m)
+	}
+}
+
+// Subscriptions answers subscription requests and reports changes to the
+// subscriptions of contacts.
+// The zero value is ready to use and leaves all requests pending.
+type Subscriptions struct {
+	// Policy decides how to answer requests that have not been pre-approved.
+	// If nil, requests are left pending.
+	Policy Policy
+
+	// Changed is called when a contact approves (subscribed), denies or revokes
+	// (unsubscribed) our subscription to its presence, or cancels its
+	// subscription to our presence (unsubscribe).
+	Changed func(from jid.JID, typ stanza.PresenceType)
+
+	mu          sync.Mutex
+	pending     map[string]Request
+	preApproved map[string]struct{}
+}
+
+// Pending returns the requests that are waiting for an answer sorted by JID.
+func (h *Subscriptions) Pending() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	reqs := make([]Request, 0, len(h.pending))
+	for _, req := range h.pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].From.String() < reqs[j].From.String()
+	})
+	return reqs
+}
+
+// Approve approves a subscription request from the bare JID of j.
+func (h *Subscriptions) Approve(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	j = j.Bare()
+	h.mu.Lock()
+	delete(h.pending, j.String())
+	h.mu.Unlock()
+	return send(ctx, s, j, stanza.SubscribedPresence)
+}
+
+// Deny denies a subscription request from the bare JID of j.
+// It can also be used to revoke a subscription that was approved earlier.
+func (h *Subscriptions) Deny(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	j = j.Bare()
+	h.mu.Lock()
+	delete(h.pending, j.String())
+	h.mu.Unlock()
+	return send(ctx, s, j, stanza.UnsubscribedPresence)
+}
+
+// PreApprove approves a subscription request from the bare JID of j before it
+// is received.
+// If a request from j is already pending it is approved.
+//
+// If the server advertised support for pre-approval during stream negotiation
+// the approval is sent to the server, which then approves the request on our
+// behalf.
+// Otherwise it is remembered by the handler and the request is approved when it
+// is received, regardless of the policy.
+func (h *Subscriptions) PreApprove(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	j = j.Bare()
+	key := j.String()
+	h.mu.Lock()
+	_, pending := h.pending[key]
+	if _, ok := s.Feature(NSPreApproval); !ok && !pending {
+		if h.preApproved == nil {
+			h.preApproved = make(map[string]struct{})
+		}
+		h.preApproved[key] = struct{}{}
+		h.mu.Unlock()
+		return nil
+	}
+	delete(h.pending, key)
+	h.mu.Unlock()
+	return send(ctx, s, j, stanza.SubscribedPresence)
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (h *Subscriptions) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	from := p.From.Bare()
+	if from.Equal(jid.JID{}) {
+		return nil
+	}
+	if p.Type != stanza.SubscribePresence {
+		key := from.String()
+		h.mu.Lock()
+		if p.Type == stanza.UnsubscribePresence {
+			delete(h.pending, key)
+			delete(h.preApproved, key)
+		}
+		h.mu.Unlock()
+		if h.Changed != nil {
+			h.Changed(from, p.Type)
+		}
+		return nil
+	}
+
+	data := struct {
+		stanza.Presence
+		Status string `xml:"status"`
+	}{}
+	if err := xml.NewTokenDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	req := Request{From: from, Status: data.Status}
+	decision := h.decide(req)
+	if decision == Pending {
+		return nil
+	}
+	typ := stanza.SubscribedPresence
+	if decision == Denied {
+		typ = stanza.UnsubscribedPresence
+	}
+	_, err := xmlstream.Copy(r, stanza.Presence{To: from, Type: typ}.Wrap(nil))
+	return err
+}
+
+// decide records the request as pending while the policy is consulted so that
+// a policy that asks the user can also answer immediately.
+// A request that is already pending is not passed to the policy again.
+func (h *Subscriptions) decide(req Request) Decision {
+	key := req.From.String()
+	h.mu.Lock()
+	if _, ok := h.preApproved[key]; ok {
+		delete(h.preApproved, key)
+		h.mu.Unlock()
+		return Approved
+	}
+	if _, ok := h.pending[key]; ok {
+		h.mu.Unlock()
+		return Pending
+	}
+	if h.pending == nil {
+		h.pending = make(map[string]Request)
+	}
+	h.pending[key] = req
+	h.mu.Unlock()
+
+	decision := Pending
+	if h.Policy != nil {
+		decision = h.Policy(req)
+	}
+	if decision != Pending {
+		h.mu.Lock()
+		delete(h.pending, key)
+		h.mu.Unlock()
+	}
+	return decision
+}
+
+// Subscribe requests a subscription to the presence of the bare JID of j.
+func Subscribe(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return send(ctx, s, j.Bare(), stanza.SubscribePresence)
+}
+
+// Unsubscribe cancels our subscription to the presence of the bare JID of j.
+func Unsubscribe(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return send(ctx, s, j.Bare(), stanza.UnsubscribePresence)
+}
+
+func send(ctx context.Context, s *xmpp.Session, to jid.JID, typ stanza.PresenceType) error {
+	return s.Send(ctx, stanza.Presence{To: to, Type: typ}.Wrap(nil))
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Event is a notification that a node changed.
+type Event struct {
+	// From is the pubsub service, or for PEP the account, that sent the event.
+	From jid.JID
+
+	// Node is the node that changed.
+	Node string
+
+	// Items contains items that were published to the node.
+	Items []Item
+
+	// Retracted contains the IDs of items that were removed from the node.
+	Retracted []string
+
+	// Purged is true if every item was removed from the node.
+	Purged bool
+
+	// Deleted is true if the node was deleted.
+	Deleted bool
+}
+
+// Handle returns an option that registers a Handler for event notifications.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		event := xml.Name{Space: NSEvent, Local: "event"}
+		// Events are normally sent without a type attribute, which the mux does not
+		// treat as equivalent to "normal".
+		mux.Message("", event, h)(m)
+		mux.Message(stanza.NormalMessage, event, h)(m)
+		mux.Message(stanza.HeadlineMessage, event, h)(m)
+	}
+}
+
+// Handler delivers event notifications to the functions registered for each
+// node.
+// The zero value is ready to use.
+type Handler struct {
+	mu    sync.Mutex
+	nodes map[string]func(Event)
+}
+
+// HandleNode registers f to be called with each event for the given node.
+// If f is nil, any function registered for the node is removed.
+//
+// Because PEP services send notifications to contacts that advertise interest
+// in a node, registering a function also advertises the node+notify feature for
+// use with entity capabilities.
+func (h *Handler) HandleNode(node string, f func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if f == nil {
+		delete(h.nodes, node)
+		return
+	}
+	if h.nodes == nil {
+		h.nodes = make(map[string]func(Event))
+	}
+	h.nodes[node] = f
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	type nodeData struct {
+		Node string `xml:"node,attr"`
+	}
+	data := struct {
+		Event struct {
+			Items *struct {
+				nodeData
+				Item    []Item `xml:"item"`
+				Retract []struct {
+					ID string `xml:"id,attr"`
+				} `xml:"retract"`
+			} `xml:"items"`
+			Purge  *nodeData `xml:"purge"`
+			Delete *nodeData `xml:"delete"`
+		} `xml:"http://jabber.org/protocol/pubsub#event event"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	e := Event{From: msg.From}
+	switch {
+	case data.Event.Items != nil:
+		e.Node = data.Event.Items.Node
+		e.Items = data.Event.Items.Item
+		for _, retract := range data.Event.Items.Retract {
+			e.Retracted = append(e.Retracted, retract.ID)
+		}
+	case data.Event.Purge != nil:
+		e.Node = data.Event.Purge.Node
+		e.Purged = true
+	case data.Event.Delete != nil:
+		e.Node = data.Event.Delete.Node
+		e.Deleted = true
+	default:
+		return nil
+	}
+
+	h.mu.Lock()
+	f := h.nodes[e.Node]
+	h.mu.Unlock()
+	if f != nil {
+		f(e)
+	}
+	return nil
+}
+
+// ForFeatures implements info.FeatureIter.
+// It advertises the node+notify feature for each node with a registered
+// function.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	h.mu.Lock()
+	nodes := make([]string, 0, len(h.nodes))
+	for n := range h.nodes {
+		nodes = append(nodes, n)
+	}
+	h.mu.Unlock()
+	sort.Strings(nodes)
+	for _, n := range nodes {
+		if err := f(info.Feature{Var: n + "+notify"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
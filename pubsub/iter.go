@@ -0,0 +1,251 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/stanzaerr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+)
+
+// Query selects the items to fetch from a node.
+// If no item IDs or limits are set, every item in the node is fetched.
+type Query struct {
+	// Node is the node to fetch items from.
+	Node string
+
+	// Item is a list of IDs of specific items to fetch.
+	Item []string
+
+	// MaxItems limits the results to the most recently published items.
+	MaxItems uint64
+
+	// Page selects a single page of the results.
+	Page paging.Request
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (q Query) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "items"},
+		Attr: []xml.Attr{nodeAttr(q.Node)},
+	}
+	if q.MaxItems > 0 {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "max_items"}, Value: strconv.FormatUint(q.MaxItems, 10)})
+	}
+	var items []xml.TokenReader
+	for _, id := range q.Item {
+		items = append(items, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "item"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		}))
+	}
+	inner := []xml.TokenReader{xmlstream.Wrap(xmlstream.MultiReader(items...), start)}
+	if q.Page != (paging.Request{}) {
+		inner = append(inner, q.Page.TokenReader())
+	}
+	return wrap(NS, inner...)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (q Query) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, q.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (q Query) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := q.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Iter is an iterator over the items in a node.
+type Iter struct {
+	r       xmlstream.TokenReadCloser
+	iter    *xmlstream.Iter
+	current Item
+	set     paging.Set
+	err     error
+}
+
+// Next returns true if there are more items to decode.
+func (i *Iter) Next() bool {
+	if i.err != nil || i.iter == nil {
+		return false
+	}
+	if !i.iter.Next() {
+		i.err = i.iter.Err()
+		if i.err == nil {
+			i.err = i.readSet()
+		}
+		i.iter = nil
+		return false
+	}
+	start, r := i.iter.Current()
+	// Skip anything that isn't an item.
+	if start.Name.Local != "item" {
+		return i.Next()
+	}
+	item := Item{}
+	// Decode the start token along with the rest of the element, token decoders
+	// do not know about start tokens passed to DecodeElement and report an error
+	// when they reach the end element.
+	i.err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&item)
+	if i.err != nil {
+		return false
+	}
+	i.current = item
+	return true
+}
+
+// readSet looks for result set management data after the items.
+func (i *Iter) readSet() error {
+	for {
+		tok, err := i.r.Token()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Space != paging.NS || start.Name.Local != "set" {
+			continue
+		}
+		return xml.NewTokenDecoder(xmlstream.MultiReader(
+			xmlstream.Token(start),
+			xmlstream.Inner(i.r),
+			xmlstream.Token(start.End()),
+		)).Decode(&i.set)
+	}
+}
+
+// Err returns the last error encountered by the iterator (if any).
+func (i *Iter) Err() error {
+	return i.err
+}
+
+// Item returns the last item parsed by the iterator.
+func (i *Iter) Item() Item {
+	return i.current
+}
+
+// Set returns the result set management data for the page of items, which can
+// be used to request the next or previous page.
+// It is only valid after Next has returned false.
+func (i *Iter) Set() paging.Set {
+	return i.set
+}
+
+// Close indicates that we are finished with the given iterator and processing
+// the stream may continue.
+// Calling it multiple times has no effect.
+func (i *Iter) Close() error {
+	if i.r == nil {
+		return nil
+	}
+	r := i.r
+	i.r = nil
+	i.iter = nil
+	return r.Close()
+}
+
+// Fetch requests items from a node on the pubsub service at to and returns an
+// iterator over the items (blocking until a response is received).
+//
+// The iterator must be closed before anything else is done on the session or it
+// will become invalid.
+// Any errors encountered while creating the iter are deferred until the iter is
+// used.
+// If the remote entity responds with an error it is returned from the
+// iterators Err method as a stanza.Error.
+func Fetch(ctx context.Context, s *xmpp.Session, to jid.JID, q Query) *Iter {
+	r, err := s.SendIQElement(ctx, q.TokenReader(), stanza.IQ{Type: stanza.GetIQ, To: to})
+	if err != nil {
+		return &Iter{err: err}
+	}
+
+	// Pop the IQ and check whether it is an error.
+	start, err := nextStart(r)
+	if err == nil {
+		var iq stanza.IQ
+		iq, err = stanza.NewIQ(start)
+		if err == nil && iq.Type == stanza.ErrorIQ {
+			err = stanzaerr.Decode(r)
+		}
+	}
+	// Pop the pubsub and items wrappers.
+	if err == nil {
+		_, err = nextStart(r)
+	}
+	if err == nil {
+		_, err = nextStart(r)
+	}
+	if err != nil {
+		/* #nosec */
+		r.Close()
+		return &Iter{err: err}
+	}
+
+	// Return the iterator which will parse the rest of the payload incrementally.
+	return &Iter{
+		r:    r,
+		iter: xmlstream.NewIter(&elementReader{r: xmlstream.Inner(r)}),
+	}
+}
+
+// elementReader drops anything between top level elements, such as
+// whitespace, which would otherwise stop an xmlstream.Iter.
+type elementReader struct {
+	r     xml.TokenReader
+	depth int
+}
+
+func (e *elementReader) Token() (xml.Token, error) {
+	for {
+		tok, err := e.r.Token()
+		if err != nil {
+			return tok, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			e.depth++
+		case xml.EndElement:
+			e.depth--
+		default:
+			if e.depth == 0 {
+				continue
+			}
+		}
+		return tok, nil
+	}
+}
+
+// nextStart returns the next start element, skipping anything before it.
+func nextStart(r xml.TokenReader) (xml.StartElement, error) {
+	for {
+		tok, err := r.Token()
+		if err == io.EOF {
+			return xml.StartElement{}, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
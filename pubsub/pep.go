@@ -0,0 +1,38 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+)
+
+// PublishPEP is like Publish except that the item is published to a node on the
+// users own account.
+// PEP services create nodes automatically when the first item is published.
+func PublishPEP(ctx context.Context, s *xmpp.Session, node, id string, payload xml.TokenReader, opts *form.Data) (string, error) {
+	return Publish(ctx, s, s.LocalAddr().Bare(), node, id, payload, opts)
+}
+
+// RetractPEP is like Retract except that the item is removed from a node on the
+// users own account.
+func RetractPEP(ctx context.Context, s *xmpp.Session, node, id string, notify bool) error {
+	return Retract(ctx, s, s.LocalAddr().Bare(), node, id, notify)
+}
+
+// FetchPEP is like Fetch except that the items are fetched from a node on the
+// users own account.
+func FetchPEP(ctx context.Context, s *xmpp.Session, q Query) *Iter {
+	return Fetch(ctx, s, s.LocalAddr().Bare(), q)
+}
+
+// DeletePEP is like Delete except that it deletes a node on the users own
+// account.
+func DeletePEP(ctx context.Context, s *xmpp.Session, node string) error {
+	return Delete(ctx, s, s.LocalAddr().Bare(), node)
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package pubsub implements the publish-subscribe pattern.
+//
+// Publish-Subscribe (XEP-0060) lets entities publish items to nodes and be
+// notified of new items in nodes they are subscribed to.
+// It is the basis of many other extensions such as user avatars, bookmarks,
+// and user mood.
+// Personal Eventing Protocol (XEP-0163), or PEP, is a profile of
+// publish-subscribe where each account acts as its own pubsub service.
+// Functions ending in PEP operate on the users own account.
+//
+// Notifications are received by registering a Handler on the mux used to serve
+// the session.
+package pubsub // import "mellium.im/xmpp/pubsub"
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS               = "http://jabber.org/protocol/pubsub"
+	NSEvent          = "http://jabber.org/protocol/pubsub#event"
+	NSOwner          = "http://jabber.org/protocol/pubsub#owner"
+	NSNodeConfig     = "http://jabber.org/protocol/pubsub#node_config"
+	NSPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+)
+
+// Subscription states.
+const (
+	StateNone         = "none"
+	StatePending      = "pending"
+	StateUnconfigured = "unconfigured"
+	StateSubscribed   = "subscribed"
+)
+
+// Item is an item that was published to a node.
+type Item struct {
+	// ID is the ID of the item within the node.
+	ID string
+
+	payload []xml.Token
+}
+
+// Payload returns a stream of XML tokens representing the payload of the item.
+func (i Item) Payload() xml.TokenReader {
+	return &tokenReader{toks: i.payload}
+}
+
+// UnmarshalXML satisfies the xml.Unmarshaler interface.
+func (i *Item) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	i.ID = ""
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			i.ID = a.Value
+			break
+		}
+	}
+	i.payload = i.payload[:0]
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		default:
+			// Ignore whitespace around the payload.
+			if depth == 0 {
+				continue
+			}
+		}
+		i.payload = append(i.payload, xml.CopyToken(tok))
+	}
+}
+
+// Subscription is the state of an entities subscription to a node.
+type Subscription struct {
+	XMLName xml.Name `xml:"subscription"`
+	Node    string   `xml:"node,attr"`
+	JID     jid.JID  `xml:"jid,attr"`
+	SubID   string   `xml:"subid,attr,omitempty"`
+	State   string   `xml:"subscription,attr,omitempty"`
+}
+
+// Create creates a node on the pubsub service at to and returns its name.
+// If node is empty an instant node is created and the service picks the name.
+// If config is not nil it is submitted as the initial configuration of the
+// node and should be a form of type "submit" with the FORM_TYPE NSNodeConfig.
+func Create(ctx context.Context, s *xmpp.Session, to jid.JID, node string, config *form.Data) (string, error) {
+	start := xml.StartElement{Name: xml.Name{Local: "create"}}
+	if node != "" {
+		start.Attr = append(start.Attr, nodeAttr(node))
+	}
+	payload := []xml.TokenReader{xmlstream.Wrap(nil, start)}
+	if config != nil {
+		payload = append(payload, xmlstream.Wrap(
+			config.TokenReader(),
+			xml.StartElement{Name: xml.Name{Local: "configure"}},
+		))
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Create  struct {
+			Node string `xml:"node,attr"`
+		} `xml:"create"`
+	}{}
+	err := s.UnmarshalIQElement(ctx, wrap(NS, payload...), stanza.IQ{Type: stanza.SetIQ, To: to}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Create.Node != "" {
+		return resp.Create.Node, nil
+	}
+	return node, nil
+}
+
+// Delete deletes a node and all of its items.
+func Delete(ctx context.Context, s *xmpp.Session, to jid.JID, node string) error {
+	return s.UnmarshalIQElement(ctx, wrap(NSOwner, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: "delete"},
+		Attr: []xml.Attr{nodeAttr(node)},
+	})), stanza.IQ{Type: stanza.SetIQ, To: to}, nil)
+}
+
+// Config returns the configuration form for a node.
+func Config(ctx context.Context, s *xmpp.Session, to jid.JID, node string) (*form.Data, error) {
+	resp := struct {
+		XMLName   xml.Name `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+		Configure struct {
+			Form form.Data `xml:"jabber:x:data x"`
+		} `xml:"configure"`
+	}{}
+	err := s.UnmarshalIQElement(ctx, wrap(NSOwner, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: "configure"},
+		Attr: []xml.Attr{nodeAttr(node)},
+	})), stanza.IQ{Type: stanza.GetIQ, To: to}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Configure.Form, nil
+}
+
+// Configure submits a new configuration for a node.
+// The config should be a form of type "submit" with the FORM_TYPE NSNodeConfig.
+func Configure(ctx context.Context, s *xmpp.Session, to jid.JID, node string, config *form.Data) error {
+	return s.UnmarshalIQElement(ctx, wrap(NSOwner, xmlstream.Wrap(config.TokenReader(), xml.StartElement{
+		Name: xml.Name{Local: "configure"},
+		Attr: []xml.Attr{nodeAttr(node)},
+	})), stanza.IQ{Type: stanza.SetIQ, To: to}, nil)
+}
+
+// Publish publishes an item to a node and returns the ID of the item.
+// If id is empty the service picks an ID.
+// If opts is not nil it is sent as the publish options and should be a form
+// of type "submit" with the FORM_TYPE NSPublishOptions.
+func Publish(ctx context.Context, s *xmpp.Session, to jid.JID, node, id string, payload xml.TokenReader, opts *form.Data) (string, error) {
+	item := xml.StartElement{Name: xml.Name{Local: "item"}}
+	if id != "" {
+		item.Attr = append(item.Attr, xml.Attr{Name: xml.Name{Local: "id"}, Value: id})
+	}
+	inner := []xml.TokenReader{xmlstream.Wrap(
+		xmlstream.Wrap(payload, item),
+		xml.StartElement{
+			Name: xml.Name{Local: "publish"},
+			Attr: []xml.Attr{nodeAttr(node)},
+		},
+	)}
+	if opts != nil {
+		inner = append(inner, xmlstream.Wrap(
+			opts.TokenReader(),
+			xml.StartElement{Name: xml.Name{Local: "publish-options"}},
+		))
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Publish struct {
+			Item struct {
+				ID string `xml:"id,attr"`
+			} `xml:"item"`
+		} `xml:"publish"`
+	}{}
+	err := s.UnmarshalIQElement(ctx, wrap(NS, inner...), stanza.IQ{Type: stanza.SetIQ, To: to}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Publish.Item.ID != "" {
+		return resp.Publish.Item.ID, nil
+	}
+	return id, nil
+}
+
+// Retract deletes an item from a node.
+// If notify is true, subscribers are notified that the item was retracted.
+func Retract(ctx context.Context, s *xmpp.Session, to jid.JID, node, id string, notify bool) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "retract"},
+		Attr: []xml.Attr{nodeAttr(node)},
+	}
+	if notify {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "notify"}, Value: "true"})
+	}
+	return s.UnmarshalIQElement(ctx, wrap(NS, xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "item"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		}),
+		start,
+	)), stanza.IQ{Type: stanza.SetIQ, To: to}, nil)
+}
+
+// Subscribe subscribes the JID j to a node and returns the resulting
+// subscription.
+// The subscription may need to be approved or configured before it is active,
+// so the returned state should be checked.
+func Subscribe(ctx context.Context, s *xmpp.Session, to jid.JID, node string, j jid.JID) (Subscription, error) {
+	resp := struct {
+		XMLName      xml.Name     `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Subscription Subscription `xml:"subscription"`
+	}{}
+	err := s.UnmarshalIQElement(ctx, wrap(NS, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: "subscribe"},
+		Attr: []xml.Attr{nodeAttr(node), {Name: xml.Name{Local: "jid"}, Value: j.String()}},
+	})), stanza.IQ{Type: stanza.SetIQ, To: to}, &resp)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub := resp.Subscription
+	if sub.Node == "" {
+		sub.Node = node
+	}
+	if sub.JID.Equal(jid.JID{}) {
+		sub.JID = j
+	}
+	if sub.State == "" {
+		sub.State = StateSubscribed
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription of j to a node.
+// If j is subscribed more than once, subID selects the subscription to remove.
+func Unsubscribe(ctx context.Context, s *xmpp.Session, to jid.JID, node string, j jid.JID, subID string) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "unsubscribe"},
+		Attr: []xml.Attr{nodeAttr(node), {Name: xml.Name{Local: "jid"}, Value: j.String()}},
+	}
+	if subID != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "subid"}, Value: subID})
+	}
+	return s.UnmarshalIQElement(ctx, wrap(NS, xmlstream.Wrap(nil, start)), stanza.IQ{Type: stanza.SetIQ, To: to}, nil)
+}
+
+func wrap(space string, payload ...xml.TokenReader) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(payload...),
+		xml.StartElement{Name: xml.Name{Space: space, Local: "pubsub"}},
+	)
+}
+
+func nodeAttr(node string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: "node"}, Value: node}
+}
+
+type tokenReader struct {
+	toks []xml.Token
+}
+
+func (r *tokenReader) Token() (xml.Token, error) {
+	if len(r.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := r.toks[0]
+	r.toks = r.toks[1:]
+	return tok, nil
+}
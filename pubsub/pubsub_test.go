@@ -0,0 +1,287 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ mux.MessageHandler  = (*pubsub.Handler)(nil)
+	_ info.FeatureIter    = (*pubsub.Handler)(nil)
+	_ xml.Unmarshaler     = (*pubsub.Item)(nil)
+	_ xmlstream.Marshaler = pubsub.Query{}
+)
+
+var service = jid.MustParse("pubsub.shakespeare.lit")
+
+// newSession returns a session connected to a fake pubsub service that records
+// each request and answers it with the payload returned by respond.
+func newSession(respond func(xmpptest.Request) string) (*xmpp.Session, chan xmpptest.Request, net.Conn) {
+	recv := make(chan xmpptest.Request, 10)
+	s, conn := xmpptest.NewServerSession(nil, func(req xmpptest.Request) string {
+		recv <- req
+		return respond(req)
+	})
+	return s, recv, conn
+}
+
+func TestPublish(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, recv, conn := newSession(func(req xmpptest.Request) string {
+		return `<pubsub xmlns="http://jabber.org/protocol/pubsub"><publish node="http://jabber.org/protocol/mood"><item id="ae890ac52d0df67ed7cfdf51b644e901"/></publish></pubsub>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	mood := xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "happy"}}),
+		xml.StartElement{Name: xml.Name{Space: "http://jabber.org/protocol/mood", Local: "mood"}},
+	)
+	id, err := pubsub.PublishPEP(ctx, s, "http://jabber.org/protocol/mood", "", mood, nil)
+	if err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	if id != "ae890ac52d0df67ed7cfdf51b644e901" {
+		t.Errorf("wrong item ID: %s", id)
+	}
+	req := <-recv
+	if req.Type != "set" || req.To != "test@example.net" {
+		t.Errorf("wrong request: %+v", req)
+	}
+	const want = `<pubsub xmlns="http://jabber.org/protocol/pubsub"><publish node="http://jabber.org/protocol/mood"><item><mood xmlns="http://jabber.org/protocol/mood"><happy></happy></mood></item></publish></pubsub>`
+	if req.Inner != want {
+		t.Errorf("wrong payload:\nwant=%s,\n got=%s", want, req.Inner)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, recv, conn := newSession(func(req xmpptest.Request) string {
+		switch {
+		case strings.Contains(req.Inner, "<create"):
+			return `<pubsub xmlns="http://jabber.org/protocol/pubsub"><create node="25e3d37dabbab9541f7523321421edc5bfeb2dae"/></pubsub>`
+		case strings.Contains(req.Inner, "<configure") && req.Type == "get":
+			return `<pubsub xmlns="http://jabber.org/protocol/pubsub#owner"><configure node="princely_musings"><x xmlns="jabber:x:data" type="form"><field var="FORM_TYPE" type="hidden"><value>http://jabber.org/protocol/pubsub#node_config</value></field><field var="pubsub#title" type="text-single" label="A friendly name for the node"><value>Princely Musings (Atom)</value></field></x></configure></pubsub>`
+		case strings.Contains(req.Inner, "<subscribe"):
+			return `<pubsub xmlns="http://jabber.org/protocol/pubsub"><subscription node="princely_musings" jid="francisco@denmark.lit" subscription="pending"/></pubsub>`
+		case strings.Contains(req.Inner, "<delete"):
+			return `<error type="auth"><forbidden xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		}
+		return ""
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	node, err := pubsub.Create(ctx, s, service, "", nil)
+	if err != nil {
+		t.Fatalf("error creating node: %v", err)
+	}
+	if node != "25e3d37dabbab9541f7523321421edc5bfeb2dae" {
+		t.Errorf("wrong node name: %s", node)
+	}
+	if req := <-recv; req.To != service.String() || req.Inner != `<pubsub xmlns="http://jabber.org/protocol/pubsub"><create></create></pubsub>` {
+		t.Errorf("wrong create request: %+v", req)
+	}
+
+	config, err := pubsub.Config(ctx, s, service, "princely_musings")
+	if err != nil {
+		t.Fatalf("error fetching config: %v", err)
+	}
+	<-recv
+	var title string
+	config.ForFields(func(f form.FieldData) {
+		if f.Var == "pubsub#title" && len(f.Values) > 0 {
+			title = f.Values[0]
+		}
+	})
+	if title != "Princely Musings (Atom)" {
+		t.Errorf("wrong title in config: %q", title)
+	}
+
+	if err = pubsub.Configure(ctx, s, service, "princely_musings", config); err != nil {
+		t.Errorf("error configuring node: %v", err)
+	}
+	if req := <-recv; req.Type != "set" || !strings.Contains(req.Inner, `<pubsub xmlns="http://jabber.org/protocol/pubsub#owner"><configure node="princely_musings"><x xmlns="jabber:x:data"`) {
+		t.Errorf("wrong configure request: %+v", req)
+	}
+
+	sub, err := pubsub.Subscribe(ctx, s, service, "princely_musings", jid.MustParse("francisco@denmark.lit"))
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	if sub.State != pubsub.StatePending || sub.Node != "princely_musings" || sub.JID.String() != "francisco@denmark.lit" {
+		t.Errorf("wrong subscription: %+v", sub)
+	}
+	<-recv
+
+	if err = pubsub.Unsubscribe(ctx, s, service, "princely_musings", jid.MustParse("francisco@denmark.lit"), "ba49252aaa4f5d320c24d3766f0bdcade78c78d3"); err != nil {
+		t.Errorf("error unsubscribing: %v", err)
+	}
+	if req := <-recv; req.Inner != `<pubsub xmlns="http://jabber.org/protocol/pubsub"><unsubscribe node="princely_musings" jid="francisco@denmark.lit" subid="ba49252aaa4f5d320c24d3766f0bdcade78c78d3"></unsubscribe></pubsub>` {
+		t.Errorf("wrong unsubscribe request: %+v", req)
+	}
+
+	if err = pubsub.Retract(ctx, s, service, "princely_musings", "ae890ac52d0df67ed7cfdf51b644e901", true); err != nil {
+		t.Errorf("error retracting item: %v", err)
+	}
+	if req := <-recv; req.Inner != `<pubsub xmlns="http://jabber.org/protocol/pubsub"><retract node="princely_musings" notify="true"><item id="ae890ac52d0df67ed7cfdf51b644e901"></item></retract></pubsub>` {
+		t.Errorf("wrong retract request: %+v", req)
+	}
+
+	err = pubsub.Delete(ctx, s, service, "princely_musings")
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.Forbidden {
+		t.Errorf("wrong error deleting node: %v", err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, recv, conn := newSession(func(req xmpptest.Request) string {
+		if strings.Contains(req.Inner, "missing") {
+			return `<error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		}
+		return `<pubsub xmlns="http://jabber.org/protocol/pubsub"><items node="princely_musings">
+<item id="368866411b877c30064a5f62b917cffe"><entry xmlns="http://www.w3.org/2005/Atom"><title>The Uses of This World</title></entry></item>
+<item id="3300659945416e274474e469a1f0154c"><entry xmlns="http://www.w3.org/2005/Atom"><title>Ghostly Encounters</title></entry></item>
+</items><set xmlns="http://jabber.org/protocol/rsm"><first index="0">368866411b877c30064a5f62b917cffe</first><last>3300659945416e274474e469a1f0154c</last><count>19</count></set></pubsub>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	iter := pubsub.Fetch(ctx, s, service, pubsub.Query{
+		Node:     "princely_musings",
+		MaxItems: 2,
+		Page:     paging.Request{Max: 2},
+	})
+	var titles []string
+	for iter.Next() {
+		entry := struct {
+			Title string `xml:"title"`
+		}{}
+		item := iter.Item()
+		if err := xml.NewTokenDecoder(item.Payload()).Decode(&entry); err != nil {
+			t.Fatalf("error decoding item %s: %v", item.ID, err)
+		}
+		titles = append(titles, item.ID+":"+entry.Title)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error iterating over items: %v", err)
+	}
+	if set := iter.Set(); set.Last != "3300659945416e274474e469a1f0154c" || set.Count != 19 {
+		t.Errorf("wrong result set: %+v", set)
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("error closing iter: %v", err)
+	}
+	const want = "368866411b877c30064a5f62b917cffe:The Uses of This World,3300659945416e274474e469a1f0154c:Ghostly Encounters"
+	if got := strings.Join(titles, ","); got != want {
+		t.Errorf("wrong items:\nwant=%s,\n got=%s", want, got)
+	}
+	const wantReq = `<pubsub xmlns="http://jabber.org/protocol/pubsub"><items node="princely_musings" max_items="2"></items><set xmlns="http://jabber.org/protocol/rsm"><max>2</max></set></pubsub>`
+	if req := <-recv; req.Type != "get" || req.Inner != wantReq {
+		t.Errorf("wrong request:\nwant=%s,\n got=%s", wantReq, req.Inner)
+	}
+
+	iter = pubsub.Fetch(ctx, s, service, pubsub.Query{Node: "missing"})
+	if iter.Next() {
+		t.Errorf("expected no items")
+	}
+	if err, ok := iter.Err().(stanza.Error); !ok || err.Condition != stanza.ItemNotFound {
+		t.Errorf("wrong error: %v", iter.Err())
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("error closing iter: %v", err)
+	}
+}
+
+type tokenReadEncoder struct {
+	xml.TokenReader
+	xmlstream.Encoder
+}
+
+func TestEvents(t *testing.T) {
+	h := &pubsub.Handler{}
+	var events []pubsub.Event
+	h.HandleNode("princely_musings", func(e pubsub.Event) {
+		events = append(events, e)
+	})
+	h.HandleNode("urn:xmpp:avatar:metadata", func(e pubsub.Event) {
+		events = append(events, e)
+	})
+	h.HandleNode("urn:xmpp:avatar:metadata", nil)
+
+	var features []string
+	err := h.ForFeatures("", func(f info.Feature) error {
+		features = append(features, f.Var)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error listing features: %v", err)
+	}
+	if s := strings.Join(features, ","); s != "princely_musings+notify" {
+		t.Errorf("wrong features: %s", s)
+	}
+
+	m := mux.New(pubsub.Handle(h))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><items node="princely_musings"><item id="ae890ac52d0df67ed7cfdf51b644e901"><entry xmlns="http://www.w3.org/2005/Atom"><title>Soliloquy</title></entry></item></items></event></message>`,
+		`<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit" type="headline"><event xmlns="http://jabber.org/protocol/pubsub#event"><items node="princely_musings"><retract id="ae890ac52d0df67ed7cfdf51b644e901"/></items></event></message>`,
+		`<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><items node="urn:xmpp:avatar:metadata"><item id="1"/></items></event></message>`,
+		`<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><delete node="princely_musings"/></event></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(tokenReadEncoder{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(ioutil.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling event: %v", err)
+		}
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("wrong number of events: want=3, got=%d", len(events))
+	}
+	for _, e := range events {
+		if e.Node != "princely_musings" || !e.From.Equal(service) {
+			t.Errorf("wrong event: %+v", e)
+		}
+	}
+	if items := events[0].Items; len(items) != 1 || items[0].ID != "ae890ac52d0df67ed7cfdf51b644e901" {
+		t.Errorf("wrong published items: %+v", items)
+	}
+	if retracted := events[1].Retracted; len(retracted) != 1 || retracted[0] != "ae890ac52d0df67ed7cfdf51b644e901" {
+		t.Errorf("wrong retracted items: %+v", retracted)
+	}
+	if !events[2].Deleted {
+		t.Errorf("expected node to be deleted: %+v", events[2])
+	}
+}
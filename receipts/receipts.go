@@ -13,6 +13,7 @@ import (
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/internal/attr"
 	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/mux"
@@ -98,6 +99,14 @@ func (h *Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder
 	return i.Err()
 }
 
+// ForFeatures implements info.FeatureIter.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
 // SendMessage transmits the first element read from the provided token reader
 // over the session if the element is a message stanza, otherwise it returns an
 // error.
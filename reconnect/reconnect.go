@@ -0,0 +1,476 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package reconnect implements a client that keeps an XMPP session alive by
+// redialing and renegotiating it whenever the connection is lost.
+//
+// A Client owns the dial and negotiate cycle and provides a stable handle that
+// may be used to send stanzas regardless of which underlying session is
+// currently connected.
+// Failed connection attempts are retried with an exponential backoff, and
+// see-other-host stream errors cause the client to redial the advertised host
+// immediately.
+package reconnect // import "mellium.im/xmpp/reconnect"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/dial"
+	"mellium.im/xmpp/internal/discover"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+// maxRedirects is the number of see-other-host errors that will be followed in
+// a row before the client falls back to its normal backoff behavior.
+const maxRedirects = 5
+
+// Errors returned by the Client when it is unable to send a stanza.
+var (
+	ErrOffline   = errors.New("reconnect: the client is offline")
+	ErrQueueFull = errors.New("reconnect: the send queue is full")
+)
+
+// State is the connection state of a Client.
+type State uint8
+
+// A list of possible connection states.
+const (
+	// Offline means that there is no session and the client is either waiting
+	// to reconnect or has stopped running.
+	Offline State = iota
+
+	// Connecting means that the client is dialing a connection or negotiating a
+	// session.
+	Connecting
+
+	// Online means that the session has been negotiated, the initial presence
+	// has been sent, and stanzas can be sent immediately.
+	Online
+)
+
+// String satisfies the fmt.Stringer interface.
+func (s State) String() string {
+	switch s {
+	case Offline:
+		return "offline"
+	case Connecting:
+		return "connecting"
+	case Online:
+		return "online"
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Config contains options for a Client.
+//
+// The zero value for each field is equivalent to running without that option.
+type Config struct {
+	// Features are the stream features that will be negotiated every time a new
+	// session is established.
+	Features []xmpp.StreamFeature
+
+	// Handler is used to handle incoming stanzas on each session.
+	// If nil, incoming stanzas are ignored.
+	Handler xmpp.Handler
+
+	// Dial is used to establish connections.
+	// The host is empty unless the server redirected the client with a
+	// see-other-host stream error, in which case it is the advertised host
+	// (which may contain a port).
+	//
+	// If nil, connections are established with the dial package, and redirects
+	// use a plain TCP connection to the advertised host (on port 5222 if no port
+	// was advertised) so the Features should include StartTLS.
+	Dial func(ctx context.Context, host string) (net.Conn, error)
+
+	// Presence returns the initial presence that is sent every time a session
+	// is established.
+	// If nil, an empty available presence is sent.
+	// If Presence returns nil, no initial presence is sent.
+	Presence func() xml.TokenReader
+
+	// Backoff controls how long the client waits between failed connection
+	// attempts.
+	Backoff Backoff
+
+	// QueueSize is the number of stanzas sent with Send that will be buffered
+	// while the client is offline and transmitted when it next comes online.
+	// If QueueSize is greater than zero, SendIQ waits for the client to come
+	// online instead of failing.
+	// If zero, Send and SendIQ return ErrOffline when the client is offline.
+	QueueSize int
+
+	// StateChanged is called every time the connection state changes.
+	// It is called from the goroutine that is running the client and must not
+	// block.
+	StateChanged func(State)
+}
+
+// Backoff configures the exponential backoff used between connection attempts.
+//
+// The zero value for each field is replaced by its default.
+type Backoff struct {
+	// Min is the delay after the first failed attempt.
+	// If zero, one second is used.
+	Min time.Duration
+
+	// Max is the maximum delay between attempts.
+	// If zero, five minutes is used.
+	Max time.Duration
+
+	// Factor is the amount by which the delay is multiplied after each failed
+	// attempt.
+	// If less than one, two is used.
+	Factor float64
+
+	// Jitter is the fraction of each delay that is randomized to keep many
+	// clients from reconnecting at the same time.
+	// It should be between 0 and 1, and if zero no jitter is applied.
+	Jitter float64
+}
+
+// Duration returns the delay before the given attempt, starting at zero.
+func (b Backoff) Duration(attempt int) time.Duration {
+	min, max, factor := b.Min, b.Max, b.Factor
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	if factor < 1 {
+		factor = 2
+	}
+	d := float64(min)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= factor
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		jitter := b.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= d * jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Client maintains a client-to-server session, reconnecting as necessary.
+// Its send methods are safe for concurrent use by multiple goroutines.
+type Client struct {
+	addr jid.JID
+	cfg  Config
+
+	mu      sync.Mutex
+	state   State
+	session *xmpp.Session
+	online  chan struct{}
+	queue   [][]xml.Token
+}
+
+// New returns a client that will log in as addr using the provided config.
+// No connection is made until Run is called.
+func New(addr jid.JID, cfg Config) *Client {
+	return &Client{
+		addr:   addr,
+		cfg:    cfg,
+		online: make(chan struct{}),
+	}
+}
+
+// State returns the current connection state of the client.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Session returns the current session or nil if the client is not online.
+// The session may be closed at any time if the connection is lost.
+func (c *Client) Session() *xmpp.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// Run connects to the server and keeps the session alive until the context is
+// canceled, at which point the connection is closed and the context error is
+// returned.
+// Run must not be called more than once at a time.
+func (c *Client) Run(ctx context.Context) error {
+	var attempt, redirects int
+	var host string
+	for {
+		c.setState(Connecting)
+		online, err := c.connect(ctx, host)
+		c.setState(Offline)
+		host = ""
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if online {
+			attempt = 0
+			redirects = 0
+		}
+
+		if se, ok := err.(stream.Error); ok && redirects < maxRedirects {
+			if other, ok := se.OtherHost(); ok {
+				redirects++
+				host = other
+				continue
+			}
+		}
+
+		t := time.NewTimer(c.cfg.Backoff.Duration(attempt))
+		attempt++
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// connect dials and negotiates a session, and then serves it until it is
+// closed.
+// It reports whether the client went online before the session ended.
+func (c *Client) connect(ctx context.Context, host string) (bool, error) {
+	conn, err := c.dial(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	/* #nosec */
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			/* #nosec */
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	session, err := xmpp.NewClientSession(ctx, c.addr, conn, false, c.cfg.Features...)
+	if err != nil {
+		return false, err
+	}
+	if err = c.goOnline(ctx, session); err != nil {
+		/* #nosec */
+		session.Close()
+		return false, err
+	}
+	return true, session.Serve(c.cfg.Handler)
+}
+
+func (c *Client) dial(ctx context.Context, host string) (net.Conn, error) {
+	if c.cfg.Dial != nil {
+		return c.cfg.Dial(ctx, host)
+	}
+	if host == "" {
+		return dial.Client(ctx, "tcp", c.addr)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port, err := discover.LookupPort("tcp", "xmpp-client")
+		if err != nil {
+			return nil, err
+		}
+		if l := len(host); l > 1 && host[0] == '[' && host[l-1] == ']' {
+			host = host[1 : l-1]
+		}
+		host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", host)
+}
+
+// goOnline sends the initial presence and any queued stanzas before marking
+// the client as online.
+func (c *Client) goOnline(ctx context.Context, session *xmpp.Session) error {
+	presence := stanza.Presence{}.Wrap(nil)
+	if c.cfg.Presence != nil {
+		presence = c.cfg.Presence()
+	}
+	if presence != nil {
+		if err := session.Send(ctx, presence); err != nil {
+			return err
+		}
+	}
+
+	// The lock is not held while sending, so more stanzas may be queued while the
+	// queue is being flushed.
+	// Keep flushing until it is empty, at which point the state is changed before
+	// unlocking so that nothing can be queued after the final flush.
+	for {
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		if len(queue) == 0 {
+			changed := c.updateState(Online, session)
+			c.mu.Unlock()
+			if changed {
+				c.stateChanged(Online)
+			}
+			return nil
+		}
+		c.mu.Unlock()
+
+		for i, toks := range queue {
+			if err := session.Send(ctx, &tokenReader{toks: toks}); err != nil {
+				// Put anything that was not sent back at the front of the queue so that
+				// it is sent in order after the next session is established.
+				c.mu.Lock()
+				c.queue = append(queue[i:], c.queue...)
+				c.mu.Unlock()
+				return err
+			}
+			queue[i] = nil
+		}
+	}
+}
+
+func (c *Client) setState(state State) {
+	c.mu.Lock()
+	changed := c.updateState(state, nil)
+	c.mu.Unlock()
+
+	if changed {
+		c.stateChanged(state)
+	}
+}
+
+// updateState must be called with the lock held.
+func (c *Client) updateState(state State, session *xmpp.Session) bool {
+	if c.state == state {
+		return false
+	}
+	switch {
+	case state == Online:
+		close(c.online)
+	case c.state == Online:
+		c.online = make(chan struct{})
+	}
+	c.state = state
+	c.session = session
+	return true
+}
+
+func (c *Client) stateChanged(state State) {
+	if c.cfg.StateChanged != nil {
+		c.cfg.StateChanged(state)
+	}
+}
+
+// Send transmits the first element read from the provided token reader over
+// the current session.
+//
+// If the client is offline and a queue size was configured, the element is
+// buffered and sent after the next session is established, otherwise
+// ErrOffline is returned.
+func (c *Client) Send(ctx context.Context, r xml.TokenReader) error {
+	c.mu.Lock()
+	session := c.session
+	if session != nil {
+		c.mu.Unlock()
+		return session.Send(ctx, r)
+	}
+	defer c.mu.Unlock()
+
+	if c.cfg.QueueSize <= 0 {
+		return ErrOffline
+	}
+	if len(c.queue) >= c.cfg.QueueSize {
+		return ErrQueueFull
+	}
+	toks, err := copyElement(r)
+	if err != nil {
+		return err
+	}
+	c.queue = append(c.queue, toks)
+	return nil
+}
+
+// SendIQ is like Send except that it returns the response to IQs of type get
+// or set as described by the SendIQ method on xmpp.Session.
+//
+// IQs are never queued.
+// If the client is offline and a queue size was configured, SendIQ blocks until
+// the client is online or the context is canceled, otherwise ErrOffline is
+// returned.
+func (c *Client) SendIQ(ctx context.Context, r xml.TokenReader) (xmlstream.TokenReadCloser, error) {
+	for {
+		c.mu.Lock()
+		session, online := c.session, c.online
+		c.mu.Unlock()
+		if session != nil {
+			return session.SendIQ(ctx, r)
+		}
+		if c.cfg.QueueSize <= 0 {
+			return nil, ErrOffline
+		}
+		select {
+		case <-online:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// copyElement reads the first element from r and returns a copy of its tokens.
+func copyElement(r xml.TokenReader) ([]xml.Token, error) {
+	var toks []xml.Token
+	var depth int
+	for {
+		tok, err := r.Token()
+		if tok != nil {
+			toks = append(toks, xml.CopyToken(tok))
+			switch tok.(type) {
+			case xml.StartElement:
+				depth++
+			case xml.EndElement:
+				depth--
+				if depth == 0 {
+					return toks, nil
+				}
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return toks, nil
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+type tokenReader struct {
+	toks []xml.Token
+}
+
+func (r *tokenReader) Token() (xml.Token, error) {
+	if len(r.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := r.toks[0]
+	r.toks = r.toks[1:]
+	return tok, nil
+}
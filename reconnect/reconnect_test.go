@@ -0,0 +1,288 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package reconnect_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mellium.im/sasl"
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/reconnect"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serve negotiates a server side session on conn and calls handle with each
+// top level element that it receives.
+func serve(ctx context.Context, conn net.Conn, handle func(s *xmpp.Session, r xmlstream.TokenReadEncoder, name string) error) {
+	/* #nosec */
+	defer conn.Close()
+	permissions := func(n *sasl.Negotiator) bool {
+		user, pass, _ := n.Credentials()
+		return string(user) == "juliet" && string(pass) == "secret"
+	}
+	s, err := xmpp.NegotiateSession(ctx, jid.MustParse("example.net"), jid.JID{}, conn, true, xmpp.NewNegotiator(xmpp.StreamConfig{
+		Features: []xmpp.StreamFeature{
+			xmpp.SASLServer(permissions, nil, sasl.Plain),
+			xmpp.BindResource(),
+		},
+	}))
+	if err != nil {
+		return
+	}
+	/* #nosec */
+	s.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		return handle(s, r, start.Name.Local)
+	}))
+	// Wait for the client to hang up so that it can read everything we sent.
+	/* #nosec */
+	io.Copy(ioutil.Discard, conn)
+}
+
+func TestRun(t *testing.T) {
+	cert := selfSigned(t, "example.net")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Use a real network connection instead of net.Pipe so that both sides can
+	// write an error at the same time without blocking.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	/* #nosec */
+	defer ln.Close()
+
+	var conns int32
+	hosts := make(chan string, 10)
+	received := make(chan string, 10)
+	states := make(chan reconnect.State, 20)
+	queued := make(chan error, 1)
+
+	var client *reconnect.Client
+	var offline int
+	client = reconnect.New(jid.MustParse("juliet@example.net"), reconnect.Config{
+		Features: []xmpp.StreamFeature{
+			xmpp.SASL("", "secret", sasl.Plain),
+			xmpp.BindResource(),
+		},
+		Dial: func(ctx context.Context, host string) (net.Conn, error) {
+			n := atomic.AddInt32(&conns, 1)
+			hosts <- host
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			serverConn, err := ln.Accept()
+			if err != nil {
+				return nil, err
+			}
+			go serve(ctx, tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}}), func(s *xmpp.Session, r xmlstream.TokenReadEncoder, name string) error {
+				received <- strconv.Itoa(int(n)) + ":" + name
+				switch n {
+				case 1:
+					addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5222}
+					if err := r.Encode(stream.SeeOtherHostError(addr, nil)); err != nil {
+						return err
+					}
+					// The error is flushed after the handler returns, so close the
+					// stream once the output lock is released.
+					/* #nosec */
+					go s.Close()
+					return nil
+				case 2:
+					return errors.New("hanging up")
+				}
+				return nil
+			})
+			return tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "example.net"}), nil
+		},
+		Backoff:   reconnect.Backoff{Min: time.Millisecond},
+		QueueSize: 1,
+		StateChanged: func(state reconnect.State) {
+			states <- state
+			if state != reconnect.Offline {
+				return
+			}
+			offline++
+			if offline == 2 {
+				queued <- client.Send(ctx, stanza.Message{To: jid.MustParse("romeo@example.net")}.Wrap(nil))
+			}
+		},
+	})
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- client.Run(ctx)
+	}()
+
+	for _, want := range []string{"1:presence", "2:presence", "3:presence", "3:message"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("wrong element received: want=%s, got=%s", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	if err := <-queued; err != nil {
+		t.Errorf("error queueing message: %v", err)
+	}
+	if s := client.State(); s != reconnect.Online {
+		t.Errorf("wrong state: want=%v, got=%v", reconnect.Online, s)
+	}
+	cancel()
+	if err := <-runErr; err != context.Canceled {
+		t.Errorf("wrong error from Run: want=%v, got=%v", context.Canceled, err)
+	}
+
+	close(hosts)
+	var gotHosts []string
+	for host := range hosts {
+		gotHosts = append(gotHosts, host)
+	}
+	if want := fmt.Sprint([]string{"", "127.0.0.1:5222", ""}); fmt.Sprint(gotHosts) != want {
+		t.Errorf("wrong hosts dialed: want=%s, got=%s", want, gotHosts)
+	}
+
+	close(states)
+	var gotStates []reconnect.State
+	for state := range states {
+		gotStates = append(gotStates, state)
+	}
+	wantStates := []reconnect.State{
+		reconnect.Connecting, reconnect.Online, reconnect.Offline,
+		reconnect.Connecting, reconnect.Online, reconnect.Offline,
+		reconnect.Connecting, reconnect.Online, reconnect.Offline,
+	}
+	if fmt.Sprint(gotStates) != fmt.Sprint(wantStates) {
+		t.Errorf("wrong state transitions: want=%v, got=%v", wantStates, gotStates)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := stanza.Message{To: jid.MustParse("romeo@example.net")}
+	iq := stanza.IQ{Type: stanza.GetIQ}
+
+	client := reconnect.New(jid.MustParse("juliet@example.net"), reconnect.Config{})
+	if err := client.Send(ctx, msg.Wrap(nil)); err != reconnect.ErrOffline {
+		t.Errorf("wrong error sending while offline: want=%v, got=%v", reconnect.ErrOffline, err)
+	}
+	if _, err := client.SendIQ(ctx, iq.Wrap(nil)); err != reconnect.ErrOffline {
+		t.Errorf("wrong error sending IQ while offline: want=%v, got=%v", reconnect.ErrOffline, err)
+	}
+
+	client = reconnect.New(jid.MustParse("juliet@example.net"), reconnect.Config{QueueSize: 1})
+	if err := client.Send(ctx, msg.Wrap(nil)); err != nil {
+		t.Errorf("unexpected error queueing message: %v", err)
+	}
+	if err := client.Send(ctx, msg.Wrap(nil)); err != reconnect.ErrQueueFull {
+		t.Errorf("wrong error with full queue: want=%v, got=%v", reconnect.ErrQueueFull, err)
+	}
+	iqCtx, iqCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer iqCancel()
+	if _, err := client.SendIQ(iqCtx, iq.Wrap(nil)); err != context.DeadlineExceeded {
+		t.Errorf("wrong error waiting to send IQ: want=%v, got=%v", context.DeadlineExceeded, err)
+	}
+}
+
+var backoffTests = [...]struct {
+	backoff reconnect.Backoff
+	attempt int
+	want    time.Duration
+}{
+	0: {reconnect.Backoff{}, 0, time.Second},
+	1: {reconnect.Backoff{}, 3, 8 * time.Second},
+	2: {reconnect.Backoff{}, 100, 5 * time.Minute},
+	3: {reconnect.Backoff{Min: time.Millisecond, Max: time.Second, Factor: 10}, 2, 100 * time.Millisecond},
+	4: {reconnect.Backoff{Min: time.Millisecond, Max: time.Second, Factor: 10}, 4, time.Second},
+}
+
+func TestBackoff(t *testing.T) {
+	for i, tc := range backoffTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if d := tc.backoff.Duration(tc.attempt); d != tc.want {
+				t.Errorf("wrong duration: want=%v, got=%v", tc.want, d)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := reconnect.Backoff{Min: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := b.Duration(1); d > 2*time.Second || d < time.Second {
+			t.Fatalf("jittered duration out of range: %v", d)
+		}
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for state, want := range map[reconnect.State]string{
+		reconnect.Offline:    "offline",
+		reconnect.Connecting: "connecting",
+		reconnect.Online:     "online",
+		reconnect.State(10):  "State(10)",
+	} {
+		if s := state.String(); s != want {
+			t.Errorf("wrong string: want=%s, got=%s", want, s)
+		}
+	}
+}
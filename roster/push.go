@@ -0,0 +1,225 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// subRemove is the subscription used to remove items from the roster.
+const subRemove = "remove"
+
+// EventType is the kind of change described by a roster push.
+type EventType uint8
+
+// A list of possible event types.
+const (
+	// Added means that a new item was added to the roster.
+	Added EventType = iota
+
+	// Updated means that an item that was already in the roster changed.
+	Updated
+
+	// Removed means that an item was removed from the roster.
+	Removed
+)
+
+// Event is a change to the roster received in a roster push.
+type Event struct {
+	Type EventType
+	Item Item
+
+	// Ver is the version of the roster after the change, if the server supports
+	// roster versioning.
+	Ver string
+}
+
+// Handle returns an option that registers a Handler for roster pushes.
+func Handle(h *Handler) mux.Option {
+	return mux.IQ(stanza.SetIQ, xml.Name{Local: "query", Space: NS}, h)
+}
+
+// Versioning reports whether the server advertised support for roster
+// versioning during stream negotiation.
+func Versioning(s *xmpp.Session) bool {
+	_, ok := s.Feature(NSFeatures)
+	return ok
+}
+
+// Handler responds to roster pushes and keeps a local copy of the roster up to
+// date.
+//
+// The handler uses the local copy to tell whether a push adds a new item or
+// updates an existing one.
+// Until the roster is fetched with the handlers Fetch method, only items
+// that were seen in earlier pushes are known.
+// The zero value is ready to use.
+type Handler struct {
+	// Push is called for each roster push after the store has been updated.
+	// If it returns an error, the push is not acknowledged and the error is
+	// returned from HandleIQ.
+	Push func(Event) error
+
+	// Store holds the local copy of the roster.
+	// If nil, an in memory store is used.
+	Store Store
+
+	// Account is the address of the account that owns the roster.
+	// Pushes from its bare JID are accepted in addition to pushes with no from
+	// address.
+	Account jid.JID
+
+	storeOnce sync.Once
+	mu        sync.Mutex
+}
+
+func (h *Handler) store() Store {
+	h.storeOnce.Do(func() {
+		if h.Store == nil {
+			h.Store = &MemStore{}
+		}
+	})
+	return h.Store
+}
+
+// Fetch requests the roster, saves it in the store, and returns its items.
+//
+// If the server advertised support for roster versioning, the version of the
+// stored roster is sent with the request.
+// If the roster has not changed since that version, the server does not send
+// it again and the stored items are returned instead.
+// Any changes are then sent as roster pushes, which the handler applies to the
+// store.
+func (h *Handler) Fetch(ctx context.Context, s *xmpp.Session) ([]Item, error) {
+	store := h.store()
+	var iter *Iter
+	if Versioning(s) {
+		ver, err := store.Ver()
+		if err != nil {
+			return nil, err
+		}
+		iter = fetchVer(ctx, ver, s)
+	} else {
+		iter = Fetch(ctx, s)
+	}
+	var items []Item
+	for iter.Next() {
+		items = append(items, iter.Item())
+	}
+	err := iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if iter.Unchanged() {
+		return store.Items()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = store.Replace(iter.Version(), items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Items returns the items in the store sorted by JID.
+func (h *Handler) Items() ([]Item, error) {
+	return h.store().Items()
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
+// HandleIQ responds to roster push IQs.
+//
+// Pushes are only accepted if they have no from address or come from the bare
+// JID of the account, which sessions normally report as having no from
+// address.
+// Any other pushes could be used to inject contacts into the roster and are
+// rejected with a service-unavailable error.
+func (h *Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	if iq.Type != stanza.SetIQ || start.Name.Local != "query" || start.Name.Space != NS {
+		return nil
+	}
+	if !iq.From.Equal(jid.JID{}) && !iq.From.Equal(h.Account.Bare()) {
+		return sendError(iq, t, stanza.Error{Type: stanza.Cancel, Condition: stanza.ServiceUnavailable})
+	}
+
+	query := struct {
+		Ver   string `xml:"ver,attr"`
+		Items []Item `xml:"item"`
+	}{}
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(
+		xmlstream.Token(*start),
+		xmlstream.Inner(t),
+		xmlstream.Token(start.End()),
+	)).Decode(&query)
+	if err != nil {
+		return err
+	}
+	if len(query.Items) != 1 {
+		return sendError(iq, t, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest})
+	}
+
+	e := Event{Item: query.Items[0], Ver: query.Ver}
+	err = h.update(&e)
+	if err != nil {
+		return err
+	}
+
+	if h.Push != nil {
+		err = h.Push(e)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
+
+// update applies the change in the push to the store and sets the event type.
+func (h *Handler) update(e *Event) error {
+	store := h.store()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e.Item.Subscription == subRemove {
+		e.Type = Removed
+		return store.Delete(e.Ver, e.Item.JID)
+	}
+	_, known, err := store.Get(e.Item.JID)
+	if err != nil {
+		return err
+	}
+	e.Type = Added
+	if known {
+		e.Type = Updated
+	}
+	return store.Put(e.Ver, e.Item)
+}
+
+func sendError(iq stanza.IQ, t xmlstream.TokenReadEncoder, stanzaErr stanza.Error) error {
+	iq.To, iq.From = iq.From, iq.To
+	iq.Type = stanza.ErrorIQ
+	_, err := xmlstream.Copy(t, iq.Wrap(stanzaErr.TokenReader()))
+	return err
+}
@@ -12,57 +12,40 @@ import (
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/stanzaerr"
 	"mellium.im/xmpp/jid"
-	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
 )
 
 // Namespaces used by this package provided as a convenience.
 const (
 	NS = "jabber:iq:roster"
+
+	// NSFeatures is the namespace of the stream feature advertised by servers
+	// that support roster versioning.
+	NSFeatures = "urn:xmpp:features:rosterver"
 )
 
 // Iter is an iterator over roster items.
 type Iter struct {
-	iter    *xmlstream.Iter
-	current Item
-	err     error
-}
-
-// Handle returns an option that registers a Handler for roster pushes.
-func Handle(h Handler) mux.Option {
-	return mux.IQ(stanza.SetIQ, xml.Name{Local: "query", Space: NS}, h)
-}
-
-// Handler responds to roster pushes.
-type Handler struct {
-	Push func(Item) error
-}
-
-// HandleIQ responds to roster push IQs.
-func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
-	item := Item{}
-	err := xml.NewTokenDecoder(t).Decode(&item)
-	if err != nil {
-		return err
-	}
-	return h.Push(item)
+	iter      *xmlstream.Iter
+	current   Item
+	err       error
+	ver       string
+	unchanged bool
 }
 
 // Next returns true if there are more items to decode.
 func (i *Iter) Next() bool {
-	if i.err != nil || !i.iter.Next() {
+	if i.err != nil || i.iter == nil || !i.iter.Next() {
 		return false
 	}
 	start, r := i.iter.Current()
-	d := xml.NewTokenDecoder(r)
 	item := Item{}
-	i.err = d.DecodeElement(&item, start)
-	// TODO remove this branch after Go 1.15 comes out.
-	// See https://mellium.im/issue/29
-	if i.err == io.EOF {
-		i.err = nil
-	}
+	// Decode the start token along with the rest of the element, token decoders
+	// do not know about start tokens passed to DecodeElement and report an error
+	// when they reach the end element.
+	i.err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&item)
 	if i.err != nil {
 		return false
 	}
@@ -72,7 +55,7 @@ func (i *Iter) Next() bool {
 
 // Err returns the last error encountered by the iterator (if any).
 func (i *Iter) Err() error {
-	if i.err != nil {
+	if i.err != nil || i.iter == nil {
 		return i.err
 	}
 
@@ -84,6 +67,19 @@ func (i *Iter) Item() Item {
 	return i.current
 }
 
+// Version returns the version of the roster sent by the server, or the empty
+// string if the server does not support roster versioning.
+func (i *Iter) Version() string {
+	return i.ver
+}
+
+// Unchanged reports whether the server responded without a roster because it
+// has not changed since the version sent in the request.
+// Any changes since that version will be sent as roster pushes.
+func (i *Iter) Unchanged() bool {
+	return i.unchanged
+}
+
 // Close indicates that we are finished with the given iterator and processing
 // the stream may continue.
 // Calling it multiple times has no effect.
@@ -102,38 +98,157 @@ func (i *Iter) Close() error {
 // Any errors encountered while creating the iter are deferred until the iter is
 // used.
 func Fetch(ctx context.Context, s *xmpp.Session) *Iter {
-	return FetchIQ(ctx, stanza.IQ{}, s)
+	return FetchIQ(ctx, IQ{}, s)
 }
 
 // FetchIQ is like Fetch but it allows you to customize the IQ.
+// If the query has a version, the server may respond with only the changes
+// since that version (see Iter.Unchanged).
 // Changing the type of the provided IQ has no effect.
-func FetchIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) *Iter {
+func FetchIQ(ctx context.Context, iq IQ, s *xmpp.Session) *Iter {
+	return fetch(ctx, iq.IQ, iq.payload(), s)
+}
+
+// fetchVer is like FetchIQ except that it always sends the version, even if it
+// is empty, to indicate that we support roster versioning.
+func fetchVer(ctx context.Context, ver string, s *xmpp.Session) *Iter {
+	return fetch(ctx, stanza.IQ{}, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: "query", Space: NS},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "ver"}, Value: ver}},
+	}), s)
+}
+
+func fetch(ctx context.Context, iq stanza.IQ, payload xml.TokenReader, s *xmpp.Session) *Iter {
 	if iq.Type != stanza.GetIQ {
 		iq.Type = stanza.GetIQ
 	}
-	rosterIQ := IQ{IQ: iq}
-	payload := rosterIQ.payload()
 	r, err := s.SendIQElement(ctx, payload, iq)
 	if err != nil {
 		return &Iter{err: err}
 	}
 
 	// Pop the start IQ token.
-	_, err = r.Token()
+	tok, err := r.Token()
 	if err != nil {
+		/* #nosec */
+		r.Close()
 		return &Iter{err: err}
 	}
+	if iqStart, ok := tok.(xml.StartElement); ok {
+		resp, err := stanza.NewIQ(iqStart)
+		if err == nil && resp.Type == stanza.ErrorIQ {
+			err = stanzaerr.Decode(r)
+		}
+		if err != nil {
+			/* #nosec */
+			r.Close()
+			return &Iter{err: err}
+		}
+	}
 
 	// Pop the roster wrapper token.
-	_, err = r.Token()
+	// If there is no roster, the roster has not changed since the version that
+	// was sent in the request.
+	tok, err = r.Token()
+	start, ok := tok.(xml.StartElement)
+	if err == io.EOF || (err == nil && !ok) {
+		return &Iter{unchanged: true, err: r.Close()}
+	}
 	if err != nil {
+		/* #nosec */
+		r.Close()
 		return &Iter{err: err}
 	}
+	var ver string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "ver" {
+			ver = attr.Value
+			break
+		}
+	}
 
 	// Return the iterator which will parse the rest of the payload incrementally.
 	return &Iter{
 		iter: xmlstream.NewIter(r),
+		ver:  ver,
+	}
+}
+
+// Set adds an item to the roster or updates an existing item.
+// The subscription state of the item is managed by the server and is ignored.
+// If the server responds with an error it is returned as a stanza.Error.
+func Set(ctx context.Context, s *xmpp.Session, item Item) error {
+	item.Subscription = ""
+	return set(ctx, s, item)
+}
+
+// Delete removes an item from the roster.
+// The server also cancels any presence subscriptions to and from the contact.
+// If the server responds with an error it is returned as a stanza.Error.
+func Delete(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return set(ctx, s, Item{JID: j, Subscription: subRemove})
+}
+
+func set(ctx context.Context, s *xmpp.Session, item Item) error {
+	return s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		item.TokenReader(),
+		xml.StartElement{Name: xml.Name{Local: "query", Space: NS}},
+	), stanza.IQ{Type: stanza.SetIQ}, nil)
+}
+
+// AddToGroup adds the item to the named group.
+// If the item is already in the group, nothing is sent.
+func AddToGroup(ctx context.Context, s *xmpp.Session, item Item, group string) error {
+	if item.InGroup(group) {
+		return nil
 	}
+	item.Group = append(item.Group[:len(item.Group):len(item.Group)], group)
+	return Set(ctx, s, item)
+}
+
+// RemoveFromGroup removes the item from the named group.
+// If the item is not in the group, nothing is sent.
+func RemoveFromGroup(ctx context.Context, s *xmpp.Session, item Item, group string) error {
+	if !item.InGroup(group) {
+		return nil
+	}
+	var groups []string
+	for _, g := range item.Group {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	item.Group = groups
+	return Set(ctx, s, item)
+}
+
+// RenameGroup moves each of the items in the group named old to the group
+// named new.
+// Items that are not in the old group are skipped.
+// If updating any item fails, the error is returned and the remaining items
+// are not updated.
+func RenameGroup(ctx context.Context, s *xmpp.Session, items []Item, old, new string) error {
+	for _, item := range items {
+		if !item.InGroup(old) {
+			continue
+		}
+		groups := make([]string, 0, len(item.Group))
+		for _, g := range item.Group {
+			if g == old {
+				if item.InGroup(new) {
+					continue
+				}
+				g = new
+			}
+			groups = append(groups, g)
+		}
+		item.Group = groups
+		err := Set(ctx, s, item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // IQ represents a user roster request or response.
@@ -142,7 +257,7 @@ type IQ struct {
 	stanza.IQ
 
 	Query struct {
-		Ver  string `xml:"version,attr,omitempty"`
+		Ver  string `xml:"ver,attr,omitempty"`
 		Item []Item `xml:"item"`
 	} `xml:"jabber:iq:roster query"`
 }
@@ -152,7 +267,7 @@ type itemMarshaler struct {
 	cur   xml.TokenReader
 }
 
-func (m itemMarshaler) Token() (xml.Token, error) {
+func (m *itemMarshaler) Token() (xml.Token, error) {
 	if len(m.items) == 0 {
 		return nil, io.EOF
 	}
@@ -190,11 +305,11 @@ func (iq IQ) TokenReader() xml.TokenReader {
 func (iq IQ) payload() xml.TokenReader {
 	attrs := []xml.Attr{}
 	if iq.Query.Ver != "" {
-		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "version"}, Value: iq.Query.Ver})
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "ver"}, Value: iq.Query.Ver})
 	}
 
 	return xmlstream.Wrap(
-		itemMarshaler{items: iq.Query.Item},
+		&itemMarshaler{items: iq.Query.Item},
 		xml.StartElement{Name: xml.Name{Local: "query", Space: NS}, Attr: attrs},
 	)
 }
@@ -216,22 +331,32 @@ func (iq IQ) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
 
 // Item represents a contact in the roster.
 type Item struct {
-	JID          jid.JID `xml:"jid,attr,omitempty"`
-	Name         string  `xml:"name,attr,omitempty"`
-	Subscription string  `xml:"subscription,attr,omitempty"`
-	Group        string  `xml:"group,omitempty"`
+	JID          jid.JID  `xml:"jid,attr,omitempty"`
+	Name         string   `xml:"name,attr,omitempty"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Group        []string `xml:"group,omitempty"`
+}
+
+// InGroup reports whether the item is in the named group.
+func (item Item) InGroup(group string) bool {
+	for _, g := range item.Group {
+		if g == group {
+			return true
+		}
+	}
+	return false
 }
 
 // TokenReader satisfies the xmlstream.Marshaler interface.
 func (item Item) TokenReader() xml.TokenReader {
-	var group xml.TokenReader
-	if item.Group != "" {
-		group = xmlstream.Wrap(
-			xmlstream.Token(xml.CharData(item.Group)),
+	var groups []xml.TokenReader
+	for _, g := range item.Group {
+		groups = append(groups, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(g)),
 			xml.StartElement{
 				Name: xml.Name{Local: "group"},
 			},
-		)
+		))
 	}
 
 	attrs := []xml.Attr{}
@@ -246,7 +371,7 @@ func (item Item) TokenReader() xml.TokenReader {
 	}
 
 	return xmlstream.Wrap(
-		group,
+		xmlstream.MultiReader(groups...),
 		xml.StartElement{
 			Name: xml.Name{Local: "item"},
 			Attr: attrs,
@@ -8,14 +8,21 @@ import (
 	"context"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/internal/xmpptest"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
@@ -24,9 +31,11 @@ import (
 )
 
 var testCases = [...]struct {
-	reply string
-	items []roster.Item
-	err   error
+	reply     string
+	items     []roster.Item
+	err       error
+	ver       string
+	unchanged bool
 }{
 	0: {
 		reply: `<query xmlns='jabber:iq:roster'/>`,
@@ -37,13 +46,23 @@ var testCases = [...]struct {
 			JID:          jid.MustParse("juliet@example.com"),
 			Name:         "Juliet",
 			Subscription: "both",
-			Group:        "Friends",
+			Group:        []string{"Friends"},
 		}, {
 			JID:          jid.MustParse("benvolio@example.org"),
 			Name:         "Benvolio",
 			Subscription: "to",
 		}},
 	},
+	2: {
+		unchanged: true,
+	},
+	3: {
+		reply: `<query xmlns='jabber:iq:roster' ver='ver7'><item jid='nurse@example.com'/></query>`,
+		items: []roster.Item{{
+			JID: jid.MustParse("nurse@example.com"),
+		}},
+		ver: "ver7",
+	},
 }
 
 func TestFetch(t *testing.T) {
@@ -72,7 +91,7 @@ func TestFetch(t *testing.T) {
 					panic(err)
 				}
 			}()
-			iter := roster.FetchIQ(context.Background(), stanza.IQ{ID: "123"}, s)
+			iter := roster.FetchIQ(context.Background(), roster.IQ{IQ: stanza.IQ{ID: "123"}}, s)
 			items := make([]roster.Item, 0, len(tc.items))
 			for iter.Next() {
 				items = append(items, iter.Item())
@@ -81,6 +100,12 @@ func TestFetch(t *testing.T) {
 				t.Errorf("Wrong error after iter: want=%q, got=%q", tc.err, err)
 			}
 			iter.Close()
+			if ver := iter.Version(); ver != tc.ver {
+				t.Errorf("wrong version: want=%q, got=%q", tc.ver, ver)
+			}
+			if unchanged := iter.Unchanged(); unchanged != tc.unchanged {
+				t.Errorf("wrong value for unchanged: want=%t, got=%t", tc.unchanged, unchanged)
+			}
 
 			// Don't try to compare nil and empty slice with DeepEqual
 			if len(items) == 0 && len(tc.items) == 0 {
@@ -94,28 +119,281 @@ func TestFetch(t *testing.T) {
 	}
 }
 
-func TestReceivePush(t *testing.T) {
-	const itemJID = "nurse@example.com"
-	const x = `<iq xmlns='jabber:client' id='a78b4q6ha463' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='` + itemJID + `'/></query></iq>`
+func TestFetchError(t *testing.T) {
+	pr, pw := io.Pipe()
+	s := xmpptest.NewSession(0, struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: pr,
+		Writer: ioutil.Discard,
+	})
+	go func() {
+		/* #nosec */
+		s.Serve(nil)
+	}()
+	go func() {
+		/* #nosec */
+		io.WriteString(pw, `<iq id="123" type="error"><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`)
+	}()
 
-	d := xml.NewDecoder(strings.NewReader(x))
-	var b strings.Builder
-	e := xml.NewEncoder(&b)
+	iter := roster.FetchIQ(context.Background(), roster.IQ{IQ: stanza.IQ{ID: "123"}}, s)
+	if iter.Next() {
+		t.Errorf("expected no items from an error response, got %+v", iter.Item())
+	}
+	if err, ok := iter.Err().(stanza.Error); !ok || err.Condition != stanza.ServiceUnavailable {
+		t.Errorf("wrong error: want=%v, got=%v", stanza.ServiceUnavailable, iter.Err())
+	}
+	if iter.Unchanged() {
+		t.Errorf("error response reported as an unchanged roster")
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("unexpected error closing iter: %v", err)
+	}
+}
 
-	called := false
-	h := roster.Handler{
-		Push: func(item roster.Item) error {
-			if item.JID.String() != itemJID {
-				t.Errorf("unexpected JID: want=%q, got=%q", itemJID, item.JID.String())
+// newSession returns a session connected to a fake server that records the
+// items in each roster set and responds with an empty result.
+func newSession(sent chan<- roster.Item) (*xmpp.Session, net.Conn) {
+	return xmpptest.NewServerSession(nil, func(req xmpptest.Request) string {
+		query := struct {
+			Items []roster.Item `xml:"item"`
+		}{}
+		/* #nosec */
+		xml.Unmarshal([]byte(req.Inner), &query)
+		for _, item := range query.Items {
+			sent <- item
+		}
+		return ""
+	})
+}
+
+var (
+	nurse  = roster.Item{JID: jid.MustParse("nurse@example.com"), Name: "Nurse", Subscription: "both", Group: []string{"Servants"}}
+	romeo  = roster.Item{JID: jid.MustParse("romeo@example.net"), Group: []string{"Montagues", "Lovers"}}
+	tybalt = roster.Item{JID: jid.MustParse("tybalt@example.com"), Group: []string{"Capulets"}}
+)
+
+var setTestCases = [...]struct {
+	update func(context.Context, *xmpp.Session) error
+	sent   []roster.Item
+}{
+	0: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.Set(ctx, s, nurse)
+		},
+		sent: []roster.Item{{JID: nurse.JID, Name: "Nurse", Group: []string{"Servants"}}},
+	},
+	1: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.Delete(ctx, s, nurse.JID)
+		},
+		sent: []roster.Item{{JID: nurse.JID, Subscription: "remove"}},
+	},
+	2: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.AddToGroup(ctx, s, nurse, "Capulets")
+		},
+		sent: []roster.Item{{JID: nurse.JID, Name: "Nurse", Group: []string{"Servants", "Capulets"}}},
+	},
+	3: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.AddToGroup(ctx, s, nurse, "Servants")
+		},
+	},
+	4: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.RemoveFromGroup(ctx, s, romeo, "Lovers")
+		},
+		sent: []roster.Item{{JID: romeo.JID, Group: []string{"Montagues"}}},
+	},
+	5: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.RemoveFromGroup(ctx, s, romeo, "Capulets")
+		},
+	},
+	6: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.RenameGroup(ctx, s, []roster.Item{nurse, romeo, tybalt}, "Capulets", "Veronese")
+		},
+		sent: []roster.Item{{JID: tybalt.JID, Group: []string{"Veronese"}}},
+	},
+	7: {
+		update: func(ctx context.Context, s *xmpp.Session) error {
+			return roster.RenameGroup(ctx, s, []roster.Item{romeo}, "Lovers", "Montagues")
+		},
+		sent: []roster.Item{{JID: romeo.JID, Group: []string{"Montagues"}}},
+	},
+}
+
+func TestSet(t *testing.T) {
+	for i, tc := range setTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			sent := make(chan roster.Item, 10)
+			s, conn := newSession(sent)
+			/* #nosec */
+			defer conn.Close()
+
+			err := tc.update(ctx, s)
+			if err != nil {
+				t.Fatalf("unexpected error updating roster: %v", err)
 			}
-			called = true
-			return nil
+			close(sent)
+			var items []roster.Item
+			for item := range sent {
+				items = append(items, item)
+			}
+			if !reflect.DeepEqual(items, tc.sent) {
+				t.Errorf("wrong items sent:\nwant=%+v,\n got=%+v", tc.sent, items)
+			}
+		})
+	}
+}
+
+// newVersionedSession returns a session with a fake server that advertises
+// support for roster versioning.
+// The server sends the version from each roster request on vers and responds
+// with reply.
+func newVersionedSession(t *testing.T, vers chan<- string, reply string) (*xmpp.Session, net.Conn) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		d := xml.NewDecoder(serverConn)
+		// Pop the XML declaration and stream header and advertise roster
+		// versioning.
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			if _, ok := tok.(xml.StartElement); ok {
+				break
+			}
+		}
+		/* #nosec */
+		fmt.Fprint(serverConn, `<stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams" version="1.0" id="123" from="example.net"><stream:features><nop xmlns="urn:example"/><ver xmlns="urn:xmpp:features:rosterver"/></stream:features>`)
+		for {
+			req := struct {
+				ID    string `xml:"id,attr"`
+				Query struct {
+					Ver *string `xml:"ver,attr"`
+				} `xml:"query"`
+			}{}
+			if err := d.Decode(&req); err != nil {
+				return
+			}
+			if req.Query.Ver == nil {
+				vers <- "<none>"
+			} else {
+				vers <- *req.Query.Ver
+			}
+			/* #nosec */
+			fmt.Fprintf(serverConn, `<iq xmlns="jabber:client" type="result" id="%s">%s</iq>`, req.ID, reply)
+		}
+	}()
+	// Negotiation fails if none of the advertised features are supported, so
+	// negotiate a feature that does nothing.
+	nop := xmpp.StreamFeature{
+		Name: xml.Name{Space: "urn:example", Local: "nop"},
+		Parse: func(ctx context.Context, r xml.TokenReader, start *xml.StartElement) (bool, interface{}, error) {
+			return false, nil, xmlstream.Skip(r)
+		},
+		Negotiate: func(ctx context.Context, session *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, error) {
+			return xmpp.Ready, nil, nil
+		},
+	}
+	s, err := xmpp.NegotiateSession(context.Background(), jid.MustParse("example.net"), jid.MustParse("juliet@example.com"), clientConn, false, xmpp.NewNegotiator(xmpp.StreamConfig{
+		Features: []xmpp.StreamFeature{nop},
+	}))
+	if err != nil {
+		t.Fatalf("error negotiating session: %v", err)
+	}
+	go func() {
+		/* #nosec */
+		s.Serve(nil)
+	}()
+	return s, clientConn
+}
+
+func TestVersioning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "roster")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	/* #nosec */
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roster.xml")
+
+	nurse := roster.Item{JID: jid.MustParse("nurse@example.com"), Name: "Nurse", Group: []string{"Servants"}}
+	for i, tc := range [...]struct {
+		reply string
+		ver   string
+	}{
+		0: {
+			reply: `<query xmlns='jabber:iq:roster' ver='ver1'><item jid='nurse@example.com' name='Nurse'><group>Servants</group></item></query>`,
+			ver:   "",
 		},
+		// The roster has not changed so it is loaded from the file.
+		1: {ver: "ver1"},
+	} {
+		store, err := roster.OpenFile(path)
+		if err != nil {
+			t.Fatalf("%d: error opening store: %v", i, err)
+		}
+		vers := make(chan string, 1)
+		s, conn := newVersionedSession(t, vers, tc.reply)
+		if !roster.Versioning(s) {
+			t.Fatalf("%d: expected roster versioning to be supported", i)
+		}
+		h := &roster.Handler{Store: store}
+		items, err := h.Fetch(ctx, s)
+		/* #nosec */
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%d: error fetching roster: %v", i, err)
+		}
+		if ver := <-vers; ver != tc.ver {
+			t.Errorf("%d: wrong version sent: want=%q, got=%q", i, tc.ver, ver)
+		}
+		if want := []roster.Item{nurse}; !reflect.DeepEqual(items, want) {
+			t.Errorf("%d: wrong items:\nwant=%+v,\n got=%+v", i, want, items)
+		}
+	}
+
+	// Pushes are applied to the store.
+	store, err := roster.OpenFile(path)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	h := &roster.Handler{Store: store}
+	handlePush(t, h, `<iq xmlns='jabber:client' id='push' type='set'><query xmlns='jabber:iq:roster' ver='ver2'><item jid='nurse@example.com' subscription='remove'/></query></iq>`)
+	store, err = roster.OpenFile(path)
+	if err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	if ver, err := store.Ver(); err != nil || ver != "ver2" {
+		t.Errorf("wrong version after push: want=ver2, got=%q (%v)", ver, err)
 	}
+	if items, err := store.Items(); err != nil || len(items) != 0 {
+		t.Errorf("expected push to remove item, got %+v (%v)", items, err)
+	}
+}
+
+// handlePush passes a roster push to the handler and returns the response.
+func handlePush(t *testing.T, h *roster.Handler, push string) string {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(push))
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
 
 	tok, err := d.Token()
 	if err != nil {
-		t.Errorf("unexpected error popping start token: %v", err)
+		t.Fatalf("unexpected error popping start token: %v", err)
 	}
 	start := tok.(xml.StartElement)
 	m := mux.New(roster.Handle(h))
@@ -127,20 +405,146 @@ func TestReceivePush(t *testing.T) {
 		Encoder:     e,
 	}, &start)
 	if err != nil {
-		t.Errorf("unexpected error in handler: %v", err)
+		t.Fatalf("unexpected error in handler: %v", err)
 	}
 	err = e.Flush()
 	if err != nil {
-		t.Errorf("unexpected error flushing encoder: %v", err)
+		t.Fatalf("unexpected error flushing encoder: %v", err)
 	}
+	return b.String()
+}
+
+var pushTestCases = [...]struct {
+	push  string
+	resp  string
+	event *roster.Event
+}{
+	0: {
+		push: `<iq xmlns='jabber:client' id='a78b4q6ha463' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster' ver='ver14'><item jid='nurse@example.com' name='Nurse'><group>Servants</group></item></query></iq>`,
+		resp: `<iq xmlns="jabber:client" type="result" from="juliet@example.com/chamber" id="a78b4q6ha463"></iq>`,
+		event: &roster.Event{
+			Type: roster.Added,
+			Item: roster.Item{JID: jid.MustParse("nurse@example.com"), Name: "Nurse", Group: []string{"Servants"}},
+			Ver:  "ver14",
+		},
+	},
+	1: {
+		push: `<iq xmlns='jabber:client' id='a78b4q6ha464' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='nurse@example.com' subscription='both'/></query></iq>`,
+		resp: `<iq xmlns="jabber:client" type="result" from="juliet@example.com/chamber" id="a78b4q6ha464"></iq>`,
+		event: &roster.Event{
+			Type: roster.Updated,
+			Item: roster.Item{JID: jid.MustParse("nurse@example.com"), Subscription: "both"},
+		},
+	},
+	2: {
+		// Pushes from anyone other than our own account are rejected.
+		push: `<iq xmlns='jabber:client' id='spoof' from='montague.example' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='romeo@example.net'/></query></iq>`,
+		resp: `<iq xmlns="jabber:client" type="error" to="montague.example" from="juliet@example.com/chamber" id="spoof"><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></service-unavailable></error></iq>`,
+	},
+	3: {
+		push: `<iq xmlns='jabber:client' id='multi' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='romeo@example.net'/><item jid='mercutio@example.com'/></query></iq>`,
+		resp: `<iq xmlns="jabber:client" type="error" from="juliet@example.com/chamber" id="multi"><error type="modify"><bad-request xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></bad-request></error></iq>`,
+	},
+	4: {
+		push: `<iq xmlns='jabber:client' id='remove' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='nurse@example.com' subscription='remove'/></query></iq>`,
+		resp: `<iq xmlns="jabber:client" type="result" from="juliet@example.com/chamber" id="remove"></iq>`,
+		event: &roster.Event{
+			Type: roster.Removed,
+			Item: roster.Item{JID: jid.MustParse("nurse@example.com"), Subscription: "remove"},
+		},
+	},
+}
+
+func TestReceivePush(t *testing.T) {
+	const itemJID = "nurse@example.com"
+	const x = `<iq xmlns='jabber:client' id='a78b4q6ha463' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='` + itemJID + `'/></query></iq>`
+	const expected = `<iq xmlns="jabber:client" type="result" from="juliet@example.com/chamber" id="a78b4q6ha463"></iq>`
 
+	called := false
+	h := &roster.Handler{
+		Push: func(e roster.Event) error {
+			if e.Item.JID.String() != itemJID {
+				t.Errorf("unexpected JID: want=%q, got=%q", itemJID, e.Item.JID.String())
+			}
+			called = true
+			return nil
+		},
+	}
+
+	out := handlePush(t, h, x)
 	if !called {
 		t.Errorf("expected push handler to be called")
 	}
+	if out != expected {
+		t.Errorf("want=%q, got=%q", expected, out)
+	}
+}
+
+func TestReceivePushFromOtherEntity(t *testing.T) {
+	// Pushes from anyone other than our own account are rejected.
+	const x = `<iq xmlns='jabber:client' id='spoof' from='montague.example' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='romeo@example.net'/></query></iq>`
+	const expected = `<iq xmlns="jabber:client" type="error" to="montague.example" from="juliet@example.com/chamber" id="spoof"><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></service-unavailable></error></iq>`
+
+	h := &roster.Handler{
+		Push: func(e roster.Event) error {
+			t.Errorf("push handler called for spoofed push: %+v", e)
+			return nil
+		},
+	}
 
-	out := b.String()
-	if out != "" {
-		t.Errorf("want=%q, got=%q", "", out)
+	if out := handlePush(t, h, x); out != expected {
+		t.Errorf("wrong response:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestPushEvents(t *testing.T) {
+	var event *roster.Event
+	h := &roster.Handler{
+		Push: func(e roster.Event) error {
+			event = &e
+			return nil
+		},
+	}
+	// The test cases share a handler so that it can tell additions from updates.
+	for i, tc := range pushTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			event = nil
+			resp := handlePush(t, h, tc.push)
+			if resp != tc.resp {
+				t.Errorf("wrong response:\nwant=%s,\n got=%s", tc.resp, resp)
+			}
+			if !reflect.DeepEqual(event, tc.event) {
+				t.Errorf("wrong event: want=%+v, got=%+v", tc.event, event)
+			}
+		})
+	}
+	if items, err := h.Items(); err != nil || len(items) != 0 {
+		t.Errorf("expected no items to remain in the roster, got %+v (%v)", items, err)
+	}
+}
+
+func TestReceivePushFromAccount(t *testing.T) {
+	var event *roster.Event
+	h := &roster.Handler{
+		Account: jid.MustParse("juliet@example.com/chamber"),
+		Push: func(e roster.Event) error {
+			event = &e
+			return nil
+		},
+	}
+	const push = `<iq xmlns='jabber:client' id='bare' from='juliet@example.com' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='nurse@example.com'/></query></iq>`
+	const want = `<iq xmlns="jabber:client" type="result" to="juliet@example.com" from="juliet@example.com/chamber" id="bare"></iq>`
+	if resp := handlePush(t, h, push); resp != want {
+		t.Errorf("wrong response:\nwant=%s,\n got=%s", want, resp)
+	}
+	if event == nil || !event.Item.JID.Equal(jid.MustParse("nurse@example.com")) {
+		t.Errorf("wrong event: %+v", event)
+	}
+
+	// Pushes from other resources of the account are still rejected.
+	const other = `<iq xmlns='jabber:client' id='full' from='juliet@example.com/balcony' to='juliet@example.com/chamber' type='set'><query xmlns='jabber:iq:roster'><item jid='romeo@example.net'/></query></iq>`
+	if resp := handlePush(t, h, other); !strings.Contains(resp, "service-unavailable") {
+		t.Errorf("expected push from another resource to be rejected, got: %s", resp)
 	}
 }
 
@@ -164,3 +568,18 @@ func TestErroredDoesNotPanic(t *testing.T) {
 		t.Errorf("got unexpected error closing iter: %v", err)
 	}
 }
+
+func TestFeatures(t *testing.T) {
+	m := mux.New(roster.Handle(&roster.Handler{}))
+	var features []string
+	err := m.ForFeatures("", func(f info.Feature) error {
+		features = append(features, f.Var)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error listing features: %v", err)
+	}
+	if s := strings.Join(features, ","); s != roster.NS {
+		t.Errorf("wrong features: want=%s, got=%s", roster.NS, s)
+	}
+}
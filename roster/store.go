@@ -0,0 +1,244 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+)
+
+// Store is a local copy of the roster.
+// If the server supports roster versioning, a store that persists between
+// sessions lets the handler fetch only the changes made since the last session
+// instead of the entire roster.
+//
+// Items are keyed by their JID.
+// Each change also records the version of the roster after the change, which
+// is empty if the server does not support roster versioning.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type Store interface {
+	// Ver returns the version of the stored roster, or the empty string if the
+	// roster is not versioned or nothing has been stored yet.
+	Ver() (string, error)
+
+	// Items returns all items in the roster sorted by JID.
+	Items() ([]Item, error)
+
+	// Get returns the item with the given JID.
+	// If there is no such item, ok is false.
+	Get(j jid.JID) (item Item, ok bool, err error)
+
+	// Replace discards the stored roster and replaces it with the items.
+	Replace(ver string, items []Item) error
+
+	// Put adds an item or replaces the item with the same JID.
+	Put(ver string, item Item) error
+
+	// Delete removes the item with the given JID.
+	Delete(ver string, j jid.JID) error
+}
+
+// MemStore is a Store that keeps the roster in memory.
+// The zero value is an empty roster that is ready to use.
+type MemStore struct {
+	mu    sync.Mutex
+	ver   string
+	items map[string]Item
+}
+
+// Ver satisfies the Store interface.
+func (m *MemStore) Ver() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ver, nil
+}
+
+// Items satisfies the Store interface.
+func (m *MemStore) Items() ([]Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list(), nil
+}
+
+func (m *MemStore) list() []Item {
+	items := make([]Item, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].JID.String() < items[j].JID.String()
+	})
+	return items
+}
+
+// Get satisfies the Store interface.
+func (m *MemStore) Get(j jid.JID) (Item, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[j.String()]
+	return item, ok, nil
+}
+
+// Replace satisfies the Store interface.
+func (m *MemStore) Replace(ver string, items []Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replace(ver, items)
+	return nil
+}
+
+func (m *MemStore) replace(ver string, items []Item) {
+	m.ver = ver
+	m.items = make(map[string]Item, len(items))
+	for _, item := range items {
+		m.items[item.JID.String()] = item
+	}
+}
+
+// Put satisfies the Store interface.
+func (m *MemStore) Put(ver string, item Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(ver, item)
+	return nil
+}
+
+func (m *MemStore) put(ver string, item Item) {
+	if m.items == nil {
+		m.items = make(map[string]Item)
+	}
+	m.ver = ver
+	m.items[item.JID.String()] = item
+}
+
+// Delete satisfies the Store interface.
+func (m *MemStore) Delete(ver string, j jid.JID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(ver, j)
+	return nil
+}
+
+func (m *MemStore) remove(ver string, j jid.JID) {
+	m.ver = ver
+	delete(m.items, j.String())
+}
+
+// FileStore is a Store that keeps the roster in memory and saves it to a file
+// after every change.
+// The file contains the roster as a jabber:iq:roster query element.
+type FileStore struct {
+	mem  MemStore
+	path string
+}
+
+// OpenFile returns a FileStore that saves the roster to the named file.
+// If the file exists the roster is loaded from it.
+func OpenFile(path string) (*FileStore, error) {
+	f := &FileStore{path: path}
+	fd, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return f, nil
+	case err != nil:
+		return nil, err
+	}
+	/* #nosec */
+	defer fd.Close()
+
+	query := struct {
+		XMLName xml.Name `xml:"jabber:iq:roster query"`
+		Ver     string   `xml:"ver,attr"`
+		Items   []Item   `xml:"item"`
+	}{}
+	err = xml.NewDecoder(fd).Decode(&query)
+	if err != nil {
+		return nil, err
+	}
+	f.mem.replace(query.Ver, query.Items)
+	return f, nil
+}
+
+// Ver satisfies the Store interface.
+func (f *FileStore) Ver() (string, error) {
+	return f.mem.Ver()
+}
+
+// Items satisfies the Store interface.
+func (f *FileStore) Items() ([]Item, error) {
+	return f.mem.Items()
+}
+
+// Get satisfies the Store interface.
+func (f *FileStore) Get(j jid.JID) (Item, bool, error) {
+	return f.mem.Get(j)
+}
+
+// Replace satisfies the Store interface.
+func (f *FileStore) Replace(ver string, items []Item) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	f.mem.replace(ver, items)
+	return f.save()
+}
+
+// Put satisfies the Store interface.
+func (f *FileStore) Put(ver string, item Item) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	f.mem.put(ver, item)
+	return f.save()
+}
+
+// Delete satisfies the Store interface.
+func (f *FileStore) Delete(ver string, j jid.JID) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	f.mem.remove(ver, j)
+	return f.save()
+}
+
+// save writes the roster to a temporary file and then renames it over the
+// original so that the file is never left partially written.
+// It must be called with the lock held.
+func (f *FileStore) save() error {
+	fd, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	/* #nosec */
+	defer os.Remove(fd.Name())
+
+	var items []xml.TokenReader
+	for _, item := range f.mem.list() {
+		items = append(items, item.TokenReader())
+	}
+	e := xml.NewEncoder(fd)
+	_, err = xmlstream.Copy(e, xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{
+			Name: xml.Name{Local: "query", Space: NS},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "ver"}, Value: f.mem.ver}},
+		},
+	))
+	if err == nil {
+		err = e.Flush()
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), f.path)
+}
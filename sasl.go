@@ -11,11 +11,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"mellium.im/sasl"
 	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
 	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/internal/saslerr"
+	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/stream"
 )
 
@@ -29,7 +32,87 @@ import (
 // For instance, an admin might want to log in as another user to help them
 // troubleshoot an issue.
 // Normally it is left blank and the localpart of the Origin JID is used.
+//
+// SASL can only be used to authenticate initiated sessions, to authenticate
+// users on received sessions see SASLServer.
 func SASL(identity, password string, mechanisms ...sasl.Mechanism) StreamFeature {
+	return saslFeature(identity, password, nil, nil, mechanisms...)
+}
+
+// SASLServer returns a stream feature for authenticating users on received
+// sessions using the Simple Authentication and Security Layer (SASL) as defined
+// in RFC 4422.
+// The mechanisms are advertised to the initiating entity in the order in which
+// they are specified.
+//
+// Permissions is called after the user has been authenticated and should
+// report whether they may log in.
+// For PLAIN the credentials supplied by the initiating entity, which can be
+// retrieved by calling the negotiators Credentials method, have not been
+// checked yet, so permissions must also check the password against the user
+// store.
+// For the SCRAM family of mechanisms the password is never sent, instead the
+// initiating entity proves that it knows the password using the salted password
+// returned by credentials, and the negotiator passed to permissions has an
+// empty password.
+// If the identity is not empty the user is asking to act on behalf of another
+// user and permissions must also check that they are authorized to do so.
+// After authentication succeeds the address of the remote entity is set to the
+// identity if one was provided, or to a bare JID made up of the username and
+// the domainpart of the local address otherwise.
+//
+// Only PLAIN and the SCRAM family of mechanisms are supported, and the SCRAM
+// mechanisms require credentials to be non-nil.
+// The -PLUS variants of the SCRAM mechanisms only support the tls-unique
+// channel binding type and cannot be used over connections that do not provide
+// it.
+// If no mechanisms are specified or any of them cannot be used, the error is
+// returned when the feature is negotiated.
+// SASLServer panics if permissions is nil.
+func SASLServer(permissions func(*sasl.Negotiator) bool, credentials SCRAMCredentials, mechanisms ...sasl.Mechanism) StreamFeature {
+	if permissions == nil {
+		panic("xmpp: attempted to create SASL server feature with nil permissions")
+	}
+	if err := checkSASLServerMechanisms(credentials, mechanisms); err != nil {
+		return StreamFeature{
+			Name:       xml.Name{Space: ns.SASL, Local: "mechanisms"},
+			Necessary:  Secure,
+			Prohibited: Authn,
+			List: func(context.Context, xmlstream.TokenWriter, xml.StartElement) (bool, error) {
+				return true, err
+			},
+			Parse: func(context.Context, xml.TokenReader, *xml.StartElement) (bool, interface{}, error) {
+				return true, nil, err
+			},
+			Negotiate: func(context.Context, *Session, interface{}) (SessionState, io.ReadWriter, error) {
+				return 0, nil, err
+			},
+		}
+	}
+	return saslFeature("", "", permissions, credentials, mechanisms...)
+}
+
+// checkSASLServerMechanisms returns an error if SASLServer cannot negotiate
+// the mechanisms.
+func checkSASLServerMechanisms(credentials SCRAMCredentials, mechanisms []sasl.Mechanism) error {
+	if len(mechanisms) == 0 {
+		return errors.New("xmpp: SASLServer requires at least 1 SASL mechanism")
+	}
+	for _, m := range mechanisms {
+		if m.Name == sasl.Plain.Name {
+			continue
+		}
+		if _, _, ok := scramMechanism(m.Name); !ok {
+			return fmt.Errorf("xmpp: SASL mechanism %s cannot be used by SASLServer", m.Name)
+		}
+		if credentials == nil {
+			return fmt.Errorf("xmpp: SASL mechanism %s cannot be used by SASLServer without SCRAM credentials", m.Name)
+		}
+	}
+	return nil
+}
+
+func saslFeature(identity, password string, permissions func(*sasl.Negotiator) bool, credentials SCRAMCredentials, mechanisms ...sasl.Mechanism) StreamFeature {
 	if len(mechanisms) == 0 {
 		panic("xmpp: Must specify at least 1 SASL mechanism")
 	}
@@ -73,7 +156,13 @@ func SASL(identity, password string, mechanisms ...sasl.Mechanism) StreamFeature
 		},
 		Negotiate: func(ctx context.Context, session *Session, data interface{}) (mask SessionState, rw io.ReadWriter, err error) {
 			if (session.State() & Received) == Received {
-				panic("SASL server not yet implemented")
+				if permissions == nil {
+					return mask, nil, errors.New("xmpp: SASL cannot be used on received sessions, use SASLServer instead")
+				}
+				return negotiateSASLServer(ctx, session, permissions, credentials, mechanisms)
+			}
+			if permissions != nil {
+				return mask, nil, errors.New("xmpp: SASLServer cannot be used on initiated sessions, use SASL instead")
 			}
 
 			c := session.Conn()
@@ -233,3 +322,238 @@ func decodeSASLChallenge(d *xml.Decoder, start xml.StartElement, allowChallenge
 		return nil, false, stream.UnsupportedStanzaType
 	}
 }
+
+// saslAttempts is the number of times an initiating entity may try to
+// authenticate before the receiving entity gives up.
+// RFC 6120 §6.4.5 recommends between 2 and 5.
+const saslAttempts = 3
+
+func negotiateSASLServer(ctx context.Context, session *Session, permissions func(*sasl.Negotiator) bool, credentials SCRAMCredentials, mechanisms []sasl.Mechanism) (mask SessionState, rw io.ReadWriter, err error) {
+	r := session.TokenReader()
+	defer r.Close()
+	d := xml.NewTokenDecoder(r)
+	w := session.TokenWriter()
+	defer w.Close()
+
+	var failure error
+	for i := 0; i < saslAttempts; i++ {
+		tok, err := d.Token()
+		if err != nil {
+			return mask, nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			// If we've already sent a failure and the initiating entity gave up
+			// instead of trying again, return the original failure.
+			if failure != nil {
+				return mask, nil, failure
+			}
+			return mask, nil, stream.BadFormat
+		}
+		if start.Name != (xml.Name{Space: ns.SASL, Local: "auth"}) {
+			return mask, nil, stream.UnsupportedStanzaType
+		}
+
+		var origin jid.JID
+		origin, err = saslServerAuth(ctx, session, d, w, start, permissions, credentials, mechanisms)
+		switch f := err.(type) {
+		case nil:
+			session.origin = origin
+			return Authn, session.Conn(), nil
+		case saslerr.Failure:
+			failure = f
+			if _, err = f.WriteXML(w); err != nil {
+				return mask, nil, err
+			}
+			if err = w.Flush(); err != nil {
+				return mask, nil, err
+			}
+		default:
+			return mask, nil, err
+		}
+	}
+	return mask, nil, failure
+}
+
+// saslServerAuth performs a single authentication exchange starting with the
+// provided <auth/> element.
+// If authentication fails the error will be a saslerr.Failure that should be
+// sent to the initiating entity.
+func saslServerAuth(ctx context.Context, session *Session, d *xml.Decoder, w xmlstream.TokenWriteFlushCloser, start xml.StartElement, permissions func(*sasl.Negotiator) bool, credentials SCRAMCredentials, mechanisms []sasl.Mechanism) (jid.JID, error) {
+	_, name := attr.Get(start.Attr, "mechanism")
+	auth := struct {
+		Data []byte `xml:",chardata"`
+	}{}
+	if err := d.DecodeElement(&auth, &start); err != nil {
+		return jid.JID{}, err
+	}
+
+	var selected sasl.Mechanism
+	for _, m := range mechanisms {
+		if m.Name == name {
+			selected = m
+			break
+		}
+	}
+	if selected.Name == "" {
+		return jid.JID{}, saslerr.Failure{Condition: saslerr.InvalidMechanism}
+	}
+
+	var username, identity []byte
+	authorize := func(n *sasl.Negotiator) bool {
+		if !permissions(n) {
+			return false
+		}
+		username, _, identity = n.Credentials()
+		return true
+	}
+	connState := session.ConnectionState()
+	var server interface {
+		Step([]byte) (bool, []byte, error)
+	}
+	if h, plus, ok := scramMechanism(selected.Name); ok {
+		scram := &scramServer{
+			mechanism:   selected,
+			hash:        h,
+			plus:        plus,
+			tlsUnique:   connState.TLSUnique,
+			credentials: credentials,
+			permissions: authorize,
+		}
+		for _, m := range mechanisms {
+			if strings.HasSuffix(m.Name, "-PLUS") && len(connState.TLSUnique) > 0 {
+				scram.cbSupported = true
+			}
+		}
+		server = scram
+	} else {
+		var opts []sasl.Option
+		if connState.Version != 0 {
+			opts = append(opts, sasl.TLSState(connState))
+		}
+		server = sasl.NewServer(selected, authorize, opts...)
+	}
+
+	// RFC6120 §6.4.2:
+	//     If the initiating entity needs to send a zero-length initial
+	//     response, it MUST transmit the response as a single equals sign
+	//     character ("="), which indicates that the response is present but
+	//     contains no data.
+	//
+	// If no initial response was sent at all, send an empty challenge to ask for
+	// one.
+	var resp []byte
+	var err error
+	switch {
+	case len(auth.Data) == 0:
+		if err = writeSASLElement(w, "challenge", nil); err != nil {
+			return jid.JID{}, err
+		}
+		resp, err = readSASLResponse(d)
+		if err != nil {
+			return jid.JID{}, err
+		}
+	case string(auth.Data) == "=":
+	default:
+		resp, err = decodeSASLData(auth.Data)
+		if err != nil {
+			return jid.JID{}, err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return jid.JID{}, ctx.Err()
+		default:
+		}
+
+		more, challenge, err := server.Step(resp)
+		switch err {
+		case nil:
+		case sasl.ErrInvalidChallenge, sasl.ErrTooManySteps:
+			return jid.JID{}, saslerr.Failure{Condition: saslerr.MalformedRequest}
+		default:
+			return jid.JID{}, saslerr.Failure{Condition: saslerr.NotAuthorized}
+		}
+		if more {
+			if err = writeSASLElement(w, "challenge", challenge); err != nil {
+				return jid.JID{}, err
+			}
+			resp, err = readSASLResponse(d)
+			if err != nil {
+				return jid.JID{}, err
+			}
+			continue
+		}
+
+		var origin jid.JID
+		if len(identity) > 0 {
+			origin, err = jid.Parse(string(identity))
+			if err != nil {
+				return jid.JID{}, saslerr.Failure{Condition: saslerr.InvalidAuthzID}
+			}
+		} else {
+			origin, err = jid.New(string(username), session.LocalAddr().Domainpart(), "")
+			if err != nil {
+				return jid.JID{}, saslerr.Failure{Condition: saslerr.NotAuthorized}
+			}
+		}
+		return origin, writeSASLElement(w, "success", challenge)
+	}
+}
+
+// readSASLResponse reads a <response/> from the initiating entity and returns
+// its decoded payload.
+// If the initiating entity aborts the exchange an aborted failure is returned.
+func readSASLResponse(d *xml.Decoder) ([]byte, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return nil, stream.BadFormat
+	}
+	switch start.Name {
+	case xml.Name{Space: ns.SASL, Local: "response"}:
+		resp := struct {
+			Data []byte `xml:",chardata"`
+		}{}
+		if err = d.DecodeElement(&resp, &start); err != nil {
+			return nil, err
+		}
+		return decodeSASLData(resp.Data)
+	case xml.Name{Space: ns.SASL, Local: "abort"}:
+		if err = d.Skip(); err != nil {
+			return nil, err
+		}
+		return nil, saslerr.Failure{Condition: saslerr.Aborted}
+	}
+	return nil, stream.UnsupportedStanzaType
+}
+
+func decodeSASLData(data []byte) ([]byte, error) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return nil, saslerr.Failure{Condition: saslerr.IncorrectEncoding}
+	}
+	return decoded[:n], nil
+}
+
+// writeSASLElement writes a challenge or success element containing the
+// base64 encoded data.
+func writeSASLElement(w xmlstream.TokenWriteFlushCloser, local string, data []byte) error {
+	var inner xml.TokenReader
+	if len(data) > 0 {
+		inner = xmlstream.Token(xml.CharData(base64.StdEncoding.EncodeToString(data)))
+	}
+	_, err := xmlstream.Copy(w, xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: ns.SASL, Local: local},
+	}))
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
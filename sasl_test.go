@@ -7,13 +7,25 @@ package xmpp_test
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/pbkdf2"
 	"mellium.im/sasl"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/internal/saslerr"
+	"mellium.im/xmpp/jid"
 )
 
 func TestSASLPanicsNoMechanisms(t *testing.T) {
@@ -132,3 +144,329 @@ func TestSASLParse(t *testing.T) {
 		}
 	}
 }
+
+func TestSASLServerPanicsNilPermissions(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected call to SASLServer() with nil permissions to panic")
+		}
+	}()
+	_ = xmpp.SASLServer(nil, nil, sasl.Plain)
+}
+
+func TestSASLServerBadMechanisms(t *testing.T) {
+	permissions := func(*sasl.Negotiator) bool { return true }
+	for i, tc := range []struct {
+		credentials xmpp.SCRAMCredentials
+		mechanisms  []sasl.Mechanism
+	}{
+		0: {},
+		1: {mechanisms: []sasl.Mechanism{sasl.Plain, sasl.ScramSha256}},
+		2: {mechanisms: []sasl.Mechanism{sasl.ScramSha1Plus}},
+		3: {credentials: scramStore{}, mechanisms: []sasl.Mechanism{sasl.Plain, {Name: "EXTERNAL"}}},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			feature := xmpp.SASLServer(permissions, tc.credentials, tc.mechanisms...)
+			b := &bytes.Buffer{}
+			e := xml.NewEncoder(b)
+			start := xml.StartElement{Name: xml.Name{Space: ns.SASL, Local: "mechanisms"}}
+			if _, err := feature.List(context.Background(), e, start); err == nil {
+				t.Errorf("expected listing the feature to fail")
+			}
+			if _, _, err := feature.Negotiate(context.Background(), nil, nil); err == nil {
+				t.Errorf("expected negotiating the feature to fail")
+			}
+		})
+	}
+}
+
+// scramStore maps usernames to passwords and derives the SCRAM credentials from
+// them.
+type scramStore map[string]string
+
+func (s scramStore) SCRAM(username string, h crypto.Hash) ([]byte, int, []byte, error) {
+	password, ok := s[username]
+	if !ok {
+		return nil, 0, nil, errors.New("no such user")
+	}
+	const iter = 4096
+	salt := []byte("salt for " + username)
+	return salt, iter, pbkdf2.Key([]byte(password), salt, iter, h.Size(), h.New), nil
+}
+
+func TestSASLServerNotAdvertised(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	clientConn, serverConn := net.Pipe()
+	permissions := func(*sasl.Negotiator) bool { return true }
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := xmpp.NegotiateSession(ctx, location, jid.JID{}, serverConn, true, withState(xmpp.Secure,
+			xmpp.SASLServer(permissions, nil, sasl.Plain),
+		))
+		serverErr <- err
+	}()
+
+	// Try to authenticate with SCRAM even though only PLAIN is advertised.
+	d := xml.NewDecoder(clientConn)
+	_, err := fmt.Fprintf(clientConn, `<stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams" to="example.net" version="1.0">`)
+	if err != nil {
+		t.Fatalf("error writing stream header: %v", err)
+	}
+	var mechanisms []string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("error reading stream features: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "mechanism" {
+			var name string
+			if err = d.DecodeElement(&name, &start); err != nil {
+				t.Fatalf("error decoding mechanism: %v", err)
+			}
+			mechanisms = append(mechanisms, name)
+		}
+		if end, ok := tok.(xml.EndElement); ok && end.Name.Local == "features" {
+			break
+		}
+	}
+	if len(mechanisms) != 1 || mechanisms[0] != sasl.Plain.Name {
+		t.Errorf("wrong mechanisms advertised: want=[%s], got=%v", sasl.Plain.Name, mechanisms)
+	}
+
+	client := sasl.NewClient(sasl.ScramSha1, sasl.Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("juliet"), []byte("secret"), nil
+	}))
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatalf("error starting SCRAM exchange: %v", err)
+	}
+	_, err = fmt.Fprintf(clientConn, `<auth xmlns="%s" mechanism="%s">%s</auth>`, ns.SASL, sasl.ScramSha1.Name, base64.StdEncoding.EncodeToString(resp))
+	if err != nil {
+		t.Fatalf("error writing auth: %v", err)
+	}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("error reading failure: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "failure" {
+			continue
+		}
+		failure := saslerr.Failure{}
+		if err = d.DecodeElement(&failure, &start); err != nil {
+			t.Fatalf("error decoding failure: %v", err)
+		}
+		if failure.Condition != saslerr.InvalidMechanism {
+			t.Errorf("wrong failure condition: want=%v, got=%v", saslerr.InvalidMechanism, failure.Condition)
+		}
+		break
+	}
+
+	/* #nosec */
+	clientConn.Close()
+	if err = <-serverErr; err == nil {
+		t.Errorf("expected server error after failed authentication")
+	}
+}
+
+func TestSASLServer(t *testing.T) {
+	permissions := func(n *sasl.Negotiator) bool {
+		user, pass, identity := n.Credentials()
+		return string(user) == "juliet" && string(pass) == "secret" &&
+			(len(identity) == 0 || string(identity) == "nurse@example.net")
+	}
+
+	for i, tc := range []struct {
+		password string
+		identity string
+		err      error
+		origin   string
+	}{
+		0: {password: "secret", origin: "juliet@example.net"},
+		1: {password: "secret", identity: "nurse@example.net", origin: "nurse@example.net"},
+		2: {password: "wrong", err: saslerr.Failure{Condition: saslerr.NotAuthorized}},
+		3: {password: "secret", identity: "romeo@example.net", err: saslerr.Failure{Condition: saslerr.NotAuthorized}},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			location := jid.MustParse("example.net")
+			origin := jid.MustParse("juliet@example.net")
+			clientConn, serverConn := net.Pipe()
+
+			type result struct {
+				s   *xmpp.Session
+				err error
+			}
+			serverResult := make(chan result, 1)
+			go func() {
+				s, err := xmpp.NegotiateSession(ctx, location, jid.JID{}, serverConn, true, withState(xmpp.Secure,
+					xmpp.SASLServer(permissions, nil, sasl.Plain),
+					xmpp.BindResource(),
+				))
+				serverResult <- result{s: s, err: err}
+			}()
+
+			client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Secure,
+				xmpp.SASL(tc.identity, tc.password, sasl.Plain),
+				xmpp.BindResource(),
+			))
+			if err != tc.err {
+				t.Fatalf("unexpected client error: want=%v, got=%v", tc.err, err)
+			}
+			if tc.err != nil {
+				/* #nosec */
+				clientConn.Close()
+				if res := <-serverResult; res.err == nil {
+					t.Fatalf("expected server error after failed authentication")
+				}
+				return
+			}
+
+			res := <-serverResult
+			if res.err != nil {
+				t.Fatalf("unexpected server error: %v", res.err)
+			}
+			if client.State()&xmpp.Authn == 0 || res.s.State()&xmpp.Authn == 0 {
+				t.Errorf("expected both sessions to be authenticated, got client=%v, server=%v", client.State(), res.s.State())
+			}
+			if addr := res.s.RemoteAddr().Bare().String(); addr != tc.origin {
+				t.Errorf("wrong authenticated address: want=%s, got=%s", tc.origin, addr)
+			}
+			if !res.s.RemoteAddr().Equal(client.LocalAddr()) {
+				t.Errorf("client and server disagree on bound address: client=%v, server=%v", client.LocalAddr(), res.s.RemoteAddr())
+			}
+		})
+	}
+}
+
+func TestSASLServerSCRAM(t *testing.T) {
+	credentials := scramStore{"juliet": "secret"}
+	permissions := func(n *sasl.Negotiator) bool {
+		_, pass, identity := n.Credentials()
+		return len(pass) == 0 && (len(identity) == 0 || string(identity) == "nurse@example.net")
+	}
+	notAuthorized := saslerr.Failure{Condition: saslerr.NotAuthorized}
+
+	for i, tc := range []struct {
+		mechanism sasl.Mechanism
+		username  string
+		password  string
+		identity  string
+		err       error
+		origin    string
+	}{
+		0: {mechanism: sasl.ScramSha1, username: "juliet", password: "secret", origin: "juliet@example.net"},
+		1: {mechanism: sasl.ScramSha256, username: "juliet", password: "secret", origin: "juliet@example.net"},
+		2: {mechanism: sasl.ScramSha256, username: "juliet", password: "secret", identity: "nurse@example.net", origin: "nurse@example.net"},
+		3: {mechanism: sasl.ScramSha256, username: "juliet", password: "wrong", err: notAuthorized},
+		4: {mechanism: sasl.ScramSha256, username: "romeo", password: "secret", err: notAuthorized},
+		5: {mechanism: sasl.ScramSha1, username: "juliet", password: "secret", identity: "romeo@example.net", err: notAuthorized},
+		// Without TLS there is nothing to bind to.
+		6: {mechanism: sasl.ScramSha256Plus, username: "juliet", password: "secret", err: notAuthorized},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			location := jid.MustParse("example.net")
+			origin := jid.MustParse(tc.username + "@example.net")
+			clientConn, serverConn := net.Pipe()
+
+			type result struct {
+				s   *xmpp.Session
+				err error
+			}
+			serverResult := make(chan result, 1)
+			go func() {
+				s, err := xmpp.NegotiateSession(ctx, location, jid.JID{}, serverConn, true, withState(xmpp.Secure,
+					xmpp.SASLServer(permissions, credentials, sasl.ScramSha256Plus, sasl.ScramSha256, sasl.ScramSha1),
+					xmpp.BindResource(),
+				))
+				serverResult <- result{s: s, err: err}
+			}()
+
+			client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Secure,
+				xmpp.SASL(tc.identity, tc.password, tc.mechanism),
+				xmpp.BindResource(),
+			))
+			if err != tc.err {
+				t.Fatalf("unexpected client error: want=%v, got=%v", tc.err, err)
+			}
+			if tc.err != nil {
+				/* #nosec */
+				clientConn.Close()
+				if res := <-serverResult; res.err == nil {
+					t.Fatalf("expected server error after failed authentication")
+				}
+				return
+			}
+
+			res := <-serverResult
+			if res.err != nil {
+				t.Fatalf("unexpected server error: %v", res.err)
+			}
+			if addr := res.s.RemoteAddr().Bare().String(); addr != tc.origin {
+				t.Errorf("wrong authenticated address: want=%s, got=%s", tc.origin, addr)
+			}
+			if !res.s.RemoteAddr().Equal(client.LocalAddr()) {
+				t.Errorf("client and server disagree on bound address: client=%v, server=%v", client.LocalAddr(), res.s.RemoteAddr())
+			}
+		})
+	}
+}
+
+func TestSASLServerSCRAMPlus(t *testing.T) {
+	cert := selfSigned(t, "example.net")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		s   *xmpp.Session
+		err error
+	}
+	serverResult := make(chan result, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, jid.JID{}, serverConn, true, withState(0,
+			xmpp.StartTLS(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				// The tls-unique channel binding type does not exist in TLS 1.3.
+				MaxVersion: tls.VersionTLS12,
+			}),
+			xmpp.SASLServer(func(*sasl.Negotiator) bool { return true }, scramStore{"juliet": "secret"}, sasl.ScramSha256Plus, sasl.ScramSha256),
+			xmpp.BindResource(),
+		))
+		serverResult <- result{s: s, err: err}
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(0,
+		xmpp.StartTLS(&tls.Config{
+			ServerName: "example.net",
+			RootCAs:    pool,
+		}),
+		xmpp.SASL("", "secret", sasl.ScramSha256Plus),
+		xmpp.BindResource(),
+	))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	res := <-serverResult
+	if res.err != nil {
+		t.Fatalf("error negotiating server session: %v", res.err)
+	}
+	if !res.s.RemoteAddr().Equal(client.LocalAddr()) {
+		t.Errorf("client and server disagree on bound address: client=%v, server=%v", client.LocalAddr(), res.s.RemoteAddr())
+	}
+}
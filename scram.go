@@ -0,0 +1,265 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	_ "crypto/sha1"   // Register SHA-1 for SCRAM-SHA-1.
+	_ "crypto/sha256" // Register SHA-256 for SCRAM-SHA-256.
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"mellium.im/sasl"
+)
+
+// SCRAMCredentials looks up the credentials of users authenticating with the
+// SCRAM family of SASL mechanisms (RFC 5802) on received sessions.
+//
+// With SCRAM the password is never sent to the receiving entity, so instead of
+// checking the password the user store must keep the salted password that was
+// derived from it when it was set.
+type SCRAMCredentials interface {
+	// SCRAM returns the salt, iteration count, and salted password of the user
+	// for the hash function used by the mechanism (SHA-1 for SCRAM-SHA-1 and
+	// SHA-256 for SCRAM-SHA-256).
+	// The salted password is the result of PBKDF2 using HMAC with the hash
+	// function, the user's password, the salt, and the iteration count and must
+	// be the size of the hash function's output.
+	// If the user does not exist or has no credentials for the hash function an
+	// error should be returned.
+	SCRAM(username string, h crypto.Hash) (salt []byte, iter int, saltedPassword []byte, err error)
+}
+
+var (
+	scramClientKey = []byte("Client Key")
+	scramServerKey = []byte("Server Key")
+)
+
+// scramNonceLen is the number of random bytes added to the initiating entity's
+// nonce.
+const scramNonceLen = 18
+
+// scramMechanism returns the hash function used by a SCRAM mechanism and
+// whether the mechanism uses channel binding.
+// If the mechanism is not part of the SCRAM family ok is false.
+func scramMechanism(name string) (h crypto.Hash, plus, ok bool) {
+	plus = strings.HasSuffix(name, "-PLUS")
+	switch strings.TrimSuffix(name, "-PLUS") {
+	case sasl.ScramSha1.Name:
+		return crypto.SHA1, plus, true
+	case sasl.ScramSha256.Name:
+		return crypto.SHA256, plus, true
+	}
+	return 0, false, false
+}
+
+// scramServer performs the receiving side of a SCRAM exchange, which is not
+// supported by the sasl package.
+// Its Step method behaves like the Step method of a sasl.Negotiator and
+// returns the same errors.
+type scramServer struct {
+	mechanism   sasl.Mechanism
+	hash        crypto.Hash
+	plus        bool
+	cbSupported bool
+	tlsUnique   []byte
+	credentials SCRAMCredentials
+	permissions func(*sasl.Negotiator) bool
+
+	step            int
+	gs2Header       []byte
+	clientFirstBare []byte
+	serverFirst     []byte
+	nonce           []byte
+	saltedPassword  []byte
+	username        []byte
+	identity        []byte
+}
+
+// Step handles the client-first-message and the client-final-message and
+// returns the server-first-message and server-final-message in response.
+func (s *scramServer) Step(resp []byte) (more bool, challenge []byte, err error) {
+	s.step++
+	switch s.step {
+	case 1:
+		return s.clientFirst(resp)
+	case 2:
+		return s.clientFinal(resp)
+	}
+	return false, nil, sasl.ErrTooManySteps
+}
+
+func (s *scramServer) clientFirst(msg []byte) (bool, []byte, error) {
+	parts := bytes.SplitN(msg, []byte{','}, 3)
+	if len(parts) != 3 {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	cbFlag, authzID, bare := parts[0], parts[1], parts[2]
+
+	switch {
+	case string(cbFlag) == "n":
+		if s.plus {
+			return false, nil, sasl.ErrAuthn
+		}
+	case string(cbFlag) == "y":
+		// RFC 5802 §6:
+		//     If the flag is set to "y" and the server supports channel
+		//     binding, the server MUST fail authentication.  This is because if
+		//     the client sets the channel binding flag to "y", then the client
+		//     must have seen the server's mechanism list without any -PLUS
+		//     mechanisms.
+		if s.plus || s.cbSupported {
+			return false, nil, sasl.ErrAuthn
+		}
+	case string(cbFlag) == "p=tls-unique":
+		if !s.plus || len(s.tlsUnique) == 0 {
+			return false, nil, sasl.ErrAuthn
+		}
+	case bytes.HasPrefix(cbFlag, []byte("p=")):
+		// Only the tls-unique channel binding type is supported.
+		return false, nil, sasl.ErrAuthn
+	default:
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+
+	if len(authzID) > 0 {
+		if !bytes.HasPrefix(authzID, []byte("a=")) {
+			return false, nil, sasl.ErrInvalidChallenge
+		}
+		identity, ok := scramUnescape(authzID[2:])
+		if !ok {
+			return false, nil, sasl.ErrInvalidChallenge
+		}
+		s.identity = identity
+	}
+
+	fields := bytes.Split(bare, []byte{','})
+	if len(fields) < 2 ||
+		!bytes.HasPrefix(fields[0], []byte("n=")) ||
+		!bytes.HasPrefix(fields[1], []byte("r=")) ||
+		len(fields[1]) == 2 {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	username, ok := scramUnescape(fields[0][2:])
+	if !ok || len(username) == 0 {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	s.username = username
+
+	salt, iter, saltedPassword, err := s.credentials.SCRAM(string(username), s.hash)
+	if err != nil || iter < 1 || len(saltedPassword) != s.hash.Size() {
+		return false, nil, sasl.ErrAuthn
+	}
+	s.saltedPassword = saltedPassword
+
+	random := make([]byte, scramNonceLen)
+	if _, err = rand.Read(random); err != nil {
+		return false, nil, err
+	}
+	s.nonce = append(append([]byte{}, fields[1][2:]...), base64.StdEncoding.EncodeToString(random)...)
+
+	s.gs2Header = msg[:len(msg)-len(bare)]
+	s.clientFirstBare = bare
+	s.serverFirst = []byte("r=" + string(s.nonce) +
+		",s=" + base64.StdEncoding.EncodeToString(salt) +
+		",i=" + strconv.Itoa(iter))
+	return true, s.serverFirst, nil
+}
+
+func (s *scramServer) clientFinal(msg []byte) (bool, []byte, error) {
+	idx := bytes.LastIndex(msg, []byte(",p="))
+	if idx < 0 {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	withoutProof := msg[:idx]
+	fields := bytes.Split(withoutProof, []byte{','})
+	if len(fields) < 2 ||
+		!bytes.HasPrefix(fields[0], []byte("c=")) ||
+		!bytes.HasPrefix(fields[1], []byte("r=")) {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	cbInput, err := base64.StdEncoding.DecodeString(string(fields[0][2:]))
+	if err != nil {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+	proof, err := base64.StdEncoding.DecodeString(string(msg[idx+3:]))
+	if err != nil {
+		return false, nil, sasl.ErrInvalidChallenge
+	}
+
+	wantCBInput := s.gs2Header
+	if s.plus {
+		wantCBInput = append(append([]byte{}, s.gs2Header...), s.tlsUnique...)
+	}
+	if !hmac.Equal(cbInput, wantCBInput) || !bytes.Equal(fields[1][2:], s.nonce) {
+		return false, nil, sasl.ErrAuthn
+	}
+
+	authMessage := make([]byte, 0, len(s.clientFirstBare)+len(s.serverFirst)+len(withoutProof)+2)
+	authMessage = append(authMessage, s.clientFirstBare...)
+	authMessage = append(authMessage, ',')
+	authMessage = append(authMessage, s.serverFirst...)
+	authMessage = append(authMessage, ',')
+	authMessage = append(authMessage, withoutProof...)
+
+	clientKey := s.hmac(s.saltedPassword, scramClientKey)
+	h := s.hash.New()
+	/* #nosec */
+	h.Write(clientKey)
+	clientSignature := s.hmac(h.Sum(nil), authMessage)
+	wantProof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		wantProof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	if !hmac.Equal(proof, wantProof) {
+		return false, nil, sasl.ErrAuthn
+	}
+
+	// The proof only shows that the user knows the password, permissions still
+	// decides whether they may log in (and act as the identity, if any).
+	n := sasl.NewServer(s.mechanism, nil, sasl.Credentials(func() ([]byte, []byte, []byte) {
+		return s.username, nil, s.identity
+	}))
+	if !s.permissions(n) {
+		return false, nil, sasl.ErrAuthn
+	}
+
+	serverSignature := s.hmac(s.hmac(s.saltedPassword, scramServerKey), authMessage)
+	return false, []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func (s *scramServer) hmac(key, data []byte) []byte {
+	mac := hmac.New(s.hash.New, key)
+	/* #nosec */
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramUnescape decodes a saslname, replacing "=2C" with "," and "=3D" with
+// "=".
+// If the name contains any other escape sequence ok is false.
+func scramUnescape(name []byte) (unescaped []byte, ok bool) {
+	unescaped = make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			unescaped = append(unescaped, name[i])
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(name[i:], []byte("=2C")):
+			unescaped = append(unescaped, ',')
+		case bytes.HasPrefix(name[i:], []byte("=3D")):
+			unescaped = append(unescaped, '=')
+		default:
+			return nil, false
+		}
+		i += 2
+	}
+	return unescaped, true
+}
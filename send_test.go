@@ -12,6 +12,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -280,3 +281,91 @@ func TestSend(t *testing.T) {
 		})
 	}
 }
+
+// respondWriter writes a response to the input stream the first time anything
+// is written to the output stream.
+type respondWriter struct {
+	once sync.Once
+	w    io.Writer
+	resp string
+}
+
+func (w *respondWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		go func() {
+			/* #nosec */
+			io.WriteString(w.w, w.resp)
+		}()
+	})
+	return len(p), nil
+}
+
+type unmarshalPayload struct {
+	XMLName xml.Name `xml:"urn:example query"`
+	A       string   `xml:"a"`
+}
+
+var unmarshalIQTests = [...]struct {
+	resp    string
+	err     error
+	payload unmarshalPayload
+}{
+	0: {
+		resp:    `<iq type="result" id="123"><query xmlns="urn:example"><a>foo</a></query></iq>`,
+		payload: unmarshalPayload{XMLName: xml.Name{Space: "urn:example", Local: "query"}, A: "foo"},
+	},
+	1: {
+		resp: `<iq type="result" id="123"></iq>`,
+	},
+	2: {
+		resp: `<iq type="error" id="123"><query xmlns="urn:example"><a>foo</a></query><error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`,
+		err:  stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound},
+	},
+	3: {
+		resp: `<iq type="error" id="123"></iq>`,
+		err:  stanza.Error{Condition: stanza.UndefinedCondition},
+	},
+}
+
+func TestUnmarshalIQ(t *testing.T) {
+	for i, tc := range unmarshalIQTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			pr, pw := io.Pipe()
+			s := xmpptest.NewSession(0, struct {
+				io.Reader
+				io.Writer
+			}{
+				Reader: pr,
+				Writer: &respondWriter{w: pw, resp: tc.resp},
+			})
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- s.Serve(nil)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var payload unmarshalPayload
+			err := s.UnmarshalIQElement(ctx, nil, stanza.IQ{ID: testIQID, Type: stanza.GetIQ}, &payload)
+			switch se, ok := err.(stanza.Error); {
+			case tc.err == nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.err != nil && !ok:
+				t.Errorf("wrong error type: want=stanza.Error, got=%T(%[1]v)", err)
+			case tc.err != nil && (se.Type != tc.err.(stanza.Error).Type || se.Condition != tc.err.(stanza.Error).Condition):
+				t.Errorf("wrong error: want=%#v, got=%#v", tc.err, se)
+			}
+			if payload != tc.payload {
+				t.Errorf("wrong payload: want=%+v, got=%+v", tc.payload, payload)
+			}
+
+			if err = pw.Close(); err != nil {
+				t.Errorf("error closing input: %v", err)
+			}
+			if err = <-serveErr; err != nil {
+				t.Errorf("error serving: %v", err)
+			}
+		})
+	}
+}
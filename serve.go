@@ -0,0 +1,284 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"hash/fnv"
+	"io"
+	"runtime"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+// workerQueueSize is the number of elements that may be waiting for each worker
+// before the remote entity is considered to be flooding the stream.
+const workerQueueSize = 256
+
+// ServeConcurrent is like Serve except that it buffers each incoming element
+// and runs the handler on a pool of worker goroutines instead of the goroutine
+// reading from the input stream.
+// If workers is less than one, one worker per CPU is used.
+//
+// Elements from the same sender (as determined by their "from" attribute) are
+// always handled by the same worker in the order in which they were received,
+// but elements from different senders may be handled concurrently.
+// Responses to IQs sent with SendIQ are still delivered directly by the input
+// stream.
+//
+// Unlike Serve, no locks are held while the handler is running, so it is safe
+// for the handler to close over the session and use any of its send methods,
+// including blocking on SendIQ until a response is received.
+// Anything written to the TokenReadEncoder passed to the handler is buffered
+// and written to the output stream all at once after the handler returns.
+// Reading from the input stream never waits for a worker, otherwise a handler
+// waiting on the response to an IQ could block the stream that the response
+// would be read from, so elements are queued until a worker is available to
+// handle them.
+// If more than a fixed number of elements are waiting for any one worker, the
+// stream is closed with a policy-violation error as if it had been returned by
+// the handler.
+//
+// If the handler returns an error it is sent as described for Serve and
+// ServeConcurrent continues until the input stream is closed by the remote
+// entity before returning the error.
+// Before ServeConcurrent returns it waits for any running handlers to finish.
+func (s *Session) ServeConcurrent(h Handler, workers int) (err error) {
+	if h == nil {
+		h = nopHandler{}
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	p := newWorkerPool(s, h, workers)
+	defer func() {
+		p.wait()
+		s.closeInputStream()
+		e := s.Close()
+		// A handler error is the reason for any other error, so it takes priority.
+		if perr := p.Err(); perr != nil {
+			err = perr
+		}
+		if err == nil {
+			err = e
+		}
+	}()
+
+	for {
+		select {
+		case <-s.in.ctx.Done():
+			return s.in.ctx.Err()
+		default:
+		}
+		err := handleInputStream(s, h, p)
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return s.sendError(err)
+		}
+	}
+}
+
+// pooledElement is an element that has been read from the input stream and is
+// waiting to be handled.
+type pooledElement struct {
+	start     xml.StartElement
+	toks      []xml.Token
+	id        string
+	needsResp bool
+	stanza    bool
+}
+
+// workerPool dispatches elements to a fixed number of workers.
+type workerPool struct {
+	s      *Session
+	h      Handler
+	queues []chan pooledElement
+	wg     sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newWorkerPool(s *Session, h Handler, workers int) *workerPool {
+	p := &workerPool{
+		s:      s,
+		h:      h,
+		queues: make([]chan pooledElement, workers),
+	}
+	p.wg.Add(workers)
+	for i := range p.queues {
+		q := make(chan pooledElement, workerQueueSize)
+		p.queues[i] = q
+		go func() {
+			defer p.wg.Done()
+			for el := range q {
+				if p.Err() != nil {
+					// If a handler has already failed the session is shutting down, so
+					// drop anything that is left.
+					continue
+				}
+				err := p.handle(el)
+				// Like Serve, stanzas only count as handled for the purpose of stream
+				// management once the handler has run.
+				if el.stanza && p.s.sm != nil {
+					p.s.sm.handled()
+				}
+				if err != nil {
+					p.fail(err)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch reads the rest of the element from r and queues it on the worker
+// for its sender.
+// It never blocks waiting for a worker, if the queue is full the element is
+// dropped and the session fails with a policy-violation stream error instead.
+func (p *workerPool) dispatch(r xml.TokenReader, start xml.StartElement, id string, needsResp bool) error {
+	el := pooledElement{
+		start:     xml.CopyToken(start).(xml.StartElement),
+		id:        id,
+		needsResp: needsResp,
+		stanza:    isStanza(start.Name),
+	}
+	inner := xmlstream.Inner(r)
+	for {
+		tok, err := inner.Token()
+		if tok != nil {
+			el.toks = append(el.toks, xml.CopyToken(tok))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	el.toks = append(el.toks, start.End())
+
+	var from string
+	for _, a := range start.Attr {
+		if a.Name.Local == "from" {
+			from = a.Value
+			break
+		}
+	}
+	hash := fnv.New32a()
+	/* #nosec */
+	io.WriteString(hash, from)
+	select {
+	case p.queues[hash.Sum32()%uint32(len(p.queues))] <- el:
+	default:
+		p.fail(stream.PolicyViolation)
+	}
+	return nil
+}
+
+// handle runs the handler for a single element and writes any output.
+func (p *workerPool) handle(el pooledElement) error {
+	buf := &tokenBuffer{}
+	rw := &responseChecker{
+		TokenReader: &tokenBuffer{toks: el.toks},
+		TokenWriter: buf,
+		id:          el.id,
+	}
+	if err := p.h.HandleXMPP(rw, &el.start); err != nil {
+		return err
+	}
+
+	// If the user did not write a response to an IQ, send a default one.
+	if el.needsResp && !rw.wroteResp {
+		_, err := xmlstream.Copy(buf, stanza.IQ{
+			ID:   el.id,
+			Type: stanza.ErrorIQ,
+		}.Wrap(stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.ServiceUnavailable,
+		}.TokenReader()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(buf.toks) == 0 {
+		return nil
+	}
+	w := p.s.TokenWriter()
+	defer w.Close()
+	if _, err := xmlstream.Copy(w, buf); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// fail records the first error returned by a handler (or the policy violation
+// of a remote entity that filled a queue) and sends it over the stream.
+func (p *workerPool) fail(err error) {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	// Like sendError, anything other than a stream error is sent as an
+	// undefined-condition, but the error is flushed before the output stream is
+	// closed so that the remote entity closes the input stream after receiving it.
+	se, ok := err.(stream.Error)
+	if !ok {
+		se = stream.UndefinedCondition
+	}
+	w := p.s.TokenWriter()
+	/* #nosec */
+	se.WriteXML(w)
+	/* #nosec */
+	w.Flush()
+	/* #nosec */
+	w.Close()
+	/* #nosec */
+	p.s.Close()
+}
+
+// Err returns the first error passed to fail.
+func (p *workerPool) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+// wait stops accepting new elements and waits for the workers to finish.
+func (p *workerPool) wait() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+// tokenBuffer is a token reader and writer backed by a slice of tokens.
+type tokenBuffer struct {
+	toks []xml.Token
+}
+
+func (b *tokenBuffer) Token() (xml.Token, error) {
+	if len(b.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := b.toks[0]
+	b.toks = b.toks[1:]
+	return tok, nil
+}
+
+func (b *tokenBuffer) EncodeToken(t xml.Token) error {
+	b.toks = append(b.toks, xml.CopyToken(t))
+	return nil
+}
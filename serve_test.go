@@ -0,0 +1,338 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpp_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+func getID(start *xml.StartElement) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func TestServeConcurrent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	handled := make(chan string, 10)
+	var server *xmpp.Session
+	handler := xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "message" {
+			return nil
+		}
+		id := getID(start)
+		if id == "ping" {
+			// Sending an IQ and waiting on the response from within a handler would
+			// deadlock if the handler were run by Serve.
+			resp, err := server.SendIQ(ctx, stanza.IQ{Type: stanza.GetIQ, To: origin}.Wrap(nil))
+			if err != nil {
+				return err
+			}
+			/* #nosec */
+			resp.Close()
+		}
+		handled <- id
+		_, err := xmlstream.Copy(r, stanza.Message{ID: id + "-reply", To: origin}.Wrap(nil))
+		return err
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn, xmpp.BindResource()))
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		server = s
+		serverErr <- s.ServeConcurrent(handler, 4)
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn, xmpp.BindResource()))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	replies := make(chan string, 10)
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			switch start.Name.Local {
+			case "iq":
+				_, err := xmlstream.Copy(r, stanza.IQ{ID: getID(start), Type: stanza.ResultIQ}.Wrap(nil))
+				return err
+			case "message":
+				replies <- getID(start)
+			}
+			return nil
+		}))
+	}()
+
+	a := jid.MustParse("a@example.net")
+	b := jid.MustParse("b@example.net")
+	msgs := []stanza.Message{
+		{ID: "ping", From: a},
+		{ID: "1", From: b},
+		{ID: "2", From: b},
+		{ID: "3", From: b},
+	}
+	for _, msg := range msgs {
+		if err = client.Send(ctx, msg.Wrap(nil)); err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+	}
+
+	var order []string
+	gotReplies := make(map[string]bool)
+	for i := 0; i < 2*len(msgs); i++ {
+		select {
+		case id := <-handled:
+			if id != "ping" {
+				order = append(order, id)
+			}
+		case id := <-replies:
+			gotReplies[id] = true
+		case err := <-serverErr:
+			t.Fatalf("server stopped early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for handlers: handled=%v, replies=%v", order, gotReplies)
+		}
+	}
+	if s := fmt.Sprint(order); s != "[1 2 3]" {
+		t.Errorf("stanzas from the same sender handled out of order: %s", s)
+	}
+	for _, msg := range msgs {
+		if !gotReplies[msg.ID+"-reply"] {
+			t.Errorf("no reply received for %s", msg.ID)
+		}
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Errorf("unexpected error from server: %v", err)
+	}
+	if err = <-clientErr; err != nil {
+		t.Errorf("unexpected error from client: %v", err)
+	}
+}
+
+func TestServeConcurrentError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	errHandler := errors.New("handler failed")
+	serverErr := make(chan error, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn, xmpp.BindResource()))
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		serverErr <- s.ServeConcurrent(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			return errHandler
+		}), 0)
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn, xmpp.BindResource()))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Serve(nil)
+	}()
+	if err = client.Send(ctx, stanza.Message{To: location}.Wrap(nil)); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	// The server sends a stream error and closes its output stream.
+	if err = <-clientErr; err == nil {
+		t.Errorf("expected the client to receive a stream error")
+	}
+	// Drain anything else the server writes now that nothing is reading.
+	/* #nosec */
+	go io.Copy(ioutil.Discard, clientConn)
+	if err = <-serverErr; err != errHandler {
+		t.Errorf("wrong error from server: want=%v, got=%v", errHandler, err)
+	}
+}
+
+func TestServeConcurrentFullQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	// A single worker blocks on an IQ while more messages arrive, so the input
+	// stream must keep being read for the response to be received.
+	const msgs = 70
+	handled := make(chan string, msgs)
+	var server *xmpp.Session
+	handler := xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "message" {
+			return nil
+		}
+		id := getID(start)
+		if id == "0" {
+			resp, err := server.SendIQ(ctx, stanza.IQ{Type: stanza.GetIQ, To: origin}.Wrap(nil))
+			if err != nil {
+				return err
+			}
+			/* #nosec */
+			resp.Close()
+		}
+		handled <- id
+		return nil
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn, xmpp.BindResource()))
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		server = s
+		serverErr <- s.ServeConcurrent(handler, 1)
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn, xmpp.BindResource()))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			if start.Name.Local != "iq" {
+				return nil
+			}
+			_, err := xmlstream.Copy(r, stanza.IQ{ID: getID(start), Type: stanza.ResultIQ}.Wrap(nil))
+			return err
+		}))
+	}()
+	for i := 0; i < msgs; i++ {
+		msg := stanza.Message{ID: strconv.Itoa(i), From: jid.MustParse("a@example.net")}
+		if err = client.Send(ctx, msg.Wrap(nil)); err != nil {
+			t.Fatalf("error sending message %d: %v", i, err)
+		}
+	}
+
+	for i := 0; i < msgs; i++ {
+		select {
+		case id := <-handled:
+			if id != strconv.Itoa(i) {
+				t.Fatalf("message handled out of order: want=%d, got=%s", i, id)
+			}
+		case err := <-serverErr:
+			t.Fatalf("server stopped early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("timed out after handling %d messages", i)
+		}
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Errorf("unexpected error from server: %v", err)
+	}
+	if err = <-clientErr; err != nil {
+		t.Errorf("unexpected error from client: %v", err)
+	}
+}
+
+func TestServeConcurrentQueueExceeded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	// The only worker does not finish handling the first message until the test
+	// is over, so the messages after it fill its queue.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local == "message" && getID(start) == "0" {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn, xmpp.BindResource()))
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		serverErr <- s.ServeConcurrent(handler, 1)
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn, xmpp.BindResource()))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	for i := 0; i < xmpp.WorkerQueueSize+2; i++ {
+		msg := stanza.Message{ID: strconv.Itoa(i), From: jid.MustParse("a@example.net")}
+		if err = client.Send(ctx, msg.Wrap(nil)); err != nil {
+			t.Fatalf("error sending message %d: %v", i, err)
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+
+	r := client.TokenReader()
+	for err == nil {
+		_, err = r.Token()
+	}
+	/* #nosec */
+	r.Close()
+	if err != stream.PolicyViolation {
+		t.Errorf("wrong error from client: want=%v, got=%v", stream.PolicyViolation, err)
+	}
+	// Drain anything else the server writes now that nothing is reading.
+	/* #nosec */
+	go io.Copy(ioutil.Discard, clientConn)
+	close(release)
+	if err = client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+	if err = <-serverErr; err != stream.PolicyViolation {
+		t.Errorf("wrong error from server: want=%v, got=%v", stream.PolicyViolation, err)
+	}
+}
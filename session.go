@@ -13,7 +13,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"mellium.im/xmlstream"
@@ -21,6 +23,7 @@ import (
 	"mellium.im/xmpp/internal/attr"
 	"mellium.im/xmpp/internal/marshal"
 	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/internal/stanzaerr"
 	intstream "mellium.im/xmpp/internal/stream"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/stanza"
@@ -35,7 +38,10 @@ var (
 
 var errNotStart = errors.New("xmpp: SendElement did not begin with a StartElement")
 
-const closeStreamTag string = `</stream:stream>`
+const (
+	closeStreamTag string = `</stream:stream>`
+	closeWSTag     string = `<close xmlns='` + ns.WS + `'/>`
+)
 
 // SessionState is a bitmask that represents the current state of an XMPP
 // session. For a description of each bit, see the various SessionState typed
@@ -72,10 +78,17 @@ const (
 // A Session represents an XMPP session comprising an input and an output XML
 // stream.
 type Session struct {
+	// lastInput is the time (in nanoseconds since the Unix epoch) that the last
+	// top level element was read from the input stream.
+	// It is accessed atomically and is first in the struct to guarantee 64-bit
+	// alignment.
+	lastInput int64
+
 	conn      net.Conn
 	connState func() tls.ConnectionState
 
-	state SessionState
+	stateMu sync.RWMutex
+	state   SessionState
 
 	origin   jid.JID
 	location jid.JID
@@ -89,6 +102,9 @@ type Session struct {
 	sentIQMutex sync.Mutex
 	sentIQs     map[string]chan xmlstream.TokenReadCloser
 
+	// The stream management state if stream management was negotiated.
+	sm *SMState
+
 	in struct {
 		intstream.Info
 		d      xml.TokenReader
@@ -134,7 +150,7 @@ func NegotiateSession(ctx context.Context, location, origin jid.JID, rw io.ReadW
 		s.connState = tc.ConnectionState
 	}
 	if received {
-		s.state |= Received
+		s.setState(Received)
 	}
 	s.out.Locker = &sync.Mutex{}
 	s.in.Locker = &sync.Mutex{}
@@ -145,12 +161,12 @@ func NegotiateSession(ctx context.Context, location, origin jid.JID, rw io.ReadW
 	// If rw was already a *tls.Conn, go ahead and mark the connection as secure
 	// so that we don't try to negotiate StartTLS.
 	if _, ok := s.conn.(*tls.Conn); ok {
-		s.state |= Secure
+		s.setState(Secure)
 	}
 
 	// Call negotiate until the ready bit is set.
 	var data interface{}
-	for s.state&Ready == 0 {
+	for s.State()&Ready == 0 {
 		var mask SessionState
 		var rw io.ReadWriter
 		var err error
@@ -172,11 +188,15 @@ func NegotiateSession(ctx context.Context, location, origin jid.JID, rw io.ReadW
 			s.in.d = xml.NewDecoder(s.conn)
 			s.out.e = xml.NewEncoder(s.conn)
 		}
-		s.state |= mask
+		s.setState(mask)
 	}
 
 	s.in.d = intstream.Reader(s.in.d)
+	if s.sm != nil {
+		s.out.e = s.sm.writer(s.out.e)
+	}
 	s.out.e = stanzaAddID(s.out.e)
+	s.touchInput()
 
 	return s, nil
 }
@@ -249,6 +269,8 @@ func NewServerSession(ctx context.Context, location, origin jid.JID, rw io.ReadW
 // Serve takes a lock on the input and output stream before calling the handler,
 // so the handler should not close over the session or use any of its send
 // methods or a deadlock will occur.
+// Handlers that need to send stanzas should be served with ServeConcurrent
+// instead.
 // After Serve finishes running the handler, it flushes the output stream.
 func (s *Session) Serve(h Handler) (err error) {
 	if h == nil {
@@ -269,7 +291,7 @@ func (s *Session) Serve(h Handler) (err error) {
 			return s.in.ctx.Err()
 		default:
 		}
-		err := handleInputStream(s, h)
+		err := handleInputStream(s, h, nil)
 		switch err {
 		case nil:
 			// No error and no sentinal error telling us to shut down; try again!
@@ -289,15 +311,26 @@ func (s *Session) sendError(err error) (e error) {
 	s.out.Lock()
 	defer s.out.Unlock()
 
-	if s.state&OutputStreamClosed == OutputStreamClosed {
+	if s.State()&OutputStreamClosed == OutputStreamClosed {
 		return err
 	}
 
 	switch typErr := err.(type) {
+	case receivedError:
+		// Errors sent by the remote entity are not sent back.
+		if e = s.closeSession(); e != nil {
+			return e
+		}
+		return typErr.err
 	case stream.Error:
 		if _, e = typErr.WriteXML(s.out.e); e != nil {
 			return e
 		}
+		// The closing tag is written directly to the connection, so the error must
+		// be flushed first.
+		if e = s.out.e.Flush(); e != nil {
+			return e
+		}
 		if e = s.closeSession(); e != nil {
 			return e
 		}
@@ -315,6 +348,15 @@ func (s *Session) sendError(err error) (e error) {
 	return err
 }
 
+// receivedError is a stream error that was read from the input stream.
+type receivedError struct {
+	err stream.Error
+}
+
+func (e receivedError) Error() string {
+	return e.err.Error()
+}
+
 type nopHandler struct{}
 
 func (nopHandler) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
@@ -335,7 +377,11 @@ func (r iqResponder) Close() error {
 	return nil
 }
 
-func handleInputStream(s *Session, handler Handler) (err error) {
+// handleInputStream reads the next element from the input stream and handles
+// it.
+// If a worker pool is provided, elements that would be passed to the handler
+// are dispatched to the pool instead.
+func handleInputStream(s *Session, handler Handler, p *workerPool) (err error) {
 	discard := xmlstream.Discard()
 	rc := s.TokenReader()
 	defer rc.Close()
@@ -343,8 +389,12 @@ func handleInputStream(s *Session, handler Handler) (err error) {
 
 	tok, err := r.Token()
 	if err != nil {
+		if se, ok := err.(stream.Error); ok {
+			return receivedError{se}
+		}
 		return err
 	}
+	s.touchInput()
 
 	var start xml.StartElement
 	switch t := tok.(type) {
@@ -363,8 +413,25 @@ func handleInputStream(s *Session, handler Handler) (err error) {
 		return stream.BadFormat
 	}
 
+	// Stream management requests and acknowledgements are handled by the session
+	// and never passed to the handler.
+	if start.Name.Space == ns.SM && s.sm != nil {
+		return handleSM(s, r, start)
+	}
+
+	var dispatched bool
+
 	// If this is a stanza, normalize the "from" attribute.
 	if isStanza(start.Name) {
+		// Stanzas dispatched to a worker pool are counted by the worker once they
+		// have been handled.
+		if s.sm != nil {
+			defer func() {
+				if !dispatched {
+					s.sm.handled()
+				}
+			}()
+		}
 		for i, attr := range start.Attr {
 			if attr.Name.Local == "from" /*&& attr.Name.Space == start.Name.Space*/ {
 				local := s.LocalAddr().Bare().String()
@@ -415,6 +482,12 @@ func handleInputStream(s *Session, handler Handler) (err error) {
 
 noreply:
 
+	if p != nil {
+		err = p.dispatch(r, start, id, needsResp)
+		dispatched = err == nil
+		return err
+	}
+
 	w := s.TokenWriter()
 	defer w.Close()
 	rw := &responseChecker{
@@ -509,7 +582,7 @@ func (lwc *lockWriteCloser) EncodeToken(t xml.Token) error {
 		return lwc.err
 	}
 
-	if lwc.w.state&OutputStreamClosed == OutputStreamClosed {
+	if lwc.w.State()&OutputStreamClosed == OutputStreamClosed {
 		return ErrOutputStreamClosed
 	}
 
@@ -520,7 +593,7 @@ func (lwc *lockWriteCloser) Flush() error {
 	if lwc.err != nil {
 		return nil
 	}
-	if lwc.w.state&OutputStreamClosed == OutputStreamClosed {
+	if lwc.w.State()&OutputStreamClosed == OutputStreamClosed {
 		return ErrOutputStreamClosed
 	}
 	return lwc.w.out.e.Flush()
@@ -546,7 +619,7 @@ func (lrc *lockReadCloser) Token() (xml.Token, error) {
 		return nil, lrc.err
 	}
 
-	if lrc.s.state&InputStreamClosed == InputStreamClosed {
+	if lrc.s.State()&InputStreamClosed == InputStreamClosed {
 		return nil, ErrInputStreamClosed
 	}
 
@@ -604,27 +677,56 @@ func (s *Session) Close() error {
 }
 
 func (s *Session) closeSession() error {
-	if s.state&OutputStreamClosed == OutputStreamClosed {
+	if s.State()&OutputStreamClosed == OutputStreamClosed {
 		return nil
 	}
 
-	s.state |= OutputStreamClosed
+	s.setState(OutputStreamClosed)
 	// We wrote the opening stream instead of encoding it, so do the same with the
 	// closing to ensure that the encoder doesn't think the tokens are mismatched.
-	_, err := s.Conn().Write([]byte(closeStreamTag))
+	tag := closeStreamTag
+	if s.out.Info.WebSocket() {
+		tag = closeWSTag
+	}
+	_, err := s.Conn().Write([]byte(tag))
 	return err
 }
 
 // State returns the current state of the session. For more information, see the
 // SessionState type.
+// State is safe for concurrent use by multiple goroutines.
 func (s *Session) State() SessionState {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
 	return s.state
 }
 
+// setState sets the state bits in mask.
+func (s *Session) setState(mask SessionState) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.state |= mask
+}
+
+// LastInput returns the time at which the last top level element (or
+// whitespace keepalive) was read from the input stream while serving the
+// session.
+// Before anything has been served it returns the time at which the session was
+// negotiated.
+//
+// LastInput is safe for concurrent use by multiple goroutines.
+func (s *Session) LastInput() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastInput))
+}
+
+func (s *Session) touchInput() {
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+}
+
 // LocalAddr returns the Origin address for initiated connections, or the
 // Location for received connections.
 func (s *Session) LocalAddr() jid.JID {
-	if (s.state & Received) == Received {
+	if (s.State() & Received) == Received {
 		return s.location
 	}
 	return s.origin
@@ -633,7 +735,7 @@ func (s *Session) LocalAddr() jid.JID {
 // RemoteAddr returns the Location address for initiated connections, or the
 // Origin address for received connections.
 func (s *Session) RemoteAddr() jid.JID {
-	if (s.state & Received) == Received {
+	if (s.State() & Received) == Received {
 		return s.origin
 	}
 	return s.location
@@ -742,6 +844,11 @@ func isIQEmptySpace(name xml.Name) bool {
 	return name.Local == "iq" && (name.Space == "" || name.Space == ns.Client || name.Space == ns.Server)
 }
 
+func isStanzaEmptySpace(name xml.Name) bool {
+	return (name.Local == "iq" || name.Local == "message" || name.Local == "presence") &&
+		(name.Space == "" || name.Space == ns.Client || name.Space == ns.Server)
+}
+
 func isStanza(name xml.Name) bool {
 	return (name.Local == "iq" || name.Local == "message" || name.Local == "presence") &&
 		(name.Space == ns.Client || name.Space == ns.Server)
@@ -812,6 +919,71 @@ func (s *Session) SendIQElement(ctx context.Context, payload xml.TokenReader, iq
 	return s.SendIQ(ctx, iq.Wrap(payload))
 }
 
+// UnmarshalIQ is like SendIQ except that it waits for the response and
+// unmarshals it instead of returning a token stream.
+// If the response is of type "error" the stanza error is unmarshaled and
+// returned as a stanza.Error.
+// Otherwise, the first child element of the response (if any) is unmarshaled
+// into v as if by xml.DecodeElement.
+// If v is nil, the payload is discarded.
+//
+// IQs that do not expect a response (those of type "result" or "error") are
+// sent and v is left unchanged.
+//
+// UnmarshalIQ is safe for concurrent use by multiple goroutines.
+func (s *Session) UnmarshalIQ(ctx context.Context, iq xml.TokenReader, v interface{}) error {
+	resp, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return nil
+	}
+	defer resp.Close()
+	return unmarshalIQ(resp, v)
+}
+
+// UnmarshalIQElement is like UnmarshalIQ except that it wraps the payload in
+// an Info/Query (IQ) element.
+// For more information, see UnmarshalIQ.
+//
+// UnmarshalIQElement is safe for concurrent use by multiple goroutines.
+func (s *Session) UnmarshalIQElement(ctx context.Context, payload xml.TokenReader, iq stanza.IQ, v interface{}) error {
+	return s.UnmarshalIQ(ctx, iq.Wrap(payload), v)
+}
+
+func unmarshalIQ(r xml.TokenReader, v interface{}) error {
+	d := xml.NewTokenDecoder(r)
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || !isIQ(start.Name) {
+		return fmt.Errorf("xmpp: expected IQ start element, got %T", tok)
+	}
+	_, typ := attr.Get(start.Attr, "type")
+	if typ == string(stanza.ErrorIQ) {
+		return stanzaerr.Decode(d)
+	}
+
+	for {
+		tok, err = d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if v == nil {
+				return d.Skip()
+			}
+			return d.DecodeElement(v, &t)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
 func (s *Session) sendResp(ctx context.Context, id string, payload xml.TokenReader, start xml.StartElement) (xmlstream.TokenReadCloser, error) {
 	c := make(chan xmlstream.TokenReadCloser)
 
@@ -843,7 +1015,7 @@ func (s *Session) sendResp(ctx context.Context, id string, payload xml.TokenRead
 func (s *Session) closeInputStream() {
 	s.in.Lock()
 	defer s.in.Unlock()
-	s.state |= InputStreamClosed
+	s.setState(InputStreamClosed)
 	s.in.cancel()
 }
 
@@ -860,6 +1032,36 @@ type tokenWriteFlusher interface {
 	xmlstream.Flusher
 }
 
+// addXMLNS sets the namespace of any top level elements that are written to w
+// without one.
+// This is used on framed streams where each top level element must be a
+// complete XML document with its own namespace declaration.
+func addXMLNS(w tokenWriteFlusher, xmlns string) tokenWriteFlusher {
+	depth := 0
+	return wrapWriter{
+		encode: func(t xml.Token) error {
+			switch tok := t.(type) {
+			case xml.StartElement:
+				depth++
+				// Skip prefixed names such as stream:features that we write without a
+				// namespace.
+				if depth == 1 && tok.Name.Space == "" && !strings.Contains(tok.Name.Local, ":") {
+					tok.Name.Space = xmlns
+					t = tok
+				}
+			case xml.EndElement:
+				if depth == 1 && tok.Name.Space == "" && !strings.Contains(tok.Name.Local, ":") {
+					tok.Name.Space = xmlns
+					t = tok
+				}
+				depth--
+			}
+			return w.EncodeToken(t)
+		},
+		flush: w.Flush,
+	}
+}
+
 func stanzaAddID(w tokenWriteFlusher) tokenWriteFlusher {
 	depth := 0
 	return wrapWriter{
@@ -0,0 +1,592 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/ns"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+var errNoSM = errors.New("xmpp: stream management is not enabled on the session")
+
+// errHandledCountTooHigh is the stream error sent when the remote entity
+// acknowledges more stanzas than were sent.
+var errHandledCountTooHigh = stream.Error{
+	Err:  stream.UndefinedCondition.Err,
+	Text: "handled-count-too-high",
+}
+
+// SMState holds the state of a stream on which XEP-0198: Stream Management has
+// been enabled.
+// This includes the number of stanzas that have been handled and acknowledged,
+// and a copy of any sent stanzas that have not yet been acknowledged by the
+// remote entity.
+//
+// Because SMState outlives the session it was negotiated on, passing the same
+// state to the StreamManagement feature of a later session lets the initiating
+// entity resume the old stream.
+// The zero value is a valid SMState that has never been enabled.
+// SMState is safe for concurrent use by multiple goroutines.
+type SMState struct {
+	// Lookup is used by a receiving entity to find the state of a previous
+	// stream when the initiating entity asks to resume it.
+	// If Lookup is nil resumption is not offered, and if it returns nil the
+	// request to resume is denied.
+	Lookup func(id string) *SMState
+
+	mu       sync.Mutex
+	id       string
+	location string
+	addr     jid.JID
+	enabled  bool
+	pending  bool
+	in       uint32
+	acked    uint32
+	unacked  [][]xml.Token
+	lost     [][]xml.Token
+}
+
+// ID returns the ID that can be used to resume the stream or an empty string if
+// the stream is not resumable.
+func (st *SMState) ID() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.id
+}
+
+// Location returns the address that the receiving entity asked to be used when
+// resuming the stream, if any.
+func (st *SMState) Location() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.location
+}
+
+// Unacked returns the number of stanzas that have been sent on the current
+// stream but not yet acknowledged by the remote entity.
+func (st *SMState) Unacked() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.unacked)
+}
+
+// Drain removes and returns any stanzas that were sent on a previous stream
+// but never acknowledged and could not be resent because the stream was not
+// resumed (for example, because the receiving entity responded to the attempt
+// to resume it with an error).
+// The stanzas may never have been received by the remote entity, so it is up
+// to the user to decide whether to send them again on the new stream or to
+// report them as undelivered.
+func (st *SMState) Drain() []xml.TokenReader {
+	st.mu.Lock()
+	lost := st.lost
+	st.lost = nil
+	st.mu.Unlock()
+
+	readers := make([]xml.TokenReader, 0, len(lost))
+	for _, stanza := range lost {
+		toks := make([]xml.TokenReader, 0, len(stanza))
+		for _, tok := range stanza {
+			toks = append(toks, xmlstream.Token(tok))
+		}
+		readers = append(readers, xmlstream.MultiReader(toks...))
+	}
+	return readers
+}
+
+// reset clears the state of the stream.
+// Any stanzas that were never acknowledged are kept so that they can be
+// retrieved with Drain.
+func (st *SMState) reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.id = ""
+	st.location = ""
+	st.enabled = false
+	st.pending = false
+	st.in = 0
+	st.acked = 0
+	st.lost = append(st.lost, st.unacked...)
+	st.unacked = nil
+}
+
+func (st *SMState) isEnabled() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.enabled
+}
+
+// handled increments the count of inbound stanzas.
+func (st *SMState) handled() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.enabled {
+		st.in++
+	}
+}
+
+// sent queues a copy of an outbound stanza until it is acknowledged.
+func (st *SMState) sent(stanza []xml.Token) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.unacked = append(st.unacked, stanza)
+}
+
+// ack removes any stanzas that were acknowledged by the remote entity from the
+// queue.
+// Counters wrap around at 2^32 as required by XEP-0198.
+// If h acknowledges stanzas that were never sent, or is lower than a previous
+// acknowledgement, the queue is left untouched and a stream error is returned
+// that closes the stream as required by XEP-0198.
+func (st *SMState) ack(h uint32) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := uint64(h - st.acked)
+	if n > uint64(len(st.unacked)) {
+		return errHandledCountTooHigh
+	}
+	st.unacked = st.unacked[n:]
+	st.acked = h
+	return nil
+}
+
+// replay writes any unacknowledged stanzas to w.
+// The stanzas are not removed from the queue until they are acknowledged.
+func (st *SMState) replay(w xmlstream.TokenWriter) error {
+	st.mu.Lock()
+	unacked := st.unacked
+	st.mu.Unlock()
+
+	for _, stanza := range unacked {
+		for _, tok := range stanza {
+			if err := w.EncodeToken(tok); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writer returns a token writer that counts and queues outbound stanzas.
+func (st *SMState) writer(w tokenWriteFlusher) tokenWriteFlusher {
+	var depth int
+	var stanza []xml.Token
+	return wrapWriter{
+		encode: func(t xml.Token) error {
+			switch tok := t.(type) {
+			case xml.StartElement:
+				if depth == 0 && isStanzaEmptySpace(tok.Name) && st.isEnabled() {
+					stanza = make([]xml.Token, 0, 8)
+				}
+				depth++
+			case xml.EndElement:
+				depth--
+			}
+			if stanza != nil {
+				stanza = append(stanza, xml.CopyToken(t))
+				if depth == 0 {
+					st.sent(stanza)
+					stanza = nil
+				}
+			}
+			return w.EncodeToken(t)
+		},
+		flush: w.Flush,
+	}
+}
+
+// StreamManagement returns a stream feature that negotiates XEP-0198: Stream
+// Management.
+// Stream management lets each side of the stream acknowledge the stanzas it
+// has handled so that stanzas lost when the underlying connection drops can be
+// detected and resent.
+//
+// On initiated sessions, if st was enabled on a previous session and the stream
+// is resumable, an attempt is made to resume the old stream instead of binding
+// a new resource and any stanzas that were never acknowledged are sent again.
+// Otherwise stream management is enabled after resource binding completes and
+// any stanzas that were not acknowledged on the old stream can be retrieved
+// with st's Drain method.
+// On received sessions st records the state of the new stream and its Lookup
+// field is used to find streams that the initiating entity wants to resume.
+// If st is nil a new state is created, meaning that the stream cannot be
+// resumed later.
+//
+// Once stream management is enabled, requests for acknowledgement and
+// acknowledgements received by the session are handled by Serve.
+func StreamManagement(st *SMState) StreamFeature {
+	if st == nil {
+		st = &SMState{}
+	}
+	return StreamFeature{
+		Name:       xml.Name{Space: ns.SM, Local: "sm"},
+		Necessary:  Authn,
+		Prohibited: Ready,
+		List: func(ctx context.Context, e xmlstream.TokenWriter, start xml.StartElement) (req bool, err error) {
+			if err = e.EncodeToken(start); err != nil {
+				return req, err
+			}
+			return req, e.EncodeToken(start.End())
+		},
+		Parse: func(ctx context.Context, r xml.TokenReader, start *xml.StartElement) (bool, interface{}, error) {
+			parsed := struct {
+				XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+			}{}
+			return false, nil, xml.NewTokenDecoder(r).DecodeElement(&parsed, start)
+		},
+		Negotiate: func(ctx context.Context, session *Session, data interface{}) (mask SessionState, rw io.ReadWriter, err error) {
+			if (session.State() & Received) == Received {
+				return negotiateSMServer(session, st, data)
+			}
+			return negotiateSMClient(session, st)
+		},
+	}
+}
+
+func negotiateSMClient(session *Session, st *SMState) (mask SessionState, rw io.ReadWriter, err error) {
+	session.sm = st
+
+	st.mu.Lock()
+	id := st.id
+	h := st.in
+	// If the stream is not resumable, stream management has to be enabled after
+	// resource binding (which will be negotiated next).
+	if id == "" {
+		st.pending = true
+	}
+	st.mu.Unlock()
+	if id == "" {
+		return mask, nil, nil
+	}
+
+	w := session.TokenWriter()
+	defer w.Close()
+	r := session.TokenReader()
+	defer r.Close()
+	d := xml.NewTokenDecoder(r)
+
+	err = writeSMElement(w, "resume", xml.Attr{
+		Name: xml.Name{Local: "previd"}, Value: id,
+	}, xml.Attr{
+		Name: xml.Name{Local: "h"}, Value: strconv.FormatUint(uint64(h), 10),
+	})
+	if err != nil {
+		return mask, nil, err
+	}
+
+	start, err := nextStart(d)
+	if err != nil {
+		return mask, nil, err
+	}
+	switch start.Name {
+	case xml.Name{Space: ns.SM, Local: "resumed"}:
+		h, err := getH(start.Attr)
+		if err != nil {
+			return mask, nil, err
+		}
+		if err = d.Skip(); err != nil {
+			return mask, nil, err
+		}
+		if err = st.ack(h); err != nil {
+			return mask, nil, err
+		}
+		st.mu.Lock()
+		session.origin = st.addr
+		st.mu.Unlock()
+		if err = st.replay(w); err != nil {
+			return mask, nil, err
+		}
+		return Ready, nil, w.Flush()
+	case xml.Name{Space: ns.SM, Local: "failed"}:
+		// If the stream cannot be resumed we bind a new resource and enable stream
+		// management afterwards as if resumption had never been attempted.
+		// Stanzas that were never acknowledged are kept by reset for Drain.
+		if err = d.Skip(); err != nil {
+			return mask, nil, err
+		}
+		st.reset()
+		st.mu.Lock()
+		st.pending = true
+		st.mu.Unlock()
+		return mask, nil, nil
+	}
+	return mask, nil, stream.UnsupportedStanzaType
+}
+
+// enableSM enables stream management on an initiated session if it was
+// selected during negotiation.
+// Enabling stream management must wait until after resource binding, so unlike
+// most stream features it is performed once the session is otherwise ready.
+func enableSM(session *Session) error {
+	st := session.sm
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	pending := st.pending
+	st.mu.Unlock()
+	if !pending {
+		return nil
+	}
+
+	w := session.TokenWriter()
+	defer w.Close()
+	r := session.TokenReader()
+	defer r.Close()
+	d := xml.NewTokenDecoder(r)
+
+	err := writeSMElement(w, "enable", xml.Attr{
+		Name: xml.Name{Local: "resume"}, Value: "true",
+	})
+	if err != nil {
+		return err
+	}
+
+	start, err := nextStart(d)
+	if err != nil {
+		return err
+	}
+	switch start.Name {
+	case xml.Name{Space: ns.SM, Local: "enabled"}:
+		_, id := attr.Get(start.Attr, "id")
+		_, resume := attr.Get(start.Attr, "resume")
+		_, location := attr.Get(start.Attr, "location")
+		if resume != "true" && resume != "1" {
+			id = ""
+		}
+		if err = d.Skip(); err != nil {
+			return err
+		}
+		st.reset()
+		st.mu.Lock()
+		st.id = id
+		st.location = location
+		st.addr = session.LocalAddr()
+		st.enabled = true
+		st.mu.Unlock()
+		return nil
+	case xml.Name{Space: ns.SM, Local: "failed"}:
+		// Failing to enable stream management is not fatal, the session can
+		// continue without it.
+		st.reset()
+		session.sm = nil
+		return d.Skip()
+	}
+	return stream.UnsupportedStanzaType
+}
+
+func negotiateSMServer(session *Session, st *SMState, data interface{}) (mask SessionState, rw io.ReadWriter, err error) {
+	// If the initiating entity did not try to resume a stream before binding a
+	// resource, a request to enable stream management may still follow once the
+	// session is ready and will be handled by Serve.
+	if _, ok := data.(negotiateLater); ok {
+		session.sm = st
+		return mask, nil, nil
+	}
+
+	w := session.TokenWriter()
+	defer w.Close()
+	r := session.TokenReader()
+	defer r.Close()
+	d := xml.NewTokenDecoder(r)
+
+	start, err := nextStart(d)
+	if err != nil {
+		return mask, nil, err
+	}
+	switch start.Name {
+	case xml.Name{Space: ns.SM, Local: "enable"}:
+		_, resume := attr.Get(start.Attr, "resume")
+		if err = d.Skip(); err != nil {
+			return mask, nil, err
+		}
+		return mask, nil, enableSMServer(session, st, w, resume)
+	case xml.Name{Space: ns.SM, Local: "resume"}:
+		_, previd := attr.Get(start.Attr, "previd")
+		h, err := getH(start.Attr)
+		if err != nil {
+			return mask, nil, err
+		}
+		if err = d.Skip(); err != nil {
+			return mask, nil, err
+		}
+
+		var prev *SMState
+		if st.Lookup != nil && previd != "" {
+			prev = st.Lookup(previd)
+		}
+		if prev == nil {
+			// The initiating entity may still bind a new resource and enable stream
+			// management on the new stream, but because this feature has now been
+			// negotiated the request to enable it will be handled by Serve.
+			session.sm = st
+			return mask, nil, writeSMFailed(w, stanza.ItemNotFound)
+		}
+
+		if err = prev.ack(h); err != nil {
+			return mask, nil, err
+		}
+		prev.mu.Lock()
+		handled := prev.in
+		session.origin = prev.addr
+		prev.mu.Unlock()
+		err = writeSMElement(w, "resumed", xml.Attr{
+			Name: xml.Name{Local: "previd"}, Value: previd,
+		}, xml.Attr{
+			Name: xml.Name{Local: "h"}, Value: strconv.FormatUint(uint64(handled), 10),
+		})
+		if err != nil {
+			return mask, nil, err
+		}
+		if err = prev.replay(w); err != nil {
+			return mask, nil, err
+		}
+		session.sm = prev
+		return Ready, nil, w.Flush()
+	}
+	return mask, nil, stream.UnsupportedStanzaType
+}
+
+// enableSMServer responds to a request to enable stream management on a
+// received session.
+func enableSMServer(session *Session, st *SMState, w xmlstream.TokenWriteFlushCloser, resume string) error {
+	// Stream management cannot be enabled until a resource is bound.
+	if session.State()&Ready == 0 {
+		return writeSMFailed(w, stanza.UnexpectedRequest)
+	}
+
+	st.reset()
+	var attrs []xml.Attr
+	st.mu.Lock()
+	if (resume == "true" || resume == "1") && st.Lookup != nil {
+		st.id = attr.RandomID()
+		attrs = append(attrs, xml.Attr{
+			Name: xml.Name{Local: "id"}, Value: st.id,
+		}, xml.Attr{
+			Name: xml.Name{Local: "resume"}, Value: "true",
+		})
+	}
+	st.addr = session.RemoteAddr()
+	st.enabled = true
+	st.mu.Unlock()
+
+	session.sm = st
+	return writeSMElement(w, "enabled", attrs...)
+}
+
+// handleSM handles stream management elements received after the stream is
+// established.
+func handleSM(s *Session, r xml.TokenReader, start xml.StartElement) error {
+	// Consume the rest of the element before responding.
+	_, err := xmlstream.Copy(xmlstream.Discard(), xmlstream.Inner(r))
+	if err != nil {
+		return err
+	}
+
+	switch start.Name.Local {
+	case "r":
+		s.sm.mu.Lock()
+		h := s.sm.in
+		s.sm.mu.Unlock()
+
+		w := s.TokenWriter()
+		defer w.Close()
+		return writeSMElement(w, "a", xml.Attr{
+			Name: xml.Name{Local: "h"}, Value: strconv.FormatUint(uint64(h), 10),
+		})
+	case "a":
+		h, err := getH(start.Attr)
+		if err != nil {
+			return err
+		}
+		return s.sm.ack(h)
+	case "enable":
+		if s.State()&Received == 0 {
+			return stream.UnsupportedStanzaType
+		}
+		w := s.TokenWriter()
+		defer w.Close()
+		if s.sm.isEnabled() {
+			return writeSMFailed(w, stanza.UnexpectedRequest)
+		}
+		_, resume := attr.Get(start.Attr, "resume")
+		return enableSMServer(s, s.sm, w, resume)
+	}
+	return nil
+}
+
+// RequestAck asks the remote entity to acknowledge the stanzas that it has
+// handled.
+// The acknowledgement is processed by Serve, after which any acknowledged
+// stanzas are removed from the stream management state.
+// If stream management has not been enabled on the session an error is
+// returned.
+func (s *Session) RequestAck(ctx context.Context) error {
+	if s.sm == nil || !s.sm.isEnabled() {
+		return errNoSM
+	}
+	w := s.TokenWriter()
+	defer w.Close()
+	return writeSMElement(w, "r")
+}
+
+func writeSMElement(w xmlstream.TokenWriteFlushCloser, local string, attrs ...xml.Attr) error {
+	start := xml.StartElement{
+		Name: xml.Name{Space: ns.SM, Local: local},
+		Attr: attrs,
+	}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := w.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeSMFailed(w xmlstream.TokenWriteFlushCloser, condition stanza.Condition) error {
+	_, err := xmlstream.Copy(w, xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: ns.Stanza, Local: string(condition)},
+		}),
+		xml.StartElement{Name: xml.Name{Space: ns.SM, Local: "failed"}},
+	))
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func nextStart(d *xml.Decoder) (xml.StartElement, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return xml.StartElement{}, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return start, stream.BadFormat
+	}
+	return start, nil
+}
+
+func getH(attrs []xml.Attr) (uint32, error) {
+	_, v := attr.Get(attrs, "h")
+	h, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, stream.BadFormat
+	}
+	return uint32(h), nil
+}
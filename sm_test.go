@@ -0,0 +1,369 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpp_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+// withState returns a negotiator that sets the provided state bits and then
+// uses the default negotiator to negotiate the provided features.
+func withState(state xmpp.SessionState, features ...xmpp.StreamFeature) xmpp.Negotiator {
+	negotiate := xmpp.NewNegotiator(xmpp.StreamConfig{Features: features})
+	var done bool
+	return func(ctx context.Context, s *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+		if !done {
+			done = true
+			return state, nil, nil, nil
+		}
+		return negotiate(ctx, s, data)
+	}
+}
+
+// smPipe negotiates a client and server session with stream management over
+// an in memory connection.
+// Once negotiated the server session is served using h.
+func smPipe(t *testing.T, clientSM, serverSM *xmpp.SMState, h xmpp.Handler) (client *xmpp.Session, clientConn, serverConn net.Conn) {
+	t.Helper()
+
+	clientConn, serverConn = net.Pipe()
+	client, _ = smConn(t, clientConn, serverConn, clientSM, serverSM, h)
+	return client, clientConn, serverConn
+}
+
+// smConn is like smPipe except that it uses the provided connections and
+// returns a channel that receives the error returned when serving the server
+// session.
+func smConn(t *testing.T, clientConn, serverConn net.Conn, clientSM, serverSM *xmpp.SMState, h xmpp.Handler) (*xmpp.Session, <-chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+
+	errs := make(chan error, 1)
+	serveErr := make(chan error, 1)
+	go func() {
+		server, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn,
+			xmpp.BindResource(),
+			xmpp.StreamManagement(serverSM),
+		))
+		errs <- err
+		if err == nil {
+			serveErr <- server.Serve(h)
+		}
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn,
+		xmpp.BindResource(),
+		xmpp.StreamManagement(clientSM),
+	))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatalf("error negotiating server session: %v", err)
+	}
+	return client, serveErr
+}
+
+func waitFor(t *testing.T, desc string, f func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", desc)
+}
+
+func TestStreamManagement(t *testing.T) {
+	clientSM := &xmpp.SMState{}
+	serverSM := &xmpp.SMState{}
+	serverSM.Lookup = func(id string) *xmpp.SMState {
+		if id == serverSM.ID() {
+			return serverSM
+		}
+		return nil
+	}
+
+	msgs := make(chan struct{}, 10)
+	handler := xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local == "message" {
+			msgs <- struct{}{}
+		}
+		return nil
+	})
+
+	client, _, serverConn := smPipe(t, clientSM, serverSM, handler)
+	if client.State()&xmpp.Ready == 0 {
+		t.Fatalf("client session not ready: %v", client.State())
+	}
+	if id := clientSM.ID(); id == "" || id != serverSM.ID() {
+		t.Fatalf("wrong stream ID: want=%q, got=%q", serverSM.ID(), id)
+	}
+	origin := client.LocalAddr()
+	if origin.Resourcepart() == "" {
+		t.Fatalf("expected a resource to be bound, got %v", origin)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- client.Serve(nil)
+	}()
+
+	ctx := context.Background()
+	msg := stanza.Message{To: jid.MustParse("romeo@example.net"), Type: stanza.ChatMessage}
+	err := client.Send(ctx, msg.Wrap(nil))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	<-msgs
+	if n := clientSM.Unacked(); n != 1 {
+		t.Fatalf("wrong number of unacked stanzas: want=1, got=%d", n)
+	}
+	err = client.RequestAck(ctx)
+	if err != nil {
+		t.Fatalf("error requesting ack: %v", err)
+	}
+	waitFor(t, "ack", func() bool { return clientSM.Unacked() == 0 })
+
+	// Drop the connection and queue a stanza that the server never receives.
+	err = serverConn.Close()
+	if err != nil {
+		t.Fatalf("error closing server conn: %v", err)
+	}
+	<-serveErr
+	/* #nosec */
+	client.Send(ctx, msg.Wrap(nil))
+	if n := clientSM.Unacked(); n != 1 {
+		t.Fatalf("wrong number of unacked stanzas after drop: want=1, got=%d", n)
+	}
+
+	// Resume the stream on a new connection.
+	newServerSM := &xmpp.SMState{Lookup: serverSM.Lookup}
+	client, _, _ = smPipe(t, clientSM, newServerSM, handler)
+	if !client.LocalAddr().Equal(origin) {
+		t.Errorf("wrong address after resumption: want=%v, got=%v", origin, client.LocalAddr())
+	}
+	select {
+	case <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unacked stanza was not resent after resumption")
+	}
+}
+
+func TestStreamManagementNotResumable(t *testing.T) {
+	clientSM := &xmpp.SMState{}
+	serverSM := &xmpp.SMState{}
+	client, clientConn, _ := smPipe(t, clientSM, serverSM, nil)
+	if id := clientSM.ID(); id != "" {
+		t.Errorf("stream should not be resumable without a lookup func, got ID %q", id)
+	}
+	err := client.RequestAck(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error requesting ack: %v", err)
+	}
+	/* #nosec */
+	clientConn.Close()
+
+	err = (&xmpp.Session{}).RequestAck(context.Background())
+	if err == nil {
+		t.Errorf("expected error requesting ack without stream management")
+	}
+}
+
+func TestStreamManagementResumeFailed(t *testing.T) {
+	clientSM := &xmpp.SMState{}
+	serverSM := &xmpp.SMState{}
+	serverSM.Lookup = func(id string) *xmpp.SMState {
+		if id == serverSM.ID() {
+			return serverSM
+		}
+		return nil
+	}
+
+	client, _, serverConn := smPipe(t, clientSM, serverSM, nil)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- client.Serve(nil)
+	}()
+
+	// Drop the connection and queue a stanza that the server never receives.
+	err := serverConn.Close()
+	if err != nil {
+		t.Fatalf("error closing server conn: %v", err)
+	}
+	<-serveErr
+	ctx := context.Background()
+	msg := stanza.Message{ID: "123", To: jid.MustParse("romeo@example.net"), Type: stanza.ChatMessage}
+	/* #nosec */
+	client.Send(ctx, msg.Wrap(nil))
+
+	// Attempt to resume on a server that no longer knows about the stream.
+	newServerSM := &xmpp.SMState{Lookup: func(string) *xmpp.SMState { return nil }}
+	client, clientConn, _ := smPipe(t, clientSM, newServerSM, nil)
+	defer clientConn.Close()
+	if client.State()&xmpp.Ready == 0 {
+		t.Fatalf("client session not ready: %v", client.State())
+	}
+	if id := clientSM.ID(); id == "" || id != newServerSM.ID() {
+		t.Fatalf("wrong stream ID: want=%q, got=%q", newServerSM.ID(), id)
+	}
+	if n := clientSM.Unacked(); n != 0 {
+		t.Errorf("new stream should have no unacked stanzas, got %d", n)
+	}
+
+	lost := clientSM.Drain()
+	if len(lost) != 1 {
+		t.Fatalf("wrong number of drained stanzas: want=1, got=%d", len(lost))
+	}
+	var buf strings.Builder
+	e := xml.NewEncoder(&buf)
+	if _, err = xmlstream.Copy(e, lost[0]); err != nil {
+		t.Fatalf("error encoding drained stanza: %v", err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("error flushing drained stanza: %v", err)
+	}
+	const want = `<message type="chat" id="123" to="romeo@example.net"></message>`
+	if out := buf.String(); out != want {
+		t.Errorf("wrong drained stanza:\nwant=%s,\n got=%s", want, out)
+	}
+	if lost = clientSM.Drain(); len(lost) != 0 {
+		t.Errorf("expected drained stanzas to be removed, got %d", len(lost))
+	}
+}
+
+func TestStreamManagementBadAck(t *testing.T) {
+	clientSM := &xmpp.SMState{}
+	serverSM := &xmpp.SMState{}
+
+	// Both sides close the stream at once, so use a connection that buffers
+	// writes instead of an in memory pipe.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer clientConn.Close()
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatal("error accepting connection")
+	}
+	defer serverConn.Close()
+
+	// Acknowledge more stanzas than the client has sent.
+	handler := xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		a := xml.StartElement{
+			Name: xml.Name{Space: "urn:xmpp:sm:3", Local: "a"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "h"}, Value: "2"}},
+		}
+		if err := r.EncodeToken(a); err != nil {
+			return err
+		}
+		return r.EncodeToken(a.End())
+	})
+	client, serverErr := smConn(t, clientConn, serverConn, clientSM, serverSM, handler)
+
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Serve(nil)
+	}()
+	msg := stanza.Message{To: jid.MustParse("romeo@example.net"), Type: stanza.ChatMessage}
+	err = client.Send(context.Background(), msg.Wrap(nil))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	// The client closes the stream and the server receives the error.
+	want := stream.Error{Err: stream.UndefinedCondition.Err, Text: "handled-count-too-high"}
+	for _, c := range []struct {
+		name string
+		errs <-chan error
+	}{{"client", clientErr}, {"server", serverErr}} {
+		select {
+		case err = <-c.errs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s session to be closed", c.name)
+		}
+		if err != want {
+			t.Errorf("wrong error from %s: want=%#v, got=%#v", c.name, want, err)
+		}
+	}
+	if n := clientSM.Unacked(); n != 1 {
+		t.Errorf("invalid ack should not remove stanzas from the queue: want=1, got=%d", n)
+	}
+}
+
+func TestStreamManagementNotRequested(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// The client binds a resource and then waits without enabling stream
+	// management, so the server must not wait for it to do so.
+	errs := make(chan error, 1)
+	go func() {
+		server, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(xmpp.Authn,
+			xmpp.BindResource(),
+			xmpp.StreamManagement(nil),
+		))
+		if err == nil && server.State()&xmpp.Ready == 0 {
+			err = fmt.Errorf("server session not ready: %v", server.State())
+		}
+		errs <- err
+	}()
+
+	_, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(xmpp.Authn,
+		xmpp.BindResource(),
+	))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Fatalf("error negotiating server session: %v", err)
+		}
+	case <-ctx.Done():
+		/* #nosec */
+		serverConn.Close()
+		t.Fatal("timed out waiting for the server to finish negotiating")
+	}
+}
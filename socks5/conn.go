@@ -0,0 +1,39 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"net"
+
+	"mellium.im/xmpp/jid"
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+// Conn is a SOCKS5 bytestream.
+// Reads and writes go directly to the TCP connection with the stream host.
+type Conn struct {
+	net.Conn
+
+	sid    string
+	local  jid.JID
+	remote jid.JID
+}
+
+// SID returns the session ID that identifies the stream.
+func (c *Conn) SID() string {
+	return c.sid
+}
+
+// LocalAddr returns the address of the session that the stream was opened on.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end of the stream.
+// To get the network address of the stream host, use the embedded net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package socks5
+
+// Functions that have been exported only for the proxy used by tests in the
+// socks5_test package.
+var (
+	Accept  = accept
+	Reply   = reply
+	DstAddr = dstAddr
+)
+
+// ReplySuccess is the SOCKS5 reply code indicating that a request succeeded.
+const ReplySuccess = replySuccess
@@ -0,0 +1,79 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"context"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// FindProxies uses service discovery to find the bytestream proxies offered by
+// the server at to and returns their network addresses.
+// Items that are not proxies, or that respond to any query with an error, are
+// skipped.
+func FindProxies(ctx context.Context, s *xmpp.Session, to jid.JID) ([]StreamHost, error) {
+	iter := disco.FetchItems(ctx, "", to, s)
+	var items []jid.JID
+	for iter.Next() {
+		items = append(items, iter.Item().JID)
+	}
+	err := iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []StreamHost
+	for _, item := range items {
+		discoInfo, err := disco.GetInfo(ctx, "", item, s)
+		if _, ok := err.(stanza.Error); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var isProxy bool
+		for _, ident := range discoInfo.Identities {
+			if ident.Category == "proxy" && ident.Type == "bytestreams" {
+				isProxy = true
+				break
+			}
+		}
+		if !isProxy {
+			continue
+		}
+		host, err := GetStreamHost(ctx, s, item)
+		if _, ok := err.(stanza.Error); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// GetStreamHost requests the network address of the proxy at to.
+// If the remote entity responds with an error it is returned as a
+// stanza.Error.
+func GetStreamHost(ctx context.Context, s *xmpp.Session, to jid.JID) (StreamHost, error) {
+	resp := query{}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, queryStart("")), stanza.IQ{Type: stanza.GetIQ, To: to}, &resp)
+	if err != nil {
+		return StreamHost{}, err
+	}
+	if len(resp.StreamHosts) == 0 {
+		return StreamHost{}, errNoHost
+	}
+	return resp.StreamHosts[0], nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"errors"
+	"io"
+)
+
+// The subset of SOCKS5 (RFC 1928) used by bytestreams: no authentication and
+// the CONNECT command with a domain name address and a port of zero.
+const (
+	socksVersion   = 5
+	methodNoAuth   = 0
+	methodNone     = 0xff
+	cmdConnect     = 1
+	addrTypeDomain = 3
+
+	replySuccess         = 0
+	replyHostUnreachable = 4
+	replyCmdUnsupported  = 7
+	replyAddrUnsupported = 8
+)
+
+var (
+	errVersion    = errors.New("socks5: unsupported SOCKS version")
+	errAuth       = errors.New("socks5: no acceptable authentication methods")
+	errCommand    = errors.New("socks5: unsupported command")
+	errAddrType   = errors.New("socks5: unsupported address type")
+	errAddrLength = errors.New("socks5: destination address too long")
+	errRejected   = errors.New("socks5: connection rejected by stream host")
+)
+
+// connect performs the client side of the SOCKS5 handshake, asking the server
+// to connect to the domain addr.
+func connect(rw io.ReadWriter, addr string) error {
+	if len(addr) > 255 {
+		return errAddrLength
+	}
+	_, err := rw.Write([]byte{socksVersion, 1, methodNoAuth})
+	if err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err = io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return errVersion
+	}
+	if buf[1] != methodNoAuth {
+		return errAuth
+	}
+
+	_, err = rw.Write(request(cmdConnect, addr))
+	if err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(rw, buf[:]); err != nil {
+		return err
+	}
+	switch {
+	case buf[0] != socksVersion:
+		return errVersion
+	case buf[1] != replySuccess:
+		return errRejected
+	}
+	// Discard the bound address and port, which are not used by bytestreams.
+	var n int
+	switch buf[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case addrTypeDomain:
+		if _, err = io.ReadFull(rw, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return errAddrType
+	}
+	_, err = io.ReadFull(rw, make([]byte, n+2))
+	return err
+}
+
+// accept performs the server side of the SOCKS5 handshake up to the point
+// where the server must reply to the request.
+// It returns the requested domain, which must be acknowledged with reply.
+// If the request is not one that bytestreams use, an error is sent to the
+// client and returned.
+func accept(rw io.ReadWriter) (string, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", errVersion
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	method := byte(methodNone)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+			break
+		}
+	}
+	if _, err := rw.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == methodNone {
+		return "", errAuth
+	}
+
+	if _, err := io.ReadFull(rw, buf[:4]); err != nil {
+		return "", err
+	}
+	switch {
+	case buf[0] != socksVersion:
+		return "", errVersion
+	case buf[1] != cmdConnect:
+		/* #nosec */
+		reply(rw, replyCmdUnsupported, "")
+		return "", errCommand
+	case buf[3] != addrTypeDomain:
+		/* #nosec */
+		reply(rw, replyAddrUnsupported, "")
+		return "", errAddrType
+	}
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return "", err
+	}
+	addr := buf[:buf[0]]
+	if _, err := io.ReadFull(rw, addr); err != nil {
+		return "", err
+	}
+	// Bytestreams always use port zero, so the port is ignored.
+	if _, err := io.ReadFull(rw, make([]byte, 2)); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
+
+// reply sends the servers reply to a request for addr.
+func reply(w io.Writer, code byte, addr string) error {
+	_, err := w.Write(request(code, addr))
+	return err
+}
+
+// request returns a request or reply message, which share the same format.
+func request(code byte, addr string) []byte {
+	b := make([]byte, 0, 7+len(addr))
+	b = append(b, socksVersion, code, 0, addrTypeDomain, byte(len(addr)))
+	b = append(b, addr...)
+	return append(b, 0, 0)
+}
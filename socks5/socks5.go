@@ -0,0 +1,458 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package socks5 implements data transfer with XEP-0065: SOCKS5 Bytestreams.
+//
+// SOCKS5 bytestreams (S5B) transfer data over a direct TCP connection between
+// two entities, or through a proxy when a direct connection is not possible.
+// Unlike in-band bytestreams the data is not sent over the XMPP session, making
+// them much faster for transferring large amounts of data.
+//
+// The entity that opens a stream (the initiator) offers one or more stream
+// hosts to the other entity (the target), which connects to the first one that
+// it can reach.
+// A stream host is either the initiator itself, which accepts connections from
+// the target with Serve, or a proxy that relays data between the two entities
+// and can be found using FindProxies.
+// Either way, once the stream is ready it is returned as a Conn, which can be
+// used as a plain net.Conn.
+package socks5 // import "mellium.im/xmpp/socks5"
+
+import (
+	"context"
+	"crypto/sha1" // #nosec
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the XML namespace used by SOCKS5 bytestreams.
+// It is provided as a convenience.
+const NS = "http://jabber.org/protocol/bytestreams"
+
+const (
+	// DefaultPort is the port used for stream hosts that do not specify one.
+	DefaultPort = 1080
+
+	// dialTimeout is the maximum amount of time the target waits for each stream
+	// host that it tries to connect to.
+	dialTimeout = 10 * time.Second
+
+	// backlog is the number of incoming streams that may be waiting to be
+	// accepted before new streams are rejected.
+	backlog = 16
+)
+
+var (
+	errListening   = errors.New("socks5: handler is already listening")
+	errClosed      = errors.New("socks5: use of closed listener")
+	errNoHost      = errors.New("socks5: response did not contain a stream host")
+	errUnknownHost = errors.New("socks5: remote entity used a stream host that was not offered")
+)
+
+// StreamHost is the network address of an entity that can relay a bytestream.
+type StreamHost struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/bytestreams streamhost"`
+	JID     jid.JID  `xml:"jid,attr"`
+	Host    string   `xml:"host,attr"`
+	Port    uint16   `xml:"port,attr,omitempty"`
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (h StreamHost) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "streamhost"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "jid"}, Value: h.JID.String()},
+			{Name: xml.Name{Local: "host"}, Value: h.Host},
+		},
+	}
+	if h.Port != 0 {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "port"}, Value: strconv.FormatUint(uint64(h.Port), 10)})
+	}
+	return xmlstream.Wrap(nil, start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (h StreamHost) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, h.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (h StreamHost) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := h.WriteXML(e)
+	return err
+}
+
+func (h StreamHost) addr() string {
+	port := h.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(h.Host, strconv.FormatUint(uint64(port), 10))
+}
+
+// query is the payload of all bytestream IQs.
+type query struct {
+	XMLName     xml.Name     `xml:"http://jabber.org/protocol/bytestreams query"`
+	SID         string       `xml:"sid,attr"`
+	Mode        string       `xml:"mode,attr"`
+	StreamHosts []StreamHost `xml:"streamhost"`
+	Used        *struct {
+		JID jid.JID `xml:"jid,attr"`
+	} `xml:"streamhost-used"`
+}
+
+// queryStart returns the start element of a query for the stream sid.
+func queryStart(sid string) xml.StartElement {
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}}
+	if sid != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "sid"}, Value: sid})
+	}
+	return start
+}
+
+// Handle returns an option that registers a Handler for bytestream requests.
+func Handle(h *Handler) mux.Option {
+	return mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "query"}, h)
+}
+
+// Handler negotiates bytestreams.
+// It opens streams, accepts direct connections from targets when the
+// initiator offers itself as a stream host, and connects to stream hosts when
+// other entities open streams.
+// The zero value is ready to use.
+type Handler struct {
+	// Allow is called with the address of the initiator and the session ID of
+	// each stream opened by another entity before connecting to any of the
+	// stream hosts that it offered.
+	// If it returns false the stream is rejected.
+	// If nil, all streams are allowed while a listener is active.
+	Allow func(from jid.JID, sid string) bool
+
+	mu      sync.Mutex
+	l       *Listener
+	pending map[string]chan net.Conn
+}
+
+// ForFeatures implements info.FeatureIter.
+func (h *Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}
+
+// Open offers the stream hosts to the target entity at to and returns the
+// stream once the target has connected to one of them.
+// Hosts are offered in order of preference.
+//
+// To offer a direct connection, include a stream host with the sessions own
+// address and the network address of a listener that is being served by the
+// handler with Serve.
+// If the target connects to a proxy, Open also connects to the proxy and asks
+// it to activate the stream before returning.
+func (h *Handler) Open(ctx context.Context, s *xmpp.Session, to jid.JID, hosts ...StreamHost) (*Conn, error) {
+	sid := attr.RandomID()
+	local := s.LocalAddr()
+	addr := dstAddr(sid, local, to)
+	newConn := func(conn net.Conn) *Conn {
+		return &Conn{Conn: conn, sid: sid, local: local, remote: to}
+	}
+
+	var direct chan net.Conn
+	for _, host := range hosts {
+		if host.JID.Equal(local) {
+			direct = h.expect(addr)
+			defer h.forget(addr)
+			break
+		}
+	}
+
+	var payload []xml.TokenReader
+	for _, host := range hosts {
+		payload = append(payload, host.TokenReader())
+	}
+	start := queryStart(sid)
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "mode"}, Value: "tcp"})
+	resp := query{}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(xmlstream.MultiReader(payload...), start), stanza.IQ{Type: stanza.SetIQ, To: to}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Used == nil {
+		return nil, errNoHost
+	}
+	used := resp.Used.JID
+
+	if direct != nil && used.Equal(local) {
+		select {
+		case conn := <-direct:
+			return newConn(conn), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var proxy *StreamHost
+	for i := range hosts {
+		if hosts[i].JID.Equal(used) {
+			proxy = &hosts[i]
+			break
+		}
+	}
+	if proxy == nil {
+		return nil, errUnknownHost
+	}
+	conn, err := dial(ctx, *proxy, addr)
+	if err != nil {
+		return nil, err
+	}
+	err = s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(to.String())),
+			xml.StartElement{Name: xml.Name{Local: "activate"}},
+		),
+		queryStart(sid),
+	), stanza.IQ{Type: stanza.SetIQ, To: used}, nil)
+	if err != nil {
+		/* #nosec */
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn), nil
+}
+
+// Serve accepts connections from targets on l, acting as a stream host for
+// streams opened by the handler.
+// Connections that do not belong to a stream that is being opened are
+// rejected.
+// Serve always returns a non-nil error, normally the error returned by l when
+// it is closed.
+func (h *Handler) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handshake(conn)
+	}
+}
+
+func (h *Handler) handshake(conn net.Conn) {
+	/* #nosec */
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	addr, err := accept(conn)
+	if err != nil {
+		/* #nosec */
+		conn.Close()
+		return
+	}
+
+	h.mu.Lock()
+	_, ok := h.pending[addr]
+	h.mu.Unlock()
+	if !ok {
+		/* #nosec */
+		reply(conn, replyHostUnreachable, addr)
+		/* #nosec */
+		conn.Close()
+		return
+	}
+	err = reply(conn, replySuccess, addr)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		/* #nosec */
+		conn.Close()
+		return
+	}
+
+	// The stream may have stopped waiting for the connection during the
+	// handshake, so look it up again.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case h.pending[addr] <- conn:
+	default:
+		// The stream is no longer waiting or the target already connected.
+		/* #nosec */
+		conn.Close()
+	}
+}
+
+// expect registers a direct connection that is about to be opened.
+func (h *Handler) expect(addr string) chan net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[string]chan net.Conn)
+	}
+	c := make(chan net.Conn, 1)
+	h.pending[addr] = c
+	return c
+}
+
+// forget unregisters a direct connection and closes it if it was never used.
+func (h *Handler) forget(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.pending[addr]
+	delete(h.pending, addr)
+	select {
+	case conn := <-c:
+		/* #nosec */
+		conn.Close()
+	default:
+	}
+}
+
+// Listen returns a listener that accepts streams opened by other entities on
+// the session.
+// Only one listener may be active at a time, until it is closed all other calls
+// to Listen return an error.
+// If there is no active listener, all incoming streams are rejected.
+//
+// Because the target must connect to a stream host before it responds to the
+// initiator, the handler blocks while connecting and the session should be
+// served with ServeConcurrent.
+// Streams can be vetted with the Allow field before any connections are made.
+func (h *Handler) Listen(s *xmpp.Session) (*Listener, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.l != nil {
+		return nil, errListening
+	}
+	h.l = &Listener{
+		h:     h,
+		s:     s,
+		conns: make(chan *Conn, backlog),
+		done:  make(chan struct{}),
+	}
+	return h.l, nil
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h *Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	if iq.Type != stanza.SetIQ || start.Name.Local != "query" || start.Name.Space != NS {
+		return nil
+	}
+	q := query{}
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(
+		xmlstream.Token(*start),
+		xmlstream.Inner(t),
+		xmlstream.Token(start.End()),
+	)).Decode(&q)
+	if err != nil {
+		return err
+	}
+
+	used, err := h.connect(iq, q)
+	if stanzaErr, ok := err.(stanza.Error); ok {
+		iq.To, iq.From = iq.From, iq.To
+		iq.Type = stanza.ErrorIQ
+		_, err = xmlstream.Copy(t, iq.Wrap(stanzaErr.TokenReader()))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = xmlstream.Copy(t, iq.Result(xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "streamhost-used"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "jid"}, Value: used.String()}},
+		}),
+		queryStart(q.SID),
+	)))
+	return err
+}
+
+// connect tries each stream host offered by the initiator in order and
+// returns the address of the first one that the target connected to.
+func (h *Handler) connect(iq stanza.IQ, q query) (jid.JID, error) {
+	h.mu.Lock()
+	l := h.l
+	h.mu.Unlock()
+	if l == nil {
+		return jid.JID{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAcceptable}
+	}
+	if q.SID == "" {
+		return jid.JID{}, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	}
+	if q.Mode != "" && q.Mode != "tcp" {
+		return jid.JID{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAcceptable}
+	}
+	if h.Allow != nil && !h.Allow(iq.From, q.SID) {
+		return jid.JID{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAcceptable}
+	}
+
+	target := iq.To
+	if target.Equal(jid.JID{}) {
+		target = l.s.LocalAddr()
+	}
+	addr := dstAddr(q.SID, iq.From, target)
+	for _, host := range q.StreamHosts {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		conn, err := dial(ctx, host, addr)
+		cancel()
+		if err != nil {
+			continue
+		}
+		select {
+		case l.conns <- &Conn{Conn: conn, sid: q.SID, local: target, remote: iq.From}:
+		default:
+			/* #nosec */
+			conn.Close()
+			return jid.JID{}, stanza.Error{Type: stanza.Wait, Condition: stanza.ResourceConstraint}
+		}
+		return host.JID, nil
+	}
+	return jid.JID{}, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+}
+
+// dial connects to the stream host and asks it to connect to addr.
+func dial(ctx context.Context, host StreamHost, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host.addr())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+	}
+	if err == nil {
+		err = connect(conn, addr)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		/* #nosec */
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dstAddr returns the destination address used to identify a stream to stream
+// hosts.
+func dstAddr(sid string, requester, target jid.JID) string {
+	/* #nosec */
+	h := sha1.Sum([]byte(sid + requester.String() + target.String()))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,482 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package socks5_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/socks5"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ mux.IQHandler       = (*socks5.Handler)(nil)
+	_ info.FeatureIter    = (*socks5.Handler)(nil)
+	_ net.Listener        = (*socks5.Listener)(nil)
+	_ xmlstream.Marshaler = socks5.StreamHost{}
+)
+
+var (
+	serverJID    = jid.MustParse("example.net")
+	proxyJID     = jid.MustParse("proxy.example.net")
+	initiatorJID = jid.MustParse("romeo@example.net/orchard")
+	targetJID    = jid.MustParse("juliet@example.net/balcony")
+)
+
+// proxy is a stand-in for a SOCKS5 bytestream proxy that listens on the
+// loopback interface.
+type proxy struct {
+	l     net.Listener
+	mu    sync.Mutex
+	conns map[string][]net.Conn
+}
+
+func newProxy(t *testing.T) *proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	p := &proxy{l: l, conns: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				addr, err := socks5.Accept(conn)
+				if err != nil {
+					/* #nosec */
+					conn.Close()
+					return
+				}
+				p.mu.Lock()
+				p.conns[addr] = append(p.conns[addr], conn)
+				p.mu.Unlock()
+				/* #nosec */
+				socks5.Reply(conn, socks5.ReplySuccess, addr)
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *proxy) StreamHost() socks5.StreamHost {
+	addr := p.l.Addr().(*net.TCPAddr)
+	return socks5.StreamHost{JID: proxyJID, Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+// activate relays data between the two connections for a stream.
+func (p *proxy) activate(sid string, requester, target jid.JID) bool {
+	addr := socks5.DstAddr(sid, requester, target)
+	p.mu.Lock()
+	conns := p.conns[addr]
+	delete(p.conns, addr)
+	p.mu.Unlock()
+	if len(conns) != 2 {
+		return false
+	}
+	/* #nosec */
+	go io.Copy(conns[0], conns[1])
+	/* #nosec */
+	go io.Copy(conns[1], conns[0])
+	return true
+}
+
+func (p *proxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.conns {
+		for _, conn := range conns {
+			/* #nosec */
+			conn.Close()
+		}
+	}
+	return p.l.Close()
+}
+
+// element is a top level element sent by a session.
+type element struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (e element) attr(local string) string {
+	for _, a := range e.Attr {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// writeTo writes the element to w with its from attribute set to from.
+func (e element) writeTo(w io.Writer, from jid.JID) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%s from=%q", e.XMLName.Local, from)
+	for _, a := range e.Attr {
+		var name string
+		switch {
+		case a.Name.Space == "" && a.Name.Local == "from":
+			continue
+		case a.Name.Space == "":
+			name = a.Name.Local
+		case a.Name.Space == "xmlns":
+			name = "xmlns:" + a.Name.Local
+		default:
+			continue
+		}
+		buf.WriteString(" " + name + `="`)
+		/* #nosec */
+		xml.EscapeText(&buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+	fmt.Fprintf(&buf, ">%s</%s>", e.Inner, e.XMLName.Local)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// syncWriter serializes writes to the underlying writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// newSession returns a session with the address origin that is connected
+// over rw.
+func newSession(origin jid.JID, rw io.ReadWriter) *xmpp.Session {
+	s, err := xmpp.NegotiateSession(
+		context.Background(), serverJID, origin,
+		struct {
+			io.Reader
+			io.Writer
+		}{
+			Reader: io.MultiReader(
+				strings.NewReader(`<stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams">`),
+				rw,
+			),
+			Writer: rw,
+		},
+		false,
+		xmpptest.NopNegotiator(0),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newPeers returns sessions for the initiator and the target that are served
+// by the provided handlers and connected by a fake server.
+// The server stamps the address of the sending session on stanzas and routes
+// them to the other session, or answers them if they are addressed to the
+// server itself or to the proxy.
+// The returned function closes the connections and the proxy.
+func newPeers(t *testing.T, h1, h2 *socks5.Handler) (s1, s2 *xmpp.Session, p *proxy, closer func()) {
+	p = newProxy(t)
+	c1, server1 := net.Pipe()
+	c2, server2 := net.Pipe()
+	routes := map[string]io.Writer{
+		initiatorJID.String(): &syncWriter{w: server1},
+		targetJID.String():    &syncWriter{w: server2},
+	}
+	go route(p, initiatorJID, server1, routes)
+	go route(p, targetJID, server2, routes)
+
+	s1 = newSession(initiatorJID, c1)
+	s2 = newSession(targetJID, c2)
+	// Serving stops with an error when the connection is closed at the end of the
+	// test, so there is nothing useful to report.
+	/* #nosec */
+	go s1.Serve(mux.New(socks5.Handle(h1)))
+	/* #nosec */
+	go s2.Serve(mux.New(socks5.Handle(h2)))
+	return s1, s2, p, func() {
+		for _, c := range []io.Closer{c1, c2, server1, server2, p} {
+			/* #nosec */
+			c.Close()
+		}
+	}
+}
+
+// route reads stanzas sent by the session at from and forwards them to the
+// other session or answers them.
+func route(p *proxy, from jid.JID, r io.Reader, routes map[string]io.Writer) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var e element
+		if err = d.DecodeElement(&e, &start); err != nil {
+			return
+		}
+		if w, ok := routes[e.attr("to")]; ok {
+			err = e.writeTo(w, from)
+		} else {
+			err = answer(p, from, routes[from.String()], e)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer responds to IQs sent to the server or the proxy, and with an error to
+// IQs sent to any other entity.
+func answer(p *proxy, from jid.JID, w io.Writer, e element) error {
+	req := xmpptest.Request{Type: e.attr("type"), To: e.attr("to"), ID: e.attr("id"), Inner: e.Inner}
+	var payload struct {
+		XMLName  xml.Name
+		SID      string `xml:"sid,attr"`
+		Activate string `xml:"activate"`
+	}
+	err := xml.Unmarshal([]byte(req.Inner), &payload)
+	if err != nil {
+		return err
+	}
+
+	var resp string
+	switch to := req.To; {
+	case to == serverJID.String() && payload.XMLName.Space == disco.NSItems:
+		resp = `<query xmlns="` + disco.NSItems + `"><item jid="conference.example.net"/><item jid="` + proxyJID.String() + `"/></query>`
+	case to == proxyJID.String() && payload.XMLName.Space == disco.NSInfo:
+		resp = `<query xmlns="` + disco.NSInfo + `"><identity category="proxy" type="bytestreams"/></query>`
+	case to == proxyJID.String() && payload.XMLName.Space == socks5.NS && req.Type == "get":
+		host := p.StreamHost()
+		resp = `<query xmlns="` + socks5.NS + `"><streamhost jid="` + host.JID.String() + `" host="` + host.Host + `" port="` + strconv.Itoa(int(host.Port)) + `"/></query>`
+	case to == proxyJID.String() && payload.XMLName.Space == socks5.NS:
+		if !p.activate(payload.SID, from, jid.MustParse(payload.Activate)) {
+			resp = `<error type="cancel"><item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		}
+	default:
+		resp = `<error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+	}
+	return xmpptest.Respond(w, req, resp)
+}
+
+// exchange checks that data can be sent in both directions over a stream.
+func exchange(t *testing.T, initiator, target net.Conn) {
+	for _, conns := range [][2]net.Conn{{initiator, target}, {target, initiator}} {
+		want := []byte("Now is the winter of our discontent")
+		errs := make(chan error, 1)
+		go func(w net.Conn) {
+			_, err := w.Write(want)
+			errs <- err
+		}(conns[0])
+		got := make([]byte, len(want))
+		err := conns[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatalf("error setting deadline: %v", err)
+		}
+		_, err = io.ReadFull(conns[1], got)
+		if err != nil {
+			t.Fatalf("error reading from stream: %v", err)
+		}
+		if err = <-errs; err != nil {
+			t.Fatalf("error writing to stream: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("wrong data: want=%q, got=%q", want, got)
+		}
+	}
+}
+
+func TestDirect(t *testing.T) {
+	h1, h2 := &socks5.Handler{}, &socks5.Handler{}
+	s1, s2, _, closer := newPeers(t, h1, h2)
+	defer closer()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	/* #nosec */
+	go h1.Serve(ln)
+
+	l, err := h2.Listen(s2)
+	if err != nil {
+		t.Fatalf("error listening for streams: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := h1.Open(ctx, s1, targetJID, socks5.StreamHost{
+		JID:  s1.LocalAddr(),
+		Host: addr.IP.String(),
+		Port: uint16(addr.Port),
+	})
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := l.AcceptSOCKS5()
+	if err != nil {
+		t.Fatalf("error accepting stream: %v", err)
+	}
+	defer accepted.Close()
+	if accepted.SID() != conn.SID() {
+		t.Errorf("wrong SID: want=%q, got=%q", conn.SID(), accepted.SID())
+	}
+	if a := accepted.RemoteAddr().String(); a != initiatorJID.String() {
+		t.Errorf("wrong remote address: want=%s, got=%s", initiatorJID, a)
+	}
+	if a := conn.RemoteAddr().String(); a != targetJID.String() {
+		t.Errorf("wrong remote address for initiator: want=%s, got=%s", targetJID, a)
+	}
+
+	exchange(t, conn, accepted)
+
+	// Connections that do not belong to a stream are rejected.
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer c.Close()
+	/* #nosec */
+	c.Write([]byte{5, 1, 0, 5, 1, 0, 3, 3, 'f', 'o', 'o', 0, 0})
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("error reading handshake: %v", err)
+	}
+	if len(resp) < 4 || resp[3] == socks5.ReplySuccess {
+		t.Errorf("expected unknown stream to be rejected, got reply %v", resp)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	h1, h2 := &socks5.Handler{}, &socks5.Handler{}
+	s1, s2, p, closer := newPeers(t, h1, h2)
+	defer closer()
+
+	l, err := h2.Listen(s2)
+	if err != nil {
+		t.Fatalf("error listening for streams: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hosts, err := socks5.FindProxies(ctx, s1, serverJID)
+	if err != nil {
+		t.Fatalf("error finding proxies: %v", err)
+	}
+	if want := p.StreamHost(); len(hosts) != 1 || hosts[0].JID.String() != want.JID.String() || hosts[0].Host != want.Host || hosts[0].Port != want.Port {
+		t.Fatalf("wrong proxies: want=[%+v], got=%+v", want, hosts)
+	}
+
+	// Offer a stream host that can't be reached first to make sure the target
+	// moves on to the next one.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := closed.Addr().(*net.TCPAddr)
+	/* #nosec */
+	closed.Close()
+	unreachable := socks5.StreamHost{
+		JID:  jid.MustParse("unreachable.example.net"),
+		Host: addr.IP.String(),
+		Port: uint16(addr.Port),
+	}
+
+	conn, err := h1.Open(ctx, s1, targetJID, append([]socks5.StreamHost{unreachable}, hosts...)...)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("error accepting stream: %v", err)
+	}
+	defer accepted.Close()
+
+	exchange(t, conn, accepted)
+}
+
+func TestRejected(t *testing.T) {
+	h1, h2 := &socks5.Handler{}, &socks5.Handler{}
+	s1, s2, p, closer := newPeers(t, h1, h2)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := h1.Open(ctx, s1, targetJID, p.StreamHost())
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.NotAcceptable {
+		t.Errorf("wrong error without a listener: want=%v, got=%v", stanza.NotAcceptable, err)
+	}
+
+	l, err := h2.Listen(s2)
+	if err != nil {
+		t.Fatalf("error listening for streams: %v", err)
+	}
+	defer l.Close()
+	_, err = h2.Listen(s2)
+	if err == nil {
+		t.Errorf("expected error listening twice")
+	}
+	_, err = h1.Open(ctx, s1, targetJID)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.ItemNotFound {
+		t.Errorf("wrong error without stream hosts: want=%v, got=%v", stanza.ItemNotFound, err)
+	}
+
+	// Streams that are not allowed are rejected without connecting to the stream
+	// hosts.
+	var from jid.JID
+	var sid string
+	h2.Allow = func(j jid.JID, id string) bool {
+		from, sid = j, id
+		return false
+	}
+	p.mu.Lock()
+	before := len(p.conns)
+	p.mu.Unlock()
+	_, err = h1.Open(ctx, s1, targetJID, p.StreamHost())
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.NotAcceptable {
+		t.Errorf("wrong error for disallowed stream: want=%v, got=%v", stanza.NotAcceptable, err)
+	}
+	if !from.Equal(initiatorJID) || sid == "" {
+		t.Errorf("wrong stream passed to Allow: from=%s, sid=%q", from, sid)
+	}
+	p.mu.Lock()
+	after := len(p.conns)
+	p.mu.Unlock()
+	if after != before {
+		t.Errorf("expected no connections to the proxy for a disallowed stream")
+	}
+}
@@ -338,7 +338,9 @@ func (se Error) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
 // UnmarshalXML satisfies the xml.Unmarshaler interface for StanzaError.
 func (se *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	decoded := struct {
-		Condition struct {
+		// Errors may contain application specific conditions alongside the defined
+		// condition.
+		Conditions []struct {
 			XMLName xml.Name
 		} `xml:",any"`
 		Type ErrorType `xml:"type,attr"`
@@ -353,8 +355,11 @@ func (se *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	}
 	se.Type = decoded.Type
 	se.By = decoded.By
-	if decoded.Condition.XMLName.Space == ns.Stanza {
-		se.Condition = Condition(decoded.Condition.XMLName.Local)
+	for _, cond := range decoded.Conditions {
+		if cond.XMLName.Space == ns.Stanza {
+			se.Condition = Condition(cond.XMLName.Local)
+			break
+		}
 	}
 
 	for _, text := range decoded.Text {
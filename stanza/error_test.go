@@ -110,6 +110,8 @@ func TestUnmarshalStanzaError(t *testing.T) {
 			Error{Condition: RecipientUnavailable, Text: map[string]string{
 				"ac-u": "test",
 			}}, false},
+		13: {`<error type="modify"><not-acceptable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></not-acceptable><file-too-large xmlns="urn:xmpp:http:upload:0"><max-file-size>20000</max-file-size></file-too-large></error>`,
+			Error{Type: Modify, Condition: NotAcceptable}, false},
 	} {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
 			se2 := Error{}
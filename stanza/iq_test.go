@@ -228,3 +228,21 @@ func TestIQFromStartElement(t *testing.T) {
 		t.Errorf("wrong value for type: want=%q, got=%q", v, msg.Type)
 	}
 }
+
+func TestIQFromStartElementEmptyAddr(t *testing.T) {
+	// The session removes the value of the from attribute when it is our own
+	// bare JID, which must be treated the same as having no from attribute.
+	iq, err := stanza.NewIQ(xml.StartElement{
+		Name: xml.Name{Space: "jabber:client", Local: "iq"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "from"}, Value: ""},
+			{Name: xml.Name{Local: "to"}, Value: ""},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !iq.From.Equal(jid.JID{}) || !iq.To.Equal(jid.JID{}) {
+		t.Errorf("expected empty addresses, got from=%q to=%q", iq.From, iq.To)
+	}
+}
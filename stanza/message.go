@@ -44,12 +44,12 @@ func NewMessage(start xml.StartElement) (Message, error) {
 		case "id":
 			v.ID = attr.Value
 		case "to":
-			v.To, err = jid.Parse(attr.Value)
+			err = v.To.UnmarshalXMLAttr(attr)
 			if err != nil {
 				return v, err
 			}
 		case "from":
-			v.From, err = jid.Parse(attr.Value)
+			err = v.From.UnmarshalXMLAttr(attr)
 			if err != nil {
 				return v, err
 			}
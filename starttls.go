@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 
@@ -19,22 +20,43 @@ import (
 // StartTLS returns a new stream feature that can be used for negotiating TLS.
 // If cfg is nil, a default configuration is used that uses the domainpart of
 // the sessions local address as the ServerName.
+//
+// On received sessions the feature is advertised as required and cfg is used to
+// upgrade the connection with tls.Server.
+// Because a server cannot negotiate TLS without a certificate, if cfg is nil
+// the initiating entity is sent a failure and an error is returned.
+// Any client certificates requested by cfg will be available from the sessions
+// ConnectionState method after the stream is restarted.
 func StartTLS(cfg *tls.Config) StreamFeature {
+	return startTLS(cfg, true)
+}
+
+// StartTLSOptional is like StartTLS except that receiving entities advertise
+// the feature as optional.
+// Initiating entities always attempt to negotiate TLS, so on initiated
+// sessions it behaves identically to StartTLS.
+func StartTLSOptional(cfg *tls.Config) StreamFeature {
+	return startTLS(cfg, false)
+}
+
+func startTLS(cfg *tls.Config, required bool) StreamFeature {
 	return StreamFeature{
 		Name:       xml.Name{Local: "starttls", Space: ns.StartTLS},
 		Prohibited: Secure,
 		List: func(ctx context.Context, e xmlstream.TokenWriter, start xml.StartElement) (req bool, err error) {
 			if err = e.EncodeToken(start); err != nil {
-				return true, err
+				return required, err
 			}
-			startRequired := xml.StartElement{Name: xml.Name{Space: "", Local: "required"}}
-			if err = e.EncodeToken(startRequired); err != nil {
-				return true, err
-			}
-			if err = e.EncodeToken(startRequired.End()); err != nil {
-				return true, err
+			if required {
+				startRequired := xml.StartElement{Name: xml.Name{Space: "", Local: "required"}}
+				if err = e.EncodeToken(startRequired); err != nil {
+					return required, err
+				}
+				if err = e.EncodeToken(startRequired.End()); err != nil {
+					return required, err
+				}
 			}
-			return true, e.EncodeToken(start.End())
+			return required, e.EncodeToken(start.End())
 		},
 		Parse: func(ctx context.Context, r xml.TokenReader, start *xml.StartElement) (bool, interface{}, error) {
 			parsed := struct {
@@ -53,6 +75,10 @@ func StartTLS(cfg *tls.Config) StreamFeature {
 			defer r.Close()
 			d := xml.NewTokenDecoder(r)
 
+			if (state & Received) == Received {
+				return negotiateStartTLSServer(session, d, cfg)
+			}
+
 			// If no TLSConfig was specified, use a default config.
 			if cfg == nil {
 				cfg = &tls.Config{
@@ -60,48 +86,90 @@ func StartTLS(cfg *tls.Config) StreamFeature {
 				}
 			}
 
-			if (state & Received) == Received {
-				fmt.Fprint(conn, `<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`)
-				rw = tls.Server(conn, cfg)
-			} else {
-				// Select starttls for negotiation.
-				fmt.Fprint(conn, `<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`)
+			// Select starttls for negotiation.
+			fmt.Fprint(conn, `<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`)
 
-				// Receive a <proceed/> or <failure/> response from the server.
-				t, err := d.Token()
-				if err != nil {
-					return mask, nil, err
-				}
-				switch tok := t.(type) {
-				case xml.StartElement:
-					switch {
-					case tok.Name.Space != ns.StartTLS:
-						return mask, nil, stream.UnsupportedStanzaType
-					case tok.Name.Local == "proceed":
-						// Skip the </proceed> token.
-						if err = d.Skip(); err != nil {
-							return mask, nil, stream.InvalidXML
-						}
-						rw = tls.Client(conn, cfg)
-					case tok.Name.Local == "failure":
-						// Skip the </failure> token.
-						if err = d.Skip(); err != nil {
-							err = stream.InvalidXML
-						}
-						// Failure is not an "error", it's expected behavior. Immediately
-						// afterwards the server will end the stream. However, if we
-						// encounter bad XML while skipping the </failure> token, return
-						// that error.
-						return mask, nil, err
-					default:
-						return mask, nil, stream.UnsupportedStanzaType
+			// Receive a <proceed/> or <failure/> response from the server.
+			t, err := d.Token()
+			if err != nil {
+				return mask, nil, err
+			}
+			switch tok := t.(type) {
+			case xml.StartElement:
+				switch {
+				case tok.Name.Space != ns.StartTLS:
+					return mask, nil, stream.UnsupportedStanzaType
+				case tok.Name.Local == "proceed":
+					// Skip the </proceed> token.
+					if err = d.Skip(); err != nil {
+						return mask, nil, stream.InvalidXML
+					}
+					rw = tls.Client(conn, cfg)
+				case tok.Name.Local == "failure":
+					// Skip the </failure> token.
+					if err = d.Skip(); err != nil {
+						err = stream.InvalidXML
 					}
+					// Failure is not an "error", it's expected behavior. Immediately
+					// afterwards the server will end the stream. However, if we
+					// encounter bad XML while skipping the </failure> token, return
+					// that error.
+					return mask, nil, err
 				default:
-					return mask, nil, stream.RestrictedXML
+					return mask, nil, stream.UnsupportedStanzaType
 				}
+			default:
+				return mask, nil, stream.RestrictedXML
 			}
 			mask = Secure
 			return
 		},
 	}
 }
+
+func negotiateStartTLSServer(session *Session, d *xml.Decoder, cfg *tls.Config) (mask SessionState, rw io.ReadWriter, err error) {
+	w := session.TokenWriter()
+	defer w.Close()
+
+	tok, err := d.Token()
+	if err != nil {
+		return mask, nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return mask, nil, stream.RestrictedXML
+	}
+	if start.Name != (xml.Name{Space: ns.StartTLS, Local: "starttls"}) {
+		return mask, nil, stream.UnsupportedStanzaType
+	}
+	if err = d.Skip(); err != nil {
+		return mask, nil, stream.InvalidXML
+	}
+
+	// RFC 6120 §5.4.2.2:
+	//     If the failure case occurs, the receiving entity MUST return a
+	//     <failure/> element qualified by the
+	//     'urn:ietf:params:xml:ns:xmpp-tls' namespace, MUST close the XML
+	//     stream, and MUST terminate the underlying TCP connection.
+	//
+	// Closing the stream is left to the caller when the error is returned.
+	respName := "proceed"
+	if cfg == nil {
+		respName = "failure"
+	}
+	resp := xml.StartElement{Name: xml.Name{Space: ns.StartTLS, Local: respName}}
+	if err = w.EncodeToken(resp); err != nil {
+		return mask, nil, err
+	}
+	if err = w.EncodeToken(resp.End()); err != nil {
+		return mask, nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return mask, nil, err
+	}
+	if cfg == nil {
+		return mask, nil, errors.New("xmpp: cannot negotiate STARTTLS as a server without a TLS config")
+	}
+
+	return Secure, tls.Server(session.Conn(), cfg), nil
+}
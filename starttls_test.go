@@ -7,16 +7,26 @@ package xmpp_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"mellium.im/sasl"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/internal/ns"
 	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
 )
 
 // There is no room for variation on the starttls feature negotiation, so step
@@ -120,16 +130,40 @@ func (nopRWC) Close() error {
 	return nil
 }
 
+func TestStartTLSOptionalList(t *testing.T) {
+	stls := xmpp.StartTLSOptional(nil)
+	var b bytes.Buffer
+	e := xml.NewEncoder(&b)
+	start := xml.StartElement{Name: xml.Name{Space: ns.StartTLS, Local: "starttls"}}
+	req, err := stls.List(context.Background(), e, start)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case req:
+		t.Error("Expected optional StartTLS listing not to be required")
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `<starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"></starttls>`
+	if s := b.String(); s != expected {
+		t.Errorf("Unexpected optional StartTLS listing: want=%s, got=%s", expected, s)
+	}
+}
+
 func TestNegotiateServer(t *testing.T) {
 	stls := xmpp.StartTLS(&tls.Config{})
 	var b bytes.Buffer
-	c := xmpptest.NewSession(xmpp.Received, nopRWC{&b, &b})
-	_, rw, err := stls.Negotiate(context.Background(), c, nil)
+	r := strings.NewReader(`<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`)
+	c := xmpptest.NewSession(xmpp.Received, nopRWC{r, &b})
+	mask, rw, err := stls.Negotiate(context.Background(), c, nil)
 	switch {
 	case err != nil:
 		t.Fatal(err)
 	case rw == nil:
 		t.Fatal("Expected a new ReadWriter when negotiating STARTTLS as a server")
+	case mask != xmpp.Secure:
+		t.Errorf("Expected session state mask %v but got %v", xmpp.Secure, mask)
 	}
 
 	// The server should send a proceed element.
@@ -142,6 +176,37 @@ func TestNegotiateServer(t *testing.T) {
 	}
 }
 
+func TestNegotiateServerFailure(t *testing.T) {
+	for i, test := range [...]struct {
+		in  string
+		cfg *tls.Config
+		out string
+	}{
+		0: {`<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`, nil, `<failure xmlns="urn:ietf:params:xml:ns:xmpp-tls"></failure>`},
+		1: {`<starttls xmlns='badns'/>`, &tls.Config{}, ``},
+		2: {`<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`, &tls.Config{}, ``},
+		3: {`chardata not start element`, &tls.Config{}, ``},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			stls := xmpp.StartTLS(test.cfg)
+			var b bytes.Buffer
+			c := xmpptest.NewSession(xmpp.Received, nopRWC{strings.NewReader(test.in), &b})
+			mask, rw, err := stls.Negotiate(context.Background(), c, nil)
+			switch {
+			case err == nil:
+				t.Error("Expected an error from starttls server negotiation")
+			case rw != nil:
+				t.Error("Did not expect a new ReadWriter after failing to negotiate STARTTLS")
+			case mask != 0:
+				t.Errorf("Expected empty session state mask but got %v", mask)
+			}
+			if s := b.String(); s != test.out {
+				t.Errorf("Unexpected output: want=%s, got=%s", test.out, s)
+			}
+		})
+	}
+}
+
 func TestNegotiateClient(t *testing.T) {
 	for i, test := range [...]struct {
 		responses []string
@@ -185,3 +250,90 @@ func TestNegotiateClient(t *testing.T) {
 		})
 	}
 }
+
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestStartTLSServer(t *testing.T) {
+	cert := selfSigned(t, "example.net")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		s   *xmpp.Session
+		err error
+	}
+	serverResult := make(chan result, 1)
+	go func() {
+		s, err := xmpp.NegotiateSession(ctx, location, origin, serverConn, true, withState(0,
+			xmpp.StartTLS(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			}),
+			xmpp.SASLServer(func(*sasl.Negotiator) bool { return true }, nil, sasl.Plain),
+			xmpp.BindResource(),
+		))
+		serverResult <- result{s: s, err: err}
+	}()
+
+	client, err := xmpp.NegotiateSession(ctx, location, origin, clientConn, false, withState(0,
+		xmpp.StartTLS(&tls.Config{
+			ServerName:   "example.net",
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+		}),
+		xmpp.SASL("", "secret", sasl.Plain),
+		xmpp.BindResource(),
+	))
+	if err != nil {
+		t.Fatalf("error negotiating client session: %v", err)
+	}
+	res := <-serverResult
+	if res.err != nil {
+		t.Fatalf("error negotiating server session: %v", res.err)
+	}
+
+	if client.State()&xmpp.Secure == 0 || res.s.State()&xmpp.Secure == 0 {
+		t.Errorf("expected both sessions to be secure, got client=%v, server=%v", client.State(), res.s.State())
+	}
+	if !client.ConnectionState().HandshakeComplete {
+		t.Errorf("expected client handshake to be complete")
+	}
+	if certs := res.s.ConnectionState().PeerCertificates; len(certs) != 1 {
+		t.Errorf("expected server to see the client certificate, got %d certs", len(certs))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/xml"
 	"io"
 	"net"
+	"strings"
 
 	"mellium.im/xmlstream"
 )
@@ -176,7 +177,12 @@ func SeeOtherHostError(addr net.Addr, payload xml.TokenReader) Error {
 type Error struct {
 	Err string
 
+	// Text is an optional description of the error that is sent after the
+	// condition in a text element.
+	Text string
+
 	innerXML xml.TokenReader
+	text     string
 }
 
 // Error satisfies the builtin error interface and returns the name of the
@@ -196,20 +202,42 @@ func (s Error) Error() string {
 func (s *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	se := struct {
 		XMLName xml.Name
-		Err     struct {
-			XMLName  xml.Name
-			InnerXML []byte `xml:",innerxml"`
+		Text    string `xml:"urn:ietf:params:xml:ns:xmpp-streams text"`
+		Err     []struct {
+			XMLName xml.Name
+			Text    string `xml:",chardata"`
 		} `xml:",any"`
 	}{}
 	err := d.DecodeElement(&se, &start)
 	if err != nil {
 		return err
 	}
-	s.Err = se.Err.XMLName.Local
-	// TODO: s.InnerXML = se.Err.InnerXML
+	s.Text = se.Text
+	// Application specific conditions may follow the defined condition, so only
+	// the first element in the error namespace is used.
+	for _, cond := range se.Err {
+		if cond.XMLName.Space != "" && cond.XMLName.Space != ErrorNS {
+			continue
+		}
+		s.Err = cond.XMLName.Local
+		s.text = strings.TrimSpace(cond.Text)
+		break
+	}
 	return nil
 }
 
+// OtherHost returns the host advertised by a see-other-host error that was
+// unmarshaled from XML.
+// The host may include a port, and IPv6 addresses are wrapped in brackets.
+// If the error is not a see-other-host error or does not contain a host, false
+// is returned.
+func (s Error) OtherHost() (string, bool) {
+	if s.Err != "see-other-host" {
+		return "", false
+	}
+	return s.text, s.text != ""
+}
+
 // MarshalXML satisfies the xml package's Marshaler interface and allows
 // StreamError's to be correctly marshaled back into XML.
 func (s Error) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
@@ -226,7 +254,20 @@ func (s Error) WriteXML(w xmlstream.TokenWriter) (n int, err error) {
 // TokenReader returns a new xml.TokenReader that returns an encoding of
 // the error.
 func (s Error) TokenReader(payload xml.TokenReader) xml.TokenReader {
-	inner := xmlstream.Wrap(s.innerXML, xml.StartElement{Name: xml.Name{Local: s.Err, Space: ErrorNS}})
+	innerXML := s.innerXML
+	if innerXML == nil && s.text != "" {
+		innerXML = xmlstream.Token(xml.CharData(s.text))
+	}
+	inner := xmlstream.Wrap(innerXML, xml.StartElement{Name: xml.Name{Local: s.Err, Space: ErrorNS}})
+	if s.Text != "" {
+		inner = xmlstream.MultiReader(
+			inner,
+			xmlstream.Wrap(
+				xmlstream.Token(xml.CharData(s.Text)),
+				xml.StartElement{Name: xml.Name{Local: "text", Space: ErrorNS}},
+			),
+		)
+	}
 	if payload != nil {
 		inner = xmlstream.MultiReader(
 			inner,
@@ -65,6 +65,10 @@ var unmarshalTests = [...]struct {
 		`<stream:error></a>`,
 		stream.RestrictedXML, true,
 	},
+	2: {
+		`<stream:error><undefined-condition xmlns="urn:ietf:params:xml:ns:xmpp-streams"/><handled-count-too-high xmlns="urn:xmpp:sm:3" h="10" send-count="8"/><text xmlns="urn:ietf:params:xml:ns:xmpp-streams">handled-count-too-high</text></stream:error>`,
+		stream.Error{Err: "undefined-condition", Text: "handled-count-too-high"}, false,
+	},
 }
 
 func TestUnmarshal(t *testing.T) {
@@ -81,7 +85,7 @@ func TestUnmarshal(t *testing.T) {
 				return
 			case err != nil:
 				return
-			case s.Err != test.se.Err:
+			case s.Err != test.se.Err || s.Text != test.se.Text:
 				t.Errorf("Expected Err `%#v` but got `%#v`", test.se, s)
 				//case string(s.InnerXML) != string(test.se.InnerXML):
 				//	t.Errorf("Expected `%#v` but got `%#v`", test.se, s)
@@ -90,8 +94,46 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestMarshalText(t *testing.T) {
+	const want = `<error xmlns="http://etherx.jabber.org/streams"><undefined-condition xmlns="urn:ietf:params:xml:ns:xmpp-streams"></undefined-condition><text xmlns="urn:ietf:params:xml:ns:xmpp-streams">handled-count-too-high</text></error>`
+	xb, err := xml.Marshal(stream.Error{Err: "undefined-condition", Text: "handled-count-too-high"})
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	if xbs := string(xb); xbs != want {
+		t.Errorf("Bad output:\nwant=`%s`,\ngot=`%s`", want, xbs)
+	}
+}
+
 func TestErrorReturnsErr(t *testing.T) {
 	if stream.RestrictedXML.Error() != "restricted-xml" {
 		t.Error("Error should return the name of the err")
 	}
 }
+
+var otherHostTests = [...]struct {
+	xml  string
+	host string
+	ok   bool
+}{
+	0: {`<stream:error><see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams">[2001:db8::1]:5222</see-other-host></stream:error>`, "[2001:db8::1]:5222", true},
+	1: {`<stream:error><see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams"> example.net </see-other-host></stream:error>`, "example.net", true},
+	2: {`<stream:error><see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams"/></stream:error>`, "", false},
+	3: {`<stream:error><restricted-xml xmlns="urn:ietf:params:xml:ns:xmpp-streams">example.net</restricted-xml></stream:error>`, "", false},
+}
+
+func TestOtherHost(t *testing.T) {
+	for i, test := range otherHostTests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			s := stream.Error{}
+			err := xml.Unmarshal([]byte(test.xml), &s)
+			if err != nil {
+				t.Fatalf("error unmarshaling: %v", err)
+			}
+			host, ok := s.OtherHost()
+			if host != test.host || ok != test.ok {
+				t.Errorf("wrong host: want=(%q, %t), got=(%q, %t)", test.host, test.ok, host, ok)
+			}
+		})
+	}
+}
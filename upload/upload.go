@@ -0,0 +1,412 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package upload implements XEP-0363: HTTP File Upload.
+//
+// HTTP file upload lets a client request a slot on an HTTP server from an
+// upload service on its server.
+// The file is then uploaded to the slot with an HTTP PUT request, after which
+// it can be downloaded by anyone with the URL of the slot, normally by sharing
+// the URL in a message as out of band data.
+package upload // import "mellium.im/xmpp/upload"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/oob"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the XML namespace used by HTTP file upload.
+// It is provided as a convenience.
+const NS = "urn:xmpp:http:upload:0"
+
+var errNoService = errors.New("upload: no upload service found")
+
+// FileTooLargeError is returned when a file is larger than the maximum size
+// allowed by the upload service.
+// If the error was returned by the service, Err is the original error.
+type FileTooLargeError struct {
+	Max uint64
+	Err stanza.Error
+}
+
+// Error satisfies the error interface.
+func (e FileTooLargeError) Error() string {
+	return fmt.Sprintf("upload: file too large, the maximum size is %d bytes", e.Max)
+}
+
+// Unwrap returns the underlying stanza error.
+func (e FileTooLargeError) Unwrap() error {
+	return e.Err
+}
+
+// QuotaError is returned when the user has reached their upload quota.
+// If the upload service said when the user may try again, Retry is set.
+type QuotaError struct {
+	Retry time.Time
+	Err   stanza.Error
+}
+
+// Error satisfies the error interface.
+func (e QuotaError) Error() string {
+	if e.Retry.IsZero() {
+		return "upload: quota reached"
+	}
+	return "upload: quota reached, retry after " + e.Retry.Format(time.RFC3339)
+}
+
+// Unwrap returns the underlying stanza error.
+func (e QuotaError) Unwrap() error {
+	return e.Err
+}
+
+// Service is an upload service.
+type Service struct {
+	// JID is the address of the upload service.
+	JID jid.JID
+
+	// MaxSize is the maximum size of files that the service accepts, or zero if
+	// the service did not advertise a maximum size.
+	MaxSize uint64
+}
+
+// Discover uses service discovery to find the upload service offered by the
+// server at to.
+// Items that respond to the query with an error are skipped.
+func Discover(ctx context.Context, s *xmpp.Session, to jid.JID) (Service, error) {
+	iter := disco.FetchItems(ctx, "", to, s)
+	var items []jid.JID
+	for iter.Next() {
+		items = append(items, iter.Item().JID)
+	}
+	err := iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return Service{}, err
+	}
+
+	for _, item := range items {
+		discoInfo, err := disco.GetInfo(ctx, "", item, s)
+		if _, ok := err.(stanza.Error); ok {
+			continue
+		}
+		if err != nil {
+			return Service{}, err
+		}
+		for _, feature := range discoInfo.Features {
+			if feature.Var == NS {
+				return Service{JID: item, MaxSize: maxSize(discoInfo.Forms)}, nil
+			}
+		}
+	}
+	return Service{}, errNoService
+}
+
+// maxSize returns the maximum file size from the service discovery extension
+// forms, or zero if there is none.
+func maxSize(forms []form.Data) uint64 {
+	for i := range forms {
+		var formType, size string
+		forms[i].ForFields(func(f form.FieldData) {
+			if len(f.Values) == 0 {
+				return
+			}
+			switch f.Var {
+			case "FORM_TYPE":
+				formType = f.Values[0]
+			case "max-file-size":
+				size = f.Values[0]
+			}
+		})
+		if formType != NS {
+			continue
+		}
+		max, err := strconv.ParseUint(size, 10, 64)
+		if err == nil {
+			return max
+		}
+	}
+	return 0
+}
+
+// File describes a file to request an upload slot for.
+type File struct {
+	Name        string
+	Size        uint64
+	ContentType string
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+// It returns a request for an upload slot for the file.
+func (f File) TokenReader() xml.TokenReader {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "request"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "filename"}, Value: f.Name},
+			{Name: xml.Name{Local: "size"}, Value: strconv.FormatUint(f.Size, 10)},
+		},
+	}
+	if f.ContentType != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "content-type"}, Value: f.ContentType})
+	}
+	return xmlstream.Wrap(nil, start)
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (f File) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, f.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (f File) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := f.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Slot is an upload slot.
+type Slot struct {
+	// File is the file that the slot was requested for.
+	File File
+
+	// Put is the URL that the file is uploaded to.
+	Put *url.URL
+
+	// Get is the URL that the file can be downloaded from after it has been
+	// uploaded.
+	Get *url.URL
+
+	// Header contains the headers that must be sent with the upload.
+	// Only headers that the specification allows services to set are included.
+	Header http.Header
+}
+
+// Data returns out of band data pointing to the uploaded file that can be sent
+// in a message.
+func (slot Slot) Data() oob.Data {
+	return oob.Data{URL: slot.Get.String()}
+}
+
+// Upload uploads the file to the slot by reading it from r using the provided
+// client.
+// If client is nil, http.DefaultClient is used.
+// Exactly File.Size bytes must be available from r.
+func (slot Slot) Upload(ctx context.Context, client *http.Client, r io.Reader) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodPut, slot.Put.String(), r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(slot.File.Size)
+	for k, v := range slot.Header {
+		req.Header[k] = v
+	}
+	if slot.File.ContentType != "" {
+		req.Header.Set("Content-Type", slot.File.ContentType)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	/* #nosec */
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload: unexpected response from server: %s", resp.Status)
+	}
+	return nil
+}
+
+// RequestSlot requests an upload slot for f from the upload service at to.
+//
+// If the file is too large, a FileTooLargeError is returned and if the user has
+// reached their quota a QuotaError is returned.
+// If the remote entity responds with any other error it is returned as a
+// stanza.Error.
+func RequestSlot(ctx context.Context, s *xmpp.Session, to jid.JID, f File) (Slot, error) {
+	r, err := s.SendIQElement(ctx, f.TokenReader(), stanza.IQ{Type: stanza.GetIQ, To: to})
+	if err != nil {
+		return Slot{}, err
+	}
+	/* #nosec */
+	defer r.Close()
+
+	resp := struct {
+		Type stanza.IQType `xml:"type,attr"`
+		Slot struct {
+			Put struct {
+				URL    string `xml:"url,attr"`
+				Header []struct {
+					Name  string `xml:"name,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"header"`
+			} `xml:"put"`
+			Get struct {
+				URL string `xml:"url,attr"`
+			} `xml:"get"`
+		} `xml:"urn:xmpp:http:upload:0 slot"`
+		Error uploadError `xml:"error"`
+	}{}
+	err = xml.NewTokenDecoder(r).Decode(&resp)
+	if err != nil {
+		return Slot{}, err
+	}
+	if resp.Type == stanza.ErrorIQ {
+		return Slot{}, resp.Error.err()
+	}
+
+	slot := Slot{File: f, Header: make(http.Header)}
+	slot.Put, err = url.Parse(resp.Slot.Put.URL)
+	if err != nil {
+		return Slot{}, err
+	}
+	slot.Get, err = url.Parse(resp.Slot.Get.URL)
+	if err != nil {
+		return Slot{}, err
+	}
+	for _, h := range resp.Slot.Put.Header {
+		name := http.CanonicalHeaderKey(h.Name)
+		switch name {
+		case "Authorization", "Cookie", "Expires":
+		default:
+			// Services may not ask us to set any other headers.
+			continue
+		}
+		// Newlines would let the service inject other headers.
+		value := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, h.Value)
+		slot.Header.Add(name, value)
+	}
+	return slot, nil
+}
+
+// Upload requests a slot for f from the upload service and uploads the file
+// by reading it from r using the provided client.
+// It returns out of band data pointing to the uploaded file that can be sent in
+// a message.
+// If client is nil, http.DefaultClient is used.
+//
+// If the file is larger than the maximum size advertised by the service, a
+// FileTooLargeError is returned without requesting a slot.
+func Upload(ctx context.Context, s *xmpp.Session, client *http.Client, service Service, f File, r io.Reader) (oob.Data, error) {
+	if service.MaxSize != 0 && f.Size > service.MaxSize {
+		return oob.Data{}, FileTooLargeError{Max: service.MaxSize}
+	}
+	slot, err := RequestSlot(ctx, s, service.JID, f)
+	if err != nil {
+		return oob.Data{}, err
+	}
+	err = slot.Upload(ctx, client, r)
+	if err != nil {
+		return oob.Data{}, err
+	}
+	return slot.Data(), nil
+}
+
+// uploadError is a stanza error that may contain application specific
+// conditions defined by HTTP file upload.
+type uploadError struct {
+	stanzaErr stanza.Error
+	tooLarge  *struct {
+		Max uint64 `xml:"max-file-size"`
+	}
+	retry *struct {
+		Stamp string `xml:"stamp,attr"`
+	}
+}
+
+func (e *uploadError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	// Record the error so that it can be decoded once as a stanza error and once
+	// for the application specific conditions.
+	toks := []xml.Token{start.Copy()}
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+		toks = append(toks, xml.CopyToken(tok))
+	}
+	err := xml.NewTokenDecoder(&tokenReader{toks: toks}).Decode(&e.stanzaErr)
+	if err != nil {
+		return err
+	}
+	ext := struct {
+		TooLarge *struct {
+			Max uint64 `xml:"max-file-size"`
+		} `xml:"urn:xmpp:http:upload:0 file-too-large"`
+		Retry *struct {
+			Stamp string `xml:"stamp,attr"`
+		} `xml:"urn:xmpp:http:upload:0 retry"`
+	}{}
+	err = xml.NewTokenDecoder(&tokenReader{toks: toks}).Decode(&ext)
+	if err != nil {
+		return err
+	}
+	e.tooLarge = ext.TooLarge
+	e.retry = ext.Retry
+	return nil
+}
+
+// err returns the most specific error type for the condition.
+func (e uploadError) err() error {
+	switch {
+	case e.tooLarge != nil:
+		return FileTooLargeError{Max: e.tooLarge.Max, Err: e.stanzaErr}
+	case e.retry != nil:
+		// If the stamp can't be parsed we still know that the quota was reached,
+		// just not when to retry.
+		/* #nosec */
+		retry, _ := time.Parse(time.RFC3339, e.retry.Stamp)
+		return QuotaError{Retry: retry, Err: e.stanzaErr}
+	case e.stanzaErr.Condition == stanza.ResourceConstraint:
+		return QuotaError{Err: e.stanzaErr}
+	}
+	return e.stanzaErr
+}
+
+type tokenReader struct {
+	toks []xml.Token
+}
+
+func (r *tokenReader) Token() (xml.Token, error) {
+	if len(r.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := r.toks[0]
+	r.toks = r.toks[1:]
+	return tok, nil
+}
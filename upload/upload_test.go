@@ -0,0 +1,214 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package upload_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/upload"
+)
+
+var (
+	_ xmlstream.Marshaler = upload.File{}
+	_ error               = upload.FileTooLargeError{}
+	_ error               = upload.QuotaError{}
+)
+
+var service = jid.MustParse("upload.montague.tld")
+
+func TestDiscover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, conn := xmpptest.NewServerSession(nil, func(req xmpptest.Request) string {
+		switch {
+		case req.To == "montague.tld":
+			return `<query xmlns="http://jabber.org/protocol/disco#items"><item jid="chat.montague.tld"/><item jid="pubsub.montague.tld"/><item jid="upload.montague.tld"/></query>`
+		case req.To == "chat.montague.tld":
+			return `<error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`
+		case req.To == "pubsub.montague.tld":
+			return `<query xmlns="http://jabber.org/protocol/disco#info"><identity category="pubsub" type="service"/><feature var="http://jabber.org/protocol/pubsub"/></query>`
+		}
+		return `<query xmlns="http://jabber.org/protocol/disco#info"><identity category="store" type="file" name="HTTP File Upload"/><feature var="urn:xmpp:http:upload:0"/><x type="result" xmlns="jabber:x:data"><field var="FORM_TYPE" type="hidden"><value>urn:xmpp:http:upload:0</value></field><field var="max-file-size"><value>5242880</value></field></x></query>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	svc, err := upload.Discover(ctx, s, jid.MustParse("montague.tld"))
+	if err != nil {
+		t.Fatalf("error discovering service: %v", err)
+	}
+	if !svc.JID.Equal(service) {
+		t.Errorf("wrong service: want=%v, got=%v", service, svc.JID)
+	}
+	if svc.MaxSize != 5242880 {
+		t.Errorf("wrong max size: want=5242880, got=%d", svc.MaxSize)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const body = "<html><body>Romeo and Juliet</body></html>"
+	var uploaded []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut:
+			t.Errorf("wrong method: want=%s, got=%s", http.MethodPut, r.Method)
+		case r.Header.Get("Authorization") != "Basic Base64String==":
+			t.Errorf("wrong authorization header: %q", r.Header.Get("Authorization"))
+		case r.Header.Get("Cookie") != "foo=bar; user=romeo":
+			t.Errorf("wrong cookie header: %q", r.Header.Get("Cookie"))
+		case r.Header.Get("X-Evil") != "":
+			t.Errorf("disallowed header was sent: %q", r.Header.Get("X-Evil"))
+		case r.Header.Get("Content-Type") != "text/html":
+			t.Errorf("wrong content type: %q", r.Header.Get("Content-Type"))
+		case r.ContentLength != int64(len(body)):
+			t.Errorf("wrong content length: want=%d, got=%d", len(body), r.ContentLength)
+		}
+		var err error
+		uploaded, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading upload: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	var req xmpptest.Request
+	s, conn := xmpptest.NewServerSession(nil, func(r xmpptest.Request) string {
+		req = r
+		return `<slot xmlns="urn:xmpp:http:upload:0"><put url="` + srv.URL + `/upload/tr%C3%A8s%20cool.html"><header name="Authorization">Basic Base64String==</header><header name="cookie">foo=bar; user=romeo</header><header name="X-Evil">true</header></put><get url="https://download.montague.tld/tr%C3%A8s%20cool.html"/></slot>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	data, err := upload.Upload(ctx, s, srv.Client(), upload.Service{JID: service, MaxSize: 1024}, upload.File{
+		Name:        "très cool.html",
+		Size:        uint64(len(body)),
+		ContentType: "text/html",
+	}, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error uploading: %v", err)
+	}
+
+	const wantReq = `<request xmlns="urn:xmpp:http:upload:0" filename="très cool.html" size="42" content-type="text/html"></request>`
+	if req.Type != "get" || req.To != service.String() || req.Inner != wantReq {
+		t.Errorf("wrong request:\nwant=%s\n got=%s", wantReq, req.Inner)
+	}
+	if string(uploaded) != body {
+		t.Errorf("wrong data uploaded: want=%q, got=%q", body, uploaded)
+	}
+	const wantURL = "https://download.montague.tld/tr%C3%A8s%20cool.html"
+	if data.URL != wantURL {
+		t.Errorf("wrong URL: want=%s, got=%s", wantURL, data.URL)
+	}
+}
+
+func TestUploadHTTPError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	s, conn := xmpptest.NewServerSession(nil, func(r xmpptest.Request) string {
+		return `<slot xmlns="urn:xmpp:http:upload:0"><put url="` + srv.URL + `/upload"/><get url="https://download.montague.tld/file"/></slot>`
+	})
+	/* #nosec */
+	defer conn.Close()
+
+	_, err := upload.Upload(ctx, s, srv.Client(), upload.Service{JID: service}, upload.File{Name: "file", Size: 4}, bytes.NewReader([]byte("test")))
+	if err == nil {
+		t.Errorf("expected error from forbidden upload")
+	}
+}
+
+var errorTestCases = [...]struct {
+	file    upload.File
+	max     uint64
+	payload string
+	check   func(*testing.T, error)
+}{
+	0: {
+		file: upload.File{Name: "large.jpg", Size: 2000},
+		max:  1000,
+		check: func(t *testing.T, err error) {
+			tooLarge, ok := err.(upload.FileTooLargeError)
+			if !ok || tooLarge.Max != 1000 {
+				t.Errorf("wrong error: want=FileTooLargeError{Max: 1000}, got=%#v", err)
+			}
+		},
+	},
+	1: {
+		file:    upload.File{Name: "large.jpg", Size: 23456},
+		payload: `<error type="modify"><not-acceptable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/><text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">File too large. The maximum file size is 20000 bytes</text><file-too-large xmlns="urn:xmpp:http:upload:0"><max-file-size>20000</max-file-size></file-too-large></error>`,
+		check: func(t *testing.T, err error) {
+			tooLarge, ok := err.(upload.FileTooLargeError)
+			if !ok || tooLarge.Max != 20000 {
+				t.Fatalf("wrong error: want=FileTooLargeError{Max: 20000}, got=%#v", err)
+			}
+			var stanzaErr stanza.Error
+			if !errors.As(err, &stanzaErr) || stanzaErr.Condition != stanza.NotAcceptable {
+				t.Errorf("wrong stanza error: want=%v, got=%v", stanza.NotAcceptable, stanzaErr.Condition)
+			}
+		},
+	},
+	2: {
+		file:    upload.File{Name: "quota.jpg", Size: 100},
+		payload: `<error type="wait"><resource-constraint xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/><text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">Quota reached. You can only upload 5 files in 5 minutes</text><retry xmlns="urn:xmpp:http:upload:0" stamp="2017-12-03T23:42:05Z"/></error>`,
+		check: func(t *testing.T, err error) {
+			quota, ok := err.(upload.QuotaError)
+			want := time.Date(2017, 12, 3, 23, 42, 5, 0, time.UTC)
+			if !ok || !quota.Retry.Equal(want) {
+				t.Errorf("wrong error: want=QuotaError{Retry: %v}, got=%#v", want, err)
+			}
+		},
+	},
+	3: {
+		file:    upload.File{Name: "forbidden.jpg", Size: 100},
+		payload: `<error type="cancel"><forbidden xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>`,
+		check: func(t *testing.T, err error) {
+			stanzaErr, ok := err.(stanza.Error)
+			if !ok || stanzaErr.Condition != stanza.Forbidden {
+				t.Errorf("wrong error: want=%v, got=%#v", stanza.Forbidden, err)
+			}
+		},
+	},
+}
+
+func TestErrors(t *testing.T) {
+	for i, tc := range errorTestCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			s, conn := xmpptest.NewServerSession(nil, func(xmpptest.Request) string {
+				return tc.payload
+			})
+			/* #nosec */
+			defer conn.Close()
+
+			_, err := upload.Upload(ctx, s, nil, upload.Service{JID: service, MaxSize: tc.max}, tc.file, nil)
+			tc.check(t, err)
+		})
+	}
+}
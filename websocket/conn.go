@@ -0,0 +1,34 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"golang.org/x/net/websocket"
+	"mellium.im/xmpp/internal/frame"
+)
+
+// conn is a net.Conn that frames the XML written to it so that each top level
+// element is sent as its own WebSocket message as required by RFC 7395.
+type conn struct {
+	*websocket.Conn
+	secure bool
+	split  *frame.Splitter
+}
+
+func newConn(ws *websocket.Conn, secure bool) *conn {
+	ws.PayloadType = websocket.TextFrame
+	c := &conn{Conn: ws, secure: secure}
+	c.split = frame.NewSplitter(func(p []byte) error {
+		_, err := c.Conn.Write(p)
+		return err
+	})
+	return c
+}
+
+// Write buffers p until one or more complete top level elements have been
+// written and then sends each of them as a separate message.
+func (c *conn) Write(p []byte) (int, error) {
+	return c.split.Write(p)
+}
@@ -0,0 +1,292 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package websocket implements a WebSocket transport for XMPP.
+//
+// The WebSocket subprotocol is defined in RFC 7395.
+// Instead of an XML stream that spans the entire connection, each top level
+// element is sent in its own WebSocket message and the stream is opened and
+// closed with <open/> and <close/> elements.
+// Connections returned from this package handle splitting the stream into
+// messages, but sessions must still be negotiated using the functions in this
+// package (or by setting the WebSocket field of xmpp.StreamConfig) so that the
+// correct stream headers are used.
+package websocket // import "mellium.im/xmpp/websocket"
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/discover"
+	"mellium.im/xmpp/jid"
+)
+
+// WSProtocol is the WebSocket subprotocol used by XMPP.
+const WSProtocol = "xmpp"
+
+// Dial discovers and connects to a WebSocket endpoint for the given address.
+//
+// For more information see the Dialer type.
+func Dial(ctx context.Context, addr jid.JID) (net.Conn, error) {
+	var d Dialer
+	return d.Dial(ctx, addr)
+}
+
+// DialDirect connects to the WebSocket endpoint at the provided URL without
+// performing service discovery.
+//
+// For more information see the Dialer type.
+func DialDirect(ctx context.Context, uri string) (net.Conn, error) {
+	var d Dialer
+	return d.DialDirect(ctx, uri)
+}
+
+// DialSession discovers and connects to a WebSocket endpoint for the given
+// address and attempts to negotiate a client-to-server session over it.
+//
+// If the provided context is canceled after stream negotiation is complete it
+// has no effect on the session.
+func DialSession(ctx context.Context, addr jid.JID, features ...xmpp.StreamFeature) (*xmpp.Session, error) {
+	conn, err := Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientSession(ctx, addr, conn, false, features...)
+}
+
+// A Dialer contains options for connecting to an XMPP address over a
+// WebSocket.
+//
+// The zero value for each field is equivalent to dialing without that option.
+type Dialer struct {
+	net.Dialer
+
+	// Resolver is used to look up the WebSocket endpoints advertised in DNS TXT
+	// records as described in XEP-0156: Discovering Alternative XMPP Connection
+	// Methods.
+	// If nil, the default resolver is used.
+	Resolver *net.Resolver
+
+	// Origin is sent in the Origin header of the opening handshake.
+	// If empty, an origin is derived from the URL being dialed.
+	Origin string
+
+	// TLSConfig is used when dialing secure (wss://) endpoints.
+	// The nil value is interpreted as a tls.Config with the expected host set to
+	// that of the URL being dialed, as is a config without a ServerName.
+	TLSConfig *tls.Config
+}
+
+// Dial discovers and connects to a WebSocket endpoint for the given address.
+// Each discovered endpoint is tried in turn until one succeeds.
+//
+// If the context expires before the connection is complete, an error is
+// returned. Once successfully connected, any expiration of the context will not
+// affect the connection.
+func (d *Dialer) Dial(ctx context.Context, addr jid.JID) (net.Conn, error) {
+	urls, err := discover.LookupWebsocket(ctx, d.Resolver, nil, &addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, discover.ErrNoServiceAtAddress
+	}
+	for _, u := range urls {
+		var conn net.Conn
+		conn, err = d.DialDirect(ctx, u)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// DialDirect connects to the WebSocket endpoint at the provided URL without
+// performing service discovery.
+// The URL must use the ws or wss scheme.
+//
+// If the context expires before the connection is complete, an error is
+// returned. Once successfully connected, any expiration of the context will not
+// affect the connection.
+func (d *Dialer) DialDirect(ctx context.Context, uri string) (net.Conn, error) {
+	location, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	var origin url.URL
+	switch location.Scheme {
+	case "ws":
+		origin.Scheme = "http"
+	case "wss":
+		secure = true
+		origin.Scheme = "https"
+	default:
+		return nil, websocket.ErrBadScheme
+	}
+	origin.Host = location.Host
+
+	originStr := d.Origin
+	if originStr == "" {
+		originStr = origin.String()
+	}
+	cfg, err := websocket.NewConfig(uri, originStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Protocol = []string{WSProtocol}
+
+	host := location.Host
+	if location.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(location.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(location.Hostname(), "80")
+		}
+	}
+	rwc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tlsCfg := d.TLSConfig
+		switch {
+		case tlsCfg == nil:
+			tlsCfg = &tls.Config{
+				ServerName: location.Hostname(),
+			}
+		case tlsCfg.ServerName == "":
+			tlsCfg = tlsCfg.Clone()
+			tlsCfg.ServerName = location.Hostname()
+		}
+		rwc = tls.Client(rwc, tlsCfg)
+	}
+
+	// Apply the context deadline (if any) to the handshake and stop waiting if the
+	// context is canceled.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = rwc.SetDeadline(deadline); err != nil {
+			/* #nosec */
+			rwc.Close()
+			return nil, err
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			/* #nosec */
+			rwc.Close()
+		case <-done:
+		}
+	}()
+	ws, err := websocket.NewClient(cfg, rwc)
+	if err != nil {
+		/* #nosec */
+		rwc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err = rwc.SetDeadline(time.Time{}); err != nil {
+		/* #nosec */
+		ws.Close()
+		return nil, err
+	}
+
+	return newConn(ws, secure), nil
+}
+
+// NewServer returns an http.Handler that accepts WebSocket connections using
+// the XMPP subprotocol and calls f with each connection.
+// Connections that do not request the XMPP subprotocol are rejected.
+// The connection is closed when f returns.
+func NewServer(f func(net.Conn)) http.Handler {
+	return websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			for _, p := range cfg.Protocol {
+				if p == WSProtocol {
+					cfg.Protocol = []string{WSProtocol}
+					return nil
+				}
+			}
+			return errNoProtocol
+		},
+		Handler: func(ws *websocket.Conn) {
+			f(newConn(ws, ws.Request().TLS != nil))
+		},
+	}
+}
+
+var errNoProtocol = errors.New("websocket: client did not request the xmpp subprotocol")
+
+// NewClientSession attempts to use an existing WebSocket connection to
+// negotiate an XMPP client-to-server session.
+// If rw is a *websocket.Conn from golang.org/x/net/websocket it is wrapped so
+// that each element is sent in its own message.
+// If the provided context is canceled before stream negotiation is complete an
+// error is returned.
+// After stream negotiation if the context is canceled it has no effect.
+func NewClientSession(ctx context.Context, origin jid.JID, rw io.ReadWriter, received bool, features ...xmpp.StreamFeature) (*xmpp.Session, error) {
+	rw, secure := wrap(rw)
+	return xmpp.NegotiateSession(ctx, origin.Domain(), origin, rw, received, negotiator(secure, xmpp.StreamConfig{
+		Features:  features,
+		WebSocket: true,
+	}))
+}
+
+// NewServerSession attempts to use an existing WebSocket connection to
+// negotiate an XMPP server-to-server session.
+// If rw is a *websocket.Conn from golang.org/x/net/websocket it is wrapped so
+// that each element is sent in its own message.
+// If the provided context is canceled before stream negotiation is complete an
+// error is returned.
+// After stream negotiation if the context is canceled it has no effect.
+func NewServerSession(ctx context.Context, location, origin jid.JID, rw io.ReadWriter, received bool, features ...xmpp.StreamFeature) (*xmpp.Session, error) {
+	rw, secure := wrap(rw)
+	return xmpp.NegotiateSession(ctx, location, origin, rw, received, negotiator(secure, xmpp.StreamConfig{
+		S2S:       true,
+		Features:  features,
+		WebSocket: true,
+	}))
+}
+
+func wrap(rw io.ReadWriter) (io.ReadWriter, bool) {
+	switch c := rw.(type) {
+	case *conn:
+		return c, c.secure
+	case *websocket.Conn:
+		var secure bool
+		if r := c.Request(); r != nil {
+			secure = r.TLS != nil
+		} else if loc := c.Config().Location; loc != nil {
+			secure = loc.Scheme == "wss"
+		}
+		return newConn(c, secure), secure
+	}
+	return rw, false
+}
+
+// negotiator returns a negotiator that marks the session as secure if the
+// WebSocket connection is using TLS before negotiating the stream.
+func negotiator(secure bool, cfg xmpp.StreamConfig) xmpp.Negotiator {
+	negotiate := xmpp.NewNegotiator(cfg)
+	return func(ctx context.Context, s *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+		if secure {
+			secure = false
+			return xmpp.Secure, nil, nil, nil
+		}
+		return negotiate(ctx, s, data)
+	}
+}
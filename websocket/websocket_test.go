@@ -0,0 +1,173 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package websocket_test
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	xwebsocket "golang.org/x/net/websocket"
+	"mellium.im/sasl"
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/websocket"
+)
+
+func TestFraming(t *testing.T) {
+	msgs := make(chan string, 10)
+	srv := httptest.NewServer(xwebsocket.Handler(func(ws *xwebsocket.Conn) {
+		for {
+			var msg string
+			if err := xwebsocket.Message.Receive(ws, &msg); err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- msg
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := websocket.DialDirect(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+
+	for _, s := range []string{
+		`<?xml version="1.0"?> <open/>`,
+		"\n<a b='/>'><b/>",
+		`<!-- </a> --><![CDATA[</a>]]></a><c`,
+		`></c>`,
+	} {
+		if _, err = conn.Write([]byte(s)); err != nil {
+			t.Fatalf("error writing %q: %v", s, err)
+		}
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatalf("error closing conn: %v", err)
+	}
+
+	var got []string
+	for msg := range msgs {
+		got = append(got, msg)
+	}
+	want := []string{
+		`<open/>`,
+		`<a b='/>'><b/><!-- </a> --><![CDATA[</a>]]></a>`,
+		`<c></c>`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong messages: want=%q, got=%q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("wrong message %d: want=%q, got=%q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestNoProtocol(t *testing.T) {
+	srv := httptest.NewServer(websocket.NewServer(func(net.Conn) {
+		t.Error("handler should not be called if no protocol was requested")
+	}))
+	defer srv.Close()
+
+	_, err := xwebsocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err == nil {
+		t.Errorf("expected error dialing without the xmpp subprotocol")
+	}
+}
+
+func TestSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	location := jid.MustParse("example.net")
+	origin := jid.MustParse("juliet@example.net")
+	permissions := func(n *sasl.Negotiator) bool {
+		user, pass, _ := n.Credentials()
+		return string(user) == "juliet" && string(pass) == "secret"
+	}
+
+	msgs := make(chan stanza.Message, 1)
+	serveErr := make(chan error, 1)
+	srv := httptest.NewTLSServer(websocket.NewServer(func(conn net.Conn) {
+		s, err := websocket.NewClientSession(ctx, location, conn, true,
+			xmpp.StartTLS(nil),
+			xmpp.SASLServer(permissions, nil, sasl.Plain),
+			xmpp.BindResource(),
+		)
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		serveErr <- s.Serve(xmpp.HandlerFunc(func(r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			msg := stanza.Message{}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&msg)
+			if err != nil {
+				return err
+			}
+			msgs <- msg
+			return nil
+		}))
+	}))
+	defer srv.Close()
+
+	d := websocket.Dialer{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	conn, err := d.DialDirect(ctx, "wss"+strings.TrimPrefix(srv.URL, "https"))
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	client, err := websocket.NewClientSession(ctx, origin, conn, false,
+		xmpp.StartTLS(nil),
+		xmpp.SASL("", "secret", sasl.Plain),
+		xmpp.BindResource(),
+	)
+	if err != nil {
+		t.Fatalf("error negotiating session: %v", err)
+	}
+	if st := client.State(); st&xmpp.Secure == 0 || st&xmpp.Authn == 0 || st&xmpp.Ready == 0 {
+		t.Fatalf("wrong session state: %v", st)
+	}
+	if client.LocalAddr().Resourcepart() == "" {
+		t.Errorf("expected a resource to be bound, got %v", client.LocalAddr())
+	}
+
+	err = client.Send(ctx, stanza.Message{
+		To:   jid.MustParse("romeo@example.net"),
+		Type: stanza.ChatMessage,
+	}.Wrap(nil))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	select {
+	case msg := <-msgs:
+		if msg.XMLName.Space != "jabber:client" || msg.Type != stanza.ChatMessage {
+			t.Errorf("wrong message received: %+v", msg)
+		}
+	case err = <-serveErr:
+		t.Fatalf("server stopped early: %v", err)
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for message")
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatalf("error closing session: %v", err)
+	}
+	if err = <-serveErr; err != nil {
+		t.Errorf("unexpected error from server: %v", err)
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
@@ -90,25 +91,14 @@ func (t *Time) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 }
 
 // Get sends a request to the provided JID asking for its time.
+// If the remote entity responds with an error it is returned as a stanza.Error.
 func Get(ctx context.Context, s *xmpp.Session, to jid.JID) (time.Time, error) {
-	result, err := s.SendIQ(ctx, stanza.IQ{
+	var t Time
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "time", Space: NS}}), stanza.IQ{
 		Type: stanza.GetIQ,
 		To:   to,
-	}.Wrap(xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "time", Space: NS}})))
-	var t time.Time
-	if err != nil {
-		return t, err
-	}
-	d := xml.NewTokenDecoder(result)
-	data := struct {
-		stanza.IQ
-		Time Time
-	}{}
-	err = d.Decode(&data)
-	if err != nil {
-		return t, err
-	}
-	return time.Time(data.Time), nil
+	}, &t)
+	return time.Time(t), err
 }
 
 // Handle returns an option that registers a Handler for entity time requests.
@@ -138,3 +128,11 @@ func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml
 	_, err := xmlstream.Copy(t, iq.Result(tt.TokenReader()))
 	return err
 }
+
+// ForFeatures implements info.FeatureIter.
+func (h Handler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: NS})
+}